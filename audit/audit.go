@@ -0,0 +1,171 @@
+/*
+
+Package audit defines the durable security log Sphyraena records
+privileged actions to.
+
+This is distinct from request logging. Request logs are operational, may
+be sampled or dropped, and describe traffic; the audit trail records who
+did what security-relevant thing, and whether it worked, and is meant to
+be kept.
+
+The framework records the events named by the Action constants below on
+its own. Handlers may record their own through the request's Audit
+method.
+
+By default, Nop is used, which discards everything. JSONAuditor writes
+one JSON object per line to any io.Writer, such as a file opened with
+OpenFile.
+
+*/
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thejerf/sphyraena/identity"
+)
+
+// An Outcome records whether an audited action succeeded.
+type Outcome string
+
+// The Outcomes of audited actions.
+const (
+	Success = Outcome("success")
+	Failure = Outcome("failure")
+)
+
+// The actions Sphyraena audits itself.
+const (
+	// Authentication is a password authentication attempt. On failure,
+	// the Identity is whoever was making the attempt, and the username
+	// tried is in the "username" detail.
+	Authentication = "authentication"
+
+	// SessionCreated is the creation of a new session for the Identity.
+	SessionCreated = "session_created"
+
+	// SessionChanged is an established session being replaced, which
+	// expires it. This covers logging out and any other privilege change.
+	// The identity of the replaced session is in the "previous" detail.
+	SessionChanged = "session_changed"
+
+	// TokenMinted is the creation of an API token by the Identity. The
+	// token's own identity is in the "subject" detail.
+	TokenMinted = "token_minted"
+
+	// TokenRevoked is the revocation of an API token by the Identity.
+	TokenRevoked = "token_revoked"
+)
+
+// An Event is a single entry in the audit trail.
+type Event struct {
+	Time time.Time `json:"time"`
+
+	// Identity is the IdentityID of who performed the action.
+	Identity string `json:"identity"`
+
+	// Session is the SessionHash of the session the action was performed
+	// in, if any.
+	Session string `json:"session,omitempty"`
+
+	Action  string            `json:"action"`
+	Outcome Outcome           `json:"outcome"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// An Auditor records Events to the audit trail.
+//
+// Implementations must be safe for concurrent use. An error means the
+// event may not have been durably recorded.
+type Auditor interface {
+	Audit(Event) error
+}
+
+// IdentityID returns the string identifying the given identity in the
+// audit trail. This is the marshaled form of its authentication, which is
+// unique to the user within each type of authentication.
+func IdentityID(id *identity.Identity) string {
+	if id == nil || id.Authentication == nil {
+		return ""
+	}
+	b, err := id.MarshalText()
+	if err != nil {
+		return id.LogName()
+	}
+	return string(b)
+}
+
+// SessionHash returns a string identifying the session with the given ID
+// in the audit trail. Session IDs are bearer credentials, so they are
+// never written to the trail themselves; this is a truncated hash that
+// can still correlate events from the same session.
+func SessionHash(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:12])
+}
+
+// Nop is an Auditor that discards everything.
+type Nop struct{}
+
+// Audit implements Auditor.
+func (n Nop) Audit(Event) error {
+	return nil
+}
+
+// A JSONAuditor writes each Event as a line of JSON.
+//
+// If the underlying writer has a Sync method, as an *os.File does, it is
+// called after each Event, so nothing reported as recorded can be lost
+// to a crash.
+type JSONAuditor struct {
+	lock    sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+// NewJSONAuditor returns a JSONAuditor writing to the given writer.
+func NewJSONAuditor(w io.Writer) *JSONAuditor {
+	return &JSONAuditor{w: w, encoder: json.NewEncoder(w)}
+}
+
+// OpenFile returns a JSONAuditor appending to the file at the given path,
+// creating it if necessary, readable only by its owner.
+func OpenFile(path string) (*JSONAuditor, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONAuditor(f), nil
+}
+
+// Audit implements Auditor.
+func (ja *JSONAuditor) Audit(e Event) error {
+	ja.lock.Lock()
+	defer ja.lock.Unlock()
+
+	err := ja.encoder.Encode(e)
+	if err != nil {
+		return err
+	}
+	if syncer, canSync := ja.w.(interface{ Sync() error }); canSync {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+// Close closes the underlying writer, if it can be closed.
+func (ja *JSONAuditor) Close() error {
+	ja.lock.Lock()
+	defer ja.lock.Unlock()
+
+	if closer, canClose := ja.w.(io.Closer); canClose {
+		return closer.Close()
+	}
+	return nil
+}
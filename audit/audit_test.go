@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+)
+
+func TestJSONAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	ja := NewJSONAuditor(&buf)
+
+	for _, e := range []Event{
+		{
+			Time:     time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			Identity: IdentityID(&identity.Identity{enticate.GetNamedUser("jerf")}),
+			Action:   Authentication,
+			Outcome:  Success,
+		},
+		{
+			Time:     time.Date(2020, 1, 2, 3, 4, 6, 0, time.UTC),
+			Identity: IdentityID(identity.AnonymousIdentity),
+			Session:  SessionHash("abc"),
+			Action:   "delete_widget",
+			Outcome:  Failure,
+			Details:  map[string]string{"widget": "7"},
+		},
+	} {
+		if err := ja.Audit(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 ||
+		lines[0] != `{"time":"2020-01-02T03:04:05Z","identity":"simple_named_user⁝jerf","action":"authentication","outcome":"success"}` ||
+		!strings.Contains(lines[1], `"session":"`+SessionHash("abc")+`"`) ||
+		!strings.Contains(lines[1], `"details":{"widget":"7"}`) {
+		t.Fatal("unexpected audit trail:", buf.String())
+	}
+
+	if strings.Contains(SessionHash("abc"), "abc") || SessionHash("abc") == SessionHash("abd") {
+		t.Fatal("session hash does not hide or distinguish the session ID")
+	}
+}
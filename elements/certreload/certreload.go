@@ -0,0 +1,171 @@
+/*
+
+Package certreload serves a TLS certificate from files on disk, picking
+up a renewed certificate without restarting the server, as for
+certificates renewed automatically by Let's Encrypt.
+
+	certs, err := certreload.New("cert.pem", "key.pem")
+	if err != nil {
+		// handle the error
+	}
+	server.TLSConfig = certs.TLSConfig()
+	err = server.ListenAndServeTLS("", "")
+
+This depends on nothing else in Sphyraena, and may be used with any
+crypto/tls server.
+
+*/
+package certreload
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+)
+
+// DefaultCheckInterval is how often a Reloader checks its files for
+// changes, if not set otherwise.
+const DefaultCheckInterval = 10 * time.Second
+
+// A Reloader provides the certificate in the CertFile and KeyFile, in the
+// PEM form tls.LoadX509KeyPair reads, to a tls.Config through its
+// GetCertificate method.
+//
+// Whenever a certificate is requested, if the CheckInterval has passed
+// since the files were last checked, they are checked for changes to
+// their size or modification time, and reloaded if they have changed. If
+// the new files can't be loaded, as when the certificate has been
+// replaced but the key not yet, the previous certificate continues to be
+// served, and the load is retried at the next check.
+//
+// The CheckInterval and AbstractTime must be set, if at all, before the
+// Reloader is used.
+type Reloader struct {
+	CertFile      string
+	KeyFile       string
+	CheckInterval time.Duration
+	abtime.AbstractTime
+
+	m         sync.Mutex
+	cert      *tls.Certificate
+	certStat  fileStat
+	keyStat   fileStat
+	lastCheck time.Time
+}
+
+// a fileStat is what is checked to see if a file has changed
+type fileStat struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fs fileStat) equal(other fileStat) bool {
+	return fs.size == other.size && fs.modTime.Equal(other.modTime)
+}
+
+func stat(filename string) (fileStat, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileStat{}, err
+	}
+	return fileStat{fi.Size(), fi.ModTime()}, nil
+}
+
+// New returns a Reloader for the given files, loading the certificate
+// from them. An error is returned if it can't be loaded, so the server
+// doesn't start without one.
+func New(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		CheckInterval: DefaultCheckInterval,
+		AbstractTime:  abtime.NewRealTime(),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate from the files immediately, as on a
+// SIGHUP. If it can't be loaded, the error is returned, and the previous
+// certificate continues to be served.
+func (r *Reloader) Reload() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.load()
+}
+
+func (r *Reloader) load() error {
+	// The files are stat'ed before they are read, so that if they
+	// change in between, the change is seen at the next check.
+	certStat, err := stat(r.CertFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := stat(r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.cert = &cert
+	r.certStat = certStat
+	r.keyStat = keyStat
+	r.lastCheck = r.now()
+	return nil
+}
+
+func (r *Reloader) now() time.Time {
+	if r.AbstractTime == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+// GetCertificate returns the current certificate, first reloading it if
+// the files have changed. It is suitable for use as the GetCertificate
+// of a tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	interval := r.CheckInterval
+	if interval == 0 {
+		interval = DefaultCheckInterval
+	}
+	now := r.now()
+	if r.cert != nil && now.Sub(r.lastCheck) < interval {
+		return r.cert, nil
+	}
+	r.lastCheck = now
+
+	certStat, certErr := stat(r.CertFile)
+	keyStat, keyErr := stat(r.KeyFile)
+	if r.cert != nil && certErr == nil && keyErr == nil &&
+		certStat.equal(r.certStat) && keyStat.equal(r.keyStat) {
+		return r.cert, nil
+	}
+
+	if err := r.load(); err != nil {
+		if r.cert == nil {
+			return nil, err
+		}
+		slog.Warn("could not reload TLS certificate; serving the previous one",
+			"cert_file", r.CertFile, "key_file", r.KeyFile, "error", err)
+	}
+	return r.cert, nil
+}
+
+// TLSConfig returns a tls.Config serving the Reloader's certificate.
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
@@ -0,0 +1,143 @@
+package certreload
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+)
+
+// writeCert writes a new self-signed certificate with the given common
+// name to the files, dated the given time so the change is always seen.
+func writeCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for filename, contents := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+		if err := ioutil.WriteFile(filename, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// served returns the common name of the certificate served by the given
+// listener.
+func served(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certreload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if _, err := New(certFile, keyFile); err == nil {
+		t.Fatal("Reloader created without a certificate")
+	}
+
+	start := time.Now()
+	writeCert(t, certFile, keyFile, "first.example", start)
+	r, err := New(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := abtime.NewManual()
+	r.AbstractTime = clock
+	r.CheckInterval = time.Minute
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", r.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	// the first check sees nothing has changed
+	clock.Advance(2 * time.Minute)
+	if served(t, addr) != "first.example" {
+		t.Fatal("initial certificate not served")
+	}
+
+	writeCert(t, certFile, keyFile, "second.example", start.Add(time.Minute))
+	if served(t, addr) != "first.example" {
+		t.Fatal("files checked before the CheckInterval passed")
+	}
+	clock.Advance(2 * time.Minute)
+	if served(t, addr) != "second.example" {
+		t.Fatal("renewed certificate not served")
+	}
+
+	// a half-written renewal leaves the last good certificate in place
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Minute)
+	if served(t, addr) != "second.example" {
+		t.Fatal("broken renewal not survived")
+	}
+	if r.Reload() == nil {
+		t.Fatal("broken certificate reloaded without error")
+	}
+
+	writeCert(t, certFile, keyFile, "third.example", start.Add(2*time.Minute))
+	if r.Reload() != nil || served(t, addr) != "third.example" {
+		t.Fatal("explicit reload not served")
+	}
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+)
+
+// A CoalescingWriter buffers writes to an underlying io.Writer, passing
+// them along in larger chunks.
+//
+// The buffer is flushed once it holds at least MaxSize bytes, or once
+// MaxDelay has passed since the first write into an empty buffer,
+// whichever comes first. This is intended for use as a StdoutFilter or
+// StderrFilter on a CommandSpecification, where a chatty command would
+// otherwise produce one CmdOutMessage per write; see CoalescingFilter.
+//
+// A CoalescingWriter is safe for concurrent use.
+type CoalescingWriter struct {
+	w        io.Writer
+	maxSize  int
+	maxDelay time.Duration
+	at       abtime.AbstractTime
+
+	sync.Mutex
+	buf        []byte
+	timer      abtime.Timer
+	timerArmed bool
+	err        error
+}
+
+// NewCoalescingWriter returns a CoalescingWriter wrapping the given writer.
+//
+// If the AbstractTime is nil, the real time will be used.
+func NewCoalescingWriter(
+	w io.Writer,
+	maxSize int,
+	maxDelay time.Duration,
+	at abtime.AbstractTime,
+) *CoalescingWriter {
+	if at == nil {
+		at = abtime.NewRealTime()
+	}
+	return &CoalescingWriter{
+		w:        w,
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		at:       at,
+	}
+}
+
+// CoalescingFilter returns a function suitable for use as a StdoutFilter
+// or StderrFilter, which wraps the output in a CoalescingWriter with the
+// given parameters.
+//
+// CommandResult will flush the CoalescingWriter when the command exits, so
+// no output is held back past the CmdExited message.
+func CoalescingFilter(
+	maxSize int,
+	maxDelay time.Duration,
+	at abtime.AbstractTime,
+) func(io.Writer) io.Writer {
+	return func(w io.Writer) io.Writer {
+		return NewCoalescingWriter(w, maxSize, maxDelay, at)
+	}
+}
+
+// Write buffers the given bytes, flushing if the buffer is full.
+//
+// An error from a flush that happened in the background will be returned
+// by the next Write.
+func (cw *CoalescingWriter) Write(b []byte) (int, error) {
+	cw.Lock()
+	defer cw.Unlock()
+
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.maxSize {
+		return len(b), cw.flush()
+	}
+
+	// Each window gets a timer of its own, rather than resetting the
+	// last one, as a manual abtime can't reset a timer that has fired.
+	if !cw.timerArmed {
+		cw.timerArmed = true
+		cw.timer = cw.at.AfterFunc(cw.maxDelay, cw.timedFlush,
+			commandCoalesceTimer)
+	}
+	return len(b), nil
+}
+
+// Flush immediately writes out anything buffered.
+func (cw *CoalescingWriter) Flush() error {
+	cw.Lock()
+	defer cw.Unlock()
+
+	return cw.flush()
+}
+
+func (cw *CoalescingWriter) timedFlush() {
+	cw.Lock()
+	defer cw.Unlock()
+
+	// the timer may have lost a race against a size-triggered flush, in
+	// which case there's nothing for it to do.
+	if !cw.timerArmed {
+		return
+	}
+	cw.timerArmed = false
+	err := cw.flush()
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+}
+
+// flush must be called with the lock held.
+func (cw *CoalescingWriter) flush() error {
+	if cw.timerArmed {
+		cw.timer.Stop()
+		cw.timerArmed = false
+	}
+
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	_, err := cw.w.Write(cw.buf)
+	cw.buf = cw.buf[:0]
+	return err
+}
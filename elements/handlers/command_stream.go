@@ -1,18 +1,40 @@
 package handlers
 
 import (
-	"fmt"
+	"encoding/json"
 	"io"
-	"log"
+	"log/slog"
+	"os"
 	"os/exec"
+	"syscall"
+	"time"
 
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/logging"
 	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/strest"
 )
 
 const (
-	msgTerminate = "terminate"
+	msgTerminate  = "terminate"
+	msgStdin      = "stdin"
+	msgStdinClose = "stdin_close"
 )
 
+const (
+	commandTerminationTimer = 1
+	commandExitDrainTimer   = 2
+	commandCoalesceTimer    = 3
+)
+
+// DefaultTerminationGrace is the TerminationGrace used by a
+// CommandSpecification that does not specify one.
+const DefaultTerminationGrace = 5 * time.Second
+
+// commandExitDrainTimeout bounds how long we will wait for a killed
+// command to be reaped before giving up on it.
+const commandExitDrainTimeout = 10 * time.Second
+
 // CommandSpecification allows you to specify a command to be run by the
 // CommandResult stream.
 //
@@ -20,6 +42,13 @@ const (
 // The Stdout and Stderr values will be overwritten by the handler, but
 // everything will be used as you specify.
 //
+// StdinFilter allows you to override the reader the command's standard
+// input is read from. The passed-in io.Reader will produce the content of
+// the CmdStdin messages sent by the user, and will return io.EOF once the
+// user sends a "stdin_close" message. The return value of this function
+// will be read from instead. If the function is nil or returns nil, the
+// user's input will be passed through unchanged.
+//
 // StdoutFilter and StderrFilter allow you to override the writers used
 // to send output to the user. The passed-in io.Writer will write out the
 // CommandOutput message with the given bytes. The return value of this
@@ -29,26 +58,71 @@ const (
 // return value of the function is nil, the default writer, which will
 // simply output the value of the command to the stream, will be used.
 //
+// If the stream goes away before the command exits, or the request's
+// context is cancelled, such as by the client disconnecting or the server
+// shutting down, the command is sent SIGTERM, then killed if it has not
+// exited after TerminationGrace. If
+// TerminationGrace is zero, DefaultTerminationGrace is used; if it is
+// negative, the command is killed immediately. The AbstractTime is used
+// for this timer, and defaults to the real time.
+//
 // Once passed to one of these functions, the functions should be assumed
 // to own the Command.
 type CommandSpecification struct {
-	Command *exec.Cmd
-	// StdinFilter  func(io.Reader) io.Reader // not used yet
+	Command      *exec.Cmd
+	StdinFilter  func(io.Reader) io.Reader
 	StdoutFilter func(io.Writer) io.Writer
 	StderrFilter func(io.Writer) io.Writer
 
-	// A log.Printf-like function for logging. If nil, will use log.Printf.
+	TerminationGrace time.Duration
+	abtime.AbstractTime
+
+	// A log.Printf-like function for logging. If nil, will log to
+	// slog.Default() at the Warn level. logging.Printf can adapt any other
+	// *slog.Logger.
 	Logger func(string, ...interface{})
 }
 
 func (cs CommandSpecification) Log(msg string, params ...interface{}) {
 	if cs.Logger == nil {
-		log.Printf(msg, params...)
+		logging.Default(slog.LevelWarn)(msg, params...)
 	} else {
 		cs.Logger(msg, params...)
 	}
 }
 
+// terminate shuts down a command that has not yet exited. exitStatus must
+// be the channel the command's Wait result will arrive on.
+func (cs CommandSpecification) terminate(exitStatus <-chan error) {
+	process := cs.Command.Process
+
+	if cs.TerminationGrace >= 0 {
+		grace := cs.TerminationGrace
+		if grace == 0 {
+			grace = DefaultTerminationGrace
+		}
+
+		// Not every OS can deliver SIGTERM; if this one can't, we go
+		// straight to the kill.
+		if process.Signal(syscall.SIGTERM) == nil {
+			select {
+			case <-exitStatus:
+				return
+			case <-cs.After(grace, commandTerminationTimer):
+			}
+		}
+	}
+
+	_ = process.Kill()
+
+	select {
+	case <-exitStatus:
+	case <-cs.After(commandExitDrainTimeout, commandExitDrainTimer):
+		cs.Log("command %d did not exit after being killed; abandoning it",
+			process.Pid)
+	}
+}
+
 // CmdOutMessage will be sent when the command emits something on either
 // standard out or standard error.
 type CmdOutMessage struct {
@@ -62,11 +136,42 @@ type CmdError struct {
 	Error string `json:"error"`
 }
 
-// CmdExit will be emitted when the command has exited, and contains the
-// error code returned by it.
+// CmdExited will be emitted when the command has exited, and contains the
+// exit code returned by it.
+//
+// If the command was terminated by a signal rather than exiting on its
+// own, Signaled will be true, Signal will contain the name of the
+// signal, and ExitCode will be -1.
 type CmdExited struct {
 	Type     string `json:"type"`
 	ExitCode int    `json:"exit_code"`
+	Signaled bool   `json:"signaled"`
+	Signal   string `json:"signal,omitempty"`
+}
+
+func cmdExited(state *os.ProcessState) CmdExited {
+	exited := CmdExited{Type: "exit", ExitCode: -1}
+	if state == nil {
+		return exited
+	}
+
+	exited.ExitCode = state.ExitCode()
+	if ws, isWaitStatus := state.Sys().(syscall.WaitStatus); isWaitStatus {
+		if ws.Signaled() {
+			exited.Signaled = true
+			exited.Signal = ws.Signal().String()
+		}
+	}
+	return exited
+}
+
+// CmdStdin is a message sent back to the stream, with the type "stdin",
+// that writes its Content to the command's standard input.
+//
+// Sending a message of type "stdin_close" will close the command's
+// standard input once all previously-sent content has been written.
+type CmdStdin struct {
+	Content string `json:"content"`
 }
 
 // CmdTerminate is a message sent back to the stream that tells the server
@@ -74,7 +179,8 @@ type CmdExited struct {
 type CmdTerminate struct{}
 
 // CommandResult is a handler that can be used to stream results of
-// commands out to the user. It is unidirectional and only sends results.
+// commands out to the user. The user may also send CmdStdin messages to
+// write to the command's standard input.
 //
 // The intended usage of this is to set up the CommandSpecification in your
 // own handler, then pass control off to this handler. Error handling is
@@ -83,12 +189,20 @@ func CommandResult(
 	spec CommandSpecification,
 	req *request.Request,
 ) error {
-	s, err := req.SubstreamToUser()
+	s, err := req.Substream()
 	if err != nil {
 		return err
 	}
+	incoming, eventsToUser := s.RawChans()
+	if spec.AbstractTime == nil {
+		spec.AbstractTime = abtime.NewRealTime()
+	}
 	stdoutC := make(chan CmdOutMessage)
 	stderrC := make(chan CmdOutMessage)
+	// Once we return, nothing reads stdoutC or stderrC any more, so this
+	// releases any writers still trying to send on them.
+	done := make(chan struct{})
+	defer close(done)
 	defer func() {
 		_ = s.Close()
 
@@ -99,8 +213,7 @@ func CommandResult(
 	DRAIN1LOOP:
 		for {
 			select {
-			case m := <-stdoutC:
-				fmt.Println(m)
+			case <-stdoutC:
 			default:
 				break DRAIN1LOOP
 			}
@@ -115,8 +228,8 @@ func CommandResult(
 		}
 	}()
 
-	stdout := io.Writer(cmdOutWriter{"out", stdoutC})
-	stderr := io.Writer(cmdOutWriter{"err", stderrC})
+	stdout := io.Writer(cmdOutWriter{"out", stdoutC, done})
+	stderr := io.Writer(cmdOutWriter{"err", stderrC, done})
 
 	if spec.StdoutFilter != nil {
 		replaceStdout := spec.StdoutFilter(stdout)
@@ -135,23 +248,78 @@ func CommandResult(
 	spec.Command.Stderr = stderr
 	spec.Command.Stdin = nil
 
-	cmdExecStatus := make(chan error)
+	// We hand the command a real pipe, rather than an arbitrary reader, so
+	// that Wait doesn't block on a user who never closes standard input.
+	// Content from the user flows through stdinC into stdinW, through the
+	// StdinFilter, and is then copied into the command's pipe.
+	cmdStdin, err := spec.Command.StdinPipe()
+	if err != nil {
+		sendCmdError(s, err)
+		return err
+	}
+	stdinR, stdinW := io.Pipe()
+	stdin := io.Reader(stdinR)
+	if spec.StdinFilter != nil {
+		replaceStdin := spec.StdinFilter(stdin)
+		if replaceStdin != nil {
+			stdin = replaceStdin
+		}
+	}
+	stdinC := make(chan []byte)
+	defer func() {
+		if stdinC != nil {
+			close(stdinC)
+		}
+	}()
+	go func() {
+		for b := range stdinC {
+			// Errors here mean the command is no longer reading, which
+			// we will hear about through its exit.
+			_, _ = stdinW.Write(b)
+		}
+		_ = stdinW.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(cmdStdin, stdin)
+		_ = stdinR.Close()
+		_ = cmdStdin.Close()
+	}()
+	var pendingStdin [][]byte
+	stdinClosing := false
+
+	// This is buffered so the Wait result can always be delivered, even if
+	// we have given up on listening for it.
+	cmdExecStatus := make(chan error, 1)
 	go func() {
 		// it is not clear what to do if this panics... it really shouldn't
 		// barring a serious bug in the command execution support.
 		cmdExecStatus <- spec.Command.Start()
-		cmdExecStatus <- spec.Command.Wait()
+		waitErr := spec.Command.Wait()
+
+		// A filter may be holding output back; make sure it reaches the
+		// user before the exit does.
+		for _, w := range []io.Writer{stdout, stderr} {
+			if f, isFlusher := w.(flusher); isFlusher {
+				_ = f.Flush()
+			}
+		}
+		cmdExecStatus <- waitErr
 	}()
 	startError := <-cmdExecStatus
 	if startError != nil {
-		s.Send(CmdError{startError.Error()})
+		sendCmdError(s, startError)
 		return startError
 	}
 
-	incoming, eventsToUser := s.RawChans()
-
 	caughtExitCode := false
 
+	// A request made over a stream may not carry an HTTP request, and so
+	// has no context to be cancelled.
+	var cancelled <-chan struct{}
+	if req.Request != nil {
+		cancelled = req.Context().Done()
+	}
+
 	// Looks like we have successfully processed the request
 	req.StreamResponse(request.StreamRequestResult{
 		SubstreamID: s.SubstreamID(),
@@ -159,40 +327,65 @@ func CommandResult(
 
 	// command is now guaranteed to have been started, successfully at
 	// least according to the OS.
+	// If we did not yet catch the exit code, the command is still running
+	// and needs to be shut down.
 	defer func() {
-		spec.Command.Process.Kill()
-
-		// If we did not yet catch the exit code, we need to drain it.
 		if !caughtExitCode {
-			go func() {
-				// there's a small chance this leaks, if the top-level
-				// process literally never exits.
-				// FIXME: Handle this case with a timeout or something.
-				<-cmdExecStatus
-			}()
+			go spec.terminate(cmdExecStatus)
 		}
 	}()
 
 	// And now we enter a message pump, managing the messages going back
 	// and forth between all these bits and pieces.
 	for {
-		fmt.Println("Cmd loop")
+		// Only offer to write to stdin when there is something to write,
+		// so a command that isn't reading its input can't stall the pump.
+		var stdinSend chan<- []byte
+		var nextStdin []byte
+		if len(pendingStdin) > 0 {
+			stdinSend = stdinC
+			nextStdin = pendingStdin[0]
+		} else if stdinClosing && stdinC != nil {
+			close(stdinC)
+			stdinC = nil
+		}
+
 		select {
 		case msg, ok := <-incoming:
 			if !ok {
-				fmt.Println(msg)
 				// remote stream has closed, time to terminate everything.
 				return nil
 			}
 
 			switch msg.Type {
 			case msgTerminate:
-				fmt.Println("Requested termination of command")
 				return nil
+			case msgStdin:
+				if stdinClosing {
+					spec.Log("stdin received after stdin_close")
+					continue
+				}
+				var in CmdStdin
+				err := json.Unmarshal(msg.JSON, &in)
+				if err != nil {
+					spec.Log("invalid stdin message: %v", err)
+					continue
+				}
+				pendingStdin = append(pendingStdin, []byte(in.Content))
+			case msgStdinClose:
+				stdinClosing = true
 			default:
 				spec.Log("unknown message received: %#v", msg)
 			}
 
+		case <-cancelled:
+			spec.Log("request cancelled; terminating command: %v",
+				req.Context().Err())
+			return nil
+
+		case stdinSend <- nextStdin:
+			pendingStdin = pendingStdin[1:]
+
 		// if we get something from the command on standard out or
 		// standard error, send it out the stream to the user.
 		case outmsg := <-stdoutC:
@@ -201,26 +394,56 @@ func CommandResult(
 			eventsToUser <- s.Message(outmsg)
 		case outmsg := <-stderrC:
 			eventsToUser <- s.Message(outmsg)
-		case <-cmdExecStatus:
-			eventsToUser <- s.Message(
-				// FIXME: Figure out how to get the exit code
-				// FIXME: handle if it's not an exit code!
-				CmdExited{ExitCode: 0, Type: "exit"},
-			)
+		case waitErr := <-cmdExecStatus:
+			// An *exec.ExitError merely reports a non-zero exit, which the
+			// ProcessState already carries; anything else is a failure in
+			// the command's I/O that the ProcessState knows nothing about.
+			if _, isExitError := waitErr.(*exec.ExitError); waitErr != nil && !isExitError {
+				spec.Log("error waiting for command: %v", waitErr)
+			}
+			eventsToUser <- s.Message(cmdExited(spec.Command.ProcessState))
 			caughtExitCode = true
 		}
 	}
 }
 
+// sendCmdError sends a CmdError before the message pump is running. As
+// we are about to give up on the command, anything the user sends in the
+// meantime is discarded.
+func sendCmdError(s *strest.Substream, err error) {
+	incoming, eventsToUser := s.RawChans()
+	for {
+		select {
+		case eventsToUser <- s.Message(CmdError{err.Error()}):
+			return
+		case _, ok := <-incoming:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// flusher is implemented by output filters that buffer, such as the
+// CoalescingWriter.
+type flusher interface {
+	Flush() error
+}
+
 type cmdOutWriter struct {
 	ty      string
 	cmdOutC chan CmdOutMessage
+	done    <-chan struct{}
 }
 
 func (cow cmdOutWriter) Write(b []byte) (int, error) {
-	cow.cmdOutC <- CmdOutMessage{
+	select {
+	case cow.cmdOutC <- CmdOutMessage{
 		Type:    cow.ty,
 		Content: string(b),
+	}:
+		return len(b), nil
+	case <-cow.done:
+		return 0, io.ErrClosedPipe
 	}
-	return len(b), nil
 }
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/strest"
+	"github.com/thejerf/sphyraena/strest/streamtest"
+)
+
+func TestCmdExited(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh command:", err)
+	}
+
+	cmd := exec.Command("sh", "-c", "exit 3")
+	_ = cmd.Run()
+	if exited := cmdExited(cmd.ProcessState); exited != (CmdExited{Type: "exit", ExitCode: 3}) {
+		t.Fatal("wrong exit status for a command that exited:", exited)
+	}
+
+	cmd = exec.Command("sh", "-c", "kill -TERM $$")
+	_ = cmd.Run()
+	exited := cmdExited(cmd.ProcessState)
+	if exited.ExitCode != -1 || !exited.Signaled ||
+		exited.Signal != syscall.SIGTERM.String() {
+		t.Fatal("wrong exit status for a command that was signaled:", exited)
+	}
+
+	if exited := cmdExited(nil); exited.ExitCode != -1 || exited.Signaled {
+		t.Fatal("wrong exit status for a command that never ran:", exited)
+	}
+}
+
+// runCommand runs CommandResult with the given specification on a new
+// stream, returning the stream, the user's end of it, the substream the
+// command's messages are sent on, and where CommandResult's return value
+// will arrive.
+func runCommand(t *testing.T, spec CommandSpecification) (
+	*strest.Stream,
+	chan strest.EventToUser,
+	chan strest.EventFromUser,
+	strest.SubstreamID,
+	chan error,
+) {
+	stream := strest.NewStream(strest.StreamID("cmd"))
+	toUser := make(chan strest.EventToUser)
+	fromUser := make(chan strest.EventFromUser)
+	stream.SetExternalStream(strest.ChannelsStream{ToUser: toUser, FromUser: fromUser})
+
+	responded := make(chan request.StreamRequestResult, 1)
+	req := request.FromStream(nil, stream, func(srr request.StreamRequestResult) {
+		responded <- srr
+	})
+	returned := make(chan error, 1)
+	go func() {
+		returned <- CommandResult(spec, req)
+	}()
+
+	select {
+	case srr := <-responded:
+		if srr.ErrorCode != 0 {
+			t.Fatal("command not started:", srr)
+		}
+		return stream, toUser, fromUser, srr.SubstreamID, returned
+	case <-time.After(5 * time.Second):
+		t.Fatal("command never responded")
+	}
+	return nil, nil, nil, 0, nil
+}
+
+// nextCommandMessage returns the next message sent on the given substream.
+func nextCommandMessage(t *testing.T, toUser chan strest.EventToUser, ssID strest.SubstreamID) interface{} {
+	for {
+		select {
+		case event := <-toUser:
+			if event.Source == ssID && !event.Close {
+				return event.Message
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message from the command")
+		}
+	}
+}
+
+// expectOutput reads CmdOutMessages of the given type until they add up
+// to the expected content, as the command's output may be split up.
+func expectOutput(t *testing.T, toUser chan strest.EventToUser, ssID strest.SubstreamID, ty, expected string) {
+	content := ""
+	for len(content) < len(expected) {
+		msg := nextCommandMessage(t, toUser, ssID)
+		out, isOut := msg.(CmdOutMessage)
+		if !isOut || out.Type != ty {
+			t.Fatalf("expected output, got %#v", msg)
+		}
+		content += out.Content
+	}
+	if content != expected {
+		t.Fatalf("wrong output: %q", content)
+	}
+}
+
+func TestCommandResultStdin(t *testing.T) {
+	if _, err := exec.LookPath("cat"); err != nil {
+		t.Skip("no cat command:", err)
+	}
+
+	stream, toUser, fromUser, ssID, returned := runCommand(t, CommandSpecification{
+		Command: exec.Command("cat"),
+		Logger:  func(string, ...interface{}) {},
+	})
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	for _, line := range []string{"hello\n", "world\n"} {
+		fromUser <- strest.EventFromUser{
+			Dest:    ssID,
+			Type:    msgStdin,
+			Message: json.RawMessage(`{"content":` + strconv.Quote(line) + `}`),
+		}
+		expectOutput(t, toUser, ssID, "out", line)
+	}
+
+	// closing stdin lets cat exit on its own
+	fromUser <- strest.EventFromUser{Dest: ssID, Type: msgStdinClose}
+	msg := nextCommandMessage(t, toUser, ssID)
+	if msg != (CmdExited{Type: "exit"}) {
+		t.Fatalf("command did not exit after stdin closed: %#v", msg)
+	}
+
+	_ = stream.Close()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CommandResult did not return once the stream closed")
+	}
+}
+
+// startReady starts a shell script that prints "ready" once it has set
+// itself up, and waits for that.
+func startReady(t *testing.T, script string) (*exec.Cmd, chan error) {
+	cmd := exec.Command("sh", "-c", script+"; echo ready; while true; do sleep 1; done")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "ready\n" {
+		t.Fatal("command did not start correctly:", line, err)
+	}
+
+	exitStatus := make(chan error, 1)
+	go func() {
+		exitStatus <- cmd.Wait()
+	}()
+	return cmd, exitStatus
+}
+
+func TestCommandTerminate(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh command:", err)
+	}
+
+	// a command that exits on SIGTERM is never killed
+	cmd, exitStatus := startReady(t, "true")
+	spec := CommandSpecification{Command: cmd, AbstractTime: abtime.NewManual()}
+	spec.terminate(exitStatus)
+	if exited := cmdExited(cmd.ProcessState); exited.Signal != syscall.SIGTERM.String() {
+		t.Fatal("command not terminated by SIGTERM:", exited)
+	}
+
+	// a command that ignores it is killed once the grace period is over
+	cmd, exitStatus = startReady(t, "trap '' TERM")
+	clock := abtime.NewManual()
+	spec = CommandSpecification{Command: cmd, AbstractTime: clock}
+	terminated := make(chan struct{})
+	go func() {
+		spec.terminate(exitStatus)
+		close(terminated)
+	}()
+	select {
+	case <-terminated:
+		t.Fatal("command killed before the grace period was over")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Trigger(commandTerminationTimer)
+	<-terminated
+	if exited := cmdExited(cmd.ProcessState); exited.Signal != syscall.SIGKILL.String() {
+		t.Fatal("command not killed after the grace period:", exited)
+	}
+
+	// with a negative grace, it is killed immediately
+	cmd, exitStatus = startReady(t, "true")
+	spec = CommandSpecification{Command: cmd, TerminationGrace: -1,
+		AbstractTime: abtime.NewManual()}
+	spec.terminate(exitStatus)
+	if exited := cmdExited(cmd.ProcessState); exited.Signal != syscall.SIGKILL.String() {
+		t.Fatal("command not killed immediately:", exited)
+	}
+}
+
+func TestCommandTerminateDrain(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh command:", err)
+	}
+
+	// If the command is never reaped, termination gives up on it after
+	// the drain timeout rather than waiting forever.
+	cmd, exitStatus := startReady(t, "true")
+	clock := abtime.NewManual()
+	logged := make(chan string, 1)
+	spec := CommandSpecification{
+		Command:          cmd,
+		TerminationGrace: -1,
+		AbstractTime:     clock,
+		Logger: func(msg string, params ...interface{}) {
+			logged <- fmt.Sprintf(msg, params...)
+		},
+	}
+	terminated := make(chan struct{})
+	go func() {
+		spec.terminate(make(chan error))
+		close(terminated)
+	}()
+	<-exitStatus
+
+	clock.Trigger(commandExitDrainTimer)
+	select {
+	case <-terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("termination did not give up on the command")
+	}
+	if msg := <-logged; !strings.Contains(msg, "did not exit") {
+		t.Fatal("abandoning the command not logged:", msg)
+	}
+}
+
+// writeRecorder records each write made to it.
+type writeRecorder struct {
+	sync.Mutex
+	writes []string
+}
+
+func (wr *writeRecorder) Write(b []byte) (int, error) {
+	wr.Lock()
+	defer wr.Unlock()
+	wr.writes = append(wr.writes, string(b))
+	return len(b), nil
+}
+
+// waitFor waits for the recorder to have the given writes, as timed
+// flushes happen in the background.
+func (wr *writeRecorder) waitFor(t *testing.T, expected ...string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		wr.Lock()
+		writes := append([]string{}, wr.writes...)
+		wr.Unlock()
+		if reflect.DeepEqual(writes, append([]string{}, expected...)) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("wrong writes: %q", writes)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	clock := abtime.NewManual()
+	wr := &writeRecorder{}
+	cw := NewCoalescingWriter(wr, 8, time.Second, clock)
+
+	// writes are held until the window closes
+	_, _ = cw.Write([]byte("a"))
+	_, _ = cw.Write([]byte("b"))
+	wr.waitFor(t)
+	clock.Trigger(commandCoalesceTimer)
+	wr.waitFor(t, "ab")
+
+	// the next write opens a new window
+	_, _ = cw.Write([]byte("c"))
+	clock.Trigger(commandCoalesceTimer)
+	wr.waitFor(t, "ab", "c")
+
+	// filling the buffer flushes it without waiting
+	_, _ = cw.Write([]byte("0123"))
+	_, _ = cw.Write([]byte("4567"))
+	wr.waitFor(t, "ab", "c", "01234567")
+
+	// as does an explicit Flush
+	_, _ = cw.Write([]byte("d"))
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	wr.waitFor(t, "ab", "c", "01234567", "d")
+}
+
+func TestCommandResultFlushesBeforeExit(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh command:", err)
+	}
+
+	// the window never closes, so the output can only arrive by being
+	// flushed when the command exits
+	filter := CoalescingFilter(1024, time.Hour, abtime.NewManual())
+	stream, toUser, _, ssID, _ := runCommand(t, CommandSpecification{
+		Command:      exec.Command("sh", "-c", "echo out; echo err >&2"),
+		StdoutFilter: filter,
+		StderrFilter: filter,
+		Logger:       func(string, ...interface{}) {},
+	})
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		msg := nextCommandMessage(t, toUser, ssID)
+		out, isOut := msg.(CmdOutMessage)
+		if !isOut {
+			t.Fatalf("exit arrived before the output: %#v", msg)
+		}
+		seen[out.Type+" "+out.Content] = true
+	}
+	if !seen["out out\n"] || !seen["err err\n"] {
+		t.Fatal("wrong output:", seen)
+	}
+	if msg := nextCommandMessage(t, toUser, ssID); msg != (CmdExited{Type: "exit"}) {
+		t.Fatalf("expected the exit, got %#v", msg)
+	}
+}
+
+func TestCommandResultCancelled(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep command:", err)
+	}
+
+	stream, _ := streamtest.NewStream()
+	defer stream.Close()
+
+	responded := make(chan request.StreamRequestResult, 1)
+	req := request.FromStream(nil, stream, func(srr request.StreamRequestResult) {
+		responded <- srr
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	req.Request, _ = http.NewRequestWithContext(ctx, "GET", "http://jerf.org/cmd", nil)
+
+	cmd := exec.Command("sleep", "60")
+	returned := make(chan error)
+	go func() {
+		returned <- CommandResult(CommandSpecification{
+			Command:          cmd,
+			TerminationGrace: -1,
+			Logger:           func(string, ...interface{}) {},
+		}, req)
+	}()
+
+	select {
+	case srr := <-responded:
+		if srr.ErrorCode != 0 {
+			t.Fatal("command not started:", srr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("command never responded")
+	}
+
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelling the request did not stop the command")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	// Signal fails once the command has exited and been reaped
+	for cmd.Process.Signal(syscall.Signal(0)) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("command not terminated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,138 @@
+package dirserve
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/thejerf/sphyraena/request"
+)
+
+// A FileCache holds the contents of small files in memory, for a
+// FileSystemServer serving a handful of small assets.
+//
+// Files are still opened and stat'ed on every request, so that all the
+// checks on what may be served continue to apply to the file as it is
+// now, and so that a cached file is discarded as soon as its ModTime or
+// size changes. What the cache saves is reading the file, and on top of
+// that it gives cached files a strong ETag computed from their content,
+// so clients can use conditional GETs. Range requests are served from
+// the cached content as well.
+//
+// Files larger than MaxFileSize are served from the FileSystem as usual.
+// Once the cached files total more than MaxSize bytes, the least recently
+// used are evicted.
+type FileCache struct {
+	MaxFileSize int64
+	MaxSize     int64
+
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+}
+
+// NewFileCache returns a new FileCache with the given limits.
+func NewFileCache(maxFileSize, maxSize int64) *FileCache {
+	return &FileCache{
+		MaxFileSize: maxFileSize,
+		MaxSize:     maxSize,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+	}
+}
+
+type cachedFile struct {
+	path    string
+	content []byte
+	modTime time.Time
+	etag    string
+}
+
+// get returns the cached file for the path, if it is cached and still
+// matches the given file information. A stale entry is discarded.
+func (fc *FileCache) get(path string, d os.FileInfo) *cachedFile {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	elem, have := fc.entries[path]
+	if !have {
+		return nil
+	}
+	cf := elem.Value.(*cachedFile)
+	if !cf.modTime.Equal(d.ModTime()) || int64(len(cf.content)) != d.Size() {
+		fc.remove(elem)
+		return nil
+	}
+	fc.lru.MoveToFront(elem)
+	return cf
+}
+
+func (fc *FileCache) put(cf *cachedFile) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	if elem, have := fc.entries[cf.path]; have {
+		fc.remove(elem)
+	}
+	fc.entries[cf.path] = fc.lru.PushFront(cf)
+	fc.size += int64(len(cf.content))
+
+	for fc.size > fc.MaxSize && fc.lru.Len() > 0 {
+		fc.remove(fc.lru.Back())
+	}
+}
+
+// remove must be called with the lock held.
+func (fc *FileCache) remove(elem *list.Element) {
+	cf := fc.lru.Remove(elem).(*cachedFile)
+	delete(fc.entries, cf.path)
+	fc.size -= int64(len(cf.content))
+}
+
+// serveCached serves the already opened and checked file out of the
+// Cache, loading it in first if necessary. ShowFile must already have
+// approved the file, with the given MIME type, so that nothing it refuses
+// is ever read or cached.
+func (fss *FileSystemServer) serveCached(
+	rw http.ResponseWriter,
+	req *request.Request,
+	path string,
+	ctype string,
+	d os.FileInfo,
+	f http.File,
+) {
+	cf := fss.Cache.get(path, d)
+	if cf == nil {
+		content, err := io.ReadAll(io.LimitReader(f, d.Size()+1))
+		if err != nil || int64(len(content)) != d.Size() {
+			// the file changed out from under us; neither it nor the
+			// FileInfo can be trusted.
+			http.Error(rw, "file changed while reading", http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(content)
+		cf = &cachedFile{
+			path:    path,
+			content: content,
+			modTime: d.ModTime(),
+			etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		}
+		fss.Cache.put(cf)
+	}
+
+	if rw.Header().Get("Etag") == "" {
+		rw.Header().Set("Etag", cf.etag)
+	}
+
+	sizeFunc := func() (int64, error) { return int64(len(cf.content)), nil }
+	fss.serveContent(rw, req, d.Name(), ctype, cf.modTime, sizeFunc,
+		bytes.NewReader(cf.content))
+}
@@ -0,0 +1,114 @@
+package dirserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+func TestFileCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.js")
+	err := os.WriteFile(file, []byte("var x = 1;"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewFileCache(1024, 4096)
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/static/", &FileSystemServer{
+		FileSystem: http.Dir(dir),
+		ShowFile:   StandardWebFiles,
+		Cache:      cache,
+	})
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org/static/app.js", nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve(nil)
+	etag := rec.Header().Get("Etag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "var x = 1;" || etag == "" {
+		t.Fatal("file not served:", rec.Code, rec.Body.String(), etag)
+	}
+	if cache.lru.Len() != 1 || cache.size != 10 {
+		t.Fatal("file not cached")
+	}
+
+	rec = serve(map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusNotModified {
+		t.Fatal("conditional GET not honored:", rec.Code)
+	}
+
+	rec = serve(map[string]string{"Range": "bytes=4-4"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "x" {
+		t.Fatal("range not served from cache:", rec.Code, rec.Body.String())
+	}
+
+	err = os.WriteFile(file, []byte("var x = 22;"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(file, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serve(map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusOK || rec.Body.String() != "var x = 22;" ||
+		rec.Header().Get("Etag") == etag {
+		t.Fatal("changed file not reloaded:", rec.Code, rec.Body.String())
+	}
+	if cache.lru.Len() != 1 || cache.size != 11 {
+		t.Fatal("stale entry not replaced")
+	}
+}
+
+func TestFileCacheSkipsRefusedFiles(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "secrets.db"), []byte("hunter2"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewFileCache(1024, 4096)
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/static/", &FileSystemServer{
+		FileSystem: http.Dir(dir),
+		ShowFile:   StandardWebFiles,
+		Cache:      cache,
+	})
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/static/secrets.db", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatal("refused file served:", rec.Code)
+	}
+	if cache.lru.Len() != 0 || cache.size != 0 {
+		t.Fatal("refused file read into the cache")
+	}
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	cache := NewFileCache(10, 10)
+	for _, path := range []string{"a", "b", "c"} {
+		cache.put(&cachedFile{path: path, content: []byte("1234")})
+	}
+	if _, have := cache.entries["a"]; have || cache.lru.Len() != 2 || cache.size != 8 {
+		t.Fatal("least recently used file not evicted")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/thejerf/sphyraena/request"
@@ -50,7 +51,7 @@ import (
 // will be used as the MIME type to serve. This server will not guess. If
 // left blank, this will be served with Content-Disposition: attachment,
 // meaning it will download when accessed instead of display in the
-// browser.
+// browser, under its own file name.
 //
 // Because X-Content-Type-Options will be set to nosniff unless you
 // override it with router clauses, it is important
@@ -75,10 +76,40 @@ type FileSystemServer struct {
 	ShowFile  func(string) (bool, string)
 	LegalMask os.FileMode
 
+	// Cache, if set, holds small files in memory. See FileCache. A
+	// FileCache must not be shared between FileSystemServers.
+	Cache *FileCache
+
 	// This turns off the SendFile optimization used by Go. We encountered
 	// this shockingly quickly for something that Go appears to have no
 	// controls for...
+	//
+	// The file is then copied through buffers drawn from a pool shared
+	// by all FileSystemServers, rather than one allocated per request.
 	BypassSendFile bool
+
+	// IndexAssets are Link header values naming the companion assets
+	// of the IndexFile, such as its scripts and stylesheets, as
+	// produced by sphyrw.PreloadLink. Whenever a file named IndexFile is
+	// served, they are sent first as a 103 Early Hints response, so the
+	// browser can begin fetching them while the page is sent.
+	IndexAssets []string
+
+	// DirectoryStatus is the status sent, with no body, for a request
+	// for a directory that isn't answered with an IndexFile. It may be
+	// http.StatusForbidden or http.StatusNotFound; if left to the zero
+	// value, it defaults to http.StatusNotFound, which does not even
+	// admit the directory exists.
+	DirectoryStatus int
+}
+
+// refuseDirectory answers a directory request that can't be served.
+func (fss *FileSystemServer) refuseDirectory(rw http.ResponseWriter) {
+	if fss.DirectoryStatus == http.StatusForbidden {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rw.WriteHeader(http.StatusNotFound)
 }
 
 func (fss *FileSystemServer) MayStream() bool {
@@ -89,7 +120,6 @@ func (fss *FileSystemServer) MayStream() bool {
 func (fss *FileSystemServer) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
 	if len(req.RemainingPath) > 0 {
 		if req.RemainingPath != path.Clean(req.RemainingPath) {
-			fmt.Println("Does not match cleaned path")
 			http.Error(rw, "Invalid request", 400)
 			return
 		}
@@ -101,7 +131,7 @@ func (fss *FileSystemServer) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter,
 	}
 
 	if req.RemainingPath == "" && !fss.Index {
-		rw.Write([]byte("This is a top-level directory request that needs redir"))
+		fss.refuseDirectory(rw)
 		return
 	}
 
@@ -269,7 +299,7 @@ func (fss *FileSystemServer) serveFile(rw http.ResponseWriter, req *request.Requ
 		if fss.IndexFile != "" {
 			path = path + fss.IndexFile
 		} else {
-			http.NotFound(rw, req.Request)
+			fss.refuseDirectory(rw)
 			return
 		}
 	}
@@ -288,7 +318,10 @@ func (fss *FileSystemServer) serveFile(rw http.ResponseWriter, req *request.Requ
 	}
 
 	// FIXME: Redirect to canonical dir path
-	// FIXME: handle being a directory with no indexing set
+	if d.IsDir() {
+		fss.refuseDirectory(rw)
+		return
+	}
 
 	// If this has an illegal mode, refuse to admit it exists
 	if !fss.validMode(d.Mode()) {
@@ -297,38 +330,48 @@ func (fss *FileSystemServer) serveFile(rw http.ResponseWriter, req *request.Requ
 	}
 
 	// FIXME: Pass it through name validation
+	show, ctype := fss.showFile(d.Name())
+	if !show {
+		http.NotFound(rw, req.Request)
+		return
+	}
+
+	if fss.Cache != nil && d.Size() <= fss.Cache.MaxFileSize {
+		fss.serveCached(rw, req, path, ctype, d, f)
+		return
+	}
+
 	sizeFunc := func() (int64, error) { return d.Size(), nil }
-	fss.serveContent(rw, req, d.Name(), d.ModTime(), sizeFunc, f)
+	fss.serveContent(rw, req, d.Name(), ctype, d.ModTime(), sizeFunc, f)
+}
+
+// showFile applies the ShowFile function, or its default.
+func (fss *FileSystemServer) showFile(name string) (bool, string) {
+	if fss.ShowFile != nil {
+		return fss.ShowFile(name)
+	}
+	return ConservativeFileServing(name)
 }
 
-func (fss *FileSystemServer) serveContent(rw http.ResponseWriter, req *request.Request, name string, modtime time.Time, sizeFunc func() (int64, error), content io.ReadSeeker) {
+// serveContent serves the given content, which ShowFile has already
+// approved, with the MIME type ShowFile gave for it.
+func (fss *FileSystemServer) serveContent(rw http.ResponseWriter, req *request.Request, name string, ctype string, modtime time.Time, sizeFunc func() (int64, error), content io.ReadSeeker) {
 	// FIXME: checkLastModified
 	rangeReq, done := fss.checkETag(rw, req, modtime)
 	if done {
 		return
 	}
 
-	code := http.StatusOK
+	if name == fss.IndexFile && len(fss.IndexAssets) != 0 {
+		if srw, isSRW := rw.(*sphyrw.SphyraenaResponseWriter); isSRW {
+			srw.EarlyHints(fss.IndexAssets...)
+		}
+	}
 
-	// this only uses the content type via the ShowFile function
+	code := http.StatusOK
 
-	var (
-		show  bool
-		ctype string
-	)
-	if fss.ShowFile != nil {
-		show, ctype = fss.ShowFile(name)
-	} else {
-		show, ctype = ConservativeFileServing(name)
-	}
-	if !show {
-		http.NotFound(rw, req.Request)
-		return
-	}
 	if ctype == "" {
-		// FIXME: Need to securely deal with filename, ensure it's a legal
-		// header value
-		rw.Header().Set("Content-Disposition", "attachment")
+		rw.Header().Set("Content-Disposition", contentDisposition(name))
 	} else {
 		rw.Header().Set("Content-Type", ctype)
 	}
@@ -416,16 +459,16 @@ func (fss *FileSystemServer) serveContent(rw http.ResponseWriter, req *request.R
 
 	if req.Request.Method != "HEAD" {
 		if fss.BypassSendFile {
-			_, err := io.CopyN(writerOnly{rw}, sendContent, sendSize)
+			err := copyNPooled(writerOnly{rw}, sendContent, sendSize)
 			if err != nil {
-				// FIXME: Log somehow, in context
-				fmt.Println("error in sending file:", err)
+				req.Logger().(request.ErrorLogger).Error(
+					"error in sending file", "err", err)
 			}
 		} else {
 			_, err := io.CopyN(rw, sendContent, sendSize)
 			if err != nil {
-				// FIXME: Log somehow, in context
-				fmt.Println("error in sending file:", err)
+				req.Logger().(request.ErrorLogger).Error(
+					"error in sending file", "err", err)
 			}
 		}
 	}
@@ -435,6 +478,68 @@ type writerOnly struct {
 	io.Writer
 }
 
+// copyBufferSize matches the size of the buffer io.Copy would allocate.
+const copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// copyNPooled is io.CopyN, but using a buffer from copyBuffers. When
+// sendfile is bypassed, neither side of the copy can supply its own
+// buffer, so io.CopyN would allocate a fresh one every time.
+func copyNPooled(dst io.Writer, src io.Reader, n int64) error {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), *buf)
+	if written < n && err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// contentDisposition returns the Content-Disposition header value for
+// downloading a file with the given name.
+//
+// The name is always given in the RFC 5987 filename* form, with
+// everything but the characters RFC 5987 permits percent-encoded, so no
+// name can break out of the header. Names that pass SimpleName are also
+// given as a plain filename, for clients that don't understand filename*.
+func contentDisposition(name string) string {
+	if name == "" {
+		return "attachment"
+	}
+
+	var b strings.Builder
+	b.WriteString("attachment; ")
+	if SimpleName(name) {
+		b.WriteString(`filename="` + name + `"; `)
+	}
+	b.WriteString("filename*=UTF-8''")
+	for _, c := range []byte(name) {
+		if attrChar(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// attrChar returns whether the byte is an attr-char from RFC 5987, which
+// may appear unencoded in an extended header parameter value.
+func attrChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) != -1
+}
+
 func (fss *FileSystemServer) checkETag(rw http.ResponseWriter, req *request.Request, modtime time.Time) (rangeReq string, done bool) {
 	etag := rw.Header().Get("Etag")
 	rangeReq = req.Request.Header.Get("Range")
@@ -0,0 +1,217 @@
+package dirserve
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+const benchmarkFileSize = 4 << 20
+
+// discardResponseWriter throws the body away, so the benchmark measures
+// the file serving rather than the buffering of a recorder. Like a real
+// connection from the point of view of a handler bypassing sendfile, it
+// does not implement io.ReaderFrom.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (drw *discardResponseWriter) Header() http.Header {
+	return drw.header
+}
+
+func (drw *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (drw *discardResponseWriter) WriteHeader(int) {}
+
+// readerOnly hides any io.WriterTo, as the LimitReader in io.CopyN does.
+type readerOnly struct {
+	io.Reader
+}
+
+func TestCopyNPooled(t *testing.T) {
+	var dst bytes.Buffer
+	err := copyNPooled(&dst, bytes.NewReader([]byte("hello world")), 5)
+	if err != nil || dst.String() != "hello" {
+		t.Fatal("copy not limited:", err, dst.String())
+	}
+
+	dst.Reset()
+	err = copyNPooled(&dst, bytes.NewReader([]byte("hi")), 5)
+	if err != io.EOF || dst.String() != "hi" {
+		t.Fatal("short copy did not return io.EOF:", err)
+	}
+}
+
+func TestDirectoryRequests(t *testing.T) {
+	dir := t.TempDir()
+	err := os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, status := range []int{0, http.StatusForbidden, http.StatusNotFound} {
+		sr := router.New(request.NewSphyraenaState(nil, nil))
+		sr.AddLocationForward("/files/", &FileSystemServer{
+			FileSystem:          http.Dir(dir),
+			ServeSubdirectories: true,
+			DirectoryStatus:     status,
+		})
+
+		expected := status
+		if expected == 0 {
+			expected = http.StatusNotFound
+		}
+		for _, path := range []string{"/files/", "/files/sub"} {
+			req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+			rec := httptest.NewRecorder()
+			sr.ServeHTTP(rec, req)
+			if rec.Code != expected || rec.Body.Len() != 0 {
+				t.Fatal("directory request not refused:", status, path,
+					rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for name, expected := range map[string]string{
+		"report.pdf":                    `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`,
+		"my report.pdf":                 `attachment; filename*=UTF-8''my%20report.pdf`,
+		"résumé.txt":                    `attachment; filename*=UTF-8''r%C3%A9sum%C3%A9.txt`,
+		"a\r\nSet-Cookie: x=\"y\";.txt": `attachment; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x%3D%22y%22%3B.txt`,
+	} {
+		if actual := contentDisposition(name); actual != expected {
+			t.Fatal("wrong Content-Disposition for", name, ":", actual)
+		}
+	}
+}
+
+func largeFileServer(b *testing.B) *router.SphyraenaRouter {
+	dir := b.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "large.bin"),
+		make([]byte, benchmarkFileSize), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	sr := router.New(ss)
+	sr.AddLocationForward("/files/", &FileSystemServer{
+		FileSystem:     http.Dir(dir),
+		ShowFile:       Downloadable(".bin"),
+		BypassSendFile: true,
+	})
+	return sr
+}
+
+func BenchmarkBypassSendFile(b *testing.B) {
+	sr := largeFileServer(b)
+	b.SetBytes(benchmarkFileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req, _ := http.NewRequest("GET", "http://jerf.org/files/large.bin", nil)
+			sr.ServeHTTP(&discardResponseWriter{http.Header{}}, req)
+		}
+	})
+}
+
+// BenchmarkCopy compares the pooled copy used when bypassing sendfile
+// against the io.CopyN it replaced.
+func BenchmarkCopy(b *testing.B) {
+	src := make([]byte, benchmarkFileSize)
+	copies := map[string]func(io.Writer, io.Reader, int64) error{
+		"CopyN": func(dst io.Writer, src io.Reader, n int64) error {
+			_, err := io.CopyN(dst, src, n)
+			return err
+		},
+		"Pooled": copyNPooled,
+	}
+
+	for name, copyN := range copies {
+		copyN := copyN
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(benchmarkFileSize)
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := copyN(writerOnly{io.Discard},
+						readerOnly{bytes.NewReader(src)}, benchmarkFileSize)
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestIndexAssets(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "app.js"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/files/", &FileSystemServer{
+		FileSystem:  http.Dir(dir),
+		IndexFile:   "index.html",
+		Index:       true,
+		ShowFile:    StandardWebFiles,
+		IndexAssets: []string{sphyrw.PreloadLink("/files/app.js", "script")},
+	})
+	server := httptest.NewServer(sr)
+	defer server.Close()
+
+	get := func(path string) (hints []string, body string) {
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header.Values("Link")...)
+				}
+				return nil
+			},
+		}
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal("wrong status:", path, resp.StatusCode)
+		}
+		return hints, string(b)
+	}
+
+	hints, body := get("/files/")
+	if body != "index.html" || len(hints) != 1 ||
+		hints[0] != "</files/app.js>; rel=preload; as=script" {
+		t.Fatal("index assets not hinted:", hints, body)
+	}
+	if hints, body = get("/files/app.js"); body != "app.js" || len(hints) != 0 {
+		t.Fatal("assets hinted for a non-index file:", hints, body)
+	}
+}
@@ -29,7 +29,8 @@ This module implements paranoid file serving out of disk directories:
    pipes, directories, executables, etc.
  * The X-Content-Type-Options header is set to nosniff.
 
-A FileSystemServer is a REST server that implements the above.
+A FileSystemServer is a REST server that implements the above. A
+FileServer serves a single file in the same manner.
 
 Someday a streaming interface that integrates with fsnotify would be neat,
 but this focuses on the static case for now.
@@ -0,0 +1,94 @@
+package dirserve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// A FileServer serves exactly one file, such as a favicon.ico or
+// robots.txt, at whatever route it is placed on. Range and conditional
+// requests are honored as they are by the FileSystemServer. If the route
+// leaves any of the path unmatched, the FileServer answers with a 404.
+//
+// The file is either the Path in the FileSystem, which is opened on
+// every request, or if FileSystem is nil, the given Content, as for
+// content embedded in the binary. Content is given a strong ETag computed
+// from it, and the ModTime, if set, is used for If-Range.
+//
+// ContentType is the MIME type the file is served with. As with ShowFile
+// on the FileSystemServer, there is no guessing; if left blank, the file
+// is served with Content-Disposition: attachment, under the base name of
+// the Path.
+//
+// A file from the FileSystem is subject to the same default LegalMask as
+// the FileSystemServer, and a directory is never served.
+//
+// A FileServer must not be copied after first use.
+type FileServer struct {
+	FileSystem  http.FileSystem
+	Path        string
+	Content     []byte
+	ModTime     time.Time
+	ContentType string
+
+	etagOnce sync.Once
+	etag     string
+}
+
+func (fs *FileServer) MayStream() bool {
+	return false
+}
+
+// ServeStreaming serves the given request.
+func (fs *FileServer) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	if req.RemainingPath != "" {
+		http.NotFound(rw, req.Request)
+		return
+	}
+
+	// the zero FileSystemServer supplies the serving itself, along
+	// with its default policy on file modes.
+	fss := &FileSystemServer{}
+	name := ""
+	if fs.Path != "" {
+		name = path.Base(fs.Path)
+	}
+
+	if fs.FileSystem == nil {
+		fs.etagOnce.Do(func() {
+			sum := sha256.Sum256(fs.Content)
+			fs.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		})
+		if rw.Header().Get("Etag") == "" {
+			rw.Header().Set("Etag", fs.etag)
+		}
+		sizeFunc := func() (int64, error) { return int64(len(fs.Content)), nil }
+		fss.serveContent(rw, req, name, fs.ContentType, fs.ModTime, sizeFunc,
+			bytes.NewReader(fs.Content))
+		return
+	}
+
+	f, err := fs.FileSystem.Open(fs.Path)
+	if err != nil {
+		http.NotFound(rw, req.Request)
+		return
+	}
+	defer f.Close()
+
+	d, err := f.Stat()
+	if err != nil || d.IsDir() || !fss.validMode(d.Mode()) {
+		http.NotFound(rw, req.Request)
+		return
+	}
+
+	sizeFunc := func() (int64, error) { return d.Size(), nil }
+	fss.serveContent(rw, req, d.Name(), fs.ContentType, d.ModTime(), sizeFunc, f)
+}
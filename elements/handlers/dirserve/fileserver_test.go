@@ -0,0 +1,76 @@
+package dirserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+func TestFileServer(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "robots.txt"),
+		[]byte("User-agent: *\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/robots.txt", &FileServer{
+		FileSystem:  http.Dir(dir),
+		Path:        "robots.txt",
+		ContentType: "text/plain; charset=utf-8",
+	})
+	sr.AddLocationForward("/missing.txt", &FileServer{
+		FileSystem: http.Dir(dir),
+		Path:       "missing.txt",
+	})
+	sr.AddLocationForward("/dir", &FileServer{FileSystem: http.Dir(dir)})
+	sr.AddLocationForward("/favicon.ico", &FileServer{
+		Content:     []byte("an icon"),
+		ContentType: "image/x-icon",
+	})
+
+	get := func(path string, headers ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/robots.txt")
+	if rec.Code != http.StatusOK || rec.Body.String() != "User-agent: *\n" ||
+		rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatal("file not served:", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = get("/robots.txt", "Range", "bytes=0-3")
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "User" {
+		t.Fatal("range not honored:", rec.Code, rec.Body.String())
+	}
+
+	for _, path := range []string{"/robots.txt/other", "/missing.txt", "/dir"} {
+		if rec = get(path); rec.Code != http.StatusNotFound {
+			t.Fatal("served something other than the file:", path, rec.Code)
+		}
+	}
+
+	rec = get("/favicon.ico")
+	etag := rec.Header().Get("Etag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "an icon" ||
+		rec.Header().Get("Content-Type") != "image/x-icon" || etag == "" {
+		t.Fatal("content not served:", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = get("/favicon.ico", "If-None-Match", etag)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Fatal("conditional request not honored:", rec.Code)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+
+Package health provides a readiness endpoint for orchestrators and
+supervisors, reporting whether the subsystems Sphyraena depends on are
+ready to serve requests.
+
+	r.AddLocationReturn("/ready", health.Handler(map[string]health.Check{
+		"secrets":     health.SecretGenerator(secretGenerator),
+		"session_ids": health.SessionIDGenerator(sessionIDGenerator),
+		"sessions":    health.SessionServer(sessionServer),
+	}))
+
+*/
+package health
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/secret"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// A Check reports whether a subsystem is ready, returning nil if it is,
+// or an error saying why not.
+//
+// Checks are run on every request to the Handler, so they must be cheap,
+// and must not block.
+type Check func() error
+
+// ErrNoneBuffered is returned by the generator checks when the generator
+// has nothing generated in advance, so getting a value from it would
+// block.
+var ErrNoneBuffered = errors.New("nothing generated in advance")
+
+// A Report is the JSON body sent by the Handler.
+//
+// NotReady maps the name of each subsystem that is not ready to the
+// reason why.
+type Report struct {
+	Ready    bool              `json:"ready"`
+	NotReady map[string]string `json:"not_ready,omitempty"`
+}
+
+// Handler returns a handler that runs the given checks, and responds with
+// a 200 if they all pass, and a 503 if any do not, with a Report as the
+// body in either case.
+func Handler(checks map[string]Check) request.Handler {
+	return request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			report := Report{Ready: true}
+			for name, check := range checks {
+				if err := check(); err != nil {
+					if report.NotReady == nil {
+						report.NotReady = map[string]string{}
+					}
+					report.NotReady[name] = err.Error()
+					report.Ready = false
+				}
+			}
+
+			rw.Header().Set("Cache-Control", "no-store")
+			if report.Ready {
+				rw.WriteJSON(report)
+			} else {
+				rw.WriteJSONStatus(http.StatusServiceUnavailable, report)
+			}
+		},
+	)
+}
+
+// SecretGenerator returns a Check that the secret.Generator has a secret
+// generated in advance.
+//
+// As the generator refills its buffer as fast as it can, this failing
+// means it is not running, or is starved of entropy.
+func SecretGenerator(g *secret.Generator) Check {
+	return func() error {
+		if !g.Ready() {
+			return ErrNoneBuffered
+		}
+		return nil
+	}
+}
+
+// SessionIDGenerator returns a Check that the session.SessionIDGenerator
+// has a SessionID generated in advance, in the manner of SecretGenerator.
+func SessionIDGenerator(g *session.SessionIDGenerator) Check {
+	return func() error {
+		if !g.Ready() {
+			return ErrNoneBuffered
+		}
+		return nil
+	}
+}
+
+// SessionServer returns a Check that the SessionServer's backing store is
+// reachable. If the SessionServer is not a session.Pinger, it has no way
+// to be unreachable, and the check always passes.
+func SessionServer(ss session.SessionServer) Check {
+	return func() error {
+		if pinger, canPing := ss.(session.Pinger); canPing {
+			return pinger.Ping()
+		}
+		return nil
+	}
+}
@@ -0,0 +1,72 @@
+package health
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/secret"
+)
+
+func TestHealth(t *testing.T) {
+	sig := session.NewSessionIDGenerator(1, nil)
+	sg := secret.NewGenerator(1)
+	dir := t.TempDir()
+	fss := session.NewFilesystemServer(dir, sig, sg, nil)
+
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationReturn("/ready", Handler(map[string]Check{
+		"secrets":     SecretGenerator(sg),
+		"session_ids": SessionIDGenerator(sig),
+		"sessions":    SessionServer(fss),
+		"ram":         SessionServer(session.NewRAMServer(sig, sg, nil)),
+	}))
+	check := func() (int, Report) {
+		req, _ := http.NewRequest("GET", "http://jerf.org/ready", nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		var report Report
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	code, report := check()
+	if code != http.StatusServiceUnavailable || report.Ready ||
+		report.NotReady["secrets"] != ErrNoneBuffered.Error() ||
+		report.NotReady["session_ids"] != ErrNoneBuffered.Error() ||
+		len(report.NotReady) != 2 {
+		t.Fatal("unprimed generators reported ready:", code, report)
+	}
+
+	go sig.Serve()
+	defer sig.Stop()
+	go sg.Serve()
+	defer sg.Stop()
+	for !sig.Ready() || !sg.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+
+	code, report = check()
+	if code != http.StatusOK || !report.Ready || len(report.NotReady) != 0 {
+		t.Fatal("ready subsystems reported not ready:", code, report)
+	}
+
+	err := os.Remove(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, report = check()
+	if code != http.StatusServiceUnavailable || report.NotReady["sessions"] == "" ||
+		len(report.NotReady) != 1 {
+		t.Fatal("missing session directory not reported:", code, report)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"net"
 	"net/http"
 	"net/url"
-	"strings"
 
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/sphyrw"
@@ -36,7 +35,8 @@ import (
 // encoding/json will turn it back into a []byte, but there's no getting
 // around this step. This isn't necessarily industrial-strength robust, but
 // it can be a great prototype tool, and if the previous disadvantages
-// never come up, nothing stops you from shipping it.
+// never come up, nothing stops you from shipping it. If they do, see
+// ReverseProxy.
 type JSONForwarder struct {
 	// The port to speak to
 	Net  string
@@ -69,7 +69,12 @@ type WrappedRequest struct {
 	RemoteAddr    string      `json:"remote_addr"`
 }
 
-func WrapRequest(req *http.Request) *WrappedRequest {
+// WrapRequest wraps the given request, reading its body.
+//
+// If the body can not be read, the error is returned. When the request
+// came through the router, this includes the body exceeding its size
+// limit, for which request.IsBodyTooLarge will be true.
+func WrapRequest(req *http.Request) (*WrappedRequest, error) {
 	// We do not want the handling for PUT or POST, because we're
 	// submitting JSON regardless.
 	if req.Method == "GET" {
@@ -80,7 +85,7 @@ func WrapRequest(req *http.Request) *WrappedRequest {
 	if req.Body != nil {
 		b, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		body = string(b)
 	}
@@ -98,7 +103,7 @@ func WrapRequest(req *http.Request) *WrappedRequest {
 		Form:          req.Form,
 		PostForm:      req.PostForm,
 		RemoteAddr:    req.RemoteAddr,
-	}
+	}, nil
 }
 
 // JSONResponse is what encode/json will be used to decode the response
@@ -115,9 +120,10 @@ type JSONResponse struct {
 // logged-in user.
 func (jf *JSONForwarder) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
 	// if this comes back blank, it will not be passed in
-	userID := req.Session().Identity().AuthenticationName()
+	userID := authenticatedUser(req)
 
-	response := jf.HandleReq(req.Request, req.PrecedingPath, userID)
+	response := jf.HandleReq(req.Request, req.PrecedingPath, userID,
+		req.RequestID())
 
 	headers := rw.Header()
 	for key, value := range response.Headers {
@@ -139,22 +145,36 @@ func (jf *JSONForwarder) MayStream() bool {
 // HandleReq forwards the request to the JSONForwarder.
 //
 // It is perfectly legal to use this with internal processes that can
-// construct a legal *http.Request.
-func (jf *JSONForwarder) HandleReq(req *http.Request, locforward string, userID string) JSONResponse {
-	wreq := WrapRequest(req)
+// construct a legal *http.Request. A blank userID or requestID is not
+// passed along.
+func (jf *JSONForwarder) HandleReq(
+	req *http.Request,
+	locforward string,
+	userID string,
+	requestID string,
+) JSONResponse {
+	wreq, err := WrapRequest(req)
+	if err != nil {
+		if request.IsBodyTooLarge(err) {
+			return JSONResponse{
+				Body:     "request body too large\n",
+				Response: http.StatusRequestEntityTooLarge,
+			}
+		}
+		panic(err)
+	}
 
 	// Purge any incoming X-Sphyraena-* headers that may have been
 	// incoming, so the JSON consumer has assurance this is from the server.
-	for header := range req.Header {
-		if len(header) > 12 && strings.ToLower(header[:12]) == "x-sphyraena-" {
-			delete(req.Header, header)
-		}
-	}
+	stripSphyraenaHeaders(req.Header)
 
 	wreq.Header["X-Sphyraena-Location-Forward"] = []string{locforward}
 	if userID != "" {
 		wreq.Header["X-Sphyraena-Authenticated-User"] = []string{userID}
 	}
+	if requestID != "" {
+		wreq.Header["X-Sphyraena-Request-ID"] = []string{requestID}
+	}
 
 	jsonReq, err := json.Marshal(wreq)
 	if err != nil {
@@ -190,8 +210,7 @@ func (jf *JSONForwarder) HandleReq(req *http.Request, locforward string, userID
 	response := JSONResponse{}
 	err = json.Unmarshal(buf, &response)
 	if err != nil {
-		fmt.Println("I couldn't handle:", string(buf), "|")
-		panic(err)
+		panic(fmt.Errorf("could not unmarshal JSON response %q: %w", buf, err))
 	}
 	return response
 }
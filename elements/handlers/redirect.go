@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// Redirect returns a request.Handler that redirects every request to the
+// given target, which must be on this site: either a path, or a
+// reference relative to the request's own URL. As this is expected to be
+// called while setting up the routes, it panics if the target could take
+// the user to another site, including through tricks like "//host" or
+// "/\host" that browsers take as referring to another host. Use
+// RedirectOffsite to redirect elsewhere on purpose.
+//
+// The status is chosen to preserve the request's method. GET and HEAD
+// requests are sent a 301 Moved Permanently if permanent, or a 302 Found
+// if not. Any other method is sent a 308 Permanent Redirect or a 307
+// Temporary Redirect respectively, which require the client to repeat
+// the request with the same method and body, where a 301 or 302 would
+// let most clients turn a POST into a GET and drop its body.
+//
+// Bear in mind that clients may cache permanent redirects indefinitely.
+func Redirect(target string, permanent bool) request.Handler {
+	if !sphyrw.IsLocalRedirect(target) {
+		panic("Redirect target " + target + " is not on this site")
+	}
+	return redirectHandler{target, permanent}
+}
+
+// RedirectOffsite is like Redirect, but permits any target, including
+// those on other sites.
+func RedirectOffsite(target string, permanent bool) request.Handler {
+	return redirectHandler{target, permanent}
+}
+
+type redirectHandler struct {
+	target    string
+	permanent bool
+}
+
+func (rh redirectHandler) MayStream() bool {
+	return false
+}
+
+func (rh redirectHandler) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	preserveMethod := req.Method != http.MethodGet && req.Method != http.MethodHead
+
+	var code int
+	switch {
+	case rh.permanent && preserveMethod:
+		code = http.StatusPermanentRedirect
+	case rh.permanent:
+		code = http.StatusMovedPermanently
+	case preserveMethod:
+		code = http.StatusTemporaryRedirect
+	default:
+		code = http.StatusFound
+	}
+	http.Redirect(rw, req.Request, rh.target, code)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+func TestRedirect(t *testing.T) {
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationReturn("/old", Redirect("/new", true))
+	sr.AddLocationReturn("/moved", Redirect("/elsewhere", false))
+	sr.AddLocationReturn("/docs", RedirectOffsite("https://docs.example/", false))
+
+	for _, test := range []struct {
+		method, path, location string
+		code                   int
+	}{
+		{"GET", "/old", "/new", http.StatusMovedPermanently},
+		{"HEAD", "/old", "/new", http.StatusMovedPermanently},
+		{"POST", "/old", "/new", http.StatusPermanentRedirect},
+		{"GET", "/moved", "/elsewhere", http.StatusFound},
+		{"PUT", "/moved", "/elsewhere", http.StatusTemporaryRedirect},
+		{"GET", "/docs", "https://docs.example/", http.StatusFound},
+	} {
+		req, _ := http.NewRequest(test.method, "http://jerf.org"+test.path, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if rec.Code != test.code || rec.Header().Get("Location") != test.location {
+			t.Fatal("wrong redirect:", test, rec.Code, rec.Header())
+		}
+	}
+}
+
+func TestRedirectRefusesOffsite(t *testing.T) {
+	for _, target := range []string{"new", "/new?a=b", "../up"} {
+		if !sphyrw.IsLocalRedirect(target) {
+			t.Fatal("local target refused:", target)
+		}
+	}
+
+	for _, target := range []string{
+		"https://evil.example/",
+		"//evil.example/",
+		`/\evil.example/`,
+		"javascript:alert(1)",
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("off-site target permitted:", target)
+				}
+			}()
+			Redirect(target, false)
+		}()
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// ReverseProxy is a handler that proxies requests to an upstream HTTP
+// server. It is the production-grade complement to the JSONForwarder:
+// request and response bodies are streamed rather than read fully, and
+// any body can be carried, not just those that fit in JSON.
+//
+// As with the JSONForwarder, any incoming X-Sphyraena-* headers are
+// removed, so the upstream has assurance that such headers come from
+// Sphyraena, and the upstream is told the LogName of the authenticated
+// user, if any, in X-Sphyraena-Authenticated-User, the path routed so far in
+// X-Sphyraena-Location-Forward, and the request.Request.RequestID in
+// X-Sphyraena-Request-ID. The hop-by-hop headers of RFC 7230
+// section 6.1, including any named by the Connection header, are removed
+// from the request and the response. X-Forwarded-For, X-Forwarded-Host
+// and X-Forwarded-Proto are set for the upstream, the last according to
+// request.Request.Scheme.
+//
+// The request's URL path is appended to the path of the Upstream, and
+// the request's query is combined with the Upstream's. If the request
+// can not be proxied, it is answered with a 502 Bad Gateway, or a 413 if
+// its body exceeded the router's size limit.
+type ReverseProxy struct {
+	Upstream *url.URL
+
+	// Transport is used to make the upstream requests. If nil,
+	// http.DefaultTransport is used.
+	Transport http.RoundTripper
+
+	// FlushInterval is how often the response is flushed to the client
+	// while it is being copied. Zero means no periodic flushing, and a
+	// negative value means flushing after every write. Responses with
+	// no Content-Length, or of type text/event-stream, are always
+	// flushed after every write.
+	FlushInterval time.Duration
+}
+
+// NewReverseProxy returns a ReverseProxy to the given upstream URL, such
+// as "http://localhost:8080/app".
+func NewReverseProxy(upstream string) (*ReverseProxy, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("reverse proxy upstream %q is not an absolute URL",
+			upstream)
+	}
+	return &ReverseProxy{Upstream: u}, nil
+}
+
+// ServeStreaming implements the request.Handler interface.
+func (rp *ReverseProxy) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	// if this comes back blank, it will not be passed in
+	userID := authenticatedUser(req)
+	scheme := req.Scheme()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(rp.Upstream)
+			pr.SetXForwarded()
+			pr.Out.Header.Set("X-Forwarded-Proto", scheme)
+
+			stripSphyraenaHeaders(pr.Out.Header)
+			pr.Out.Header.Set("X-Sphyraena-Location-Forward", req.PrecedingPath)
+			if userID != "" {
+				pr.Out.Header.Set("X-Sphyraena-Authenticated-User", userID)
+			}
+			if req.RequestID() != "" {
+				pr.Out.Header.Set("X-Sphyraena-Request-ID", req.RequestID())
+			}
+		},
+		Transport:     rp.Transport,
+		FlushInterval: rp.FlushInterval,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if request.IsBodyTooLarge(err) {
+				rw.Error(http.StatusRequestEntityTooLarge, "request body too large")
+				return
+			}
+			req.Logger().Info("could not proxy request",
+				"upstream", rp.Upstream.String(), "error", err)
+			rw.Error(http.StatusBadGateway, "bad gateway")
+		},
+	}
+	proxy.ServeHTTP(rw, req.Request)
+}
+
+// stripSphyraenaHeaders removes any X-Sphyraena-* headers from the given
+// headers, which are reserved for Sphyraena to send to what it forwards
+// requests to.
+func stripSphyraenaHeaders(headers http.Header) {
+	for header := range headers {
+		if len(header) > 12 && strings.ToLower(header[:12]) == "x-sphyraena-" {
+			delete(headers, header)
+		}
+	}
+}
+
+// authenticatedUser returns the LogName of the request's user, or the
+// empty string if the user is not authenticated, for the
+// X-Sphyraena-Authenticated-User header.
+func authenticatedUser(req *request.Request) string {
+	id := req.Session().Identity()
+	if id == nil || id.Authentication == nil || !id.IsAuthenticated() {
+		return ""
+	}
+	return id.LogName()
+}
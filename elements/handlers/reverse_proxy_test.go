@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+func TestReverseProxy(t *testing.T) {
+	var upstreamReq *http.Request
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			upstreamReq = r
+			b, _ := io.ReadAll(r.Body)
+			upstreamBody = string(b)
+			w.Header().Set("Connection", "X-Upstream-Hop")
+			w.Header().Set("X-Upstream-Hop", "1")
+			w.Header().Set("X-Upstream", "yes")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("proxied " + r.URL.Path))
+		},
+	))
+	defer upstream.Close()
+
+	rp, err := NewReverseProxy(upstream.URL + "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := request.NewSphyraenaState(nil, nil)
+	state.MaxBodySize = 10
+	sr := router.New(state)
+	sr.AddLocationForward("/proxy", rp)
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "http://jerf.org/proxy/thing?a=b",
+			strings.NewReader(body))
+		req.ContentLength = -1
+		req.Header.Set("X-Sphyraena-Authenticated-User", "admin")
+		req.Header.Set("X-Sphyraena-Request-ID", "forged")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("X-Kept", "1")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("hello")
+	if rec.Code != http.StatusCreated || rec.Body.String() != "proxied /app/proxy/thing" {
+		t.Fatal("request not proxied:", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("X-Upstream") != "yes" || rec.Header().Get("X-Upstream-Hop") != "" {
+		t.Fatal("wrong response headers:", rec.Header())
+	}
+	h := upstreamReq.Header
+	if upstreamBody != "hello" || upstreamReq.URL.RawQuery != "a=b" ||
+		h.Get("X-Kept") != "1" || h.Get("X-Hop") != "" ||
+		h.Get("X-Sphyraena-Authenticated-User") != "" ||
+		h.Get("X-Sphyraena-Location-Forward") != "/proxy" ||
+		h.Get("X-Sphyraena-Request-ID") == "" || h.Get("X-Sphyraena-Request-ID") == "forged" ||
+		h.Get("X-Forwarded-Proto") != "http" || h.Get("X-Forwarded-Host") != "jerf.org" {
+		t.Fatal("wrong upstream request:", upstreamBody, upstreamReq.URL, h)
+	}
+
+	if rec = serve("far too large a body"); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("large body not refused:", rec.Code)
+	}
+
+	upstream.Close()
+	if rec = serve(""); rec.Code != http.StatusBadGateway {
+		t.Fatal("unreachable upstream not reported:", rec.Code)
+	}
+}
+
+func TestNewReverseProxy(t *testing.T) {
+	for _, bad := range []string{"", "/relative", "localhost:8080", "http://%zz"} {
+		if _, err := NewReverseProxy(bad); err == nil {
+			t.Fatal("bad upstream accepted:", bad)
+		}
+	}
+}
+
+type namedSession struct {
+	session.Session
+	id *identity.Identity
+}
+
+func (ns namedSession) Identity() *identity.Identity {
+	return ns.id
+}
+
+func TestAuthenticatedUser(t *testing.T) {
+	named := namedSession{session.AnonymousSession,
+		&identity.Identity{enticate.GetNamedUser("jerf")}}
+	if user := authenticatedUser(request.FromStream(named, nil, nil)); user != "jerf" {
+		t.Fatal("authenticated user not named:", user)
+	}
+	if user := authenticatedUser(request.FromStream(session.AnonymousSession, nil, nil)); user != "" {
+		t.Fatal("unauthenticated user named:", user)
+	}
+}
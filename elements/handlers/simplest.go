@@ -2,10 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"log/slog"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/strest"
 )
@@ -13,7 +12,6 @@ import (
 // CounterOut is the "hello world" of outgoing-only Streaming REST,
 // emitting a stream of incrementing integers.
 func CounterOut(req *request.Request) {
-	fmt.Println("Starting counter out")
 	val := uint64(0)
 
 	stream, err := req.SubstreamToUser()
@@ -35,7 +33,6 @@ func CounterOut(req *request.Request) {
 		val++
 		<-ticker.C
 		err := stream.Send(val)
-		fmt.Println("sent", val)
 		if err != nil {
 			return
 		}
@@ -46,36 +43,28 @@ func CounterOut(req *request.Request) {
 // emitting a stream of incrementing integers, and accepting incoming
 // integers as things to add or subtract from the stream
 func InteractiveCounterOut(req *request.Request) {
-	fmt.Println("Starting interactive counter out")
 	val := int64(0)
 
 	stream, err := req.Substream()
-	spew.Dump(stream)
-
-	req.StreamResponse(request.StreamRequestResult{
-		SubstreamID: stream.SubstreamID(),
-	})
-
 	if err != nil {
 		req.StreamResponse(request.StreamRequestResult{
 			Error:     err.Error(),
 			ErrorCode: 500,
 		})
-		fmt.Println("Couldn't initiate stream:", err)
 		return
 	}
 
+	req.StreamResponse(request.StreamRequestResult{
+		SubstreamID: stream.SubstreamID(),
+	})
+
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 
 	fromUser, toUser := stream.RawChans()
 	maybeToUser := toUser
 	haveMsg := false
-	msg := strest.EventToUser{
-		Source: stream.SubstreamID(),
-		Close:  false,
-		Type:   "event",
-	}
+	msg := strest.NewEventToUser(stream.SubstreamID(), false, nil)
 
 	for {
 		if haveMsg {
@@ -95,16 +84,14 @@ func InteractiveCounterOut(req *request.Request) {
 
 		case incoming, ok := <-fromUser:
 			if !ok {
-				fmt.Println("Terminating ioc due to stream close")
 				return
 			}
 
-			fmt.Println("Incoming message from user found")
 			var msgcontent int64
 			err := json.Unmarshal(incoming.JSON, &msgcontent)
 			if err != nil {
-				// FIXME: Need better logging. Perhaps a default error-like return?
-				fmt.Println("Error unmarshaling message:", err)
+				slog.Debug("ignoring a message that is not an integer",
+					"err", err)
 				continue
 			}
 			val += msgcontent
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// StringHandler returns a request.Handler that answers every request with
+// the given body and Content-Type, such as for a stub API or a
+// maintenance page. See BytesHandler.
+func StringHandler(contentType, body string) request.Handler {
+	return BytesHandler(contentType, []byte(body))
+}
+
+// BytesHandler returns a request.Handler that answers every request with
+// the given body and Content-Type. The body is copied, so the slice may
+// be reused afterwards.
+//
+// The response is always a 200 with a Content-Length. A HEAD request gets
+// the same headers without the body.
+func BytesHandler(contentType string, body []byte) request.Handler {
+	return staticHandler{
+		contentType: contentType,
+		body:        append([]byte{}, body...),
+	}
+}
+
+// JSONHandler returns a request.Handler that answers every request with
+// the given value encoded as JSON, as BytesHandler does.
+//
+// The value is encoded once, now, so later changes to it are not
+// reflected in the responses. As this is expected to be called while
+// setting up the routes, it panics if the value can't be encoded.
+func JSONHandler(value interface{}) request.Handler {
+	body, err := json.Marshal(value)
+	if err != nil {
+		panic("Can't use JSONHandler to serve value: " + err.Error())
+	}
+	return staticHandler{
+		contentType: "application/json",
+		body:        append(body, '\n'),
+	}
+}
+
+type staticHandler struct {
+	contentType string
+	body        []byte
+}
+
+func (sh staticHandler) MayStream() bool {
+	return false
+}
+
+func (sh staticHandler) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	header := rw.Header()
+	header.Set("Content-Type", sh.contentType)
+	header.Set("Content-Length", strconv.Itoa(len(sh.body)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		_, _ = rw.Write(sh.body)
+	}
+}
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+func TestStaticHandlers(t *testing.T) {
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationReturn("/maintenance",
+		StringHandler("text/plain; charset=utf-8", "down for maintenance"))
+	sr.AddLocationReturn("/stub", JSONHandler(map[string]int{"count": 3}))
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://jerf.org"+path, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", "/maintenance")
+	if rec.Code != http.StatusOK || rec.Body.String() != "down for maintenance" ||
+		rec.Header().Get("Content-Type") != "text/plain; charset=utf-8" ||
+		rec.Header().Get("Content-Length") != "20" {
+		t.Fatal("string not served:", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = serve("HEAD", "/maintenance")
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 ||
+		rec.Header().Get("Content-Length") != "20" {
+		t.Fatal("HEAD not supported:", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	rec = serve("GET", "/stub")
+	if rec.Body.String() != "{\"count\":3}\n" ||
+		rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("JSON not served:", rec.Header(), rec.Body.String())
+	}
+}
+
+func TestJSONHandlerPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("unencodable value accepted")
+		}
+	}()
+	JSONHandler(make(chan int))
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"html/template"
 
+	"github.com/thejerf/sphyraena/identity/auth/enticate/clauses"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/sphyrw"
 )
@@ -16,11 +18,22 @@ type LoginHint struct {
 	Username string
 	Password string
 	Title    string
+
+	// CSRFField carries the token that the CSRFProtect in front of the
+	// CookieAuth requires the login POST to have.
+	CSRFField template.HTML
 }
 
 func Login(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
-	err := templates.ExecuteTemplate(rw, "login.tmpl",
-		LoginHint{*username, *password, "Login to Sample Site"})
+	csrfField, err := clauses.CSRFField(rw, req)
+	if err != nil {
+		fmt.Printf("Could not create CSRF token: %v\n", err)
+		rw.WriteHeader(500)
+		return
+	}
+
+	err = templates.ExecuteTemplate(rw, "login.tmpl",
+		LoginHint{*username, *password, "Login to Sample Site", csrfField})
 
 	if err != nil {
 		fmt.Printf("Error while trying to build login page: %v\n", err)
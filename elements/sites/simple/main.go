@@ -4,16 +4,21 @@ package main
 // get it connected to a streaming REST interface like the counter.
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/template"
 	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/elements/certreload"
 	"github.com/thejerf/sphyraena/elements/handlers"
 	"github.com/thejerf/sphyraena/elements/handlers/dirserve"
+	"github.com/thejerf/sphyraena/elements/handlers/health"
 	"github.com/thejerf/sphyraena/identity/auth/enticate/clauses"
 	"github.com/thejerf/sphyraena/identity/auth/enticate/samples"
 	"github.com/thejerf/sphyraena/identity/session"
@@ -56,8 +61,10 @@ func main() {
 
 	ramSessionServer := session.NewRAMServer(
 		sessionIDGenerator, secretGenerator,
-		&session.RAMSessionSettings{time.Minute * 180,
-			abtime.NewRealTime()})
+		&session.RAMSessionSettings{
+			Timeout:      time.Minute * 180,
+			AbstractTime: abtime.NewRealTime(),
+		})
 	ss := request.NewSphyraenaState(ramSessionServer, nil)
 	r := router.New(ss)
 
@@ -70,12 +77,22 @@ func main() {
 		BypassSendFile:      true,
 	})
 
+	// The readiness probe must be reachable without logging in.
+	r.AddLocationReturn("/ready", health.Handler(map[string]health.Check{
+		"secrets":     health.SecretGenerator(secretGenerator),
+		"session_ids": health.SessionIDGenerator(sessionIDGenerator),
+		"sessions":    health.SessionServer(ramSessionServer),
+	}))
+
 	hardCoded := samples.NewHardcodedAuth()
 	hardCoded.AddUser(*username, *password)
 	cookieAuth, _ := clauses.NewCookieAuth(
 		router.NewRouteBlock(&router.ForwardClause{request.HandlerFunc(Login)}),
 		hardCoded,
 	)
+	// CSRFProtect goes in front of the CookieAuth so it protects the
+	// login form as well.
+	r.Add(&clauses.CSRFProtect{})
 	r.Add(cookieAuth)
 	r.AddStreamForward("/samplerest", request.StreamHandlerFunc(handlers.InteractiveCounterOut))
 	r.AddLocationForward("/socket/", sockjs.StreamingRESTHandler(
@@ -85,26 +102,63 @@ func main() {
 		sockjs.DefaultOptions,
 	))
 	r.AddLocationForward("/", request.HandlerFunc(Index))
+	r.WarnRoutes()
+
+	// The certificate is reloaded when it is renewed, without a restart.
+	certs, err := certreload.New("cert.pem", "key.pem")
+	if err != nil {
+		fmt.Printf("Could not load the TLS certificate: %v\n", err)
+		os.Exit(1)
+	}
 
 	m.Handle("/", r)
 	server := &http.Server{
 		Addr:           *bind,
 		MaxHeaderBytes: 1 << 20,
 		Handler:        m,
+		TLSConfig:      certs.TLSConfig(),
 	}
 
 	fmt.Printf("Serving https://%s\n", *bind)
 	go func() {
-		err := server.ListenAndServeTLS("cert.pem", "key.pem")
-		if err != nil {
+		err := server.ListenAndServeTLS("", "")
+		if err != nil && err != http.ErrServerClosed {
 			fmt.Printf("No longer serving: %v\n", err)
 			panic(err)
 		}
 	}()
 
+	go shutdownOnSignal(server, ss, supervisor)
+
 	supervisor.Serve()
 }
 
+// shutdownOnSignal waits for SIGINT or SIGTERM, then shuts everything down,
+// giving in-flight requests and streams a bit of time to finish.
+func shutdownOnSignal(
+	server *http.Server,
+	ss *request.SphyraenaState,
+	supervisor *suture.Supervisor,
+) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	fmt.Println("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		fmt.Printf("Error shutting down the HTTP server: %v\n", err)
+	}
+	err = ss.Shutdown(ctx)
+	if err != nil {
+		fmt.Printf("Not all streams closed: %v\n", err)
+	}
+	supervisor.Stop()
+}
+
 type IndexType struct {
 	Title       string
 	StreamID    string
@@ -10,6 +10,8 @@ import (
 func init() {
 	Register(defaultUnauthenticated{})
 	Register(&NamedUser{})
+	Register(&OIDCUser{})
+	Register(&ClaimsUser{})
 }
 
 // this needs to use the class method pattern to create serializable
@@ -0,0 +1,46 @@
+package enticate
+
+import (
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+// A ChainAuthenticator is a PasswordAuthenticator that tries each of the
+// PasswordAuthenticators in it in order, such as an LDAP server, and then
+// local accounts, returning the first successful Authentication.
+//
+// If none succeeds, the AuthError reflects all of them. If any of them
+// was reached and refused the user, WrongUserOrPassword is returned, even
+// if others were down, as the user may simply not exist in those. If all
+// of them were down, AuthServiceDown is returned.
+//
+// If any of them returns an AuthError the user may not try again after,
+// such as LockedOut, that AuthError is returned immediately, without
+// trying the rest, so that a lockout in one can't be bypassed through
+// another. An empty ChainAuthenticator refuses everyone with
+// WrongUserOrPassword.
+type ChainAuthenticator []PasswordAuthenticator
+
+// Authenticate implements the PasswordAuthenticator interface.
+func (ca ChainAuthenticator) Authenticate(
+	username, password unicode.NFKCNormalized,
+) (Authentication, AuthError) {
+	down := 0
+	for _, pa := range ca {
+		auth, err := pa.Authenticate(username, password)
+		switch {
+		case err == nil && auth != nil:
+			return auth, nil
+		case err == nil:
+			// no Authentication is not a success, whatever it claims
+		case !err.MayTryAgain():
+			return nil, err
+		case err.AuthServiceDown():
+			down++
+		}
+	}
+
+	if len(ca) > 0 && down == len(ca) {
+		return nil, AuthServiceDown()
+	}
+	return nil, WrongUserOrPassword()
+}
@@ -0,0 +1,73 @@
+package enticate
+
+import (
+	"testing"
+
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+type passwordAuthenticatorFunc func(username, password unicode.NFKCNormalized) (Authentication, AuthError)
+
+func (paf passwordAuthenticatorFunc) Authenticate(
+	username, password unicode.NFKCNormalized,
+) (Authentication, AuthError) {
+	return paf(username, password)
+}
+
+func failing(ae AuthError, tried *int) PasswordAuthenticator {
+	return passwordAuthenticatorFunc(
+		func(unicode.NFKCNormalized, unicode.NFKCNormalized) (Authentication, AuthError) {
+			*tried++
+			return nil, ae
+		})
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	user := GetNamedUser("jerf")
+	tried := 0
+	succeeds := passwordAuthenticatorFunc(
+		func(username, password unicode.NFKCNormalized) (Authentication, AuthError) {
+			tried++
+			if username.String() == "jerf" && password.String() == "pass" {
+				return user, nil
+			}
+			return nil, WrongUserOrPassword()
+		})
+	down := failing(AuthServiceDown(), &tried)
+	wrong := failing(WrongUserOrPassword(), &tried)
+	locked := failing(LockedOut(), &tried)
+
+	authenticate := func(ca ChainAuthenticator, password string) (Authentication, AuthError) {
+		tried = 0
+		return ca.Authenticate(unicode.NFKCNormalize("jerf"),
+			unicode.NFKCNormalize(password))
+	}
+
+	auth, err := authenticate(ChainAuthenticator{down, wrong, succeeds}, "pass")
+	if err != nil || auth != user || tried != 3 {
+		t.Fatal("chain did not fall back to the authenticator that succeeds:", auth, err)
+	}
+	auth, err = authenticate(ChainAuthenticator{succeeds, down}, "pass")
+	if err != nil || auth != user || tried != 1 {
+		t.Fatal("chain did not stop at the first success:", auth, err, tried)
+	}
+
+	auth, err = authenticate(ChainAuthenticator{down, succeeds}, "wrong")
+	if auth != nil || err == nil || !err.WrongUserOrPassword() || !err.MayTryAgain() {
+		t.Fatal("refusal with a service down not reported as wrong password:", err)
+	}
+	auth, err = authenticate(ChainAuthenticator{down, down}, "pass")
+	if auth != nil || err == nil || !err.AuthServiceDown() || !err.MayTryAgain() {
+		t.Fatal("all services down not reported as such:", err)
+	}
+
+	auth, err = authenticate(ChainAuthenticator{locked, succeeds}, "pass")
+	if auth != nil || err == nil || err.MayTryAgain() || tried != 1 {
+		t.Fatal("lockout bypassed through a later authenticator:", auth, err)
+	}
+
+	auth, err = authenticate(ChainAuthenticator{}, "pass")
+	if auth != nil || err == nil || !err.WrongUserOrPassword() {
+		t.Fatal("empty chain did not refuse:", auth, err)
+	}
+}
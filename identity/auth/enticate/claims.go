@@ -0,0 +1,118 @@
+package enticate
+
+import (
+	"encoding/json"
+
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+// The names of the claims ClaimsUser gives methods for. These match the
+// claim names of OpenID Connect, so claims from there can be carried over
+// as they are.
+const (
+	ClaimEmail  = "email"
+	ClaimGroups = "groups"
+	ClaimRoles  = "roles"
+)
+
+// A ClaimsUser is an Authentication carrying a username along with claims
+// discovered about the user when they authenticated, such as their email,
+// groups, or roles, as LDAP or OAuth authenticators may find. It survives
+// being marshaled into a session, so the claims may be used in
+// authorization decisions on later requests without repeating the lookup.
+//
+// As with NamedUser, the Username identifies the user. Each claim may
+// have any number of values. The claims are as of when the user
+// authenticated; a user removed from a group keeps the claim until they
+// authenticate again.
+//
+// Use NamedUser if there are no claims to carry.
+type ClaimsUser struct {
+	Username unicode.NFKCNormalized
+	Claims   map[string][]string
+}
+
+// GetClaimsUser provides a convenient method for getting a ClaimsUser
+// with the given username and claims.
+//
+// It is legal to directly construct ClaimsUsers, this is just a
+// convenience.
+func GetClaimsUser(name string, claims map[string][]string) *ClaimsUser {
+	return &ClaimsUser{unicode.NFKCNormalize(name), claims}
+}
+
+// Claim returns the first value of the named claim, or "" if there is
+// none.
+func (cu *ClaimsUser) Claim(name string) string {
+	values := cu.Claims[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// HasClaim returns whether the named claim has the given value.
+func (cu *ClaimsUser) HasClaim(name, value string) bool {
+	for _, v := range cu.Claims[name] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// InGroup returns whether the ClaimGroups claim includes the given group.
+func (cu *ClaimsUser) InGroup(group string) bool {
+	return cu.HasClaim(ClaimGroups, group)
+}
+
+// HasRole returns whether the ClaimRoles claim includes the given role.
+func (cu *ClaimsUser) HasRole(role string) bool {
+	return cu.HasClaim(ClaimRoles, role)
+}
+
+// LogName implements the Authentication interface.
+//
+// This returns the Username of the ClaimsUser.
+func (cu *ClaimsUser) LogName() string {
+	return cu.Username.String()
+}
+
+// IsAuthenticated implements the Authentication interface. This returns
+// true.
+func (cu *ClaimsUser) IsAuthenticated() bool {
+	return true
+}
+
+// AuthenticationName implements the Authentication interface.
+func (cu *ClaimsUser) AuthenticationName() string {
+	return "claims_user"
+}
+
+// Empty implements the Authentication interface.
+func (cu *ClaimsUser) Empty() Authentication {
+	return &ClaimsUser{}
+}
+
+// claimsUserText is how a ClaimsUser is marshaled. As encoding/json
+// writes maps in key order, the same ClaimsUser always marshals the same.
+type claimsUserText struct {
+	Username string              `json:"username"`
+	Claims   map[string][]string `json:"claims,omitempty"`
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (cu *ClaimsUser) MarshalText() ([]byte, error) {
+	return json.Marshal(claimsUserText{cu.Username.String(), cu.Claims})
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (cu *ClaimsUser) UnmarshalText(b []byte) error {
+	var text claimsUserText
+	if err := json.Unmarshal(b, &text); err != nil {
+		return err
+	}
+	cu.Username = unicode.NFKCNormalize(text.Username)
+	cu.Claims = text.Claims
+	return nil
+}
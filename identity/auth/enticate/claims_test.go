@@ -0,0 +1,45 @@
+package enticate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimsUser(t *testing.T) {
+	user := GetClaimsUser("jerf", map[string][]string{
+		ClaimEmail:  {"jerf@example.com"},
+		ClaimGroups: {"admins", "staff"},
+	})
+
+	if !user.InGroup("staff") || user.InGroup("interns") || user.HasRole("admins") ||
+		user.Claim(ClaimEmail) != "jerf@example.com" || user.Claim(ClaimRoles) != "" {
+		t.Fatal("claims not read correctly")
+	}
+
+	name, text, err := Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := user.MarshalText()
+	if string(again) != string(text) {
+		t.Fatal("ClaimsUser does not marshal stably")
+	}
+
+	auth, err := Unmarshal(name, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmarshaled, isClaimsUser := auth.(*ClaimsUser)
+	if !isClaimsUser || unmarshaled.LogName() != "jerf" ||
+		!reflect.DeepEqual(unmarshaled.Claims, user.Claims) {
+		t.Fatalf("ClaimsUser did not survive marshaling: %#v", auth)
+	}
+
+	// a user with no claims round-trips as well, with the username
+	// normalized
+	text, _ = GetClaimsUser("ｊｅｒｆ", nil).MarshalText()
+	auth, err = Unmarshal(name, text)
+	if err != nil || auth.LogName() != "jerf" || auth.(*ClaimsUser).Claims != nil {
+		t.Fatalf("ClaimsUser without claims did not survive marshaling: %#v %v", auth, err)
+	}
+}
@@ -0,0 +1,157 @@
+package clauses
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/metrics"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+// BasicAuth is a router clause that authenticates requests with HTTP
+// Basic authentication, for machine clients of API endpoints that can't
+// be expected to deal with a login form and cookies.
+//
+// The credentials in the Authorization header are checked with the
+// PasswordAuthenticator. On success, the request proceeds to the
+// subsequent clauses with a session for the authenticated identity. By
+// default that session lasts only for the one request, and the client
+// sends its credentials every time; if CreateSession is true, a real
+// session is created and its cookie set, as CookieAuth would, with the
+// given Options, which are subject to the same restrictions as
+// CookieAuth's.
+//
+// A request with missing or wrong credentials is refused with a 401 and
+// a WWW-Authenticate header naming the Realm. As with CookieAuth, an
+// unauthenticated request can never route past a BasicAuth, but a
+// request that already has a session is let through, as is a request
+// that is only being probed; see router.Request.Probing.
+//
+// As Basic authentication sends the password with every request, this
+// should only be used over HTTPS.
+type BasicAuth struct {
+	passwordAuthenticator enticate.PasswordAuthenticator
+	Realm                 string
+	CreateSession         bool
+	Options               []cookie.Option
+}
+
+// NewBasicAuth returns a new BasicAuth routing component for the given
+// realm, which the client may show the user when asking for credentials.
+func NewBasicAuth(
+	realm string,
+	pa enticate.PasswordAuthenticator,
+	options ...cookie.Option,
+) (*BasicAuth, error) {
+	if pa == nil {
+		return nil, errors.New("no password authenticator passed in for basic auth")
+	}
+	if err := checkSessionCookieOptions(options); err != nil {
+		return nil, err
+	}
+	return &BasicAuth{pa, realm, false, options}, nil
+}
+
+var realmEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// challenge returns the handler refusing a request for lack of valid
+// credentials with a 401, asking for the given authentication scheme in
+// the realm. The params are appended to the challenge as given.
+func challenge(scheme, realm, params string) request.Handler {
+	return request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Header().Set("WWW-Authenticate",
+				scheme+` realm="`+realmEscaper.Replace(realm)+`"`+params)
+			rw.Error(http.StatusUnauthorized, "authentication required")
+		},
+	)
+}
+
+func (ba *BasicAuth) basicChallenge() request.Handler {
+	return challenge("Basic", ba.Realm, `, charset="UTF-8"`)
+}
+
+// Route implements the RoutingClause interface.
+func (ba *BasicAuth) Route(r *router.Request) (res router.Result) {
+	if haveID, _ := r.Session().SessionID(); haveID || r.Probing() {
+		return
+	}
+
+	// parsed from the headers as an AllowHeaders may have left them
+	headers := &http.Request{Header: r.RequestHeader()}
+	rawUsername, rawPassword, ok := headers.BasicAuth()
+	if !ok {
+		res.Handler = ba.basicChallenge()
+		return
+	}
+	username := unicode.NFKCNormalize(rawUsername)
+	password := unicode.NFKCNormalize(rawPassword)
+
+	auth, authErr := ba.passwordAuthenticator.Authenticate(username, password)
+	if authErr != nil {
+		r.Metrics().IncCounter(metrics.Authentications,
+			metrics.Labels{"result": "failure"})
+		_ = r.Audit(audit.Event{
+			Action:  audit.Authentication,
+			Outcome: audit.Failure,
+			Details: map[string]string{
+				"method":   "basic",
+				"username": username.String(),
+			},
+		})
+		r.SetAuthError(authErr)
+		res.Handler = ba.basicChallenge()
+		return
+	}
+	r.Metrics().IncCounter(metrics.Authentications,
+		metrics.Labels{"result": "success"})
+
+	id := &identity.Identity{auth}
+	_ = r.Audit(audit.Event{
+		Identity: audit.IdentityID(id),
+		Action:   audit.Authentication,
+		Outcome:  audit.Success,
+		Details:  map[string]string{"method": "basic"},
+	})
+
+	if !ba.CreateSession {
+		r.SetSession(session.NewRequestSession(id))
+		markJustAuthenticated(r)
+		return
+	}
+
+	err := startSession(r.Request, r, r, id, 0, ba.Options)
+	if err != nil {
+		res.Error = err
+	}
+	return
+}
+
+// Name returns the name of this clause.
+func (ba *BasicAuth) Name() string {
+	return "BasicAuth"
+}
+
+// Argument returns the realm.
+func (ba *BasicAuth) Argument() string {
+	return ba.Realm
+}
+
+// GetRouteBlock returns nil, as BasicAuth has no RouteBlock.
+func (ba *BasicAuth) GetRouteBlock() *router.RouteBlock {
+	return nil
+}
+
+// Prototype returns an empty BasicAuth.
+func (ba *BasicAuth) Prototype() router.RouterClause {
+	return &BasicAuth{}
+}
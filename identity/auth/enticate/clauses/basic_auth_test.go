@@ -0,0 +1,134 @@
+package clauses
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thejerf/sphyraena/identity/auth/enticate/samples"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
+)
+
+func TestBasicAuth(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := NewBasicAuth(`API "v1"`, ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reached session.Session
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	sr := router.New(request.NewSphyraenaState(rss, nil))
+	sr.Add(ba)
+	sr.AddLocationReturn("/api", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			reached = req.Session()
+			rw.Write([]byte("ok"))
+		},
+	))
+
+	serve := func(username, password string) *httptest.ResponseRecorder {
+		reached = nil
+		req, _ := http.NewRequest("GET", "http://jerf.org/api", nil)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"user", "wrong"}, {"nobody", "password"}} {
+		rec := serve(creds[0], creds[1])
+		if reached != nil || rec.Code != http.StatusUnauthorized ||
+			rec.Header().Get("WWW-Authenticate") !=
+				`Basic realm="API \"v1\"", charset="UTF-8"` {
+			t.Fatal("bad credentials not challenged:", creds, rec.Code, rec.Header())
+		}
+	}
+
+	rec := serve("user", "password")
+	if reached == nil || rec.Code != http.StatusOK {
+		t.Fatal("valid credentials not accepted:", rec.Code)
+	}
+	if haveID, _ := reached.SessionID(); haveID {
+		t.Fatal("persistent session created by default")
+	}
+	if reached.Identity().Authentication.LogName() != "user" {
+		t.Fatal("wrong identity for request:", reached.Identity())
+	}
+	if rec.Header().Get("Set-Cookie") != "" {
+		t.Fatal("cookie set without a persistent session")
+	}
+
+	ba.CreateSession = true
+	rec = serve("user", "password")
+	if reached == nil || rec.Code != http.StatusOK {
+		t.Fatal("valid credentials not accepted:", rec.Code)
+	}
+	if haveID, _ := reached.SessionID(); !haveID {
+		t.Fatal("no persistent session created")
+	}
+	var sessionCookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == cookie.SessionCookieName {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("no session cookie set for the persistent session")
+	}
+}
+
+func TestPreflightPastAuthentication(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	ba, err := NewBasicAuth("API", ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCookieAuth(router.NewRouteBlock(), ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.Add(ba, ca, &CSRFProtect{})
+	sr.WithHoles(hole.CORS([]string{"https://good.example"},
+		[]string{"PUT"}, nil, true)).
+		AddLocationReturn("/api", request.HandlerFunc(
+			func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+				t.Fatal("handler run for a preflight")
+			},
+		))
+
+	// a preflight never carries credentials or a CSRF token, so it must
+	// be let through to the CORS hole rather than challenged
+	req, _ := http.NewRequest("OPTIONS", "http://jerf.org/api", nil)
+	req.Header.Set("Origin", "https://good.example")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" {
+		t.Fatal("preflight behind authentication refused:", rec.Code, rec.Header())
+	}
+
+	// the request itself is still challenged
+	req, _ = http.NewRequest("PUT", "http://jerf.org/api", nil)
+	req.Header.Set("Origin", "https://good.example")
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatal("request behind authentication not challenged:", rec.Code)
+	}
+}
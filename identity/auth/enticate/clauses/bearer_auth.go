@@ -0,0 +1,111 @@
+package clauses
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity/auth/enticate/tokens"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/metrics"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+// BearerAuth is a router clause that authenticates requests with an API
+// token in an "Authorization: Bearer" header, as minted by the tokens
+// package.
+//
+// On success, the request proceeds to the subsequent clauses with a
+// session for the token's identity that lasts only for the one request,
+// and the Token is available from RequestToken, so handlers can check its
+// scopes. A request with a missing, invalid or expired token is refused
+// with a 401 and a WWW-Authenticate header naming the Realm.
+//
+// As with BasicAuth, a request that already has a session or is only
+// being probed is let through, and this should only be used over HTTPS.
+type BearerAuth struct {
+	verifier tokens.Verifier
+	Realm    string
+}
+
+// NewBearerAuth returns a new BearerAuth routing component for the given
+// realm, verifying tokens with the given Verifier.
+func NewBearerAuth(realm string, v tokens.Verifier) (*BearerAuth, error) {
+	if v == nil {
+		return nil, errors.New("no token verifier passed in for bearer auth")
+	}
+	return &BearerAuth{v, realm}, nil
+}
+
+type bearerToken struct{}
+
+// RequestToken returns the API token the request was authenticated with
+// by a BearerAuth, or nil if it wasn't.
+func RequestToken(req *request.Request) *tokens.Token {
+	t, _ := req.Value(bearerToken{}).(*tokens.Token)
+	return t
+}
+
+// Route implements the RoutingClause interface.
+func (ba *BearerAuth) Route(r *router.Request) (res router.Result) {
+	if haveID, _ := r.Session().SessionID(); haveID || r.Probing() {
+		return
+	}
+
+	authorization := r.RequestHeader().Get("Authorization")
+	const prefix = "bearer "
+	if len(authorization) <= len(prefix) ||
+		!strings.EqualFold(authorization[:len(prefix)], prefix) {
+		res.Handler = challenge("Bearer", ba.Realm, "")
+		return
+	}
+
+	t, err := ba.verifier.Verify(strings.TrimSpace(authorization[len(prefix):]))
+	if err != nil {
+		r.Metrics().IncCounter(metrics.Authentications,
+			metrics.Labels{"result": "failure"})
+		_ = r.Audit(audit.Event{
+			Action:  audit.Authentication,
+			Outcome: audit.Failure,
+			Details: map[string]string{
+				"method": "bearer",
+				"reason": err.Error(),
+			},
+		})
+		res.Handler = challenge("Bearer", ba.Realm, `, error="invalid_token"`)
+		return
+	}
+	r.Metrics().IncCounter(metrics.Authentications,
+		metrics.Labels{"result": "success"})
+	_ = r.Audit(audit.Event{
+		Identity: audit.IdentityID(t.Identity),
+		Action:   audit.Authentication,
+		Outcome:  audit.Success,
+		Details:  map[string]string{"method": "bearer", "token": t.ID},
+	})
+
+	r.SetSession(session.NewRequestSession(t.Identity))
+	r.Set(bearerToken{}, t)
+	return
+}
+
+// Name returns the name of this clause.
+func (ba *BearerAuth) Name() string {
+	return "BearerAuth"
+}
+
+// Argument returns the realm.
+func (ba *BearerAuth) Argument() string {
+	return ba.Realm
+}
+
+// GetRouteBlock returns nil, as BearerAuth has no RouteBlock.
+func (ba *BearerAuth) GetRouteBlock() *router.RouteBlock {
+	return nil
+}
+
+// Prototype returns an empty BearerAuth.
+func (ba *BearerAuth) Prototype() router.RouterClause {
+	return &BearerAuth{}
+}
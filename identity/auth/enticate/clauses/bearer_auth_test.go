@@ -0,0 +1,75 @@
+package clauses
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/identity/auth/enticate/tokens"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/secret"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+func TestBearerAuth(t *testing.T) {
+	signed := tokens.NewSigned(secret.Get(), nil)
+	user := &identity.Identity{enticate.GetNamedUser("jerf")}
+	token, err := signed.Mint(audit.Nop{}, "admin", &tokens.Token{
+		Identity: user,
+		Scopes:   []string{"read"},
+		Expires:  time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ba, err := NewBearerAuth("api", signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reached *tokens.Token
+	var reachedUser string
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.Add(ba)
+	sr.AddLocationReturn("/api", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			reached = RequestToken(req)
+			reachedUser = req.Session().Identity().LogName()
+		},
+	))
+
+	serve := func(authorization string) *httptest.ResponseRecorder {
+		reached = nil
+		req, _ := http.NewRequest("GET", "http://jerf.org/api", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("")
+	if reached != nil || rec.Code != http.StatusUnauthorized ||
+		rec.Header().Get("WWW-Authenticate") != `Bearer realm="api"` {
+		t.Fatal("missing token not challenged:", rec.Code, rec.Header())
+	}
+
+	rec = serve("Bearer " + token + "x")
+	if reached != nil || rec.Code != http.StatusUnauthorized ||
+		rec.Header().Get("WWW-Authenticate") !=
+			`Bearer realm="api", error="invalid_token"` {
+		t.Fatal("invalid token not challenged:", rec.Code, rec.Header())
+	}
+
+	rec = serve("bearer " + token)
+	if rec.Code != http.StatusOK || reached == nil || !reached.HasScope("read") ||
+		reachedUser != "jerf" {
+		t.Fatal("valid token not accepted:", rec.Code, reached, reachedUser)
+	}
+}
@@ -3,36 +3,67 @@ package clauses
 import (
 	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
 
+	"github.com/thejerf/sphyraena/audit"
 	"github.com/thejerf/sphyraena/identity"
 	"github.com/thejerf/sphyraena/identity/auth/enticate"
 	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/metrics"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
 	"github.com/thejerf/sphyraena/sphyrw/cookie"
 	"github.com/thejerf/sphyraena/unicode"
 )
 
-// FIXME: We need some way to guarantee that this won't be proceeded past
-// if auth fails. Router at teh moment is awfully forgiving if we manage to
-// get past this.
-
 // CookieAuth is a router clause that turns on the cookie-based
 // authentication. This allows you to not incur the costs of authentication
 // on requests that don't need it.
 //
-// Options can be used to modify the cookie's options on the way out. This
-// would probably be used primarily to add cookie.Insecure to the options
-// to permit use on non-HTTPS environments.
+// Despite the name, the session ID is found and issued through the
+// SphyraenaState's SessionTransport, which is the session cookie unless
+// configured otherwise.
+//
+// Options can be used to modify the cookie's options on the way out. They
+// may not include cookie.Insecure, as the session cookie's "__Secure-"
+// prefix requires it to be Secure; to develop over plain HTTP, call the
+// SphyraenaState's EnableInsecureCookies instead, which also drops the
+// prefix. Environments that can't guarantee HTTPS in production should
+// set the SphyraenaState's UnprefixedSessionCookie.
+//
+// If Remember is non-zero, a login form that includes a non-empty
+// "remember" value will have its session extended to last that long, if
+// the session supports session.LifetimeExtender, and the cookie will be
+// set to persist for as long as the session server actually granted.
+// Otherwise the cookie remains a session cookie, which the browser
+// discards when it closes.
+//
+// Such a persistent cookie would expire in the browser at the end of the
+// lifetime first granted, even though the session itself is kept alive
+// by use. So when a request arrives with a remembered session that has
+// less than RenewWithin left, which if zero is half of Remember, the
+// session is extended by Remember again, and the cookie is re-issued to
+// last as long as the session now will. This requires the session to
+// support session.LifetimeReporter as well.
+//
+// A request that is only being probed, as for a CORS preflight, is let
+// through without looking at its session or credentials, so that probing
+// never logs anyone in or renews their session; see
+// router.Request.Probing.
 type CookieAuth struct {
 	authBlock             *router.RouteBlock
 	passwordAuthenticator enticate.PasswordAuthenticator
 	Options               []cookie.Option
+	Remember              time.Duration
+	RenewWithin           time.Duration
 }
 
 type justAuthenticated struct{}
 
-func markJustAuthenticated(req *request.Request) {
+func markJustAuthenticated(req sessionHolder) {
 	req.Set(justAuthenticated{}, true)
 }
 
@@ -63,6 +94,10 @@ func IsJustAuthenticated(req *request.Request) bool {
 // user a form. To use it with an independent REST request that will auth
 // the user, you can pass in something that just statically returns some
 // form of permission denied/404/whatever.
+//
+// If the user is not authenticated and the RouteBlock does not produce a
+// handler for the request, routing stops with a 403. An unauthenticated
+// request can never route past a CookieAuth.
 func NewCookieAuth(
 	rb *router.RouteBlock,
 	pa enticate.PasswordAuthenticator,
@@ -74,15 +109,56 @@ func NewCookieAuth(
 	if pa == nil {
 		return nil, errors.New("no password authenticator passed in for cookie auth")
 	}
-	return &CookieAuth{rb, pa, options}, nil
+	if err := checkSessionCookieOptions(options); err != nil {
+		return nil, err
+	}
+	return &CookieAuth{rb, pa, options, 0, 0}, nil
+}
+
+// checkSessionCookieOptions refuses options that the session cookie can
+// never be issued with, such as cookie.Insecure on its default prefixed
+// name, which would otherwise fail every login only once the password had
+// been checked.
+func checkSessionCookieOptions(options []cookie.Option) error {
+	_, err := cookie.NewOut(cookie.SessionCookieName, "", nil, options...)
+	if err != nil {
+		return fmt.Errorf("session cookie options invalid, use "+
+			"SphyraenaState.EnableInsecureCookies for plain HTTP: %w", err)
+	}
+	return nil
+}
+
+// sessionHolder is what password authentication sets the new session and
+// the just-authenticated mark on. This allows the CookieAuth clause to
+// route them through the router.Request, so they only take effect if the
+// routing goes through it.
+type sessionHolder interface {
+	Set(key, value interface{})
+	SetSession(session.Session)
+	Session() session.Session
 }
 
-// FIXME: CookieAdder belong here or somewhere else?
+// PasswordAuthenticate authenticates the user with the username and
+// password in the request's form. On success, a new session is set on the
+// request and issued to the client through the SessionResponse by the
+// SessionTransport.
 func PasswordAuthenticate(
 	pa enticate.PasswordAuthenticator,
 	r *request.Request,
+	sr request.SessionResponse,
 	options ...cookie.Option,
-) (*cookie.OutCookie, error) {
+) error {
+	return passwordAuthenticate(pa, r, r, sr, 0, options...)
+}
+
+func passwordAuthenticate(
+	pa enticate.PasswordAuthenticator,
+	r *request.Request,
+	holder sessionHolder,
+	sr request.SessionResponse,
+	remember time.Duration,
+	options ...cookie.Option,
+) error {
 	// FIXME: CSRF form protection
 	// FIXME: Which ideally shouldn't require a call here and/or can't be skipped
 	r.ParseForm()
@@ -92,38 +168,105 @@ func PasswordAuthenticate(
 
 	auth, authErr := pa.Authenticate(username, password)
 	if authErr != nil {
-		// FIXME: Remove logging detail
-		fmt.Printf("Got an auth error: %v u %s p %s\n", authErr, username, password)
+		slog.Debug("password authentication failed",
+			"username", username.String(), "err", authErr)
+		// a request with no username at all is just someone arriving at
+		// the login page, not a failed attempt.
+		if username.String() != "" {
+			r.Metrics().IncCounter(metrics.Authentications,
+				metrics.Labels{"result": "failure"})
+			_ = r.Audit(audit.Event{
+				Action:  audit.Authentication,
+				Outcome: audit.Failure,
+				Details: map[string]string{"username": username.String()},
+			})
+		}
 		r.SetAuthError(authErr)
-		return nil, authErr
+		return authErr
 	}
+	r.Metrics().IncCounter(metrics.Authentications,
+		metrics.Labels{"result": "success"})
 
 	identity := &identity.Identity{auth}
+	_ = r.Audit(audit.Event{
+		Identity: audit.IdentityID(identity),
+		Action:   audit.Authentication,
+		Outcome:  audit.Success,
+	})
+	return startSession(r, holder, sr, identity, remember, options)
+}
+
+// startSession creates a new session for the freshly authenticated
+// identity, sets it on the holder, and issues it to the client through
+// the SessionResponse.
+func startSession(
+	r *request.Request,
+	holder sessionHolder,
+	sr request.SessionResponse,
+	identity *identity.Identity,
+	remember time.Duration,
+	options []cookie.Option,
+) error {
 	session, err := r.NewSession(identity)
 	if err != nil {
-		// FIXME
-		fmt.Printf("What does it mean for this error: %v\n", err)
-		return nil, err
+		slog.Error("could not create a session", "err", err)
+		return err
 	}
-	r.SetSession(session)
-	markJustAuthenticated(r)
-	hasID, sessionID := session.SessionID()
-	if hasID {
-		cookie, err := cookie.NewOut(
-			"session",
-			string(sessionID),
-			r.Session(),
-			options...,
-		)
-		if err != nil {
-			return nil, err
-		}
-		return cookie, nil
-	} else {
-		fmt.Printf("Established session without identity?\n")
+	holder.SetSession(session)
+	markJustAuthenticated(holder)
+	options = r.CookieOptions(rememberOptions(r, session, remember, options)...)
+	_, usesCookie := r.SessionTransport.(request.CookieSessionTransport)
+	if usesCookie && !r.SecureCookiesWork() && !r.InsecureCookies() {
+		r.Logger().Info("session cookie set on a request not made over " +
+			"TLS, which the browser will not keep; if Sphyraena is behind " +
+			"a TLS-terminating proxy, set ForwardedProtoHeader")
 	}
+	if hasID, _ := session.SessionID(); !hasID {
+		slog.Warn("session established without a session ID")
+		return nil
+	}
+	return r.SessionTransport.Issue(r, sr, session, options...)
+}
+
+// denyUnauthenticated is the handler used when an unauthenticated request
+// is not handled by the auth block.
+func denyUnauthenticated(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	rw.Error(http.StatusForbidden, "authentication required")
+}
 
-	return nil, nil
+// routeUnauthenticated routes the request through the auth block, and
+// refuses to let it proceed any further if the auth block doesn't handle
+// it.
+func (ca *CookieAuth) routeUnauthenticated(r *router.Request) router.Result {
+	res := ca.authBlock.Route(r)
+	if res.Handler != nil || res.StreamHandler != nil || res.Error != nil {
+		return res
+	}
+	return router.Result{Handler: request.HandlerFunc(denyUnauthenticated)}
+}
+
+// rememberOptions extends the session and returns the cookie options for a
+// persistent cookie, if the user asked to be remembered and the session
+// allows it. Otherwise the options are returned unchanged.
+func rememberOptions(
+	r *request.Request,
+	s session.Session,
+	remember time.Duration,
+	options []cookie.Option,
+) []cookie.Option {
+	if remember == 0 || r.Form.Get("remember") == "" {
+		return options
+	}
+	extender, canExtend := s.(session.LifetimeExtender)
+	if !canExtend {
+		return options
+	}
+
+	granted := extender.ExtendLifetime(remember)
+	if granted < time.Second {
+		return options
+	}
+	return append(append([]cookie.Option{}, options...), cookie.Duration(granted))
 }
 
 func (ca *CookieAuth) Route(r *router.Request) (res router.Result) {
@@ -131,44 +274,77 @@ func (ca *CookieAuth) Route(r *router.Request) (res router.Result) {
 	// mechanism, like this being from a persistent web socket
 	if haveID, _ := r.Session().SessionID(); haveID {
 		// continue on through the resources protected by this session.
-		fmt.Println("\n\nAlready have an id")
+		return
+	}
+	if r.Probing() {
 		return
 	}
 
-	sessionCookie := r.Request.Cookies.Get("session")
+	sessionID, haveSessionID := r.SessionTransport.SessionID(r.Request)
 
-	if sessionCookie == nil {
-		cookie, err := PasswordAuthenticate(
+	if !haveSessionID {
+		err := passwordAuthenticate(
 			ca.passwordAuthenticator,
 			r.Request,
+			r,
+			r,
+			ca.Remember,
 			ca.Options...,
 		)
 		if err == nil {
-			if cookie != nil {
-				r.AddCookie(cookie)
-			}
 			// pass through to the underlying mechanism
 			return
 		}
 		// If auth yielded neither an error nor an authentication, we are
 		// probably visiting the page for the first time. We still need to
 		// auth, but there is no error.
-		res.RouteBlock = ca.authBlock
+		return ca.routeUnauthenticated(r)
 	} else {
-		session, err := r.GetSession(session.SessionID(sessionCookie.Value()))
+		session, err := r.GetSession(sessionID)
 		if err != nil {
 			// FIXME: This is actually an odd path, like, the session
 			// expired between the cookie check and this extraction. Should
 			// mark the session as expired or something and re-auth.
-			res.RouteBlock = ca.authBlock
-			return
+			return ca.routeUnauthenticated(r)
 		}
 		r.SetSession(session)
+		ca.renew(r, session)
 		// Return with passthrough to subsequent resources
 		return
 	}
+}
+
+// renew extends a remembered session and re-issues it, if it is close to
+// expiring.
+func (ca *CookieAuth) renew(r *router.Request, s session.Session) {
+	if ca.Remember == 0 {
+		return
+	}
+	reporter, canReport := s.(session.LifetimeReporter)
+	extender, canExtend := s.(session.LifetimeExtender)
+	if !canReport || !canExtend {
+		return
+	}
+
+	renewWithin := ca.RenewWithin
+	if renewWithin == 0 {
+		renewWithin = ca.Remember / 2
+	}
+	remaining, extended := reporter.Lifetime()
+	if !extended || remaining >= renewWithin {
+		return
+	}
 
-	return
+	granted := extender.ExtendLifetime(ca.Remember)
+	if granted < time.Second {
+		return
+	}
+	options := append(append([]cookie.Option{}, ca.Options...),
+		cookie.Duration(granted))
+	err := r.SessionTransport.Issue(r.Request, r, s, r.CookieOptions(options...)...)
+	if err != nil {
+		r.Logger().Info("could not renew the session", "err", err)
+	}
 }
 
 func (ca *CookieAuth) Name() string {
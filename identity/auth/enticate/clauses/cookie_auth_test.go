@@ -0,0 +1,385 @@
+package clauses
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/identity/auth/enticate/samples"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/secret"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// getRAMServer returns a RAM session server with the given settings, and
+// the function that stops the generators it uses.
+func getRAMServer(settings *session.RAMSessionSettings) (*session.RAMSessionServer, func()) {
+	idGen := session.NewSessionIDGenerator(0, []byte("0123456789012345"))
+	go idGen.Serve()
+	secretGen := secret.NewGenerator(8)
+	go secretGen.Serve()
+
+	return session.NewRAMServer(idGen, secretGen, settings), func() {
+		idGen.Stop()
+		secretGen.Stop()
+	}
+}
+
+func TestCookieAuthBlocksUnauthenticated(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reachedProtected := false
+	protected := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			reachedProtected = true
+		},
+	)
+
+	// The auth block only handles the login page, so a request for
+	// anything else must not fall through to the protected resource.
+	authBlock := router.NewRouteBlock()
+	login := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Write([]byte("login"))
+		},
+	)
+	authBlock.AddLocationReturn("/login", login)
+
+	ca, err := NewCookieAuth(authBlock, ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.Add(ca)
+	sr.AddLocationReturn("/protected", protected)
+
+	serve := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://jerf.org"+path,
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", "/protected", nil)
+	if reachedProtected || rec.Code != http.StatusForbidden {
+		t.Fatal("unauthenticated request reached protected resource:", rec.Code)
+	}
+
+	rec = serve("POST", "/protected",
+		url.Values{"username": {"user"}, "password": {"wrong"}})
+	if reachedProtected || rec.Code != http.StatusForbidden {
+		t.Fatal("wrong password reached protected resource:", rec.Code)
+	}
+
+	rec = serve("GET", "/login", nil)
+	if reachedProtected || rec.Body.String() != "login" {
+		t.Fatal("auth block not used for unauthenticated request")
+	}
+}
+
+func TestCookieAuthRefusesInsecureOption(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	// the prefixed session cookie can't be Insecure, so this would
+	// otherwise fail every login after checking the password
+	if _, err := NewCookieAuth(router.NewRouteBlock(), ha, cookie.Insecure); err == nil {
+		t.Fatal("cookie auth accepted an Insecure session cookie")
+	}
+	if _, err := NewBasicAuth("API", ha, cookie.Insecure); err == nil {
+		t.Fatal("basic auth accepted an Insecure session cookie")
+	}
+	if _, err := NewCookieAuth(router.NewRouteBlock(), ha,
+		cookie.Duration(time.Hour)); err != nil {
+		t.Fatal("cookie auth refused valid options:", err)
+	}
+}
+
+type testSession struct {
+	session.Session
+	expired bool
+}
+
+func (ts *testSession) Expire() {
+	ts.expired = true
+}
+
+func TestLogout(t *testing.T) {
+	ts := &testSession{Session: session.AnonymousSession}
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.Location("/logout").Add(&Logout{RedirectTo: "/bye"})
+
+	// a GET, as from a link embedded in some other page, does nothing
+	req, _ := http.NewRequest("GET", "http://jerf.org/logout", nil)
+	rec := httptest.NewRecorder()
+	ctx, srw := request.NewSphyraenaState(nil, nil).NewRequest(rec, req, false)
+	ctx.SetSession(ts)
+	sr.RunRoute(srw, ctx)
+	if ts.expired || rec.Code != http.StatusMethodNotAllowed ||
+		rec.Header().Get("Allow") != "POST" {
+		t.Fatal("logout by GET not refused:", ts.expired, rec.Code, rec.Header())
+	}
+
+	req, _ = http.NewRequest("POST", "http://jerf.org/logout", nil)
+	rec = httptest.NewRecorder()
+	ctx, srw = request.NewSphyraenaState(nil, nil).NewRequest(rec, req, false)
+	ctx.SetSession(ts)
+	sr.RunRoute(srw, ctx)
+
+	if !ts.expired {
+		t.Fatal("logout did not expire the session")
+	}
+	if ctx.Session() != session.AnonymousSession {
+		t.Fatal("logout did not reset the session")
+	}
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/bye" {
+		t.Fatal("logout did not redirect:", rec.Code, rec.Header())
+	}
+	setCookie := rec.Header().Get("Set-Cookie")
+	if !strings.HasPrefix(setCookie, cookie.SessionCookieName+"=;") ||
+		!strings.Contains(setCookie, "Expires=") {
+		t.Fatal("logout did not delete the session cookie:", setCookie)
+	}
+}
+
+type recordingAuditor struct {
+	events []audit.Event
+}
+
+func (ra *recordingAuditor) Audit(e audit.Event) error {
+	ra.events = append(ra.events, e)
+	return nil
+}
+
+func TestCookieAuthAudits(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCookieAuth(router.NewRouteBlock(), ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	ss := request.NewSphyraenaState(rss, nil)
+	auditor := &recordingAuditor{}
+	ss.Auditor = auditor
+	sr := router.New(ss)
+	sr.Add(ca)
+	sr.AddLocationReturn("/protected", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {},
+	))
+
+	serve := func(form url.Values) {
+		req, _ := http.NewRequest("POST", "http://jerf.org/protected",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		sr.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve(url.Values{"username": {"user"}, "password": {"wrong"}})
+	if len(auditor.events) != 1 {
+		t.Fatal("failed authentication not audited:", auditor.events)
+	}
+	e := auditor.events[0]
+	if e.Action != audit.Authentication || e.Outcome != audit.Failure ||
+		e.Details["username"] != "user" || e.Time.IsZero() {
+		t.Fatal("wrong failed authentication event:", e)
+	}
+
+	serve(url.Values{"username": {"user"}, "password": {"password"}})
+	if len(auditor.events) != 3 {
+		t.Fatal("authentication not audited:", auditor.events)
+	}
+	e = auditor.events[1]
+	userID := audit.IdentityID(&identity.Identity{enticate.GetNamedUser("user")})
+	if e.Action != audit.Authentication || e.Outcome != audit.Success ||
+		e.Identity != userID {
+		t.Fatal("wrong authentication event:", e)
+	}
+	e = auditor.events[2]
+	if e.Action != audit.SessionCreated || e.Outcome != audit.Success ||
+		e.Identity != userID || e.Session == "" {
+		t.Fatal("wrong session creation event:", e)
+	}
+}
+
+func TestCookieAuthHeaderTransport(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCookieAuth(router.NewRouteBlock(), ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	ss := request.NewSphyraenaState(rss, nil)
+	ss.SessionTransport = request.HeaderSessionTransport{
+		Header:         "Authorization",
+		Scheme:         "Session",
+		ResponseHeader: "X-Session-ID",
+	}
+	sr := router.New(ss)
+	sr.Add(ca)
+	var user string
+	sr.AddLocationReturn("/protected", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			user = req.Session().Identity().AuthenticationName()
+		},
+	))
+
+	req, _ := http.NewRequest("POST", "http://jerf.org/protected",
+		strings.NewReader(url.Values{
+			"username": {"user"},
+			"password": {"password"},
+		}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+
+	sessionID := rec.Header().Get("X-Session-ID")
+	if sessionID == "" || rec.Header().Get("Set-Cookie") != "" {
+		t.Fatal("session not issued in the header:", rec.Header())
+	}
+
+	user = ""
+	req, _ = http.NewRequest("GET", "http://jerf.org/protected", nil)
+	req.Header.Set("Authorization", "session "+sessionID)
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || user == "" {
+		t.Fatal("session in the header not accepted:", rec.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "http://jerf.org/protected", nil)
+	req.Header.Set("Authorization", "Session wrong")
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("invalid session in the header accepted:", rec.Code)
+	}
+}
+
+func TestCookieAuthRenewsRememberedSessions(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCookieAuth(router.NewRouteBlock(), ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Remember = 10 * time.Hour
+
+	manTime := abtime.NewManual()
+	rss, deffunc := getRAMServer(
+		&session.RAMSessionSettings{Timeout: time.Hour, AbstractTime: manTime})
+	defer deffunc()
+	ss := request.NewSphyraenaState(rss, nil)
+	sr := router.New(ss)
+	sr.Add(ca)
+	sr.AddLocationReturn("/protected", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {},
+	))
+
+	serve := func(sessionCookie string, form url.Values) string {
+		req, _ := http.NewRequest("POST", "https://jerf.org/protected",
+			strings.NewReader(form.Encode()))
+		req.TLS = &tls.ConnectionState{}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if sessionCookie != "" {
+			req.Header.Set("Cookie", sessionCookie)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatal("request not authenticated:", rec.Code)
+		}
+		return rec.Header().Get("Set-Cookie")
+	}
+
+	setCookie := serve("", url.Values{
+		"username": {"user"},
+		"password": {"password"},
+		"remember": {"on"},
+	})
+	if !strings.Contains(setCookie, "Max-Age=36000") {
+		t.Fatal("remembered session not issued a persistent cookie:", setCookie)
+	}
+	sessionCookie := strings.SplitN(setCookie, ";", 2)[0]
+
+	if setCookie = serve(sessionCookie, nil); setCookie != "" {
+		t.Fatal("session renewed with plenty of lifetime left:", setCookie)
+	}
+
+	manTime.Advance(6 * time.Hour)
+	setCookie = serve(sessionCookie, nil)
+	if !strings.HasPrefix(setCookie, sessionCookie+";") ||
+		!strings.Contains(setCookie, "Max-Age=36000") {
+		t.Fatal("session cookie not renewed:", setCookie)
+	}
+}
+
+func TestProbingDoesNotAuthenticate(t *testing.T) {
+	ha := samples.NewHardcodedAuth()
+	err := ha.AddUser("user", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := NewCookieAuth(router.NewRouteBlock(), ha)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	ss := request.NewSphyraenaState(rss, nil)
+	auditor := &recordingAuditor{}
+	ss.Auditor = auditor
+	sr := router.New(ss)
+	sr.RedirectTrailingSlash = true
+	sr.Add(ca)
+	sr.AddLocationReturn("/protected/", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {},
+	))
+
+	// the login is routed once for real, and once more when probing for
+	// the path with the trailing slash, which must not log in again
+	req, _ := http.NewRequest("POST", "http://jerf.org/protected",
+		strings.NewReader(url.Values{
+			"username": {"user"},
+			"password": {"password"},
+		}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatal("login to the path without the slash not redirected:", rec.Code)
+	}
+	if len(auditor.events) != 2 {
+		t.Fatal("probe authenticated the request again:", auditor.events)
+	}
+}
@@ -0,0 +1,223 @@
+package clauses
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html"
+	"html/template"
+	"net/http"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// CSRFFieldName is the name of the form field carrying the CSRF token.
+const CSRFFieldName = "csrf_token"
+
+// CSRFHeader is the request header that may carry the CSRF token instead
+// of the form field, for use by scripts.
+const CSRFHeader = "X-CSRF-Token"
+
+// csrfCookieName is the cookie holding the token for requests without a
+// session.
+const csrfCookieName = "csrf"
+
+// csrfContext is authenticated along with the session's CSRF token, so
+// nothing else the session signs can be presented as one.
+var csrfContext = []byte("csrf_token")
+
+// csrfSessionValue is the value signed by the session to produce its
+// token. The signature is what matters; the session's secret is unique
+// to it, so the token is too.
+var csrfSessionValue = []byte("csrf")
+
+type csrfCookieKey struct{}
+
+// CSRFProtect is a router clause that protects everything after it from
+// cross-site request forgery. Like CookieAuth, if the request passes, it
+// simply lets routing continue on to the subsequent clauses.
+//
+// GET, HEAD, OPTIONS and TRACE requests always pass, as do requests that
+// are only being probed, such as for a CORS preflight, which can carry no
+// token; see router.Request.Probing. Any other request must carry a token
+// produced by CSRFToken, in the CSRFFieldName form field or the
+// CSRFHeader, or it is refused with a 403 and routing terminates.
+//
+// The form field is only looked for in application/x-www-form-urlencoded
+// bodies within the route's body size limit, as given by
+// router.Request.PostedForm, so that no other body is read before the
+// handler gets it. Other requests, including multipart uploads, must send
+// the token in the CSRFHeader.
+//
+// A token bound to the user's session is accepted whether or not the
+// session has been set on the request yet, as the session cookie is
+// consulted directly, so this may be placed in front of the CookieAuth,
+// protecting its login form too.
+type CSRFProtect struct{}
+
+// Route implements the RoutingClause interface.
+func (cp *CSRFProtect) Route(r *router.Request) (res router.Result) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if r.Probing() {
+		return
+	}
+
+	token := r.RequestHeader().Get(CSRFHeader)
+	if token == "" {
+		token = r.PostedForm().Get(CSRFFieldName)
+	}
+	if token != "" && validCSRFToken(r, token) {
+		return
+	}
+
+	res.Handler = request.HandlerFunc(refuseCSRF)
+	return
+}
+
+func validCSRFToken(r *router.Request, token string) bool {
+	c := r.Request.Cookies.GetPossiblyUnauthenticated(csrfCookieName)
+	if c != nil && c.Value() != "" &&
+		subtle.ConstantTimeCompare([]byte(c.Value()), []byte(token)) == 1 {
+		return true
+	}
+
+	s := r.Session()
+	if haveID, _ := s.SessionID(); !haveID {
+		s = cookieSession(r)
+		if s == nil {
+			return false
+		}
+	}
+	value, err := s.UnwrapAuthentication(csrfContext, []byte(token))
+	return err == nil && subtle.ConstantTimeCompare(value, csrfSessionValue) == 1
+}
+
+// cookieSession returns the session named by the session cookie, if there
+// is one.
+func cookieSession(r *router.Request) session.Session {
+	if r.SphyraenaState == nil || r.SessionServer == nil {
+		return nil
+	}
+	c := r.Request.Cookies.Get(r.SessionCookieName())
+	if c == nil {
+		return nil
+	}
+	s, err := r.GetSession(session.SessionID(c.Value()))
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func refuseCSRF(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	rw.Error(http.StatusForbidden, "CSRF token missing or invalid")
+}
+
+// Name returns "csrf_protect".
+func (cp *CSRFProtect) Name() string {
+	return "csrf_protect"
+}
+
+// Argument returns the empty string, as CSRFProtect takes no arguments.
+func (cp *CSRFProtect) Argument() string {
+	return ""
+}
+
+// GetRouteBlock returns nil, as CSRFProtect has no RouteBlock.
+func (cp *CSRFProtect) GetRouteBlock() *router.RouteBlock {
+	return nil
+}
+
+// Prototype returns a CSRFProtect object.
+func (cp *CSRFProtect) Prototype() router.RouterClause {
+	return &CSRFProtect{}
+}
+
+// CSRFToken returns the CSRF token that CSRFProtect will accept for this
+// user.
+//
+// If the request has a session, the token is bound to it. Otherwise, a
+// random token is used, and set in a cookie, with the given options, if
+// the user doesn't already have one.
+func CSRFToken(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	options ...cookie.Option,
+) (string, error) {
+	s := req.Session()
+	if haveID, _ := s.SessionID(); haveID {
+		token, err := s.Authenticate(csrfContext, csrfSessionValue)
+		if err != nil {
+			return "", err
+		}
+		return string(token), nil
+	}
+
+	if token, have := req.Value(csrfCookieKey{}).(string); have {
+		return token, nil
+	}
+	if c := req.Cookies.GetPossiblyUnauthenticated(csrfCookieName); c != nil && c.Value() != "" {
+		return c.Value(), nil
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	c, err := cookie.NewOut(csrfCookieName, token, nil, req.CookieOptions(options...)...)
+	if err != nil {
+		return "", err
+	}
+	rw.SetCookie(c)
+	req.Set(csrfCookieKey{}, token)
+	return token, nil
+}
+
+// CSRFField returns a hidden form input carrying the CSRF token from
+// CSRFToken, suitable for placing directly into a form.
+//
+// The result is escaped HTML. It is typed as an html/template HTML so that
+// html/template will not escape it again; text/template, or a fork of it,
+// will simply print it.
+func CSRFField(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	options ...cookie.Option,
+) (template.HTML, error) {
+	token, err := CSRFToken(rw, req, options...)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<input type="hidden" name="` + CSRFFieldName +
+		`" value="` + html.EscapeString(token) + `">`), nil
+}
+
+// CSRFFuncMap returns template functions for the given request, which
+// can be passed to the Funcs method of a text/template or html/template
+// Template:
+//
+//    csrf_field: the result of CSRFField
+//    csrf_token: the result of CSRFToken
+func CSRFFuncMap(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	options ...cookie.Option,
+) map[string]interface{} {
+	return map[string]interface{}{
+		"csrf_field": func() (template.HTML, error) {
+			return CSRFField(rw, req, options...)
+		},
+		"csrf_token": func() (string, error) {
+			return CSRFToken(rw, req, options...)
+		},
+	}
+}
@@ -0,0 +1,134 @@
+package clauses
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	var field string
+	posted := false
+
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.Add(&CSRFProtect{})
+	sr.AddLocationReturn("/form", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			if req.Method == "POST" {
+				posted = true
+				return
+			}
+			f, err := CSRFField(rw, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			field = string(f)
+			rw.Write([]byte(field))
+		},
+	))
+
+	serve := func(method string, form url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://jerf.org/form",
+			strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := serve("GET", nil, nil)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookieName {
+		t.Fatal("CSRF cookie not set:", rec.Header())
+	}
+	token := cookies[0].Value
+	if field != `<input type="hidden" name="csrf_token" value="`+token+`">` {
+		t.Fatal("Unexpected CSRF field:", field)
+	}
+
+	rec = serve("POST", url.Values{}, cookies)
+	if posted || rec.Code != http.StatusForbidden {
+		t.Fatal("POST without a CSRF token was not refused:", rec.Code)
+	}
+
+	rec = serve("POST", url.Values{CSRFFieldName: {"wrong"}}, cookies)
+	if posted || rec.Code != http.StatusForbidden {
+		t.Fatal("POST with the wrong CSRF token was not refused:", rec.Code)
+	}
+
+	rec = serve("POST", url.Values{CSRFFieldName: {token}}, nil)
+	if posted || rec.Code != http.StatusForbidden {
+		t.Fatal("POST without the CSRF cookie was not refused:", rec.Code)
+	}
+
+	rec = serve("POST", url.Values{CSRFFieldName: {token}}, cookies)
+	if !posted || rec.Code != http.StatusOK {
+		t.Fatal("POST with the CSRF token was refused:", rec.Code)
+	}
+}
+
+func TestCSRFProtectLeavesBody(t *testing.T) {
+	var form url.Values
+	var parseErr error
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.MaxBodySize = 100
+	sr := router.New(ss)
+	sr.Add(&CSRFProtect{})
+	sr.AddLocationReturn("/form", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			parseErr = req.ParseMultipartForm(1000)
+			if parseErr == http.ErrNotMultipart {
+				parseErr = req.ParseForm()
+			}
+			form = req.PostForm
+		},
+	))
+
+	serve := func(contentType, body, token string) int {
+		form, parseErr = nil, nil
+		req, _ := http.NewRequest("POST", "http://jerf.org/form",
+			strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "token"})
+		if token != "" {
+			req.Header.Set(CSRFHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the form the token is found in is left for the handler
+	code := serve("application/x-www-form-urlencoded", "a=b&csrf_token=token", "")
+	if code != http.StatusOK || parseErr != nil || form.Get("a") != "b" {
+		t.Fatal("form with the CSRF token not passed on intact:", code, parseErr, form)
+	}
+
+	// a multipart body is not read, so the token must be in the header
+	multipart := "--x\r\nContent-Disposition: form-data; name=\"csrf_token\"\r\n\r\n" +
+		"token\r\n--x--\r\n"
+	multipartType := "multipart/form-data; boundary=x"
+	if code = serve(multipartType, multipart, ""); code != http.StatusForbidden {
+		t.Fatal("CSRF token accepted from a multipart body:", code)
+	}
+	code = serve(multipartType, multipart, "token")
+	if code != http.StatusOK || parseErr != nil || form.Get("csrf_token") != "token" {
+		t.Fatal("multipart body not passed on intact:", code, parseErr, form)
+	}
+
+	// nor is a form over the body size limit, which is refused one way or
+	// the other
+	large := "csrf_token=token&a=" + strings.Repeat("b", 100)
+	if code = serve("application/x-www-form-urlencoded", large, ""); code == http.StatusOK {
+		t.Fatal("CSRF token read from a form over the body size limit")
+	}
+}
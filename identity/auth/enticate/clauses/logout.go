@@ -0,0 +1,91 @@
+package clauses
+
+import (
+	"net/http"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// LogOut logs the user out of the current request. The current session is
+// expired, the request's session becomes the AnonymousSession, and the
+// SessionTransport clears the session ID, deleting the session cookie by
+// default.
+//
+// The options should be the same as those given to the CookieAuth, so
+// the deletion matches the cookie that was set. cookie.Delete is applied
+// after them.
+func LogOut(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	options ...cookie.Option,
+) error {
+	// SetSession expires the current session for us.
+	req.SetSession(session.AnonymousSession)
+
+	return req.SessionTransport.Clear(req, request.WriterSessionResponse(rw),
+		req.CookieOptions(options...)...)
+}
+
+// Logout is a handler that logs the user out, as per LogOut, and then
+// redirects them to RedirectTo, or "/" if that is empty.
+//
+// Only a POST logs the user out; anything else is refused with a 405
+// Method Not Allowed. Otherwise any page could log the user out by
+// embedding a link to the Logout, as in an image. For the POST to be
+// protected as well, place it behind a CSRFProtect.
+//
+// It can also be used directly as a RouterClause, in which case it
+// behaves like a ReturnClause, handling the request only if the path has
+// been fully consumed.
+type Logout struct {
+	RedirectTo string
+	Options    []cookie.Option
+}
+
+// ServeStreaming implements the request.Handler interface.
+func (lo *Logout) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.Error(http.StatusMethodNotAllowed, "logging out requires a POST")
+		return
+	}
+
+	err := LogOut(rw, req, lo.Options...)
+	if err != nil {
+		rw.Error(http.StatusInternalServerError, "could not log out")
+		return
+	}
+
+	redirectTo := lo.RedirectTo
+	if redirectTo == "" {
+		redirectTo = "/"
+	}
+	http.Redirect(rw, req.Request, redirectTo, http.StatusSeeOther)
+}
+
+func (lo *Logout) Route(r *router.Request) (res router.Result) {
+	if len(r.CurrentPath()) == 0 {
+		res.Handler = lo
+	}
+	return
+}
+
+func (lo *Logout) Name() string {
+	return "logout"
+}
+
+func (lo *Logout) Argument() string {
+	return lo.RedirectTo
+}
+
+func (lo *Logout) GetRouteBlock() *router.RouteBlock {
+	return nil
+}
+
+func (lo *Logout) Prototype() router.RouterClause {
+	return &Logout{}
+}
@@ -0,0 +1,660 @@
+package clauses
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/metrics"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/secret"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+
+	// oidcStateLifetime is how long the user has to complete the login
+	// at the provider.
+	oidcStateLifetime = 10 * time.Minute
+
+	// oidcClockSkew is how far the provider's clock may be from ours
+	// when checking the times in an ID token.
+	oidcClockSkew = time.Minute
+
+	// oidcKeyRefetch is the minimum time between fetches of the
+	// provider's keys, which happen when a token is signed by a key we
+	// don't know.
+	oidcKeyRefetch = time.Minute
+
+	// oidcMaxResponse limits how much of any response from the provider
+	// is read.
+	oidcMaxResponse = 1 << 20
+)
+
+var oidcStateContext = []byte(oidcStateCookie)
+
+// OIDCAuth is a router clause that authenticates users against an OpenID
+// Connect provider, such as Google, Okta or Azure AD, using the
+// authorization code flow.
+//
+// Like CookieAuth, it lets requests with a valid session cookie continue
+// on to the subsequent clauses. Any other GET or HEAD request is
+// redirected to the provider to log in; other methods are refused with a
+// 403, as they can't survive the trip. When the provider sends the user
+// back to the RedirectURL, which this clause handles itself, the code is
+// exchanged for an ID token, the token is verified, and a session is
+// created for an enticate.OIDCUser built from its claims, in the same way
+// CookieAuth does for a password login. The user is then returned to the
+// page they originally asked for.
+//
+// A request that is only being probed is let through without being sent
+// to the provider; see router.Request.Probing.
+//
+// The state and nonce the flow relies on to prevent forged callbacks are
+// kept in a cookie signed by the StateSecret, along with a PKCE verifier.
+// If StateSecret is nil, a random one is generated, which is fine unless
+// the login may be completed by a different process than started it, as
+// behind a load balancer; in that case all the processes must be given
+// the same StateSecret.
+//
+// Only RS256-signed ID tokens are accepted, which all OpenID Connect
+// providers must support. The client authenticates to the token endpoint
+// with HTTP Basic authentication.
+//
+// The endpoints may be set directly, or discovered from the Issuer with
+// NewOIDCAuth. The configuration must not be changed once the OIDCAuth is
+// in use. If the Client is nil, http.DefaultClient is used; if the
+// AbstractTime is nil, the real time is used; if the Scopes are empty,
+// "openid email profile" is requested.
+type OIDCAuth struct {
+	Issuer                string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	StateSecret *secret.Secret
+	Options     []cookie.Option
+	Client      *http.Client
+	abtime.AbstractTime
+
+	initOnce     sync.Once
+	initErr      error
+	callbackPath string
+	stateSecret  *secret.Secret
+
+	keysLock    sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// NewOIDCAuth returns a new OIDCAuth for the given issuer, discovering its
+// endpoints from its /.well-known/openid-configuration document.
+//
+// The redirectURL must be the absolute URL the provider has been told to
+// send users back to, and its path must route to the OIDCAuth.
+func NewOIDCAuth(
+	issuer string,
+	clientID string,
+	clientSecret string,
+	redirectURL string,
+	options ...cookie.Option,
+) (*OIDCAuth, error) {
+	oa := &OIDCAuth{
+		Issuer:       issuer,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Options:      options,
+	}
+	err := oa.Discover(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return oa, nil
+}
+
+// Discover sets the endpoints from the Issuer's discovery document.
+func (oa *OIDCAuth) Discover(ctx context.Context) error {
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	err := oa.getJSON(ctx,
+		strings.TrimSuffix(oa.Issuer, "/")+"/.well-known/openid-configuration",
+		&config)
+	if err != nil {
+		return fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	// OpenID Connect Discovery 1.0, section 4.3
+	if config.Issuer != oa.Issuer {
+		return fmt.Errorf("oidc discovery: issuer %q does not match %q",
+			config.Issuer, oa.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" ||
+		config.JWKSURI == "" {
+		return errors.New("oidc discovery: provider configuration incomplete")
+	}
+
+	oa.AuthorizationEndpoint = config.AuthorizationEndpoint
+	oa.TokenEndpoint = config.TokenEndpoint
+	oa.JWKSURI = config.JWKSURI
+	return nil
+}
+
+func (oa *OIDCAuth) init() {
+	if oa.AbstractTime == nil {
+		oa.AbstractTime = abtime.NewRealTime()
+	}
+	oa.stateSecret = oa.StateSecret
+	if oa.stateSecret == nil {
+		oa.stateSecret = secret.Get()
+	}
+
+	redirect, err := url.Parse(oa.RedirectURL)
+	if err != nil || !redirect.IsAbs() {
+		oa.initErr = fmt.Errorf("oidc: RedirectURL %q is not an absolute URL",
+			oa.RedirectURL)
+		return
+	}
+	oa.callbackPath = redirect.Path
+	if oa.callbackPath == "" {
+		oa.callbackPath = "/"
+	}
+}
+
+func (oa *OIDCAuth) client() *http.Client {
+	if oa.Client == nil {
+		return http.DefaultClient
+	}
+	return oa.Client
+}
+
+// Route implements the RoutingClause interface.
+func (oa *OIDCAuth) Route(r *router.Request) (res router.Result) {
+	oa.initOnce.Do(oa.init)
+	if oa.initErr != nil {
+		res.Error = oa.initErr
+		return
+	}
+
+	if haveID, _ := r.Session().SessionID(); haveID {
+		return
+	}
+
+	if r.URL.Path == oa.callbackPath {
+		res.Handler = request.HandlerFunc(oa.callback)
+		return
+	}
+
+	if r.Probing() {
+		return
+	}
+
+	if sessionID, haveSessionID := r.SessionTransport.SessionID(r.Request); haveSessionID {
+		s, err := r.GetSession(sessionID)
+		if err == nil {
+			r.SetSession(s)
+			return
+		}
+	}
+
+	res.Handler = request.HandlerFunc(oa.login)
+	return
+}
+
+// Name returns the name of this clause.
+func (oa *OIDCAuth) Name() string {
+	return "OIDCAuth"
+}
+
+// Argument returns the empty string, as OIDCAuth takes no arguments.
+func (oa *OIDCAuth) Argument() string {
+	return ""
+}
+
+// GetRouteBlock returns nil, as OIDCAuth has no RouteBlock.
+func (oa *OIDCAuth) GetRouteBlock() *router.RouteBlock {
+	return nil
+}
+
+// Prototype returns an empty OIDCAuth.
+func (oa *OIDCAuth) Prototype() router.RouterClause {
+	return &OIDCAuth{}
+}
+
+// oidcState is what the state cookie carries between the redirect to the
+// provider and the callback.
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// login sends the user off to the provider to log in.
+func (oa *OIDCAuth) login(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Error(http.StatusForbidden, "authentication required")
+		return
+	}
+
+	st := oidcState{Return: req.URL.RequestURI()}
+	for _, token := range []*string{&st.State, &st.Nonce, &st.Verifier} {
+		var err error
+		*token, err = randomToken()
+		if err != nil {
+			rw.Error(http.StatusInternalServerError, "could not start login")
+			return
+		}
+	}
+
+	c, err := oa.stateCookie(req, st)
+	if err != nil {
+		slog.Error("could not create OIDC state cookie", "error", err)
+		rw.Error(http.StatusInternalServerError, "could not start login")
+		return
+	}
+	rw.SetCookie(c)
+
+	scopes := oa.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oa.ClientID},
+		"redirect_uri":          {oa.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(oa.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(rw, req.Request,
+		oa.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// stateCookie returns the signed cookie carrying the state. The signed
+// value is base64 encoded so it isn't mistaken for a cookie authenticated
+// by a session.
+//
+// The cookie must be SameSite=Lax, as the callback is a cross-site
+// navigation from the provider.
+func (oa *OIDCAuth) stateCookie(req *request.Request, st oidcState) (*cookie.OutCookie, error) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := oa.stateSecret.Authenticate(oidcStateContext, b)
+	if err != nil {
+		return nil, err
+	}
+
+	options := append(req.CookieOptions(oa.Options...),
+		cookie.SameSite(cookie.Lax), cookie.Duration(oidcStateLifetime))
+	return cookie.NewOut(oidcStateCookie,
+		base64.RawURLEncoding.EncodeToString(signed), nil, options...)
+}
+
+func (oa *OIDCAuth) readState(req *request.Request) (oidcState, error) {
+	var st oidcState
+
+	c := req.Cookies.GetPossiblyUnauthenticated(oidcStateCookie)
+	if c == nil {
+		return st, errors.New("no state cookie")
+	}
+	signed, err := base64.RawURLEncoding.DecodeString(c.Value())
+	if err != nil {
+		return st, err
+	}
+	b, err := oa.stateSecret.UnwrapAuthentication(oidcStateContext, signed)
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(b, &st)
+	return st, err
+}
+
+// callback handles the user's return from the provider.
+func (oa *OIDCAuth) callback(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	fail := func(reason string, err error) {
+		slog.Warn("OIDC login failed", "reason", reason, "error", err)
+		req.Metrics().IncCounter(metrics.Authentications,
+			metrics.Labels{"result": "failure"})
+		_ = req.Audit(audit.Event{
+			Action:  audit.Authentication,
+			Outcome: audit.Failure,
+			Details: map[string]string{"method": "oidc", "reason": reason},
+		})
+		rw.Error(http.StatusForbidden, "authentication failed")
+	}
+
+	// the state is single-use, whatever happens
+	deleteOptions := append(req.CookieOptions(oa.Options...),
+		cookie.SameSite(cookie.Lax), cookie.Delete)
+	if c, err := cookie.NewOut(oidcStateCookie, "", nil, deleteOptions...); err == nil {
+		rw.SetCookie(c)
+	}
+
+	st, err := oa.readState(req)
+	if err != nil {
+		fail("invalid_state", err)
+		return
+	}
+	query := req.URL.Query()
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(st.State)) != 1 {
+		fail("state_mismatch", nil)
+		return
+	}
+	if providerErr := query.Get("error"); providerErr != "" {
+		fail("provider_error", errors.New(providerErr))
+		return
+	}
+
+	ctx := req.Request.Context()
+	rawToken, err := oa.exchange(ctx, query.Get("code"), st.Verifier)
+	if err != nil {
+		fail("token_exchange", err)
+		return
+	}
+	claims, err := oa.verify(ctx, rawToken, st.Nonce)
+	if err != nil {
+		fail("invalid_id_token", err)
+		return
+	}
+
+	id := &identity.Identity{&enticate.OIDCUser{
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Name:    claims.Name,
+	}}
+	req.Metrics().IncCounter(metrics.Authentications,
+		metrics.Labels{"result": "success"})
+	_ = req.Audit(audit.Event{
+		Identity: audit.IdentityID(id),
+		Action:   audit.Authentication,
+		Outcome:  audit.Success,
+		Details:  map[string]string{"method": "oidc"},
+	})
+
+	err = startSession(req, req, request.WriterSessionResponse(rw), id, 0, oa.Options)
+	if err != nil {
+		rw.Error(http.StatusInternalServerError, "could not create session")
+		return
+	}
+
+	// The session cookie is SameSite=Strict by default, and browsers
+	// won't send it on a redirect that is part of a navigation that
+	// started at the provider. Returning the user from a page of our own
+	// makes it a same-site navigation.
+	returnTo := st.Return
+	if !sphyrw.IsLocalRedirect(returnTo) {
+		returnTo = "/"
+	}
+	escaped := html.EscapeString(returnTo)
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(rw, `<!DOCTYPE html><meta http-equiv="refresh" content="0;url=%s">`+
+		`<a href="%s">Continue</a>`+"\n", escaped, escaped)
+}
+
+// exchange trades the authorization code for an ID token.
+func (oa *OIDCAuth) exchange(ctx context.Context, code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("no authorization code")
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oa.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, oa.TokenEndpoint,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	hreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hreq.Header.Set("Accept", "application/json")
+	// RFC 6749, section 2.3.1
+	hreq.SetBasicAuth(url.QueryEscape(oa.ClientID), url.QueryEscape(oa.ClientSecret))
+
+	resp, err := oa.client().Do(hreq)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(&tokens)
+	if err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// audience is the "aud" claim, which may be a single string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenClaims struct {
+	Issuer          string   `json:"iss"`
+	Subject         string   `json:"sub"`
+	Audience        audience `json:"aud"`
+	AuthorizedParty string   `json:"azp"`
+	Expires         float64  `json:"exp"`
+	IssuedAt        float64  `json:"iat"`
+	Nonce           string   `json:"nonce"`
+	Email           string   `json:"email"`
+	Name            string   `json:"name"`
+}
+
+func unixTime(t float64) time.Time {
+	return time.Unix(int64(t), 0)
+}
+
+// verify checks the ID token's signature and claims, as per OpenID
+// Connect Core 1.0, section 3.1.3.7, and returns its claims.
+func (oa *OIDCAuth) verify(ctx context.Context, rawToken, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err == nil {
+		err = json.Unmarshal(b, &header)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("ID token signed with unsupported algorithm %q", header.Alg)
+	}
+
+	key, err := oa.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, errors.New("ID token signature invalid")
+	}
+
+	var claims idTokenClaims
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err == nil {
+		err = json.Unmarshal(b, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+
+	now := oa.Now()
+	switch {
+	case claims.Issuer != oa.Issuer:
+		return nil, fmt.Errorf("ID token from wrong issuer %q", claims.Issuer)
+	case !claims.Audience.contains(oa.ClientID):
+		return nil, errors.New("ID token not issued to this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != oa.ClientID:
+		return nil, errors.New("ID token not authorized for this client")
+	case !now.Before(unixTime(claims.Expires).Add(oidcClockSkew)):
+		return nil, errors.New("ID token expired")
+	case unixTime(claims.IssuedAt).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("ID token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// key returns the provider's signing key with the given ID, fetching the
+// provider's keys if it isn't known, as it may have rotated them.
+func (oa *OIDCAuth) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	oa.keysLock.Lock()
+	defer oa.keysLock.Unlock()
+
+	if key, have := oa.keys[kid]; have {
+		return key, nil
+	}
+	if !oa.keysFetched.IsZero() && oa.Now().Sub(oa.keysFetched) < oidcKeyRefetch {
+		return nil, fmt.Errorf("ID token signed by unknown key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	err := oa.getJSON(ctx, oa.JWKSURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch provider keys: %w", err)
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	oa.keys = keys
+	oa.keysFetched = oa.Now()
+
+	if key, have := oa.keys[kid]; have {
+		return key, nil
+	}
+	return nil, fmt.Errorf("ID token signed by unknown key %q", kid)
+}
+
+func (oa *OIDCAuth) getJSON(ctx context.Context, u string, dst interface{}) error {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Accept", "application/json")
+
+	resp, err := oa.client().Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(dst)
+}
@@ -0,0 +1,203 @@
+package clauses
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// testProvider is a minimal OpenID Connect provider.
+type testProvider struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	// set by the test from the authorization request
+	nonce     string
+	challenge string
+
+	// claims overrides the claims of the next ID token
+	claims map[string]interface{}
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp := &testProvider{t: t, key: key}
+	tp.Server = httptest.NewServer(http.HandlerFunc(tp.serve))
+	return tp
+}
+
+func (tp *testProvider) serve(rw http.ResponseWriter, req *http.Request) {
+	enc := base64.RawURLEncoding
+	switch req.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 tp.URL,
+			"authorization_endpoint": tp.URL + "/authorize",
+			"token_endpoint":         tp.URL + "/token",
+			"jwks_uri":               tp.URL + "/keys",
+		})
+	case "/keys":
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": "k1",
+				"n":   enc.EncodeToString(tp.key.N.Bytes()),
+				"e":   enc.EncodeToString(big.NewInt(int64(tp.key.E)).Bytes()),
+			}},
+		})
+	case "/token":
+		user, pass, _ := req.BasicAuth()
+		verifier := sha256.Sum256([]byte(req.FormValue("code_verifier")))
+		if user != "client" || pass != "s3cret" || req.FormValue("code") != "abc" ||
+			enc.EncodeToString(verifier[:]) != tp.challenge {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]string{
+			"access_token": "unused",
+			"id_token":     tp.idToken(),
+		})
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (tp *testProvider) idToken() string {
+	claims := map[string]interface{}{
+		"iss":   tp.URL,
+		"sub":   "12345",
+		"aud":   "client",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": tp.nonce,
+		"email": "jerf@jerf.org",
+	}
+	for name, value := range tp.claims {
+		claims[name] = value
+	}
+
+	enc := base64.RawURLEncoding
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, tp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		tp.t.Fatal(err)
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestOIDCAuth(t *testing.T) {
+	tp := newTestProvider(t)
+	defer tp.Close()
+
+	oa, err := NewOIDCAuth(tp.URL, "client", "s3cret",
+		"https://jerf.org/oidc/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var user *enticate.OIDCUser
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	sr := router.New(request.NewSphyraenaState(rss, nil))
+	sr.Add(oa)
+	sr.AddLocationReturn("/protected", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			user = req.Session().Identity().Authentication.(*enticate.OIDCUser)
+		},
+	))
+
+	serve := func(u string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", u, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// log in, playing the part of the browser and the provider, returning
+	// the response to the callback.
+	login := func(state func(string) string) *httptest.ResponseRecorder {
+		rec := serve("https://jerf.org/protected?x=1", nil)
+		if rec.Code != http.StatusFound {
+			t.Fatal("unauthenticated request not redirected:", rec.Code)
+		}
+		redirect, _ := url.Parse(rec.Header().Get("Location"))
+		params := redirect.Query()
+		if !strings.HasPrefix(redirect.String(), tp.URL+"/authorize?") ||
+			params.Get("client_id") != "client" ||
+			params.Get("redirect_uri") != "https://jerf.org/oidc/callback" ||
+			params.Get("scope") != "openid email profile" {
+			t.Fatal("bad redirect to provider:", redirect)
+		}
+		tp.nonce = params.Get("nonce")
+		tp.challenge = params.Get("code_challenge")
+
+		return serve("https://jerf.org/oidc/callback?code=abc&state="+
+			url.QueryEscape(state(params.Get("state"))), rec.Result().Cookies())
+	}
+
+	rec := login(func(state string) string { return state })
+	if rec.Code != http.StatusOK ||
+		!strings.Contains(rec.Body.String(), `content="0;url=/protected?x=1"`) {
+		t.Fatal("callback did not return the user:", rec.Code, rec.Body.String())
+	}
+	var sessionCookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == cookie.SessionCookieName {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("no session cookie set")
+	}
+
+	rec = serve("https://jerf.org/protected", []*http.Cookie{sessionCookie})
+	if rec.Code != http.StatusOK || user == nil || user.Subject != "12345" ||
+		user.Issuer != tp.URL || user.LogName() != "jerf@jerf.org" {
+		t.Fatal("session not established for the provider's user:", rec.Code, user)
+	}
+
+	rec = login(func(string) string { return "forged" })
+	if rec.Code != http.StatusForbidden {
+		t.Fatal("callback with the wrong state accepted:", rec.Code)
+	}
+
+	for _, claims := range []map[string]interface{}{
+		{"aud": "someone_else"},
+		{"iss": "https://evil.example.com"},
+		{"exp": time.Now().Add(-time.Hour).Unix()},
+		{"nonce": "replayed"},
+	} {
+		tp.claims = claims
+		rec = login(func(state string) string { return state })
+		if rec.Code != http.StatusForbidden {
+			t.Fatal("invalid ID token accepted:", claims)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package enticate
+
+import (
+	"encoding/json"
+)
+
+// An OIDCUser is an Authentication established by an OpenID Connect
+// provider, from the claims of an ID token that has been verified.
+//
+// The Issuer and Subject together uniquely identify the user; the Email
+// and Name are carried along for logging only, as providers may let
+// users change them.
+type OIDCUser struct {
+	Issuer  string `json:"iss"`
+	Subject string `json:"sub"`
+	Email   string `json:"email,omitempty"`
+	Name    string `json:"name,omitempty"`
+}
+
+// LogName implements the Authentication interface.
+//
+// This returns the Email if the provider gave one, or else the Name, or
+// failing that the Subject.
+func (ou *OIDCUser) LogName() string {
+	switch {
+	case ou.Email != "":
+		return ou.Email
+	case ou.Name != "":
+		return ou.Name
+	}
+	return ou.Subject
+}
+
+// IsAuthenticated implements the Authentication interface. This returns
+// true.
+func (ou *OIDCUser) IsAuthenticated() bool {
+	return true
+}
+
+// AuthenticationName implements the Authentication interface.
+func (ou *OIDCUser) AuthenticationName() string {
+	return "oidc"
+}
+
+// Empty implements the Authentication interface.
+func (ou *OIDCUser) Empty() Authentication {
+	return &OIDCUser{}
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (ou *OIDCUser) MarshalText() ([]byte, error) {
+	return json.Marshal(*ou)
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (ou *OIDCUser) UnmarshalText(b []byte) error {
+	type plain OIDCUser
+	return json.Unmarshal(b, (*plain)(ou))
+}
@@ -0,0 +1,250 @@
+package enticate
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	unicodeclass "unicode"
+	"unicode/utf8"
+
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+// A PasswordViolation is a symbolic reason a password does not satisfy a
+// PasswordPolicy, suitable for choosing a message to show the user in
+// their own language.
+type PasswordViolation string
+
+const (
+	// PasswordTooShort means the password has fewer than MinLength
+	// characters.
+	PasswordTooShort = PasswordViolation("too_short")
+
+	// PasswordTooLong means the password has more than MaxLength
+	// characters.
+	PasswordTooLong = PasswordViolation("too_long")
+
+	// PasswordNeedsLowercase means the policy requires a lowercase
+	// letter, and there is none.
+	PasswordNeedsLowercase = PasswordViolation("needs_lowercase")
+
+	// PasswordNeedsUppercase means the policy requires an uppercase
+	// letter, and there is none.
+	PasswordNeedsUppercase = PasswordViolation("needs_uppercase")
+
+	// PasswordNeedsDigit means the policy requires a digit, and there is
+	// none.
+	PasswordNeedsDigit = PasswordViolation("needs_digit")
+
+	// PasswordNeedsSymbol means the policy requires a character that is
+	// not a letter or a digit, and there is none.
+	PasswordNeedsSymbol = PasswordViolation("needs_symbol")
+
+	// PasswordCompromised means the password is known to have been
+	// compromised, according to the policy's CompromisedChecker.
+	PasswordCompromised = PasswordViolation("compromised")
+)
+
+// A PasswordPolicyError is returned by PasswordPolicy.Check when the
+// password does not satisfy the policy, listing every reason why not.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (ppe *PasswordPolicyError) Error() string {
+	reasons := make([]string, len(ppe.Violations))
+	for i, violation := range ppe.Violations {
+		reasons[i] = string(violation)
+	}
+	return "password does not satisfy the policy: " + strings.Join(reasons, ", ")
+}
+
+// Has returns whether the given violation is among the Violations.
+func (ppe *PasswordPolicyError) Has(violation PasswordViolation) bool {
+	for _, v := range ppe.Violations {
+		if v == violation {
+			return true
+		}
+	}
+	return false
+}
+
+// A CompromisedChecker checks whether a password is known to have been
+// compromised, such as by appearing in a breach.
+type CompromisedChecker interface {
+	Compromised(password unicode.NFKCNormalized) (bool, error)
+}
+
+// A PasswordPolicy describes the passwords an authenticator will accept
+// when a password is set. It is independent of how the password is then
+// stored, so any authenticator can use one.
+//
+// Lengths are counted in characters, not bytes. A zero MinLength or
+// MaxLength is not checked. If Compromised is not nil, the password is
+// also checked with it; this is only done if the password passes the
+// other checks, as the check may be expensive or remote.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+
+	RequireLowercase bool
+	RequireUppercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+
+	Compromised CompromisedChecker
+}
+
+// Check checks the password against the policy. It returns nil if the
+// password satisfies it, or a *PasswordPolicyError listing the
+// violations. Any other error means the CompromisedChecker failed, and
+// whether the password satisfies the policy is not known.
+func (pp *PasswordPolicy) Check(password unicode.NFKCNormalized) error {
+	pw := password.String()
+	var violations []PasswordViolation
+
+	length := utf8.RuneCountInString(pw)
+	if pp.MinLength != 0 && length < pp.MinLength {
+		violations = append(violations, PasswordTooShort)
+	}
+	if pp.MaxLength != 0 && length > pp.MaxLength {
+		violations = append(violations, PasswordTooLong)
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range pw {
+		switch {
+		case unicodeclass.IsLower(r):
+			lower = true
+		case unicodeclass.IsUpper(r):
+			upper = true
+		case unicodeclass.IsDigit(r):
+			digit = true
+		case !unicodeclass.IsLetter(r):
+			symbol = true
+		}
+	}
+	for _, requirement := range []struct {
+		required, present bool
+		violation         PasswordViolation
+	}{
+		{pp.RequireLowercase, lower, PasswordNeedsLowercase},
+		{pp.RequireUppercase, upper, PasswordNeedsUppercase},
+		{pp.RequireDigit, digit, PasswordNeedsDigit},
+		{pp.RequireSymbol, symbol, PasswordNeedsSymbol},
+	} {
+		if requirement.required && !requirement.present {
+			violations = append(violations, requirement.violation)
+		}
+	}
+
+	if len(violations) == 0 && pp.Compromised != nil {
+		compromised, err := pp.Compromised.Compromised(password)
+		if err != nil {
+			return fmt.Errorf("could not check whether the password is compromised: %w", err)
+		}
+		if compromised {
+			violations = append(violations, PasswordCompromised)
+		}
+	}
+
+	if len(violations) != 0 {
+		return &PasswordPolicyError{violations}
+	}
+	return nil
+}
+
+// A Wordlist is a CompromisedChecker that checks passwords against a
+// list held in memory, for deployments that can't reach HaveIBeenPwned.
+type Wordlist struct {
+	words map[string]struct{}
+}
+
+// NewWordlist reads a Wordlist of one password per line from the reader,
+// such as one of the common password lists. Blank lines are ignored.
+func NewWordlist(r io.Reader) (*Wordlist, error) {
+	wl := &Wordlist{map[string]struct{}{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		word := strings.TrimRight(scanner.Text(), "\r")
+		if word != "" {
+			normalized := unicode.NFKCNormalize(word)
+			wl.words[normalized.String()] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return wl, nil
+}
+
+// Compromised implements the CompromisedChecker interface.
+func (wl *Wordlist) Compromised(password unicode.NFKCNormalized) (bool, error) {
+	_, have := wl.words[password.String()]
+	return have, nil
+}
+
+// DefaultHaveIBeenPwnedURL is the Pwned Passwords range API.
+const DefaultHaveIBeenPwnedURL = "https://api.pwnedpasswords.com/range/"
+
+// HaveIBeenPwned is a CompromisedChecker that checks passwords against
+// the Pwned Passwords service.
+//
+// This uses the k-anonymity API: only the first five hex characters of
+// the password's SHA-1 hash are sent, and the service returns every
+// compromised hash with that prefix, so neither the password nor its
+// hash leaves the server.
+//
+// If Client is nil, http.DefaultClient is used; as that has no timeout,
+// setting a Client with one is recommended. If URL is empty,
+// DefaultHaveIBeenPwnedURL is used.
+type HaveIBeenPwned struct {
+	Client *http.Client
+	URL    string
+}
+
+// Compromised implements the CompromisedChecker interface.
+func (hibp *HaveIBeenPwned) Compromised(password unicode.NFKCNormalized) (bool, error) {
+	sum := sha1.Sum([]byte(password.String()))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	client := hibp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	url := hibp.URL
+	if url == "" {
+		url = DefaultHaveIBeenPwnedURL
+	}
+
+	req, err := http.NewRequest("GET", url+prefix, nil)
+	if err != nil {
+		return false, err
+	}
+	// padding keeps the size of the response from revealing the prefix
+	req.Header.Set("Add-Padding", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("pwned passwords returned %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		candidate, count, found := strings.Cut(line, ":")
+		// padding entries have a count of zero
+		if found && strings.EqualFold(candidate, suffix) && count != "0" {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package enticate
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := &PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        16,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+	}
+
+	for _, test := range []struct {
+		password   string
+		violations []PasswordViolation
+	}{
+		{"Corr3ct-horse", nil},
+		{"Ünïcödé-Pässw0rd", nil},
+		{"aB3-", []PasswordViolation{PasswordTooShort}},
+		{"Corr3ct-horse-battery", []PasswordViolation{PasswordTooLong}},
+		{"correct-horse", []PasswordViolation{PasswordNeedsUppercase, PasswordNeedsDigit}},
+		{"CORRECTHORSE", []PasswordViolation{PasswordNeedsLowercase,
+			PasswordNeedsDigit, PasswordNeedsSymbol}},
+	} {
+		err := policy.Check(unicode.NFKCNormalize(test.password))
+		if test.violations == nil {
+			if err != nil {
+				t.Fatal("good password refused:", test.password, err)
+			}
+			continue
+		}
+		var ppe *PasswordPolicyError
+		if !errors.As(err, &ppe) || !reflect.DeepEqual(ppe.Violations, test.violations) {
+			t.Fatal("wrong violations for", test.password, ":", err)
+		}
+	}
+
+	wordlist, err := NewWordlist(strings.NewReader("password\r\n\nCorr3ct-horse\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.Compromised = wordlist
+	err = policy.Check(unicode.NFKCNormalize("Corr3ct-horse"))
+	var ppe *PasswordPolicyError
+	if !errors.As(err, &ppe) || !ppe.Has(PasswordCompromised) || ppe.Has(PasswordTooShort) {
+		t.Fatal("compromised password accepted:", err)
+	}
+	if policy.Check(unicode.NFKCNormalize("Batt3ry-staple")) != nil {
+		t.Fatal("uncompromised password refused")
+	}
+}
+
+func TestHaveIBeenPwned(t *testing.T) {
+	// SHA-1("password") is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, req *http.Request) {
+			requested = req.URL.Path
+			if req.Header.Get("Add-Padding") != "true" {
+				t.Error("padding not requested")
+			}
+			fmt.Fprint(rw, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n"+
+				"1E4C9B93F3F0682250B6CF8331B7EE68FD8:9659365\r\n"+
+				"00D4F6E8FA6EECAD2A3AA415EEC418D38EC:0\r\n")
+		},
+	))
+	defer server.Close()
+
+	hibp := &HaveIBeenPwned{URL: server.URL + "/range/"}
+	compromised, err := hibp.Compromised(unicode.NFKCNormalize("password"))
+	if err != nil || !compromised || requested != "/range/5BAA6" {
+		t.Fatal("compromised password not found:", compromised, err, requested)
+	}
+
+	// a padding entry, with a count of zero, is not a match
+	compromised, err = hibp.Compromised(unicode.NFKCNormalize("not the password"))
+	if err != nil || compromised {
+		t.Fatal("uncompromised password reported:", compromised, err)
+	}
+
+	server.Close()
+	policy := &PasswordPolicy{Compromised: hibp}
+	err = policy.Check(unicode.NFKCNormalize("password"))
+	var ppe *PasswordPolicyError
+	if err == nil || errors.As(err, &ppe) {
+		t.Fatal("failed check not reported:", err)
+	}
+}
+
+func TestMessageKey(t *testing.T) {
+	for _, test := range []struct {
+		err      AuthError
+		expected string
+	}{
+		{WrongUserOrPassword(), KeyWrongUserOrPassword},
+		{AuthServiceDown(), KeyAuthServiceDown},
+		{NoAuthGiven(), KeyNoAuthGiven},
+		{LockedOut(), KeyLockedOut},
+		{&autherror{mayTryAgain: true}, KeyAuthFailed},
+	} {
+		if key := MessageKey(test.err); key != test.expected {
+			t.Fatalf("got %q, expected %q", key, test.expected)
+		}
+	}
+}
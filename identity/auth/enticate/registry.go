@@ -2,7 +2,10 @@ package enticate
 
 import (
 	"errors"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -13,37 +16,85 @@ var ErrUnknownAuthType = errors.New("Unknown authentication type")
 
 var ErrNilAuth = errors.New("Nil authentication passed to Marshal")
 
-var authentications = map[string]Authentication{}
+// An UnknownAuthTypeError is returned by Unmarshal when asked for an
+// authentication name that was never Register()ed. This usually means a
+// session was persisted by a program that registered an Authentication
+// this one does not.
+//
+// errors.Is(err, ErrUnknownAuthType) is true for it.
+type UnknownAuthTypeError struct {
+	Name string
+}
+
+func (uate UnknownAuthTypeError) Error() string {
+	return ErrUnknownAuthType.Error() + " " + strconv.Quote(uate.Name) +
+		"; it must be passed to enticate.Register before it can be unmarshaled"
+}
+
+// Is returns true for ErrUnknownAuthType.
+func (uate UnknownAuthTypeError) Is(target error) bool {
+	return target == ErrUnknownAuthType
+}
+
+var (
+	registryLock    sync.RWMutex
+	authentications = map[string]Authentication{}
+)
 
 // Register will register the given Authenication with sphyraena, so it can
-// be Unmarshaled into.
+// be Unmarshaled into. This is what allows sessions holding your own
+// Authentication types to be persisted and restored by session servers
+// such as the FilesystemServer.
 //
-// All Registrations must be completed before any Unmarshal or Marshal
-// calls are made.
+// Register is safe to call at any time, but the conventional place is an
+// init function in the package defining the Authentication, as this
+// package does for its own. Registering the same type again has no
+// effect.
 //
 // ⁝ is a reserved character for authentication names. Due to the expected
 // rarity of this coming up, this method will panic if that constraint is
-// violated.
+// violated. Two different types can not share an authentication name, as
+// then one could be unmarshaled as the other; this will also panic if
+// that is attempted.
 func Register(auth Authentication) {
 	name := auth.AuthenticationName()
 	if strings.Contains(name, EnticateSeparator) {
 		panic("authentication name can't contain tricolon (" +
 			EnticateSeparator + ")")
 	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if existing, have := authentications[name]; have &&
+		reflect.TypeOf(existing) != reflect.TypeOf(auth) {
+		panic("authentication name " + strconv.Quote(name) +
+			" registered by two different types")
+	}
 	authentications[name] = auth
 }
 
+// Lookup returns the Authentication registered under the given name, if
+// any.
+func Lookup(name string) (Authentication, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	auth, have := authentications[name]
+	return auth, have
+}
+
 // Unmarshal takes the tuple of the authentication's name and the
 // authentication info, and turns it into an Authentication that can be
 // used by the rest of Sphyraena.
 //
 // The authName should match the return value of the AuthenticationName()
 // of the relevant Authentication type, and it must have been Register()ed
-// before this method is called or you will get ErrUnknownAuthType.
+// before this method is called or you will get an UnknownAuthTypeError.
 func Unmarshal(authName string, authInfo []byte) (Authentication, error) {
-	authType := authentications[authName]
-	if authType == nil {
-		return nil, ErrUnknownAuthType
+	authType, have := Lookup(authName)
+	if !have {
+		return nil, UnknownAuthTypeError{authName}
 	}
 
 	empty := authType.Empty()
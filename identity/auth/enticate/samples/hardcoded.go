@@ -1,8 +1,12 @@
 package samples
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
+
 	"github.com/thejerf/sphyraena/identity/auth/enticate"
 	"github.com/thejerf/sphyraena/unicode"
 )
@@ -22,24 +26,67 @@ var ErrTooLarge = errors.New("username or password too large")
 // This is primarily for A: development and B: showing the simplest
 // possible authentication provider.
 //
-// Both username and password are case-sensitive. Passwords are limited to
-// 128 bytes.
+// Both username and password are case-sensitive, unless
+// CaseInsensitiveUsernames is set, in which case usernames are compared
+// as unicode.NFKCCasefold compares them; set it before adding any users.
+// A user authenticated this way is always named by the username as it was
+// added, however it was typed to log in.
+// Passwords are limited to 128 bytes.
+//
+// Authenticate takes the same time whether or not the username exists, so
+// the response time does not reveal which usernames are valid. Other
+// PasswordAuthenticators should take the same care, by checking the given
+// password against a dummy hash of the same cost when there is no such
+// user.
+//
+// If Policy is not nil, AddUser refuses passwords that don't satisfy it.
 type HardcodedAuthentication struct {
-	users map[unicode.NFKCNormalized]unicode.NFKCNormalized
+	Policy                   *enticate.PasswordPolicy
+	CaseInsensitiveUsernames bool
+
+	// the passwords are held as HMACs under the key, which makes every
+	// comparison the same length, whatever the length of the password
+	key   []byte
+	users map[string]hardcodedUser
+	dummy []byte
+}
+
+type hardcodedUser struct {
+	username unicode.NFKCNormalized
+	hash     []byte
 }
 
 func NewHardcodedAuth() *HardcodedAuthentication {
-	return &HardcodedAuthentication{
-		map[unicode.NFKCNormalized]unicode.NFKCNormalized{},
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	ha := &HardcodedAuthentication{
+		key:   key,
+		users: map[string]hardcodedUser{},
 	}
+	ha.dummy = ha.hash(unicode.NFKCNormalize("no such user"))
+	return ha
+}
+
+func (ha *HardcodedAuthentication) hash(password unicode.NFKCNormalized) []byte {
+	mac := hmac.New(sha256.New, ha.key)
+	_, _ = mac.Write([]byte(password.String()))
+	return mac.Sum(nil)
+}
+
+func (ha *HardcodedAuthentication) userKey(username unicode.NFKCNormalized) string {
+	if ha.CaseInsensitiveUsernames {
+		folded := username.Casefold()
+		return folded.String()
+	}
+	return username.String()
 }
 
 // AddUser will add the given username/password combination to the
 // hardcoded authenticator. If the given username is already assigned to a
 // given password, it will be overwritten.
 //
-// The only error that can result is that the username or the password is
-// too long.
+// An error results if the username or the password is too long, or if
+// the password does not satisfy the Policy.
 func (ha *HardcodedAuthentication) AddUser(username, password string) error {
 	user := unicode.NFKCNormalize(username)
 	pw := unicode.NFKCNormalize(password)
@@ -49,7 +96,12 @@ func (ha *HardcodedAuthentication) AddUser(username, password string) error {
 	if len(password) > MaxSize {
 		return ErrTooLarge
 	}
-	ha.users[user] = pw
+	if ha.Policy != nil {
+		if err := ha.Policy.Check(pw); err != nil {
+			return err
+		}
+	}
+	ha.users[ha.userKey(user)] = hardcodedUser{user, ha.hash(pw)}
 	return nil
 }
 
@@ -58,21 +110,21 @@ func (ha *HardcodedAuthentication) Authenticate(username, password unicode.NFKCN
 		return nil, enticate.WrongUserOrPassword()
 	}
 
-	correctPassword, haveUser := ha.users[username]
-
-	// guaranteed that the correct password is not > MaxSize by the AddUser
-	// method above; can not insert a password that is too long.
-	given := make([]byte, MaxSize, MaxSize)
-	copy(given, password.String())
-	correct := make([]byte, MaxSize, MaxSize)
-	copy(correct, correctPassword.String())
+	// An unknown user is compared against the dummy hash, so the same
+	// work is done either way, and the result only examined once it's all
+	// done.
+	user, haveUser := ha.users[ha.userKey(username)]
+	correct := user.hash
+	userExists := 1
+	if !haveUser {
+		correct = ha.dummy
+		userExists = 0
+	}
 
-	compare := subtle.ConstantTimeCompare(given, correct)
+	compare := subtle.ConstantTimeCompare(ha.hash(password), correct)
 
-	if compare == 1 && haveUser {
-		return &enticate.NamedUser{username}, nil
-		// redo request
-	} else {
-		return nil, enticate.WrongUserOrPassword()
+	if compare&userExists == 1 {
+		return &enticate.NamedUser{user.username}, nil
 	}
+	return nil, enticate.WrongUserOrPassword()
 }
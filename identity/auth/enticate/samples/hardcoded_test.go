@@ -0,0 +1,79 @@
+package samples
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/unicode"
+)
+
+func TestHardcodedAuthentication(t *testing.T) {
+	ha := NewHardcodedAuth()
+	long := strings.Repeat("x", MaxSize)
+	if ha.AddUser("jerf", "password") != nil || ha.AddUser("long", long) != nil {
+		t.Fatal("could not add users")
+	}
+	if ha.AddUser("toolong", long+"x") != ErrTooLarge {
+		t.Fatal("overly long password accepted")
+	}
+	ha.Policy = &enticate.PasswordPolicy{MinLength: 12}
+	if ha.AddUser("weak", "password") == nil {
+		t.Fatal("password violating the policy accepted")
+	}
+
+	for _, test := range []struct {
+		username, password string
+		succeeds           bool
+	}{
+		{"jerf", "password", true},
+		{"jerf", "passwor", false},
+		{"jerf", "password\x00", false},
+		{"jerf", "", false},
+		{"nobody", "password", false},
+		{"nobody", "no such user", false},
+		{"long", long, true},
+		{"long", long + "x", false},
+	} {
+		auth, err := ha.Authenticate(unicode.NFKCNormalize(test.username),
+			unicode.NFKCNormalize(test.password))
+		if (err == nil) != test.succeeds || (auth != nil) != test.succeeds {
+			t.Fatal("wrong result authenticating", test.username, test.password)
+		}
+	}
+}
+
+func TestHardcodedCaseInsensitiveUsernames(t *testing.T) {
+	ha := NewHardcodedAuth()
+	ha.CaseInsensitiveUsernames = true
+	if ha.AddUser("Jerf", "password") != nil {
+		t.Fatal("could not add user")
+	}
+
+	for _, test := range []struct {
+		username, password string
+		succeeds           bool
+	}{
+		{"jerf", "password", true},
+		{"JERF", "password", true},
+		{"ＪＥＲＦ", "password", true},
+		{"jerf", "PASSWORD", false},
+		{"jeff", "password", false},
+	} {
+		auth, err := ha.Authenticate(unicode.NFKCNormalize(test.username),
+			unicode.NFKCNormalize(test.password))
+		if (err == nil) != test.succeeds || (auth != nil) != test.succeeds {
+			t.Fatal("wrong result authenticating", test.username, test.password)
+		}
+		if test.succeeds && auth.(*enticate.NamedUser).Username.String() != "Jerf" {
+			t.Fatal("user not named as registered:", test.username, auth)
+		}
+	}
+
+	ha = NewHardcodedAuth()
+	_ = ha.AddUser("Jerf", "password")
+	if _, err := ha.Authenticate(unicode.NFKCNormalize("jerf"),
+		unicode.NFKCNormalize("password")); err == nil {
+		t.Fatal("usernames case-insensitive by default")
+	}
+}
@@ -0,0 +1,163 @@
+package tokens
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/audit"
+)
+
+// ErrTokenNotFound is returned by a Store for a token it doesn't have.
+var ErrTokenNotFound = errors.New("token not found")
+
+// A Store holds the Tokens for Revocable, by their ID.
+//
+// The token strings themselves are never given to the Store, only the
+// IDs, which are derived from them by a one-way hash; someone who reads
+// the Store can not use what they find to authenticate.
+//
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Put stores the token under its ID.
+	Put(*Token) error
+
+	// Get returns the token with the given ID, or ErrTokenNotFound.
+	Get(id string) (*Token, error)
+
+	// Delete removes the token with the given ID. Deleting a token that
+	// isn't there is not an error.
+	Delete(id string) error
+}
+
+// Revocable mints and verifies tokens that are random strings, looked up
+// in a Store on every use, so they can be revoked.
+type Revocable struct {
+	store Store
+	at    abtime.AbstractTime
+}
+
+// NewRevocable returns a Revocable keeping its tokens in the given Store.
+//
+// If the AbstractTime is nil, the real time will be used.
+func NewRevocable(store Store, at abtime.AbstractTime) *Revocable {
+	if at == nil {
+		at = abtime.NewRealTime()
+	}
+	return &Revocable{store, at}
+}
+
+// tokenID returns the ID of the given token string.
+func tokenID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Mint returns a new token string for the given Token, storing it and
+// recording it to the auditor as minted by the given audit.IdentityID.
+// The Token's ID is set from the new token.
+//
+// If the auditor fails to record the minting, the token is not stored.
+func (r *Revocable) Mint(auditor audit.Auditor, by string, t *Token) (string, error) {
+	if t.Expires.IsZero() {
+		return "", ErrNoExpiry
+	}
+	token := randomString()
+	t.ID = tokenID(token)
+
+	err := auditMint(auditor, r.at.Now(), by, t, "revocable")
+	if err != nil {
+		return "", err
+	}
+	err = r.store.Put(t)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Revoke deletes the token with the given ID, recording it to the
+// auditor as revoked by the given audit.IdentityID.
+func (r *Revocable) Revoke(auditor audit.Auditor, by string, id string) error {
+	err := r.store.Delete(id)
+	outcome := audit.Success
+	if err != nil {
+		outcome = audit.Failure
+	}
+	auditErr := auditor.Audit(audit.Event{
+		Time:     r.at.Now(),
+		Identity: by,
+		Action:   audit.TokenRevoked,
+		Outcome:  outcome,
+		Details:  map[string]string{"token": id},
+	})
+	if err != nil {
+		return err
+	}
+	return auditErr
+}
+
+// Verify implements the Verifier interface.
+func (r *Revocable) Verify(token string) (*Token, error) {
+	t, err := r.store.Get(tokenID(token))
+	if errors.Is(err, ErrTokenNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !r.at.Now().Before(t.Expires) {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
+
+// RAMStore is a Store that keeps the tokens in memory, which is mostly
+// useful for testing, as they are lost when the process exits.
+//
+// Expired tokens are removed as they are found.
+type RAMStore struct {
+	tokens map[string]*Token
+	sync.Mutex
+}
+
+// NewRAMStore returns a new, empty RAMStore.
+func NewRAMStore() *RAMStore {
+	return &RAMStore{tokens: map[string]*Token{}}
+}
+
+// Put implements the Store interface.
+func (rs *RAMStore) Put(t *Token) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	rs.tokens[t.ID] = t
+	return nil
+}
+
+// Get implements the Store interface.
+func (rs *RAMStore) Get(id string) (*Token, error) {
+	rs.Lock()
+	defer rs.Unlock()
+
+	t, have := rs.tokens[id]
+	if !have {
+		return nil, ErrTokenNotFound
+	}
+	if !time.Now().Before(t.Expires) {
+		delete(rs.tokens, id)
+	}
+	return t, nil
+}
+
+// Delete implements the Store interface.
+func (rs *RAMStore) Delete(id string) error {
+	rs.Lock()
+	defer rs.Unlock()
+
+	delete(rs.tokens, id)
+	return nil
+}
@@ -0,0 +1,84 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/secret"
+)
+
+var signedContext = []byte("api_token")
+
+// Signed mints and verifies stateless tokens, which carry the Token
+// signed with the secret.
+//
+// Anyone holding the secret can mint tokens, and every token signed with
+// it remains valid until it expires; changing the secret is the only way
+// to revoke them, and revokes all of them. Use Revocable if that is a
+// problem.
+type Signed struct {
+	secret *secret.Secret
+	at     abtime.AbstractTime
+}
+
+// NewSigned returns a Signed using the given secret. All the processes
+// accepting the tokens must use the same secret.
+//
+// If the AbstractTime is nil, the real time will be used.
+func NewSigned(s *secret.Secret, at abtime.AbstractTime) *Signed {
+	if at == nil {
+		at = abtime.NewRealTime()
+	}
+	return &Signed{s, at}
+}
+
+// Mint returns the token string for the given Token, recording it to the
+// auditor as minted by the given audit.IdentityID. The Token's ID is set
+// to a new random value.
+//
+// If the auditor fails to record the minting, no token is returned.
+func (s *Signed) Mint(auditor audit.Auditor, by string, t *Token) (string, error) {
+	if t.Expires.IsZero() {
+		return "", ErrNoExpiry
+	}
+	t.ID = randomString()
+
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	signed, err := s.secret.Authenticate(signedContext, payload)
+	if err != nil {
+		return "", err
+	}
+
+	err = auditMint(auditor, s.at.Now(), by, t, "signed")
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(signed), nil
+}
+
+// Verify implements the Verifier interface.
+func (s *Signed) Verify(token string) (*Token, error) {
+	signed, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	payload, err := s.secret.UnwrapAuthentication(signedContext, signed)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	t := &Token{}
+	err = json.Unmarshal(payload, t)
+	if err != nil || t.Identity == nil {
+		return nil, ErrInvalidToken
+	}
+	if !s.at.Now().Before(t.Expires) {
+		return nil, ErrTokenExpired
+	}
+	return t, nil
+}
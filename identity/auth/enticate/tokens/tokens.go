@@ -0,0 +1,109 @@
+/*
+
+Package tokens implements API tokens, for services that authenticate with
+an "Authorization: Bearer" header rather than a password.
+
+A Token carries an identity, optional scopes limiting what it may be used
+for, and an expiry. Two kinds are provided. Signed tokens carry the Token
+itself, signed with a server secret, so verifying one requires no lookup;
+the price is that one can't be revoked short of changing the secret.
+Revocable tokens are random strings looked up in a Store, and can be
+revoked individually.
+
+Minting and revoking tokens are recorded to the audit trail, and so take
+the audit.Auditor to record them to. Use clauses.BearerAuth to accept the
+tokens on a route.
+
+*/
+package tokens
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+)
+
+var (
+	// ErrInvalidToken is returned for a token that is malformed, not
+	// signed by the server, or not known to the Store.
+	ErrInvalidToken = errors.New("invalid token")
+
+	// ErrTokenExpired is returned for a token past its expiry.
+	ErrTokenExpired = errors.New("token expired")
+
+	// ErrNoExpiry is returned when minting a token without an expiry.
+	// Tokens that are meant to be long-lived still need one, even if it
+	// is years away.
+	ErrNoExpiry = errors.New("token has no expiry")
+)
+
+// A Token is what an API token stands for.
+type Token struct {
+	// ID identifies the token in the audit trail, and for revocable
+	// tokens, when revoking it. It is set when the token is minted.
+	ID string `json:"jti"`
+
+	Identity *identity.Identity `json:"id"`
+
+	// Scopes limit what the token may be used for. What they mean is up
+	// to the application; see HasScope.
+	Scopes []string `json:"scopes,omitempty"`
+
+	Expires time.Time `json:"exp"`
+}
+
+// HasScope returns whether the token carries the given scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// A Verifier turns the token string a client presents back into the
+// Token, if it is valid and unexpired.
+type Verifier interface {
+	Verify(token string) (*Token, error)
+}
+
+// randomString returns a random URL-safe string with 256 bits of entropy.
+func randomString() string {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("can't read random bytes for token: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// auditMint records the minting of the given token by the given
+// identity.
+func auditMint(
+	auditor audit.Auditor,
+	now time.Time,
+	by string,
+	t *Token,
+	kind string,
+) error {
+	return auditor.Audit(audit.Event{
+		Time:     now,
+		Identity: by,
+		Action:   audit.TokenMinted,
+		Outcome:  audit.Success,
+		Details: map[string]string{
+			"token":   t.ID,
+			"subject": audit.IdentityID(t.Identity),
+			"kind":    kind,
+			"scopes":  strings.Join(t.Scopes, " "),
+			"expires": strconv.FormatInt(t.Expires.Unix(), 10),
+		},
+	})
+}
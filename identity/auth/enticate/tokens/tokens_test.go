@@ -0,0 +1,139 @@
+package tokens
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/secret"
+)
+
+type recordingAuditor struct {
+	events []audit.Event
+	err    error
+}
+
+func (ra *recordingAuditor) Audit(e audit.Event) error {
+	ra.events = append(ra.events, e)
+	return ra.err
+}
+
+type minter interface {
+	Verifier
+	Mint(audit.Auditor, string, *Token) (string, error)
+}
+
+func testMintAndVerify(t *testing.T, m minter, at *abtime.ManualTime) {
+	user := &identity.Identity{enticate.GetNamedUser("jerf")}
+	auditor := &recordingAuditor{}
+
+	_, err := m.Mint(auditor, "admin", &Token{Identity: user})
+	if err != ErrNoExpiry {
+		t.Fatal("token without expiry minted:", err)
+	}
+
+	token := &Token{
+		Identity: user,
+		Scopes:   []string{"read", "write"},
+		Expires:  at.Now().Add(time.Hour),
+	}
+	s, err := m.Mint(auditor, "admin", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auditor.events) != 1 {
+		t.Fatal("minting not audited")
+	}
+	e := auditor.events[0]
+	if e.Action != audit.TokenMinted || e.Identity != "admin" ||
+		e.Details["subject"] != audit.IdentityID(user) ||
+		e.Details["token"] != token.ID || e.Details["scopes"] != "read write" {
+		t.Fatal("wrong minting event:", e)
+	}
+
+	verified, err := m.Verify(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.ID != token.ID || verified.Identity.LogName() != "jerf" ||
+		!verified.HasScope("write") || verified.HasScope("admin") {
+		t.Fatal("token did not verify as minted:", verified)
+	}
+
+	for _, bad := range []string{"", "garbage", s[:len(s)-2], s + "x"} {
+		_, err = m.Verify(bad)
+		if err != ErrInvalidToken {
+			t.Fatal("invalid token accepted:", bad, err)
+		}
+	}
+
+	at.Advance(time.Hour)
+	_, err = m.Verify(s)
+	if err != ErrTokenExpired {
+		t.Fatal("expired token accepted:", err)
+	}
+
+	auditor.err = errors.New("audit trail down")
+	_, err = m.Mint(auditor, "admin",
+		&Token{Identity: user, Expires: at.Now().Add(time.Hour)})
+	if err != auditor.err {
+		t.Fatal("token minted without being audited")
+	}
+}
+
+func TestSigned(t *testing.T) {
+	at := abtime.NewManual()
+	signed := NewSigned(secret.Get(), at)
+	testMintAndVerify(t, signed, at)
+
+	// a token signed with a different secret is rejected
+	s, err := NewSigned(secret.Get(), at).Mint(&recordingAuditor{}, "admin",
+		&Token{
+			Identity: &identity.Identity{enticate.GetNamedUser("jerf")},
+			Expires:  at.Now().Add(time.Hour),
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = signed.Verify(s)
+	if err != ErrInvalidToken {
+		t.Fatal("token from another secret accepted:", err)
+	}
+}
+
+func TestRevocable(t *testing.T) {
+	at := abtime.NewManual()
+	store := NewRAMStore()
+	revocable := NewRevocable(store, at)
+	testMintAndVerify(t, revocable, at)
+
+	auditor := &recordingAuditor{}
+	token := &Token{
+		Identity: &identity.Identity{enticate.GetNamedUser("jerf")},
+		Expires:  at.Now().Add(time.Hour),
+	}
+	s, err := revocable.Mint(auditor, "admin", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = revocable.Verify(s); err != nil {
+		t.Fatal(err)
+	}
+
+	err = revocable.Revoke(auditor, "admin", token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := auditor.events[len(auditor.events)-1]
+	if e.Action != audit.TokenRevoked || e.Details["token"] != token.ID {
+		t.Fatal("revocation not audited:", e)
+	}
+	_, err = revocable.Verify(s)
+	if err != ErrInvalidToken {
+		t.Fatal("revoked token accepted:", err)
+	}
+}
@@ -11,7 +11,8 @@ import (
 // defines a default suite of reasons why the authentication may have
 // failed. This is intended to give symbolic reasons for failure that may
 // be used for return errors in preference to the underlying error's string
-// value, which is intrinsically a single language.
+// value, which is intrinsically a single language. MessageKey maps them to
+// the keys for looking up a translation with Request.Localize.
 //
 // All AuthErrors are also errors.
 type AuthError interface {
@@ -92,6 +93,35 @@ func NoAuthGiven() AuthError {
 	}
 }
 
+// The message keys returned by MessageKey.
+const (
+	KeyWrongUserOrPassword = "auth.wrong_user_or_password"
+	KeyAuthServiceDown     = "auth.auth_service_down"
+	KeyNoAuthGiven         = "auth.no_auth_given"
+	KeyLockedOut           = "auth.locked_out"
+	KeyAuthFailed          = "auth.failed"
+)
+
+// MessageKey returns the symbolic key for the reason the given AuthError
+// gives for failing, suitable for looking up a message in the user's
+// language with a request.Catalog. An AuthError giving none of the
+// standard reasons yields KeyAuthFailed if the user may try again, and
+// KeyLockedOut if they may not.
+func MessageKey(ae AuthError) string {
+	switch {
+	case ae.WrongUserOrPassword():
+		return KeyWrongUserOrPassword
+	case ae.AuthServiceDown():
+		return KeyAuthServiceDown
+	case ae.NoAuthGiven():
+		return KeyNoAuthGiven
+	case !ae.MayTryAgain():
+		return KeyLockedOut
+	default:
+		return KeyAuthFailed
+	}
+}
+
 type PasswordAuthenticator interface {
 	Authenticate(username, password unicode.NFKCNormalized) (Authentication, AuthError)
 }
@@ -1,6 +1,7 @@
 package identity
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
 
@@ -60,3 +61,50 @@ func (i *Identity) UnmarshalText(b []byte) error {
 	i.Authentication = auth
 	return nil
 }
+
+// marshaledIdentity is the JSON form of an Identity. Type is the
+// AuthenticationName, which selects the registered Authentication that
+// Info, its MarshalText, is unmarshaled into.
+type marshaledIdentity struct {
+	Type string `json:"type"`
+	Info string `json:"info"`
+}
+
+// MarshalJSON implements json.Marshaler, encoding the identity as an
+// object carrying the type of its Authentication alongside its contents.
+func (i *Identity) MarshalJSON() ([]byte, error) {
+	name, contents, err := enticate.Marshal(i.Authentication)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(marshaledIdentity{name, string(contents)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+//
+// The Authentication type must have been passed to enticate.Register, or
+// an enticate.UnknownAuthTypeError results. For compatibility with
+// identities persisted before MarshalJSON existed, a JSON string in the
+// MarshalText format is also accepted.
+func (i *Identity) UnmarshalJSON(b []byte) error {
+	var text string
+	if json.Unmarshal(b, &text) == nil {
+		return i.UnmarshalText([]byte(text))
+	}
+
+	var mi marshaledIdentity
+	err := json.Unmarshal(b, &mi)
+	if err != nil {
+		return err
+	}
+	if mi.Type == "" {
+		return ErrInvalidIdentity
+	}
+
+	auth, err := enticate.Unmarshal(mi.Type, []byte(mi.Info))
+	if err != nil {
+		return err
+	}
+	i.Authentication = auth
+	return nil
+}
@@ -0,0 +1,72 @@
+package identity
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+)
+
+// badgeAuth is an Authentication defined outside of enticate, whose
+// contents are more than a plain name.
+type badgeAuth struct {
+	Site  string
+	Badge string
+}
+
+func (ba *badgeAuth) LogName() string            { return ba.Site + "/" + ba.Badge }
+func (ba *badgeAuth) IsAuthenticated() bool      { return true }
+func (ba *badgeAuth) AuthenticationName() string { return "test_badge" }
+func (ba *badgeAuth) Empty() enticate.Authentication {
+	return &badgeAuth{}
+}
+
+func (ba *badgeAuth) MarshalText() ([]byte, error) {
+	return json.Marshal(*ba)
+}
+
+func (ba *badgeAuth) UnmarshalText(b []byte) error {
+	type plain badgeAuth
+	return json.Unmarshal(b, (*plain)(ba))
+}
+
+func TestIdentityJSON(t *testing.T) {
+	enticate.Register(&badgeAuth{})
+
+	for _, auth := range []enticate.Authentication{
+		enticate.GetNamedUser("jerf"),
+		&badgeAuth{"hq", "1234"},
+		enticate.DefaultUnauthenticated,
+	} {
+		b, err := json.Marshal(&Identity{auth})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Identity
+		err = json.Unmarshal(b, &decoded)
+		if err != nil {
+			t.Fatal("could not unmarshal", string(b), ":", err)
+		}
+		if decoded.AuthenticationName() != auth.AuthenticationName() ||
+			decoded.LogName() != auth.LogName() {
+			t.Fatal("identity did not round trip:", string(b), decoded.Authentication)
+		}
+	}
+
+	b, _ := json.Marshal(&Identity{&badgeAuth{"hq", "1234"}})
+	if string(b) != `{"type":"test_badge","info":"{\"Site\":\"hq\",\"Badge\":\"1234\"}"}` {
+		t.Fatal("unexpected JSON for identity:", string(b))
+	}
+
+	var legacy Identity
+	err := json.Unmarshal([]byte(`"simple_named_user⁝jerf"`), &legacy)
+	if err != nil || legacy.LogName() != "jerf" {
+		t.Fatal("could not unmarshal identity in the text format:", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"type":"nonexistent","info":""}`), &legacy)
+	if !errors.Is(err, enticate.ErrUnknownAuthType) {
+		t.Fatal("unknown authentication type not refused:", err)
+	}
+}
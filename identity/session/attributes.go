@@ -0,0 +1,65 @@
+package session
+
+import (
+	"errors"
+)
+
+// ErrAttributeConflict is returned by CompareAndSwapAttributes when the
+// attributes have been changed since the given version was read.
+var ErrAttributeConflict = errors.New("session attributes changed concurrently")
+
+// ErrNoAttributes is returned by UpdateAttributes for a Session that is
+// not an AttributeStore.
+var ErrNoAttributes = errors.New("session does not carry attributes")
+
+// An AttributeStore is a Session that can carry attributes, string values
+// the application keeps for the life of the session.
+//
+// Several requests may be using the same session at once, so rather than
+// letting the last writer win, the attributes carry a version, which is
+// advanced by every write. Attributes returns a copy of the attributes
+// and their version. CompareAndSwapAttributes replaces the attributes
+// with the given ones only if they are still at the given version,
+// returning the new version, or ErrAttributeConflict if they are not.
+//
+// UpdateAttributes wraps these up with a retry on conflict, and is what
+// should normally be used.
+type AttributeStore interface {
+	Attributes() (attributes map[string]string, version uint64)
+	CompareAndSwapAttributes(version uint64, attributes map[string]string) (uint64, error)
+}
+
+// UpdateAttributes applies the update to the attributes of the given
+// session, which must be an AttributeStore.
+//
+// The update is passed a copy of the current attributes to modify. If it
+// returns an error, the attributes are left alone, and the error is
+// returned. If another write changed the attributes while the update was
+// running, the update is run again on the new attributes, so it may be
+// called more than once, and should do nothing but modify the attributes.
+func UpdateAttributes(s Session, update func(map[string]string) error) error {
+	store, isStore := s.(AttributeStore)
+	if !isStore {
+		return ErrNoAttributes
+	}
+
+	for {
+		attributes, version := store.Attributes()
+		err := update(attributes)
+		if err != nil {
+			return err
+		}
+		_, err = store.CompareAndSwapAttributes(version, attributes)
+		if err != ErrAttributeConflict {
+			return err
+		}
+	}
+}
+
+func copyAttributes(attributes map[string]string) map[string]string {
+	copied := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		copied[key] = value
+	}
+	return copied
+}
@@ -5,13 +5,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/thejerf/abtime"
 	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
 	"github.com/thejerf/sphyraena/identity/session/internal"
 	"github.com/thejerf/sphyraena/secret"
 	"github.com/thejerf/sphyraena/strest"
@@ -43,18 +46,34 @@ const (
 // it to be purged.
 //
 // It is safe to not use the service, but the files will stack up.
+//
+// Its sessions are AttributeStores, keeping the attributes in the
+// session's file. Writes are serialized within the FilesystemServer, and
+// each replaces the file atomically, but nothing coordinates writes by
+// more than one process; only one FilesystemServer should use a directory.
 type FilesystemServer struct {
 	directory          string
 	sessionIDGenerator *SessionIDGenerator
 	secretGenerator    *secret.Generator
 	*FilesystemServerSettings
 
+	// held across each read, check and write of a session's attributes
+	attributesLock sync.Mutex
+
 	stopScanExpired chan struct{}
 	sync            chan struct{} // used in testing
 }
 
+// FilesystemServerSettings configures a FilesystemServer.
+//
+// Sessions expire once they have gone unused for the Timeout, which
+// defaults to an hour. The session file's modification time records the
+// last use; as rewriting it on every request would turn every read into a
+// write, it is only refreshed once it is at least RefreshInterval old,
+// which defaults to a tenth of the Timeout.
 type FilesystemServerSettings struct {
-	Timeout time.Duration
+	Timeout         time.Duration
+	RefreshInterval time.Duration
 	abtime.AbstractTime
 }
 
@@ -100,6 +119,9 @@ func NewFilesystemServer(
 	if settings.Timeout == 0 {
 		settings.Timeout = time.Hour
 	}
+	if settings.RefreshInterval == 0 {
+		settings.RefreshInterval = settings.Timeout / 10
+	}
 	if settings.AbstractTime == nil {
 		settings.AbstractTime = abtime.NewRealTime()
 	}
@@ -163,6 +185,19 @@ var encoder = strings.NewReplacer(
 	"!", "!9",
 )
 
+// Ping implements the Pinger interface, checking that the session
+// directory is still there.
+func (fss *FilesystemServer) Ping() error {
+	info, err := os.Stat(fss.directory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("session directory is not a directory")
+	}
+	return nil
+}
+
 func (fss *FilesystemServer) sessionToFile(sID string) string {
 	return filepath.Join(fss.directory, encoder.Replace(sID))
 }
@@ -172,11 +207,15 @@ func (fss *FilesystemServer) GetSession(sID SessionID) (Session, error) {
 
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, ErrSessionNotFound
+		if os.IsNotExist(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, sessionNotFound(err)
 	}
+	defer f.Close()
 	stat, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return nil, sessionNotFound(err)
 	}
 	lastRefreshTime := stat.ModTime().UTC()
 	now := fss.Now()
@@ -188,14 +227,23 @@ func (fss *FilesystemServer) GetSession(sID SessionID) (Session, error) {
 		Identity: &identity.Identity{},
 	}
 
+	// The Identity unmarshals its Authentication through the enticate
+	// registry, so custom Authentications must be Register()ed.
 	decoder := json.NewDecoder(f)
 	err = decoder.Decode(fs)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, enticate.ErrUnknownAuthType) {
+			// this is a configuration problem rather than a bad session,
+			// and it would otherwise look to the user like a mysterious
+			// logout, so make sure someone hears about it.
+			slog.Error("file session uses an unregistered authentication",
+				"error", err)
+		}
+		return nil, sessionNotFound(err)
 	}
 
 	if fs.SessionID == "" {
-		return nil, errors.New("file session: session ID missing")
+		return nil, sessionNotFound(errors.New("file session: session ID missing"))
 	}
 	if fs.SessionID != string(sID) {
 		// The only way I can think of for this to happen is case mismatch
@@ -204,13 +252,24 @@ func (fss *FilesystemServer) GetSession(sID SessionID) (Session, error) {
 		// going to get some random other identity, which is catastrophic,
 		// so I'd rather scream and die and have this session just be
 		// mysteriously invalid than have the wrong authentication.
-		return nil, errors.New("file session: session ID mismatch")
+		return nil, sessionNotFound(errors.New("file session: session ID mismatch"))
 	}
 	if fs.Identity.Authentication == nil {
-		return nil, errors.New("file session: authentication missing")
+		return nil, sessionNotFound(errors.New("file session: authentication missing"))
 	}
 	if fs.Secret.IsZero() {
-		return nil, errors.New("file session: missing secret")
+		return nil, sessionNotFound(errors.New("file session: missing secret"))
+	}
+
+	// The session is in use, so it should not expire until it has gone
+	// unused for the Timeout again.
+	if !now.Before(lastRefreshTime.Add(fss.RefreshInterval)) {
+		err = os.Chtimes(filename, now, now)
+		if err != nil {
+			slog.Warn("could not refresh file session", "error", err)
+		} else {
+			lastRefreshTime = now.UTC()
+		}
 	}
 
 	return &fileSession{
@@ -242,8 +301,16 @@ func (fss *FilesystemServer) NewSession(id *identity.Identity) (Session, error)
 	}
 	_ = f.Close()
 
+	// The file's modification time is compared against the
+	// AbstractTime, so it needs to come from there as well.
+	now := fss.AbstractTime.Now().UTC()
+	err = os.Chtimes(filename, now, now)
+	if err != nil {
+		return nil, err
+	}
+
 	return &fileSession{
-		fss.AbstractTime.Now().UTC(),
+		now,
 		SessionID(fs.SessionID),
 		fs.Identity,
 		fs.Secret,
@@ -274,7 +341,11 @@ func (fs *fileSession) Identity() *identity.Identity {
 }
 
 func (fs *fileSession) NewStream() (*strest.Stream, error) {
-	id := strest.StreamID(base64.StdEncoding.EncodeToString(thirtytwoRandomBytes(rand.Reader)))
+	id, err := SignStreamID(fs,
+		strest.StreamID(base64.StdEncoding.EncodeToString(thirtytwoRandomBytes(rand.Reader))))
+	if err != nil {
+		return nil, err
+	}
 	stream := strest.NewStream(id)
 
 	return stream, nil
@@ -283,3 +354,91 @@ func (fs *fileSession) NewStream() (*strest.Stream, error) {
 func (fs *fileSession) GetStream(b []byte) (*strest.Stream, error) {
 	return nil, errors.New("Filesystem does not currently support GetStream")
 }
+
+// readFile reads the session's file as it is now, returning it along with
+// the file's information.
+func (fs *fileSession) readFile() (*internal.MarshalFileSession, os.FileInfo, error) {
+	f, err := os.Open(fs.fss.sessionToFile(string(fs.sessionID)))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mfs := &internal.MarshalFileSession{
+		Identity: &identity.Identity{},
+	}
+	err = json.NewDecoder(f).Decode(mfs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return mfs, stat, nil
+}
+
+// writeFile atomically replaces the session's file with the given
+// contents, keeping its modification time, which records its last use.
+func (fs *fileSession) writeFile(
+	mfs *internal.MarshalFileSession,
+	modTime time.Time,
+) error {
+	f, err := os.CreateTemp(fs.fss.directory, "attributes-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	err = json.NewEncoder(f).Encode(mfs)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmpName, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fs.fss.sessionToFile(string(fs.sessionID)))
+	}
+	if err != nil {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+// Attributes implements the AttributeStore interface, reading them from
+// the session's file. If the file can't be read, as when the session has
+// expired, there are no attributes.
+func (fs *fileSession) Attributes() (map[string]string, uint64) {
+	mfs, _, err := fs.readFile()
+	if err != nil {
+		slog.Warn("could not read file session attributes", "error", err)
+		return map[string]string{}, 0
+	}
+	return copyAttributes(mfs.Attributes), mfs.AttributesVersion
+}
+
+// CompareAndSwapAttributes implements the AttributeStore interface,
+// checking the version in the session's file and rewriting it.
+func (fs *fileSession) CompareAndSwapAttributes(
+	version uint64,
+	attributes map[string]string,
+) (uint64, error) {
+	fs.fss.attributesLock.Lock()
+	defer fs.fss.attributesLock.Unlock()
+
+	mfs, stat, err := fs.readFile()
+	if err != nil {
+		return 0, err
+	}
+	if version != mfs.AttributesVersion {
+		return mfs.AttributesVersion, ErrAttributeConflict
+	}
+	mfs.Attributes = copyAttributes(attributes)
+	mfs.AttributesVersion++
+	err = fs.writeFile(mfs, stat.ModTime())
+	if err != nil {
+		return version, err
+	}
+	return mfs.AttributesVersion, nil
+}
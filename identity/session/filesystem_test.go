@@ -1,8 +1,12 @@
 package session
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -159,3 +163,213 @@ func TestDiskCleaner(t *testing.T) {
 		t.Fatal("File was not deleted when it was expired")
 	}
 }
+
+func TestSessionNotFoundCause(t *testing.T) {
+	fss, deffunc := getDiskSession(t)
+	defer deffunc()
+
+	_, err := fss.GetSession(SessionID("nonexistent"))
+	if err != ErrSessionNotFound {
+		t.Fatal("missing session not plainly not found:", err)
+	}
+
+	err = ioutil.WriteFile(fss.sessionToFile("corrupt"), []byte("{not json"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fss.GetSession(SessionID("corrupt"))
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatal("corrupt session not treated as not found:", err)
+	}
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		t.Fatal("corrupt session did not carry its cause:", err)
+	}
+}
+
+// employeeAuth is an Authentication defined outside of enticate.
+type employeeAuth struct {
+	Number int
+}
+
+func (ea *employeeAuth) LogName() string            { return "employee " + strconv.Itoa(ea.Number) }
+func (ea *employeeAuth) IsAuthenticated() bool      { return true }
+func (ea *employeeAuth) AuthenticationName() string { return "test_employee" }
+func (ea *employeeAuth) Empty() enticate.Authentication {
+	return &employeeAuth{}
+}
+
+func (ea *employeeAuth) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(ea.Number)), nil
+}
+
+func (ea *employeeAuth) UnmarshalText(b []byte) error {
+	n, err := strconv.Atoi(string(b))
+	ea.Number = n
+	return err
+}
+
+// contractorAuth is never registered.
+type contractorAuth struct {
+	employeeAuth
+}
+
+func (ca *contractorAuth) AuthenticationName() string { return "test_contractor" }
+func (ca *contractorAuth) Empty() enticate.Authentication {
+	return &contractorAuth{}
+}
+
+func TestCustomAuthentication(t *testing.T) {
+	fss, deffunc := getDiskSession(t)
+	defer deffunc()
+
+	enticate.Register(&employeeAuth{})
+
+	s, err := fss.NewSession(&identity.Identity{&employeeAuth{42}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sID := s.SessionID()
+	s, err = fss.GetSession(sID)
+	if err != nil {
+		t.Fatal("could not restore session with a registered authentication:", err)
+	}
+	if auth, isEmployee := s.Identity().Authentication.(*employeeAuth); !isEmployee ||
+		auth.Number != 42 {
+		t.Fatal("custom authentication not restored:", s.Identity().Authentication)
+	}
+
+	s, err = fss.NewSession(&identity.Identity{&contractorAuth{employeeAuth{7}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sID = s.SessionID()
+	_, err = fss.GetSession(sID)
+	var unknown enticate.UnknownAuthTypeError
+	if !errors.Is(err, ErrSessionNotFound) || !errors.As(err, &unknown) ||
+		unknown.Name != "test_contractor" {
+		t.Fatal("unregistered authentication not clearly refused:", err)
+	}
+}
+
+func TestDirSessionsRefresh(t *testing.T) {
+	fss, deffunc := getDiskSession(t)
+	defer deffunc()
+	manTime := fss.AbstractTime.(*abtime.ManualTime)
+
+	session, err := fss.NewSession(&identity.Identity{enticate.GetNamedUser("test")})
+	if err != nil {
+		t.Fatalf("Could not get user session: %v", err)
+	}
+	_, sessionID := session.SessionID()
+	filename := fss.sessionToFile(string(sessionID))
+	modTime := func() time.Time {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.ModTime()
+	}
+
+	// Used every 40 minutes, the session outlives its hour timeout.
+	for i := 0; i < 4; i++ {
+		manTime.Advance(40 * time.Minute)
+		session, err = fss.GetSession(sessionID)
+		if err != nil {
+			t.Fatalf("active session expired after %d accesses: %v", i, err)
+		}
+		if session.Expired() {
+			t.Fatal("refreshed session reports being expired")
+		}
+	}
+
+	// Within the RefreshInterval, the file is not rewritten.
+	refreshed := modTime()
+	manTime.Advance(time.Minute)
+	_, err = fss.GetSession(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !modTime().Equal(refreshed) {
+		t.Fatal("session refreshed within the RefreshInterval")
+	}
+
+	// And once it goes unused for the timeout, it expires.
+	manTime.Advance(61 * time.Minute)
+	_, err = fss.GetSession(sessionID)
+	if err != ErrSessionNotFound {
+		t.Fatal("unused session did not expire:", err)
+	}
+}
+
+func TestFileAttributes(t *testing.T) {
+	fss, deffunc := getDiskSession(t)
+	defer deffunc()
+
+	s, err := fss.NewSession(&identity.Identity{enticate.GetNamedUser("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s.(AttributeStore)
+	_, sessionID := s.SessionID()
+
+	// a write from a stale version is refused
+	attributes, version := store.Attributes()
+	attributes["theme"] = "dark"
+	if _, err = store.CompareAndSwapAttributes(version, attributes); err != nil {
+		t.Fatal(err)
+	}
+	attributes["theme"] = "light"
+	if _, err = store.CompareAndSwapAttributes(version, attributes); err != ErrAttributeConflict {
+		t.Fatal("stale write not refused:", err)
+	}
+	if attributes, _ = store.Attributes(); attributes["theme"] != "dark" {
+		t.Fatal("stale write took effect:", attributes)
+	}
+
+	// concurrent updates through separately loaded sessions are each
+	// applied exactly once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loaded, err := fss.GetSession(sessionID)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			err = UpdateAttributes(loaded, func(attributes map[string]string) error {
+				count, _ := strconv.Atoi(attributes["count"])
+				attributes["count"] = strconv.Itoa(count + 1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	attributes, version = store.Attributes()
+	if attributes["count"] != "50" || attributes["theme"] != "dark" || version != 51 {
+		t.Fatal("concurrent updates lost:", attributes, version)
+	}
+
+	// a failed update changes nothing
+	failed := errors.New("failed")
+	err = UpdateAttributes(s, func(attributes map[string]string) error {
+		attributes["count"] = "0"
+		return failed
+	})
+	if err != failed {
+		t.Fatal("update error not returned:", err)
+	}
+	if attributes, _ = store.Attributes(); attributes["count"] != "50" {
+		t.Fatal("failed update took effect:", attributes)
+	}
+
+	// the session itself still loads
+	if _, err = fss.GetSession(sessionID); err != nil {
+		t.Fatal("session lost its file:", err)
+	}
+}
@@ -11,4 +11,7 @@ type MarshalFileSession struct {
 	SessionID string             `json:"session_id"`
 	Identity  *identity.Identity `json:"identity"`
 	Secret    *secret.Secret     `json:"secret"`
+
+	Attributes        map[string]string `json:"attributes,omitempty"`
+	AttributesVersion uint64            `json:"attributes_version,omitempty"`
 }
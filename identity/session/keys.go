@@ -30,6 +30,12 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -74,7 +80,14 @@ type SecretKey []byte
 // Session keys are moderately expensive to generate. We buffer them up
 // using Go channels so that when we need a new one, we should ideally have
 // one available. Worst case scenario we have to generate it on the spot.
+//
+// EntropyPolicy and MinEntropy configure the check of the system's
+// entropy made when Serve starts, as documented on EntropyPolicy. They
+// must be set before Serve is called.
 type SessionIDGenerator struct {
+	EntropyPolicy EntropyPolicy
+	MinEntropy    int
+
 	output     chan SessionID
 	stop       chan struct{}
 	hmacKey    []byte
@@ -104,8 +117,6 @@ type SessionIDGenerator struct {
 //
 // Changing this key invalidates all current sessions.
 func NewSessionIDGenerator(bufferSize int, key []byte) *SessionIDGenerator {
-	// on Linux, we can check the entropy in
-	// /proc/sys/kernel/random/entropy_avail and complain if it's not big enough.
 	if bufferSize == 0 {
 		bufferSize = 128
 	}
@@ -116,6 +127,8 @@ func NewSessionIDGenerator(bufferSize int, key []byte) *SessionIDGenerator {
 	}
 
 	return &SessionIDGenerator{
+		EntropyWarn,
+		DefaultMinEntropy,
 		make(chan SessionID, bufferSize),
 		make(chan struct{}),
 		key,
@@ -124,7 +137,101 @@ func NewSessionIDGenerator(bufferSize int, key []byte) *SessionIDGenerator {
 	}
 }
 
+// An EntropyPolicy says what a SessionIDGenerator does if, when Serve
+// starts, the system has less than its MinEntropy bits of entropy.
+//
+// Shortly after a machine (especially a virtual machine) boots, the
+// system may not have gathered enough entropy to generate unguessable
+// session IDs. This can only be checked on Linux, through
+// /proc/sys/kernel/random/entropy_avail; elsewhere the check is skipped.
+type EntropyPolicy int
+
+const (
+	// EntropyWarn logs a warning, then generates session IDs anyway.
+	// This is the default.
+	EntropyWarn EntropyPolicy = iota
+
+	// EntropyWait logs a warning, then waits for the entropy to reach the
+	// MinEntropy before generating any session IDs.
+	EntropyWait
+
+	// EntropyIgnore skips the check.
+	EntropyIgnore
+)
+
+// DefaultMinEntropy is the default MinEntropy of a SessionIDGenerator, in
+// bits.
+const DefaultMinEntropy = 256
+
+var (
+	entropyAvailPath    = "/proc/sys/kernel/random/entropy_avail"
+	entropyPollInterval = time.Second
+)
+
+// entropyAvailable returns the bits of entropy the system has, and
+// whether that could be determined.
+func entropyAvailable() (int, bool) {
+	if runtime.GOOS != "linux" {
+		return 0, false
+	}
+	b, err := os.ReadFile(entropyAvailPath)
+	if err != nil {
+		return 0, false
+	}
+	avail, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false
+	}
+	return avail, true
+}
+
+// checkEntropy applies the EntropyPolicy. It returns false if the
+// generator was stopped while waiting for entropy.
+func (skg *SessionIDGenerator) checkEntropy() bool {
+	if skg.EntropyPolicy == EntropyIgnore {
+		return true
+	}
+	min := skg.MinEntropy
+	if min == 0 {
+		min = DefaultMinEntropy
+	}
+
+	avail, known := entropyAvailable()
+	if !known || avail >= min {
+		return true
+	}
+	slog.Warn("SYSTEM ENTROPY IS LOW: session IDs generated now may be guessable",
+		"entropy_avail", avail, "minimum", min,
+		"waiting", skg.EntropyPolicy == EntropyWait)
+	if skg.EntropyPolicy != EntropyWait {
+		return true
+	}
+
+	ticker := time.NewTicker(entropyPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			avail, known = entropyAvailable()
+			if !known || avail >= min {
+				slog.Info("system entropy has recovered", "entropy_avail", avail)
+				return true
+			}
+		case <-skg.stop:
+			return false
+		}
+	}
+}
+
+// Serve implements the Service interface from Suture.
+//
+// Before generating any session IDs, this checks the system's entropy
+// according to the EntropyPolicy.
 func (skg *SessionIDGenerator) Serve() {
+	if !skg.checkEntropy() {
+		return
+	}
+
 	// this code plays a bit of silly buggers with slices, so follow along
 	// with me:
 	// first: we make a 64-byte length and cap slice...
@@ -150,6 +257,31 @@ func (skg *SessionIDGenerator) Get() SessionID {
 	return <-skg.output
 }
 
+// TryGet returns a SessionID if one has already been generated, without
+// blocking. If none is available, it returns NoSessionID and false.
+func (skg *SessionIDGenerator) TryGet() (SessionID, bool) {
+	select {
+	case id := <-skg.output:
+		return id, true
+	default:
+		return NoSessionID, false
+	}
+}
+
+// Len returns the number of SessionIDs currently generated in advance. If
+// this stays low while sessions are being created, generation is not
+// keeping up, most likely for lack of entropy.
+func (skg *SessionIDGenerator) Len() int {
+	return len(skg.output)
+}
+
+// Ready returns whether a SessionID has been generated in advance, so
+// that the next Get will not block. If this remains false while Serve is
+// running, the generator is being starved of entropy.
+func (skg *SessionIDGenerator) Ready() bool {
+	return skg.Len() > 0
+}
+
 // separated for easy testing; conceptually this is just inline in Serve.
 func (skg *SessionIDGenerator) generate(sessionID []byte) SessionID {
 	// third: ... read 32 bytes into our 32-byte length slice
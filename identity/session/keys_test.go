@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"crypto/rand"
 	"io"
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 // we use this as the quote-unquote "random" reader for testing.
@@ -93,6 +97,22 @@ func TestInsufficientCrypoReaders(t *testing.T) {
 	}
 }
 
+func TestSessionIDGeneratorTryGet(t *testing.T) {
+	skg := NewSessionIDGenerator(2, nil)
+	if id, ok := skg.TryGet(); ok || id != NoSessionID || skg.Len() != 0 {
+		t.Fatal("TryGet returned an ID before any were generated")
+	}
+
+	go skg.Serve()
+	defer skg.Stop()
+	for skg.Len() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if id, ok := skg.TryGet(); !ok || !skg.Check(id) {
+		t.Fatal("TryGet did not return a generated ID")
+	}
+}
+
 func TestDefault(t *testing.T) {
 	skg := NewSessionIDGenerator(0, nil)
 	if len(skg.hmacKey) != 32 {
@@ -126,3 +146,57 @@ func BenchmarkGetting32Bytes(b *testing.B) {
 		}
 	}
 }
+
+func TestEntropyWait(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("entropy can only be checked on Linux")
+	}
+
+	defer func(path string, interval time.Duration) {
+		entropyAvailPath = path
+		entropyPollInterval = interval
+	}(entropyAvailPath, entropyPollInterval)
+	entropyAvailPath = filepath.Join(t.TempDir(), "entropy_avail")
+	entropyPollInterval = time.Millisecond
+	setEntropy := func(s string) {
+		err := os.WriteFile(entropyAvailPath, []byte(s), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setEntropy("10\n")
+	skg := NewSessionIDGenerator(1, nil)
+	skg.EntropyPolicy = EntropyWait
+	go skg.Serve()
+	time.Sleep(20 * time.Millisecond)
+	if skg.Ready() {
+		t.Fatal("session IDs generated with low entropy")
+	}
+
+	setEntropy("300\n")
+	for !skg.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	skg.Stop()
+
+	// stopping while waiting works
+	setEntropy("10\n")
+	skg = NewSessionIDGenerator(1, nil)
+	skg.EntropyPolicy = EntropyWait
+	done := make(chan struct{})
+	go func() {
+		skg.Serve()
+		close(done)
+	}()
+	skg.Stop()
+	<-done
+
+	// the default policy only warns
+	skg = NewSessionIDGenerator(1, nil)
+	go skg.Serve()
+	defer skg.Stop()
+	for !skg.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+}
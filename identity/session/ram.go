@@ -4,8 +4,8 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
-	"fmt"
 	"io"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -16,6 +16,7 @@ import (
 )
 
 var _ SessionServer = &RAMSessionServer{}
+var _ StreamEnumerator = &RAMSessionServer{}
 
 // This file defines a session server that functions entirely in RAM.
 //
@@ -48,9 +49,29 @@ type RAMSessionServer struct {
 	sync.Mutex
 }
 
+// DefaultMaxStreams is the most streams a RAMSession may have open at
+// once, if the RAMSessionSettings don't specify otherwise.
+const DefaultMaxStreams = 16
+
+// ErrTooManyStreams is returned by NewStream when the session already
+// has as many open streams as it is allowed.
+var ErrTooManyStreams = errors.New("session has too many open streams")
+
+// RAMSessionSettings configures a RAMSessionServer.
+//
+// Timeout is how long a new session lasts. MaxLifetime, if non-zero,
+// bounds how long after its creation a session's lifetime may be
+// extended to via ExtendLifetime, no matter what is requested.
+//
+// MaxStreams is the most streams each session may have open at once, so
+// a client can't exhaust the server by opening them without end. A
+// stream stops counting against this once it is closed. If zero,
+// DefaultMaxStreams is used. If negative, there is no limit.
 type RAMSessionSettings struct {
 	Timeout time.Duration
 	abtime.AbstractTime
+	MaxLifetime time.Duration
+	MaxStreams  int
 }
 
 // NewRAMServer returns a new RAM-based session server, using the given
@@ -77,6 +98,9 @@ func NewRAMServer(
 	if settings.AbstractTime == nil {
 		settings.AbstractTime = abtime.NewRealTime()
 	}
+	if settings.MaxStreams == 0 {
+		settings.MaxStreams = DefaultMaxStreams
+	}
 	return ss
 }
 
@@ -93,7 +117,13 @@ func (rss *RAMSessionServer) GetSession(sk SessionID) (Session, error) {
 			delete(rss.sessions, sk)
 			return nil, ErrSessionNotFound
 		} else {
-			session.ExpirationTime = now.Add(rss.Timeout)
+			// This slides the session forward, but must not cut short
+			// a lifetime granted by ExtendLifetime.
+			rss.Lock()
+			if target := now.Add(rss.Timeout); target.After(session.ExpirationTime) {
+				session.ExpirationTime = target
+			}
+			rss.Unlock()
 			return session, nil
 		}
 	}
@@ -108,6 +138,7 @@ func (rss *RAMSessionServer) NewSession(identity *identity.Identity) (Session, e
 
 	session := &RAMSession{
 		ExpirationTime: now.Add(rss.Timeout),
+		created:        now,
 		sessionID:      rss.sessionIDGenerator.Get(),
 		Secret:         rss.secretGenerator.Get(),
 		id:             identity,
@@ -119,6 +150,26 @@ func (rss *RAMSessionServer) NewSession(identity *identity.Identity) (Session, e
 	return session, nil
 }
 
+// Streams implements the StreamEnumerator interface.
+func (rss *RAMSessionServer) Streams() []*strest.Stream {
+	rss.Lock()
+	sessions := make([]*RAMSession, 0, len(rss.sessions))
+	for _, session := range rss.sessions {
+		sessions = append(sessions, session)
+	}
+	rss.Unlock()
+
+	streams := []*strest.Stream{}
+	for _, session := range sessions {
+		session.Lock()
+		for _, stream := range session.streams {
+			streams = append(streams, stream)
+		}
+		session.Unlock()
+	}
+	return streams
+}
+
 var ErrStreamNotFound = errors.New("stream not found by id")
 
 // A RAMSession is a basic session handed out by a RAMSessionServer.
@@ -128,6 +179,8 @@ var ErrStreamNotFound = errors.New("stream not found by id")
 // Stay tuned.
 type RAMSession struct {
 	ExpirationTime time.Time
+	created        time.Time
+	extended       bool
 	sessionID      SessionID
 	id             *identity.Identity
 	*secret.Secret
@@ -137,7 +190,9 @@ type RAMSession struct {
 	rss *RAMSessionServer
 
 	sync.Mutex
-	streams map[strest.StreamID]*strest.Stream
+	streams           map[strest.StreamID]*strest.Stream
+	attributes        map[string]string
+	attributesVersion uint64
 }
 
 func (rs *RAMSession) Expired() bool {
@@ -156,6 +211,62 @@ func (rs *RAMSession) Expire() {
 	rs.rss.Unlock()
 }
 
+// ExtendLifetime implements the LifetimeExtender interface.
+//
+// The extension is bounded by the server's MaxLifetime. This never
+// shortens the session's lifetime, nor revives an expired session.
+func (rs *RAMSession) ExtendLifetime(d time.Duration) time.Duration {
+	now := rs.rss.Now()
+	target := now.Add(d)
+	if rs.rss.MaxLifetime != 0 {
+		limit := rs.created.Add(rs.rss.MaxLifetime)
+		if target.After(limit) {
+			target = limit
+		}
+	}
+
+	rs.rss.Lock()
+	defer rs.rss.Unlock()
+	if now.After(rs.ExpirationTime) {
+		return 0
+	}
+	if target.After(rs.ExpirationTime) {
+		rs.ExpirationTime = target
+	}
+	rs.extended = true
+	return rs.ExpirationTime.Sub(now)
+}
+
+// Lifetime implements the LifetimeReporter interface.
+func (rs *RAMSession) Lifetime() (time.Duration, bool) {
+	now := rs.rss.Now()
+	rs.rss.Lock()
+	defer rs.rss.Unlock()
+	return rs.ExpirationTime.Sub(now), rs.extended
+}
+
+// Attributes implements the AttributeStore interface.
+func (rs *RAMSession) Attributes() (map[string]string, uint64) {
+	rs.Lock()
+	defer rs.Unlock()
+	return copyAttributes(rs.attributes), rs.attributesVersion
+}
+
+// CompareAndSwapAttributes implements the AttributeStore interface.
+func (rs *RAMSession) CompareAndSwapAttributes(
+	version uint64,
+	attributes map[string]string,
+) (uint64, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	if version != rs.attributesVersion {
+		return rs.attributesVersion, ErrAttributeConflict
+	}
+	rs.attributes = copyAttributes(attributes)
+	rs.attributesVersion++
+	return rs.attributesVersion, nil
+}
+
 func (rs *RAMSession) SessionID() (bool, SessionID) {
 	return true, rs.sessionID
 }
@@ -173,32 +284,64 @@ func thirtytwoRandomBytes(r io.Reader) []byte {
 	return b
 }
 
+// NewStream implements the Session interface.
+//
+// If the session already has the server's MaxStreams open,
+// ErrTooManyStreams is returned. The stream is forgotten by the session
+// once it is closed.
+//
+// The stream's ID is signed by the session with SignStreamID, so it may be
+// handed to the client as is, and GetStream will accept it only from this
+// session.
 func (rs *RAMSession) NewStream() (*strest.Stream, error) {
-	fmt.Println("Getting new stream from ram session")
-	id := strest.StreamID(base64.StdEncoding.EncodeToString(thirtytwoRandomBytes(rand.Reader)))
-	stream := strest.NewStream(id)
+	slog.Debug("creating new stream in RAM session")
+	id, err := SignStreamID(rs,
+		strest.StreamID(base64.StdEncoding.EncodeToString(thirtytwoRandomBytes(rand.Reader))))
+	if err != nil {
+		return nil, err
+	}
 
 	rs.Lock()
+	if rs.rss.MaxStreams > 0 && len(rs.streams) >= rs.rss.MaxStreams {
+		rs.Unlock()
+		return nil, ErrTooManyStreams
+	}
+	stream := strest.NewStream(id)
 	rs.streams[id] = stream
 	rs.Unlock()
 
+	go rs.forgetStream(stream)
+
 	return stream, nil
 }
 
+// forgetStream removes the stream from the session once it closes,
+// freeing its place under MaxStreams.
+func (rs *RAMSession) forgetStream(stream *strest.Stream) {
+	<-stream.Done()
+
+	rs.Lock()
+	if rs.streams[stream.ID()] == stream {
+		delete(rs.streams, stream.ID())
+	}
+	rs.Unlock()
+}
+
 func (rs *RAMSession) GetStream(signedSid []byte) (*strest.Stream, error) {
-	fmt.Println("Getting stream", string(signedSid))
+	slog.Debug("getting stream from RAM session")
 	if len(signedSid) == 0 {
 		panic("GetStream with no stream ID")
 	}
-	sid, err := rs.UnwrapAuthentication(signedSid)
-	if err != nil {
+	// A stream ID from any other session is rejected here, before the
+	// streams are even consulted.
+	if _, err := VerifyStreamID(rs, signedSid); err != nil {
 		// return an error indistinguishable from the 'not found' case on
 		// purpose, to not leak whether the signature was correct.
-		fmt.Println("Authentication unwrap failed", err)
+		slog.Debug("stream ID failed verification", "err", err)
 		return nil, ErrStreamNotFound
 	}
 	rs.Lock()
-	stream, haveStream := rs.streams[strest.StreamID(string(sid))]
+	stream, haveStream := rs.streams[strest.StreamID(signedSid)]
 	rs.Unlock()
 	if !haveStream {
 		return nil, ErrStreamNotFound
@@ -208,9 +351,8 @@ func (rs *RAMSession) GetStream(signedSid []byte) (*strest.Stream, error) {
 }
 
 func (rs *RAMSession) ActiveStreams() []strest.StreamID {
-	streams := make([]strest.StreamID, 0, len(rs.streams))
-
 	rs.Lock()
+	streams := make([]strest.StreamID, 0, len(rs.streams))
 	for streamID := range rs.streams {
 		streams = append(streams, streamID)
 	}
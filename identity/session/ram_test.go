@@ -0,0 +1,283 @@
+package session
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/secret"
+)
+
+// getRAMServer returns a RAMSessionServer with the given settings, and the
+// function that stops the generators it uses.
+func getRAMServer(settings *RAMSessionSettings) (*RAMSessionServer, func()) {
+	idGen := NewSessionIDGenerator(0, []byte("0123456789012345"))
+	go idGen.Serve()
+	secretGen := secret.NewGenerator(8)
+	go secretGen.Serve()
+
+	return NewRAMServer(idGen, secretGen, settings), func() {
+		idGen.Stop()
+		secretGen.Stop()
+	}
+}
+
+func TestRAMExtendLifetime(t *testing.T) {
+	manTime := abtime.NewManual()
+	rss, deffunc := getRAMServer(&RAMSessionSettings{
+		Timeout:      time.Hour,
+		AbstractTime: manTime,
+		MaxLifetime:  24 * time.Hour,
+	})
+	defer deffunc()
+
+	s, err := rss.NewSession(&identity.Identity{enticate.GetNamedUser("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	extender, isExtender := s.(LifetimeExtender)
+	if !isExtender {
+		t.Fatal("RAMSession is not a LifetimeExtender")
+	}
+
+	if _, extended := s.(LifetimeReporter).Lifetime(); extended {
+		t.Fatal("new session reported as extended")
+	}
+	if granted := extender.ExtendLifetime(10 * time.Hour); granted != 10*time.Hour {
+		t.Fatal("extension within the max lifetime not granted:", granted)
+	}
+	if granted := extender.ExtendLifetime(time.Minute); granted != 10*time.Hour {
+		t.Fatal("extension shortened the session:", granted)
+	}
+	if _, err := rss.GetSession(s.(*RAMSession).sessionID); err != nil {
+		t.Fatal(err)
+	}
+	remaining, extended := s.(LifetimeReporter).Lifetime()
+	if remaining != 10*time.Hour || !extended {
+		t.Fatal("access shortened the extended session:", remaining, extended)
+	}
+
+	if granted := extender.ExtendLifetime(30 * 24 * time.Hour); granted != 24*time.Hour {
+		t.Fatal("extension not bounded by the max lifetime:", granted)
+	}
+
+	manTime.Advance(23 * time.Hour)
+	if s.Expired() {
+		t.Fatal("session expired despite its extension")
+	}
+	manTime.Advance(2 * time.Hour)
+	if !s.Expired() {
+		t.Fatal("extended session did not expire")
+	}
+	if granted := extender.ExtendLifetime(time.Hour); granted != 0 || !s.Expired() {
+		t.Fatal("expired session was revived")
+	}
+}
+
+func TestStreamIDsAreSessionBound(t *testing.T) {
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	id := &identity.Identity{enticate.GetNamedUser("test")}
+	mine, err := rss.NewSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := rss.NewSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := mine.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	theirStream, err := theirs.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer theirStream.Close()
+
+	// the ID the stream is created with is the one that retrieves it
+	gotStream, err := mine.GetStream([]byte(stream.ID()))
+	if err != nil || gotStream != stream {
+		t.Fatal("could not retrieve stream by the ID it was created with:", err)
+	}
+	if _, err = theirs.GetStream([]byte(stream.ID())); err != ErrStreamNotFound {
+		t.Fatal("stream retrieved through another session:", err)
+	}
+	if _, err = mine.GetStream([]byte(theirStream.ID())); err != ErrStreamNotFound {
+		t.Fatal("another session's stream retrieved:", err)
+	}
+
+	// the random ID underneath the signature doesn't work alone
+	raw, err := VerifyStreamID(mine, []byte(stream.ID()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mine.GetStream([]byte(raw)); err != ErrStreamNotFound {
+		t.Fatal("stream retrieved by its raw ID:", err)
+	}
+
+	// a value signed without the stream ID context, as a cookie would be,
+	// must not work either
+	plain, err := mine.Authenticate([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mine.GetStream(plain); err != ErrStreamNotFound {
+		t.Fatal("stream retrieved by a value signed for another purpose:", err)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	rss, deffunc := getRAMServer(&RAMSessionSettings{MaxStreams: 2})
+	defer deffunc()
+	s, err := rss.NewSession(&identity.Identity{enticate.GetNamedUser("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := s.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if _, err = s.NewStream(); err != ErrTooManyStreams {
+		t.Fatal("stream beyond the limit created:", err)
+	}
+
+	first.Close()
+	<-first.Done()
+	// the session forgets the stream just after it is done
+	deadline := time.Now().Add(time.Second)
+	for {
+		third, err := s.NewStream()
+		if err == nil {
+			defer third.Close()
+			break
+		}
+		if err != ErrTooManyStreams || time.Now().After(deadline) {
+			t.Fatal("closing a stream did not free its place:", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err = s.GetStream([]byte(first.ID())); err != ErrStreamNotFound {
+		t.Fatal("closed stream still retrievable:", err)
+	}
+	if active := s.(*RAMSession).ActiveStreams(); len(active) != 2 {
+		t.Fatal("wrong active streams:", active)
+	}
+}
+
+// Stream IDs used to be handed out by NewStream unsigned, while GetStream
+// only accepted signed ones, so no stream could ever be retrieved by the
+// ID it was created with.
+func TestNewStreamIDsAreSigned(t *testing.T) {
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	id := &identity.Identity{enticate.GetNamedUser("test")}
+	ram, err := rss.NewSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fss, diskDeffunc := getDiskSession(t)
+	defer diskDeffunc()
+	disk, err := fss.NewSession(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []Session{ram, disk} {
+		stream, err := s.NewStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = VerifyStreamID(s, []byte(stream.ID())); err != nil {
+			t.Fatalf("%T handed out an unsigned stream ID: %v", s, err)
+		}
+		stream.Close()
+	}
+
+	stream, err := ram.NewStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	if gotStream, err := ram.GetStream([]byte(stream.ID())); err != nil || gotStream != stream {
+		t.Fatal("stream not retrievable by its own ID:", err)
+	}
+}
+
+func TestRAMAttributes(t *testing.T) {
+	rss, deffunc := getRAMServer(nil)
+	defer deffunc()
+	s, err := rss.NewSession(&identity.Identity{enticate.GetNamedUser("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := s.(AttributeStore)
+
+	// a write from a stale version is refused
+	attributes, version := store.Attributes()
+	attributes["theme"] = "dark"
+	if _, err = store.CompareAndSwapAttributes(version, attributes); err != nil {
+		t.Fatal(err)
+	}
+	attributes["theme"] = "light"
+	if _, err = store.CompareAndSwapAttributes(version, attributes); err != ErrAttributeConflict {
+		t.Fatal("stale write not refused:", err)
+	}
+	if attributes, _ = store.Attributes(); attributes["theme"] != "dark" {
+		t.Fatal("stale write took effect:", attributes)
+	}
+
+	// concurrent updates are each applied exactly once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := UpdateAttributes(s, func(attributes map[string]string) error {
+				count, _ := strconv.Atoi(attributes["count"])
+				attributes["count"] = strconv.Itoa(count + 1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	attributes, version = store.Attributes()
+	if attributes["count"] != "50" || attributes["theme"] != "dark" || version != 51 {
+		t.Fatal("concurrent updates lost:", attributes, version)
+	}
+
+	// a failed update changes nothing
+	failed := errors.New("failed")
+	err = UpdateAttributes(s, func(attributes map[string]string) error {
+		attributes["count"] = "0"
+		return failed
+	})
+	if err != failed {
+		t.Fatal("update error not returned:", err)
+	}
+	if attributes, _ = store.Attributes(); attributes["count"] != "50" {
+		t.Fatal("failed update took effect:", attributes)
+	}
+
+	if UpdateAttributes(AnonymousSession, func(map[string]string) error { return nil }) != ErrNoAttributes {
+		t.Fatal("attributes updated on a session without them")
+	}
+}
@@ -0,0 +1,50 @@
+package session
+
+import (
+	"sync/atomic"
+
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/secret"
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// NewRequestSession returns a Session carrying the given identity for
+// the duration of a single request, such as one authenticated by HTTP
+// Basic authentication. It is not stored by any SessionServer, has no
+// SessionID, and does not support streams.
+//
+// It has its own random secret, so values authenticated by it can't be
+// unwrapped by any other request.
+func NewRequestSession(id *identity.Identity) Session {
+	return &requestSession{Secret: secret.Get(), identity: id}
+}
+
+type requestSession struct {
+	*secret.Secret
+	identity *identity.Identity
+	expired  atomic.Bool
+}
+
+func (rs *requestSession) Expired() bool {
+	return rs.expired.Load()
+}
+
+func (rs *requestSession) Expire() {
+	rs.expired.Store(true)
+}
+
+func (rs *requestSession) SessionID() (bool, SessionID) {
+	return false, NoSessionID
+}
+
+func (rs *requestSession) Identity() *identity.Identity {
+	return rs.identity
+}
+
+func (rs *requestSession) NewStream() (*strest.Stream, error) {
+	return nil, ErrSessionDoesNotSupportStreams
+}
+
+func (rs *requestSession) GetStream([]byte) (*strest.Stream, error) {
+	return nil, ErrSessionDoesNotSupportStreams
+}
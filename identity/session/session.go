@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"time"
 
 	"github.com/thejerf/sphyraena/identity"
 	"github.com/thejerf/sphyraena/secret"
@@ -61,7 +62,9 @@ type Session interface {
 
 	// This returns a new stream that can be identified by ID, or an error
 	// if no stream can be created (perhaps because this is for some reason
-	// an impoverished session that lacks that capability).
+	// an impoverished session that lacks that capability). The stream's ID
+	// must be produced by SignStreamID, so that it may be given to the
+	// client, and later presented to GetStream.
 	//
 	// FIXME: In general, sessions can't provide GetStream. In which case,
 	// why are they providing the streams at all? The answer is probably
@@ -69,8 +72,10 @@ type Session interface {
 	// authentication that this mixes in too freely right now.
 	NewStream() (*strest.Stream, error)
 
-	// This retrieves a stream by the given key. If it is from this
-	// session, the stream will be returned. (FIXME: or created?)
+	// This retrieves a stream by the given ID, as produced by NewStream.
+	// If it is from this session, the stream will be returned; an ID not
+	// signed by this session must be rejected, before any lookup is done,
+	// as must the random ID that was signed. (FIXME: or created?)
 	// This can be problematic with streams that may live in other
 	// processes, requiring some sort of forwarding arrangment or a message
 	// bus or something.
@@ -90,17 +95,91 @@ type Session interface {
 	secret.AuthenticationUnwrapper
 }
 
-// FIXME: this should have a slot for the underlying problem
+// A LifetimeExtender is a Session whose lifetime can be extended past the
+// server's normal timeout, as used for "remember me" logins.
+//
+// ExtendLifetime requests that the session last for the given duration
+// from now. The server may grant less than requested; the duration the
+// session will actually last from now is returned.
+type LifetimeExtender interface {
+	ExtendLifetime(time.Duration) time.Duration
+}
+
+// A LifetimeReporter is a Session that can report how much longer it will
+// last, so a persistent session cookie can be renewed before the browser
+// discards it.
+//
+// Lifetime returns the time remaining before the session expires, and
+// whether ExtendLifetime has ever been granted for it, which is what makes
+// its cookie persistent.
+type LifetimeReporter interface {
+	Lifetime() (remaining time.Duration, extended bool)
+}
+
+// A StreamEnumerator is a SessionServer that can list every stream
+// currently held by any of its sessions, so they can all be closed when
+// the server shuts down.
+//
+// As with ActiveStreams, this is inherently racy; streams may be created
+// after the list is made.
+type StreamEnumerator interface {
+	Streams() []*strest.Stream
+}
+
+// A Pinger is a SessionServer that can check whether its backing store is
+// reachable, for health checks. Ping returns nil if it is.
+type Pinger interface {
+	Ping() error
+}
 
+// ErrSessionNotFound is returned when a session can not be found.
+//
+// A SessionServer that failed to find a session for some reason other
+// than its simple absence, such as an I/O or decoding error, should
+// instead return a *SessionNotFoundError carrying that cause, which will
+// still match this via errors.Is.
 var ErrSessionNotFound = errors.New("session not found")
 
+// A SessionNotFoundError indicates a session could not be found because
+// of some underlying problem, as given by the Cause.
+//
+// For the purposes of authorization this is exactly as if the session
+// doesn't exist, and errors.Is(err, ErrSessionNotFound) is true for
+// it. The cause is retained for logging, and is available via
+// errors.Unwrap.
+type SessionNotFoundError struct {
+	Cause error
+}
+
+func (snfe *SessionNotFoundError) Error() string {
+	if snfe.Cause == nil {
+		return ErrSessionNotFound.Error()
+	}
+	return ErrSessionNotFound.Error() + ": " + snfe.Cause.Error()
+}
+
+// Unwrap returns the Cause.
+func (snfe *SessionNotFoundError) Unwrap() error {
+	return snfe.Cause
+}
+
+// Is returns true for ErrSessionNotFound.
+func (snfe *SessionNotFoundError) Is(target error) bool {
+	return target == ErrSessionNotFound
+}
+
+func sessionNotFound(cause error) error {
+	return &SessionNotFoundError{cause}
+}
+
 // A SessionServer takes SessionIDs, and returns Sessions, with or without
 // creating them if they do not currently exist.
 type SessionServer interface {
 	// since sessions may be on the network, in the DB, etc., it can still
 	// be an error that we may want to log if we can't get a session.
 	// ErrSessionNotFound must be returned to indicate that it wasn't found,
-	// but nothing has particularly gone wrong.
+	// but nothing has particularly gone wrong. If something did go wrong,
+	// return a *SessionNotFoundError wrapping it.
 	//
 	// If a session is expired, it should not be returned; users of your
 	// SessionServer should not need to track that.
@@ -0,0 +1,37 @@
+package session
+
+import (
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// streamIDContext is authenticated along with every stream ID, so that a
+// value the session signed for some other purpose, such as a cookie,
+// can't be presented as a stream ID.
+var streamIDContext = []byte("stream_id")
+
+// SignStreamID returns the token for the given random stream ID that a
+// client must present to the session's GetStream to retrieve the stream.
+//
+// The token is signed by the session's secret, so it only works with the
+// session that issued it. Session implementations should use this in
+// NewStream, and give the Stream the token as its StreamID, so that the
+// ID of any Stream may be handed to the client as is.
+func SignStreamID(s Session, id strest.StreamID) (strest.StreamID, error) {
+	signed, err := s.Authenticate(streamIDContext, []byte(id))
+	if err != nil {
+		return strest.StreamID(""), err
+	}
+	return strest.StreamID(signed), nil
+}
+
+// VerifyStreamID returns the stream ID carried by the given token, if and
+// only if the token was produced by SignStreamID for the same session.
+//
+// Session implementations should use this in GetStream.
+func VerifyStreamID(s Session, token []byte) (strest.StreamID, error) {
+	id, err := s.UnwrapAuthentication(streamIDContext, token)
+	if err != nil {
+		return strest.StreamID(""), err
+	}
+	return strest.StreamID(id), nil
+}
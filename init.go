@@ -6,6 +6,7 @@ Package sphyraena provides the default startup functionality for Sphyraena.
 package sphyraena
 
 import (
+	"context"
 	"time"
 
 	"github.com/thejerf/sphyraena/identity/session"
@@ -68,7 +69,7 @@ func New(args *Args) *Sphyraena {
 		if args.SessionServerFunc == nil {
 			args.SessionServer = session.NewRAMServer(
 				args.SessionIDGenerator, args.SecretGenerator,
-				&session.RAMSessionSettings{time.Minute * 180, nil})
+				&session.RAMSessionSettings{Timeout: time.Minute * 180})
 		} else {
 			args.SessionServer = args.SessionServerFunc(
 				args.SessionIDGenerator, args.SecretGenerator)
@@ -84,3 +85,15 @@ func New(args *Args) *Sphyraena {
 		r,
 	}
 }
+
+// Shutdown gracefully shuts down Sphyraena, by shutting down the
+// SphyraenaState, which stops new requests and closes all the streams,
+// then stopping the supervisor and the services it runs.
+//
+// The supervisor is stopped even if the context expires before the
+// streams have all closed, in which case the context's error is returned.
+func (s *Sphyraena) Shutdown(ctx context.Context) error {
+	err := s.SphyraenaState.Shutdown(ctx)
+	s.Supervisor.Stop()
+	return err
+}
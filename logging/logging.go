@@ -0,0 +1,74 @@
+/*
+
+Package logging adapts Go's log/slog package to the logging hooks used
+around Sphyraena.
+
+Sphyraena has two shapes of logger. Older code, such as strest.Stream and
+handlers.CommandSpecification, takes a log.Printf-like
+func(string, ...interface{}); Printf and Default produce those. The
+per-request records of the router go to a request.Logger, which
+*slog.Logger satisfies directly.
+
+By default, all of these log to slog.Default(), looked up at the time of
+each call, so configuring one logger with slog.SetDefault is enough to
+direct all of Sphyraena's logging.
+
+*/
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Printf returns a log.Printf-like function that logs to the given
+// logger at the given level.
+//
+// The format and arguments are rendered with fmt.Sprintf to become the
+// message, with any trailing newlines removed, since slog handlers
+// terminate their own records. If the logger is nil, slog.Default() is
+// used at the time of each call.
+func Printf(l *slog.Logger, level slog.Level) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		logger := l
+		if logger == nil {
+			logger = slog.Default()
+		}
+		if !logger.Enabled(context.Background(), level) {
+			return
+		}
+		msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+		logger.Log(context.Background(), level, msg)
+	}
+}
+
+// Default returns a log.Printf-like function that logs to slog.Default()
+// at the given level.
+func Default(level slog.Level) func(string, ...interface{}) {
+	return Printf(nil, level)
+}
+
+// DefaultWith returns a log.Printf-like function that logs to
+// slog.Default() at the given level, with the given alternating keys and
+// values added to every record, as with slog.Logger.With.
+func DefaultWith(level slog.Level, keyvals ...interface{}) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		Printf(slog.Default().With(keyvals...), level)(format, args...)
+	}
+}
+
+// DefaultLogger is a request.ErrorLogger that logs to slog.Default(),
+// looking it up at the time of each call.
+type DefaultLogger struct{}
+
+// Info logs to slog.Default() at the Info level.
+func (dl DefaultLogger) Info(msg string, keyvals ...interface{}) {
+	slog.Default().Info(msg, keyvals...)
+}
+
+// Error logs to slog.Default() at the Error level.
+func (dl DefaultLogger) Error(msg string, keyvals ...interface{}) {
+	slog.Default().Error(msg, keyvals...)
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestPrintf(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}))
+
+	Printf(l, slog.LevelWarn)("stream %d crashed: %v\n", 3, "oops")
+	out := buf.String()
+	if !strings.Contains(out, "level=WARN") ||
+		!strings.Contains(out, `msg="stream 3 crashed: oops"`) {
+		t.Fatal("printf call not logged correctly:", out)
+	}
+
+	buf.Reset()
+	Printf(l, slog.LevelDebug)("too quiet %d", 1)
+	if buf.Len() != 0 {
+		t.Fatal("disabled level was logged:", buf.String())
+	}
+}
+
+func TestDefault(t *testing.T) {
+	original := slog.Default()
+	defer slog.SetDefault(original)
+
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	Default(slog.LevelError)("to the default")
+	DefaultLogger{}.Info("request", "status", 200)
+	DefaultWith(slog.LevelError, "request_id", "abc")("with %s", "fields")
+	out := buf.String()
+	if !strings.Contains(out, `msg="to the default"`) ||
+		!strings.Contains(out, "status=200") ||
+		!strings.Contains(out, `msg="with fields" request_id=abc`) {
+		t.Fatal("default logger not used at call time:", out)
+	}
+}
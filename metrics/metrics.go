@@ -0,0 +1,71 @@
+/*
+
+Package metrics defines the hooks Sphyraena uses to report on itself.
+
+Sphyraena does not depend on any particular metrics system. Instead, the
+places in the framework worth measuring call a Metrics, which you can
+implement by forwarding to Prometheus, expvar, statsd, or whatever you
+already use. The names and labels are chosen to map directly onto
+Prometheus conventions.
+
+By default, Nop is used, which discards everything.
+
+*/
+package metrics
+
+// Labels qualify a metric, in the Prometheus sense. Sphyraena only ever
+// uses the label names documented on each metric name below, so an
+// implementation can declare them up front if it needs to.
+//
+// Callers must not modify Labels after passing them to a Metrics.
+type Labels map[string]string
+
+// Metrics is the interface Sphyraena reports metrics through.
+//
+// Implementations must be safe for concurrent use, and should not block,
+// as they are called on request paths.
+type Metrics interface {
+	// IncCounter increments the named counter by one.
+	IncCounter(name string, labels Labels)
+
+	// ObserveHistogram records the given value in the named histogram.
+	ObserveHistogram(name string, value float64, labels Labels)
+
+	// SetGauge sets the named gauge to the given value.
+	SetGauge(name string, value float64, labels Labels)
+}
+
+// The metrics Sphyraena reports.
+const (
+	// RequestsTotal counts HTTP requests run by the router, including
+	// those that were not found, labeled with "method" and "status".
+	RequestsTotal = "sphyraena_requests_total"
+
+	// RequestDuration observes how long it took to route and run an HTTP
+	// request, in seconds, labeled with "method" and "status".
+	RequestDuration = "sphyraena_request_duration_seconds"
+
+	// Authentications counts password authentication attempts, labeled
+	// with "result", which is either "success" or "failure".
+	Authentications = "sphyraena_authentications_total"
+
+	// ActiveStreams is the number of streams currently running.
+	ActiveStreams = "sphyraena_active_streams"
+
+	// DroppedMessages counts messages from the user a stream could not
+	// deliver, labeled with "reason", which is either "no_substream" or
+	// "cannot_receive".
+	DroppedMessages = "sphyraena_stream_dropped_messages_total"
+)
+
+// Nop is a Metrics that discards everything.
+type Nop struct{}
+
+// IncCounter implements Metrics.
+func (n Nop) IncCounter(string, Labels) {}
+
+// ObserveHistogram implements Metrics.
+func (n Nop) ObserveHistogram(string, float64, Labels) {}
+
+// SetGauge implements Metrics.
+func (n Nop) SetGauge(string, float64, Labels) {}
@@ -0,0 +1,73 @@
+package request
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/session"
+)
+
+// Auditor returns the Auditor to record this request's audit events to.
+//
+// Requests created from streams don't carry a SphyraenaState, in which
+// case audit.Nop is returned.
+func (c *Request) Auditor() audit.Auditor {
+	if c.SphyraenaState == nil || c.SphyraenaState.Auditor == nil {
+		return audit.Nop{}
+	}
+	return c.SphyraenaState.Auditor
+}
+
+// Audit records the given event to the audit trail. Any of the Time, the
+// Identity and the Session left empty are filled in from the current time
+// and the request's current session.
+//
+// A failure to record the event is logged, as well as returned.
+func (c *Request) Audit(e audit.Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if c.session != nil {
+		if e.Identity == "" {
+			e.Identity = audit.IdentityID(c.session.Identity())
+		}
+		if e.Session == "" {
+			if haveID, id := c.session.SessionID(); haveID {
+				e.Session = audit.SessionHash(string(id))
+			}
+		}
+	}
+
+	err := c.Auditor().Audit(e)
+	if err != nil {
+		slog.Error("could not record audit event", "action", e.Action,
+			"identity", e.Identity, "error", err)
+	}
+	return err
+}
+
+// NewSession creates a new session for the given identity, recording its
+// creation in the audit trail.
+//
+// This shadows the NewSession of the SessionServer, so everything
+// creating sessions through a Request is audited.
+func (c *Request) NewSession(id *identity.Identity) (session.Session, error) {
+	s, err := c.SphyraenaState.NewSession(id)
+
+	e := audit.Event{
+		Identity: audit.IdentityID(id),
+		Action:   audit.SessionCreated,
+		Outcome:  audit.Success,
+	}
+	if err != nil {
+		e.Outcome = audit.Failure
+		e.Details = map[string]string{"error": err.Error()}
+	} else if haveID, sessionID := s.SessionID(); haveID {
+		e.Session = audit.SessionHash(string(sessionID))
+	}
+	_ = c.Audit(e)
+
+	return s, err
+}
@@ -0,0 +1,61 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thejerf/sphyraena/audit"
+	"github.com/thejerf/sphyraena/identity"
+	"github.com/thejerf/sphyraena/identity/auth/enticate"
+	"github.com/thejerf/sphyraena/identity/session"
+)
+
+type recordingAuditor struct {
+	events []audit.Event
+}
+
+func (ra *recordingAuditor) Audit(e audit.Event) error {
+	ra.events = append(ra.events, e)
+	return nil
+}
+
+// establishedSession is a session with an ID, for a named user.
+type establishedSession struct {
+	session.Session
+}
+
+func (es establishedSession) SessionID() (bool, session.SessionID) {
+	return true, "established"
+}
+
+func (es establishedSession) Identity() *identity.Identity {
+	return &identity.Identity{enticate.GetNamedUser("jerf")}
+}
+
+func (es establishedSession) Expire() {}
+
+func TestSetSessionAudits(t *testing.T) {
+	ss := NewSphyraenaState(nil, nil)
+	auditor := &recordingAuditor{}
+	ss.Auditor = auditor
+	httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+	req, _ := ss.NewRequest(httptest.NewRecorder(), httpReq, false)
+
+	// attaching a session to a request without one is not audited
+	req.SetSession(establishedSession{session.AnonymousSession})
+	if len(auditor.events) != 0 {
+		t.Fatal("attaching a session was audited:", auditor.events)
+	}
+
+	req.SetSession(session.AnonymousSession)
+	if len(auditor.events) != 1 {
+		t.Fatal("replacing a session was not audited")
+	}
+	e := auditor.events[0]
+	if e.Action != audit.SessionChanged || e.Outcome != audit.Success ||
+		e.Identity != audit.IdentityID(identity.AnonymousIdentity) ||
+		e.Details["previous"] != "simple_named_user⁝jerf" {
+		t.Fatal("wrong session change event:", e)
+	}
+}
@@ -0,0 +1,60 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+)
+
+// DefaultMaxBodySize is the largest request body accepted when neither
+// the route nor the SphyraenaState specifies a limit. It is deliberately
+// conservative; routes that accept uploads should raise it for just
+// themselves with the router's MaxBodySize clause.
+const DefaultMaxBodySize = 1 << 20
+
+// IsBodyTooLarge returns whether the given error is the result of reading
+// past the request body size limit.
+func IsBodyTooLarge(err error) bool {
+	var mbe *http.MaxBytesError
+	return errors.As(err, &mbe)
+}
+
+// maxBodySize returns the body size limit for the request, from the route
+// if it set one, or else the SphyraenaState. A negative limit means there
+// is none.
+func (c *Request) maxBodySize() int64 {
+	if c.RouteResult != nil && c.RouteResult.MaxBodySize != 0 {
+		return c.RouteResult.MaxBodySize
+	}
+	if c.SphyraenaState != nil && c.SphyraenaState.MaxBodySize != 0 {
+		return c.SphyraenaState.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+// LimitBody enforces the body size limit on the request before its
+// handler runs.
+//
+// If the request declares a Content-Length over the limit, it is refused
+// with a 413 Request Entity Too Large, and false is returned; the handler
+// must not be run. Otherwise, the body is wrapped in an
+// http.MaxBytesReader, so reading past the limit is an error for which
+// IsBodyTooLarge is true, and the connection will be closed afterwards.
+//
+// This is called by the router once the route has been determined; it
+// normally shouldn't be called by anything else.
+func (c *Request) LimitBody(rw http.ResponseWriter) bool {
+	limit := c.maxBodySize()
+	if limit < 0 || c.Body == nil {
+		return true
+	}
+
+	if c.ContentLength > limit {
+		rw.Header().Set("Connection", "close")
+		http.Error(rw, "request body too large",
+			http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	c.Body = http.MaxBytesReader(rw, c.Body, limit)
+	return true
+}
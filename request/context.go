@@ -4,13 +4,17 @@ package request
 // resolving this to the google version.
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/thejerf/sphyraena/audit"
 	"github.com/thejerf/sphyraena/identity"
 	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/logging"
+	"github.com/thejerf/sphyraena/metrics"
 	"github.com/thejerf/sphyraena/sphyrw"
 	"github.com/thejerf/sphyraena/sphyrw/cookie"
 	"github.com/thejerf/sphyraena/sphyrw/hole"
@@ -25,6 +29,113 @@ type SphyraenaState struct {
 	// This is the default object to use for an unauthenticated user
 	// If nil, this will automatically be set to enticate.DefaultUnauthenticated{}.
 	defaultIdentity func() *identity.Identity
+
+	// Metrics is what the framework reports its metrics through. It is
+	// set to metrics.Nop by NewSphyraenaState, and must not be nil.
+	Metrics metrics.Metrics
+
+	// Logger receives one record for each HTTP request the router
+	// runs. NewSphyraenaState sets it to a logging.DefaultLogger, so
+	// records go to slog.Default(). If nil, nothing is logged.
+	Logger Logger
+
+	// Auditor receives the audit trail of security-relevant actions. It
+	// is set to audit.Nop by NewSphyraenaState, and must not be nil.
+	Auditor audit.Auditor
+
+	// SessionTransport is how the session ID travels between the client
+	// and Sphyraena, which the authentication clauses use to find and
+	// issue sessions. It is set to a CookieSessionTransport by
+	// NewSphyraenaState, and must not be nil.
+	SessionTransport SessionTransport
+
+	// UnprefixedSessionCookie names the session cookie
+	// cookie.UnprefixedSessionCookieName, rather than giving it the
+	// "__Secure-" prefix that prevents a cookie set over plain HTTP from
+	// shadowing it. This is for compatibility with environments that
+	// can't guarantee HTTPS; EnableInsecureCookies implies it. See
+	// SessionCookieName.
+	UnprefixedSessionCookie bool
+
+	// MaxBodySize is the largest request body accepted by routes that
+	// don't set their own limit. If zero, DefaultMaxBodySize is used. If
+	// negative, there is no limit.
+	MaxBodySize int64
+
+	// MaxHeaderCount and MaxHeaderBytes limit the number and total size
+	// of the headers of HTTP requests, which are refused with a 431 if
+	// they exceed either. If zero, DefaultMaxHeaderCount and
+	// DefaultMaxHeaderBytes are used. If negative, there is no limit.
+	// The http.Server's own MaxHeaderBytes is applied before these. See
+	// CheckHeaders.
+	MaxHeaderCount int
+	MaxHeaderBytes int
+
+	// MaxPathLength and MaxPathSegments limit the length of the URL path
+	// of requests, and the number of segments in it, which are refused
+	// with a 414 before routing if they exceed either. If zero,
+	// DefaultMaxPathLength and DefaultMaxPathSegments are used. If
+	// negative, there is no limit. See CheckPath.
+	MaxPathLength   int
+	MaxPathSegments int
+
+	// ResponseBufferSize, if positive, is the size of the body up to
+	// which HTTP responses are held back and sent all at once with a
+	// Content-Length, as described by SphyraenaResponseWriter.Buffer.
+	// Handlers that stream their response over time must call Flush on
+	// the SphyraenaResponseWriter to avoid being held back. If zero, the
+	// default, responses are written straight through.
+	ResponseBufferSize int
+
+	// ForwardedProtoHeader is the header a TLS-terminating proxy in
+	// front of Sphyraena uses to indicate the protocol the client used,
+	// such as "X-Forwarded-Proto". If empty, the default, such headers
+	// are ignored and only the real connection is trusted. Only set this
+	// if the proxy always sets or strips that header, as otherwise the
+	// client can simply send it. See Request.Scheme.
+	ForwardedProtoHeader string
+
+	// RequestIDHeader is the header a proxy in front of Sphyraena uses
+	// to send the ID it assigned to the request, such as
+	// "X-Request-ID", so that it can be correlated with the proxy's own
+	// logs. If empty, the default, or if the header is missing or not
+	// an acceptable ID, a new random ID is generated. As with
+	// ForwardedProtoHeader, only set this if the proxy always sets or
+	// strips that header. See Request.RequestID.
+	RequestIDHeader string
+
+	// Locales are the locales the site can render responses in, such as
+	// "en-US", in order of preference. DefaultLocale is used when none
+	// of them are acceptable to the user; if empty, the first of the
+	// Locales is. LocaleCookie, if set, is the name of a cookie with
+	// which the user may choose one of the Locales, overriding their
+	// Accept-Language header. Catalog provides the translated messages.
+	// See Request.Locale and Request.Localize.
+	Locales       []string
+	DefaultLocale string
+	LocaleCookie  string
+	Catalog       Catalog
+
+	// MethodOverride lets HTML forms, which can only GET and POST, reach
+	// PUT, PATCH, and DELETE routes. If set, a POST request with a
+	// MethodOverrideHeader, or a urlencoded form body with a
+	// MethodOverrideField, naming one of those methods is treated as
+	// having that method, by the router and the handler alike.
+	// OriginalMethod returns the method it was actually sent with. Only a
+	// POST is ever overridden, and never to a GET or HEAD. As CSRFProtect
+	// protects all of those methods, it protects the overridden requests
+	// as well. This is off by default.
+	MethodOverride bool
+
+	// set by EnableInsecureCookies
+	insecureCookies bool
+
+	// set atomically to 1 once Shutdown has been called
+	shuttingDown int32
+
+	// closed once Shutdown has been called; see ShutdownStarted
+	shutdownLock    sync.Mutex
+	shutdownStarted chan struct{}
 }
 
 // FromStream allows the creation of requests from streams, where the
@@ -36,6 +147,7 @@ func FromStream(
 ) *Request {
 	return &Request{
 		session:               session,
+		requestID:             newRequestID(),
 		currentStream:         stream,
 		isStreaming:           true,
 		handleInitialResponse: handleInitialResponse,
@@ -58,11 +170,19 @@ type Request struct {
 	session session.Session
 	Cookies *cookie.InCookies
 
+	requestID string
+
 	*http.Request
 
+	// the method the request was sent with, if MethodOverride changed it
+	originalMethod string
+
 	// FIXME: Probably broken, use context properly instead
 	values map[interface{}]interface{}
 
+	// the extra fields for this request's log record
+	logFields []interface{}
+
 	currentStream *strest.Stream
 
 	isStreaming bool
@@ -80,22 +200,54 @@ type Request struct {
 	// This handles the initial response to the stream, which may include a
 	// complete failure to initiate due to being not found, etc. FIXME:
 	// Simply opening a stream directly should automatically handle this,
-	// if possible, as well as the HandleStream call returning without
-	// having initiated any stream.
+	// if possible. The HandleStream call returning without having
+	// initiated any stream is handled by the router.
 	hrOnce                sync.Once
 	handleInitialResponse func(StreamRequestResult)
+
+	// set atomically to 1 once StreamResponse has been called
+	streamResponded int32
 }
 
 func (c *Request) Session() session.Session {
 	return c.session
 }
 
+// StreamResponse sends the initial response to a streaming request,
+// resolving the client's request to open a stream. Only the first call
+// has any effect.
 func (c *Request) StreamResponse(srr StreamRequestResult) {
+	c.TryStreamResponse(srr)
+}
+
+// TryStreamResponse is StreamResponse, but returns whether this call was
+// the one that sent the initial response, for code racing the handler to
+// respond, such as the router's Timeout.
+func (c *Request) TryStreamResponse(srr StreamRequestResult) (responded bool) {
 	c.hrOnce.Do(func() {
+		responded = true
+		atomic.StoreInt32(&c.streamResponded, 1)
 		if c.handleInitialResponse != nil {
 			c.handleInitialResponse(srr)
 		}
 	})
+	return responded
+}
+
+// StreamResponded returns whether StreamResponse has been called.
+func (c *Request) StreamResponded() bool {
+	return atomic.LoadInt32(&c.streamResponded) == 1
+}
+
+// Metrics returns the Metrics to report through for this request.
+//
+// Requests created from streams don't carry a SphyraenaState, in which
+// case metrics.Nop is returned.
+func (c *Request) Metrics() metrics.Metrics {
+	if c.SphyraenaState == nil || c.SphyraenaState.Metrics == nil {
+		return metrics.Nop{}
+	}
+	return c.SphyraenaState.Metrics
 }
 
 // IsStreaming indicates whether the request is a streaming request or a
@@ -113,11 +265,26 @@ func (c *Request) IsStreaming() bool {
 // It is intended that any attempt to modify the user's permissions
 // requires a new session and results in a new session authorization
 // (cookie, usually).
+//
+// Replacing an established session is recorded in the audit trail as an
+// audit.SessionChanged. Attaching a session to a request that had none,
+// as CookieAuth does for every request bearing a session cookie, is not.
 func (c *Request) SetSession(s session.Session) {
 	// note this does not manipulate cookies, because there are session
 	// mechanims other than cookies.
-	c.session.Expire()
+	previous := c.session
+	previous.Expire()
 	c.session = s
+
+	if haveID, _ := previous.SessionID(); haveID {
+		_ = c.Audit(audit.Event{
+			Action:  audit.SessionChanged,
+			Outcome: audit.Success,
+			Details: map[string]string{
+				"previous": audit.IdentityID(previous.Identity()),
+			},
+		})
+	}
 }
 
 // A Sphyraena-specific context key type.
@@ -133,6 +300,10 @@ type RouteResult struct {
 	PrecedingPath string
 	RemainingPath string
 	Holes         hole.SecurityHoles
+
+	// MaxBodySize is the body size limit set by the route. Zero means
+	// the route did not set one; negative means there is no limit.
+	MaxBodySize int64
 }
 
 // Deadline implements the Request's Deadline method, by hardcoding that there
@@ -162,6 +333,40 @@ func (c *Request) Set(key, value interface{}) {
 	c.values[key] = value
 }
 
+// Fork returns a copy of the request for a handler to be run on in
+// another goroutine, which may still be using it after the caller has
+// moved on, as a handler under a router.Timeout may. The copy has its own
+// values, log fields and session, so neither side's changes to those race
+// with the other's; Join brings the handler's changes back.
+//
+// This is only for HTTP requests, not those from streams.
+func (c *Request) Fork() *Request {
+	fork := &Request{
+		SphyraenaState: c.SphyraenaState,
+		RouteResult:    c.RouteResult,
+		session:        c.session,
+		Cookies:        c.Cookies,
+		requestID:      c.requestID,
+		Request:        c.Request,
+		originalMethod: c.originalMethod,
+		values:         make(map[interface{}]interface{}, len(c.values)),
+		logFields:      append([]interface{}(nil), c.logFields...),
+		isStreaming:    c.isStreaming,
+	}
+	for key, value := range c.values {
+		fork.values[key] = value
+	}
+	return fork
+}
+
+// Join takes on the values, log fields and session of a request returned
+// by Fork, once the handler it was given to has returned.
+func (c *Request) Join(fork *Request) {
+	c.session = fork.session
+	c.values = fork.values
+	c.logFields = fork.logFields
+}
+
 func NewSphyraenaState(ss session.SessionServer, defaultIdentity func() *identity.Identity) *SphyraenaState {
 	if defaultIdentity == nil {
 		defaultIdentity = func() *identity.Identity {
@@ -170,8 +375,12 @@ func NewSphyraenaState(ss session.SessionServer, defaultIdentity func() *identit
 	}
 
 	return &SphyraenaState{
-		SessionServer:   ss,
-		defaultIdentity: defaultIdentity,
+		SessionServer:    ss,
+		defaultIdentity:  defaultIdentity,
+		Metrics:          metrics.Nop{},
+		Logger:           logging.DefaultLogger{},
+		Auditor:          audit.Nop{},
+		SessionTransport: CookieSessionTransport{},
 	}
 }
 
@@ -187,14 +396,21 @@ func (ss *SphyraenaState) NewRequest(
 	// For now, put all requests into the same session
 	var failedCookies []string
 	cookies, failedCookies := cookie.ParseCookies(req.Header["Cookie"],
-		ss.SessionServer)
+		ss.SessionCookieName(), ss.SessionServer)
 	srw := sphyrw.NewSphyraenaResponseWriter(rw)
+	if !isStreaming && ss.ResponseBufferSize > 0 {
+		srw.Buffer(ss.ResponseBufferSize)
+	}
+	var originalMethod string
+	if !isStreaming {
+		originalMethod = ss.overrideMethod(req)
+	}
 
 	if len(failedCookies) != 0 {
-		// temporary for debugging
-		fmt.Printf("Rejecting cookies: %v\n", failedCookies)
+		slog.Info("rejecting cookies", "cookies", failedCookies)
 		for _, cookieName := range failedCookies {
-			cookie, err := cookie.NewNonstandardOut(cookieName, "", nil, cookie.Delete)
+			cookie, err := cookie.NewNonstandardOut(cookieName, "", nil,
+				ss.cookieOptions(cookie.Delete)...)
 			if err != nil {
 				continue
 			}
@@ -206,6 +422,8 @@ func (ss *SphyraenaState) NewRequest(
 		SphyraenaState: ss,
 		Request:        req,
 		session:        session.AnonymousSession,
+		requestID:      ss.requestID(req.Header.Get),
+		originalMethod: originalMethod,
 		Cookies:        cookies,
 		values:         map[interface{}]interface{}{},
 		isStreaming:    isStreaming,
@@ -13,12 +13,21 @@ import (
 // A Handler is something that can handle Streaming REST responses.
 //
 // ServeStreaming is the core interface that permits Streaming REST
-// responses. You should also consider implementing the MayStream interface
-// on anything that implements this interface.
+// responses. You should also consider implementing the MayStreamer
+// interface on anything that implements this interface.
 type Handler interface {
 	ServeStreaming(*sphyrw.SphyraenaResponseWriter, *Request)
 }
 
+// A MayStreamer declares whether it may serve streaming requests. The
+// router refuses to route a streaming request to a handler whose
+// MayStream returns false, telling the client the resource does not
+// support streaming, rather than leaving it waiting for a stream that
+// will never come.
+type MayStreamer interface {
+	MayStream() bool
+}
+
 // A HandlerFunc allows a simple function to function as a Streaming REST
 // handler, just like http.HandlerFunc.
 type HandlerFunc func(*sphyrw.SphyraenaResponseWriter, *Request)
@@ -0,0 +1,57 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+)
+
+// DefaultMaxHeaderCount and DefaultMaxHeaderBytes are the limits on the
+// request headers when the SphyraenaState doesn't specify its own. They
+// are well beyond what any browser sends, but keep handlers that echo or
+// forward headers from being handed hundreds of them.
+const (
+	DefaultMaxHeaderCount = 100
+	DefaultMaxHeaderBytes = 64 << 10
+)
+
+// ErrTooManyHeaders and ErrHeadersTooLarge are returned by CheckHeaders
+// for headers beyond the SphyraenaState's limits.
+var (
+	ErrTooManyHeaders  = errors.New("too many request headers")
+	ErrHeadersTooLarge = errors.New("request headers too large")
+)
+
+// CheckHeaders returns an error if the given request headers exceed the
+// SphyraenaState's MaxHeaderCount or MaxHeaderBytes, or nil if they
+// don't. The router checks this before anything else is done with an HTTP
+// request, and refuses it with a 431 Request Header Fields Too Large.
+//
+// Each value counts as a header, as it would have been sent on its own
+// line. The size is that of the names and values, without the
+// punctuation between them.
+func (ss *SphyraenaState) CheckHeaders(header http.Header) error {
+	maxCount := ss.MaxHeaderCount
+	if maxCount == 0 {
+		maxCount = DefaultMaxHeaderCount
+	}
+	maxBytes := ss.MaxHeaderBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxHeaderBytes
+	}
+
+	count, size := 0, 0
+	for name, values := range header {
+		count += len(values)
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+
+	if maxCount > 0 && count > maxCount {
+		return ErrTooManyHeaders
+	}
+	if maxBytes > 0 && size > maxBytes {
+		return ErrHeadersTooLarge
+	}
+	return nil
+}
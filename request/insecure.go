@@ -0,0 +1,60 @@
+package request
+
+import (
+	"log/slog"
+
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// EnableInsecureCookies turns off the Secure flag on every cookie
+// Sphyraena itself issues, such as the session cookie and the CSRF
+// cookie, so that logging in works while developing over plain HTTP.
+//
+// This must NEVER be done in production, as it lets the session cookie
+// be sent in the clear. There is no way to turn this on by configuring a
+// field or by default; it must be explicitly called, and it logs a
+// warning when it is.
+//
+// Cookies Sphyraena issues with SameSite=None can not be created while
+// this is on, as browsers require those to be Secure. For the same reason,
+// the session cookie loses its "__Secure-" prefix; see SessionCookieName.
+func (ss *SphyraenaState) EnableInsecureCookies() {
+	slog.Warn("INSECURE COOKIES ENABLED: session cookies will be sent " +
+		"over plain HTTP. This is for development only, and must never " +
+		"be enabled in production.")
+	ss.insecureCookies = true
+}
+
+// InsecureCookies returns whether EnableInsecureCookies has been called.
+func (ss *SphyraenaState) InsecureCookies() bool {
+	return ss.insecureCookies
+}
+
+// SessionCookieName returns the name of the session cookie, which is
+// cookie.SessionCookieName unless UnprefixedSessionCookie is set or
+// EnableInsecureCookies has been called, as browsers refuse the prefixed
+// name on cookies that aren't Secure.
+func (ss *SphyraenaState) SessionCookieName() string {
+	if ss.UnprefixedSessionCookie || ss.insecureCookies {
+		return cookie.UnprefixedSessionCookieName
+	}
+	return cookie.SessionCookieName
+}
+
+func (ss *SphyraenaState) cookieOptions(options ...cookie.Option) []cookie.Option {
+	if ss.insecureCookies {
+		options = append(options, cookie.Insecure)
+	}
+	return options
+}
+
+// CookieOptions returns the given options for a cookie Sphyraena issues
+// on this request, with cookie.Insecure appended if the SphyraenaState has
+// had EnableInsecureCookies called.
+func (c *Request) CookieOptions(options ...cookie.Option) []cookie.Option {
+	options = append([]cookie.Option{}, options...)
+	if c.SphyraenaState == nil {
+		return options
+	}
+	return c.SphyraenaState.cookieOptions(options...)
+}
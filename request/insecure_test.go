@@ -0,0 +1,37 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+func TestInsecureCookies(t *testing.T) {
+	state := NewSphyraenaState(nil, nil)
+	render := func() string {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		req, _ := state.NewRequest(httptest.NewRecorder(), httpReq, false)
+		c, err := cookie.NewOut("c", "v", nil, req.CookieOptions(cookie.Session)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rendered, _ := c.Render()
+		return rendered
+	}
+
+	if state.InsecureCookies() || !strings.Contains(render(), ";Secure") {
+		t.Fatal("cookies insecure by default:", render())
+	}
+
+	state.EnableInsecureCookies()
+	if !state.InsecureCookies() || strings.Contains(render(), ";Secure") {
+		t.Fatal("cookies still secure:", render())
+	}
+
+	if len(FromStream(nil, nil, nil).CookieOptions(cookie.Session)) != 1 {
+		t.Fatal("stream request without a SphyraenaState not handled")
+	}
+}
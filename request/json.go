@@ -0,0 +1,81 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// ErrNotJSON is returned by DecodeJSON when the request does not declare
+// its body to be application/json.
+var ErrNotJSON = errors.New("request body is not declared as JSON")
+
+// ErrJSONTooLarge is returned by DecodeJSON when the body exceeds the body
+// size limit.
+var ErrJSONTooLarge = errors.New("JSON body too large")
+
+// A MalformedJSONError is returned by DecodeJSON when the body is not a
+// single valid JSON value matching the destination.
+type MalformedJSONError struct {
+	Err error
+}
+
+func (mje MalformedJSONError) Error() string {
+	return "malformed JSON body: " + mje.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (mje MalformedJSONError) Unwrap() error {
+	return mje.Err
+}
+
+var errTrailingJSON = errors.New("data after the JSON value")
+
+// DecodeJSON decodes the request body, which must be a single JSON value,
+// into dst, strictly.
+//
+// The request's Content-Type must be application/json, or ErrNotJSON is
+// returned. The body is subject to the body size limit described on
+// LimitBody, and if it goes over ErrJSONTooLarge is returned. Objects may
+// not contain fields that don't exist in dst, and nothing but whitespace
+// may follow the value; these, and all other decoding failures, produce a
+// MalformedJSONError.
+//
+// This is the counterpart to the response writer's WriteJSON.
+func (c *Request) DecodeJSON(dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(c.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return ErrNotJSON
+	}
+	if c.Body == nil {
+		return MalformedJSONError{io.ErrUnexpectedEOF}
+	}
+
+	body := c.Body
+	if limit := c.maxBodySize(); limit >= 0 {
+		if c.ContentLength > limit {
+			return ErrJSONTooLarge
+		}
+		body = http.MaxBytesReader(nil, body, limit)
+	}
+
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(dst)
+	if err == nil {
+		_, err = decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = errTrailingJSON
+		}
+	}
+
+	if IsBodyTooLarge(err) {
+		return ErrJSONTooLarge
+	}
+	return MalformedJSONError{err}
+}
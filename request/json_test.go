@@ -0,0 +1,53 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type decodeTarget struct {
+	Name string `json:"name"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	decode := func(contentType, body string) (decodeTarget, error) {
+		httpReq, _ := http.NewRequest("POST", "http://jerf.org/",
+			strings.NewReader(body))
+		httpReq.Header.Set("Content-Type", contentType)
+		ss := NewSphyraenaState(nil, nil)
+		ss.MaxBodySize = 32
+		req, _ := ss.NewRequest(httptest.NewRecorder(), httpReq, false)
+
+		var target decodeTarget
+		err := req.DecodeJSON(&target)
+		return target, err
+	}
+
+	target, err := decode("application/json; charset=utf-8", ` {"name": "jerf"} `)
+	if err != nil || target.Name != "jerf" {
+		t.Fatal("could not decode valid JSON:", err)
+	}
+
+	if _, err = decode("text/plain", `{"name": "jerf"}`); err != ErrNotJSON {
+		t.Fatal("non-JSON content type accepted:", err)
+	}
+
+	var malformed MalformedJSONError
+	for _, body := range []string{
+		`{"name": "jerf", "admin": true}`,
+		`{"name": "jerf"} {}`,
+		`{"name": `,
+	} {
+		if _, err = decode("application/json", body); !errors.As(err, &malformed) {
+			t.Fatal("malformed JSON accepted:", body, err)
+		}
+	}
+
+	_, err = decode("application/json", `{"name": "`+strings.Repeat("x", 40)+`"}`)
+	if err != ErrJSONTooLarge {
+		t.Fatal("oversized JSON accepted:", err)
+	}
+}
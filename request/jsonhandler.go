@@ -0,0 +1,84 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// A StatusError is an error that carries the HTTP status it should be
+// reported with. Return one from a JSONHandler's function to choose the
+// status of the error response.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (se StatusError) Error() string {
+	return se.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (se StatusError) Unwrap() error {
+	return se.Err
+}
+
+// JSONError is the body a JSONHandler sends for an error.
+type JSONError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// errorStatus maps the given error to the status it should be reported
+// with. Besides StatusError, the errors returned by this package's
+// request body functions are recognized, so they can simply be returned.
+func errorStatus(err error) int {
+	var se StatusError
+	var mje MalformedJSONError
+	var dcte DisallowedContentTypeError
+
+	switch {
+	case errors.As(err, &se):
+		return se.Status
+	case errors.Is(err, ErrJSONTooLarge), errors.Is(err, ErrUploadTooLarge),
+		IsBodyTooLarge(err):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrNotJSON), errors.Is(err, ErrNotMultipart),
+		errors.As(err, &dcte):
+		return http.StatusUnsupportedMediaType
+	case errors.As(err, &mje):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// JSONHandler adapts a function returning a value to be sent as JSON into
+// a Handler.
+//
+// If the function returns a nil error, the value is sent with WriteJSON.
+// Otherwise a JSONError is sent instead. Its status is taken from the
+// error if it is (or wraps) a StatusError, or is derived from the errors
+// returned by DecodeJSON and ParseUpload, and is otherwise a 500. The
+// text of a 500 error is not sent, as it may expose internal details; it
+// is logged to the request's Logger instead.
+//
+// As with WriteJSON, this will panic if the value can not be encoded.
+func JSONHandler(f func(*Request) (interface{}, error)) Handler {
+	return HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *Request) {
+		val, err := f(req)
+		if err == nil {
+			rw.WriteJSON(val)
+			return
+		}
+
+		status := errorStatus(err)
+		msg := err.Error()
+		if status == http.StatusInternalServerError {
+			req.Logger().Info("JSON handler failed",
+				"path", req.URL.Path, "error", msg)
+			msg = http.StatusText(status)
+		}
+		rw.WriteJSONStatus(status, JSONError{status, msg})
+	})
+}
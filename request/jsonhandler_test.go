@@ -0,0 +1,50 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONHandler(t *testing.T) {
+	serve := func(val interface{}, err error) (*httptest.ResponseRecorder, JSONError) {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		rec := httptest.NewRecorder()
+		req, srw := NewSphyraenaState(nil, nil).NewRequest(rec, httpReq, false)
+
+		JSONHandler(func(*Request) (interface{}, error) {
+			return val, err
+		}).ServeStreaming(srw, req)
+		srw.Finish()
+
+		var jerr JSONError
+		_ = json.Unmarshal(rec.Body.Bytes(), &jerr)
+		return rec, jerr
+	}
+
+	rec, _ := serve(map[string]int{"a": 1}, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"a\":1}\n" ||
+		rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("value not written as JSON:", rec.Code, rec.Body.String())
+	}
+
+	rec, jerr := serve(nil, StatusError{http.StatusNotFound, errors.New("no such widget")})
+	if rec.Code != http.StatusNotFound ||
+		jerr != (JSONError{http.StatusNotFound, "no such widget"}) {
+		t.Fatal("StatusError not used:", rec.Code, rec.Body.String())
+	}
+
+	rec, jerr = serve(nil, fmt.Errorf("decoding: %w", MalformedJSONError{errors.New("bad")}))
+	if rec.Code != http.StatusBadRequest || jerr.Status != http.StatusBadRequest {
+		t.Fatal("wrapped DecodeJSON error not mapped:", rec.Code)
+	}
+
+	rec, jerr = serve(nil, errors.New("database password is hunter2"))
+	if rec.Code != http.StatusInternalServerError ||
+		jerr.Error != "Internal Server Error" {
+		t.Fatal("internal error not hidden:", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,91 @@
+package request
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A Catalog provides messages translated into the site's locales, for
+// Request.Localize.
+//
+// Message returns the message for the given key in the given locale, and
+// whether the catalog has one. Keys are whatever symbolic names the site
+// chooses; enticate.MessageKey provides the keys for AuthErrors.
+type Catalog interface {
+	Message(locale, key string) (string, bool)
+}
+
+// A MapCatalog is a Catalog held in memory, mapping locales to keys to
+// messages.
+type MapCatalog map[string]map[string]string
+
+// Message implements Catalog.
+func (mc MapCatalog) Message(locale, key string) (string, bool) {
+	msg, have := mc[locale][key]
+	return msg, have
+}
+
+// Locale returns the locale the response should be rendered in.
+//
+// If the LocaleCookie is set and the request carries that cookie with
+// one of the Locales as its value, that locale is used, as the user has
+// explicitly chosen it. Otherwise, the Locales are negotiated against
+// the Accept-Language header as Negotiate does. If none are acceptable,
+// or the request has no headers to negotiate with, the DefaultLocale is
+// returned.
+//
+// As with Negotiate, the headers consulted are added to the response's
+// Vary header.
+func (c *Request) Locale(rw http.ResponseWriter) string {
+	if len(c.Locales) == 0 || c.Request == nil {
+		return c.defaultLocale()
+	}
+
+	if c.LocaleCookie != "" {
+		// Which locale we negotiate depends on whether the cookie
+		// chose one, so the response varies by both regardless.
+		addVary(rw.Header(), "Cookie")
+		addVary(rw.Header(), "Accept-Language")
+		// This is set by the user, usually from a language picker, so
+		// it can't be authenticated; it may only select one of the
+		// Locales, though.
+		if in := c.Cookies.GetPossiblyUnauthenticated(c.LocaleCookie); in != nil {
+			for _, locale := range c.Locales {
+				if strings.EqualFold(in.Value(), locale) {
+					return locale
+				}
+			}
+		}
+	}
+
+	locale := c.Negotiate(rw, "Accept-Language", c.Locales...)
+	if locale == "" {
+		return c.defaultLocale()
+	}
+	return locale
+}
+
+func (ss *SphyraenaState) defaultLocale() string {
+	if ss.DefaultLocale == "" && len(ss.Locales) > 0 {
+		return ss.Locales[0]
+	}
+	return ss.DefaultLocale
+}
+
+// Localize returns the Catalog's message for the given key in the
+// request's Locale. If the Catalog has no such message, the message in
+// the DefaultLocale is used, and failing that, the given fallback, which
+// is usually the untranslated text, such as an error's Error().
+func (c *Request) Localize(rw http.ResponseWriter, key, fallback string) string {
+	if c.Catalog == nil {
+		return fallback
+	}
+
+	if msg, have := c.Catalog.Message(c.Locale(rw), key); have {
+		return msg
+	}
+	if msg, have := c.Catalog.Message(c.defaultLocale(), key); have {
+		return msg
+	}
+	return fallback
+}
@@ -0,0 +1,68 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLocale(t *testing.T) {
+	state := NewSphyraenaState(nil, nil)
+	state.Locales = []string{"en-US", "de-DE", "fr-FR"}
+	state.LocaleCookie = "lang"
+	state.Catalog = MapCatalog{
+		"en-US": {"greeting": "Hello", "farewell": "Goodbye"},
+		"de-DE": {"greeting": "Hallo"},
+	}
+
+	locale := func(acceptLanguage, cookie string) (*Request, *httptest.ResponseRecorder, string) {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		if acceptLanguage != "" {
+			httpReq.Header.Set("Accept-Language", acceptLanguage)
+		}
+		if cookie != "" {
+			httpReq.Header.Set("Cookie", "lang="+cookie)
+		}
+		rec := httptest.NewRecorder()
+		req, _ := state.NewRequest(rec, httpReq, false)
+		return req, rec, req.Locale(rec)
+	}
+
+	for _, test := range []struct {
+		acceptLanguage, cookie string
+		expected               string
+	}{
+		{"", "", "en-US"},
+		{"de", "", "de-DE"},
+		{"ja", "", "en-US"},
+		{"de", "fr-fr", "fr-FR"},
+		{"de", "ja-JP", "de-DE"},
+	} {
+		_, rec, result := locale(test.acceptLanguage, test.cookie)
+		if result != test.expected {
+			t.Fatalf("%q with cookie %q: got %q, expected %q",
+				test.acceptLanguage, test.cookie, result, test.expected)
+		}
+		if vary := rec.Header().Values("Vary"); len(vary) != 2 ||
+			vary[0] != "Cookie" || vary[1] != "Accept-Language" {
+			t.Fatal("Vary header not set:", rec.Header())
+		}
+	}
+
+	state.DefaultLocale = "de-DE"
+	if _, _, result := locale("ja", ""); result != "de-DE" {
+		t.Fatal("DefaultLocale not used:", result)
+	}
+	state.DefaultLocale = "en-US"
+
+	req, rec, _ := locale("de", "")
+	for key, expected := range map[string]string{
+		"greeting": "Hallo",
+		"farewell": "Goodbye",
+		"missing":  "fallback",
+	} {
+		if msg := req.Localize(rec, key, "fallback"); msg != expected {
+			t.Fatalf("%s: got %q, expected %q", key, msg, expected)
+		}
+	}
+}
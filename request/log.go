@@ -0,0 +1,112 @@
+package request
+
+import "time"
+
+// A Logger receives structured log records, as a message followed by
+// alternating keys and values.
+//
+// This is the same shape as the log/slog package's Info method, so a
+// *slog.Logger can be used directly.
+type Logger interface {
+	Info(msg string, keyvals ...interface{})
+}
+
+// An ErrorLogger is a Logger that can also log records at the error
+// level, as *slog.Logger can.
+//
+// The Logger returned by Request.Logger is always an ErrorLogger. Its
+// Error method uses the Error method of the configured Logger if it has
+// one, and its Info method otherwise.
+type ErrorLogger interface {
+	Logger
+	Error(msg string, keyvals ...interface{})
+}
+
+// requestLogger is the Logger handed out by Request.Logger, which adds
+// the request's method, path and ID to every record.
+type requestLogger struct {
+	Logger
+	req *Request
+}
+
+func (rl requestLogger) Info(msg string, keyvals ...interface{}) {
+	rl.Logger.Info(msg, rl.fields(keyvals)...)
+}
+
+func (rl requestLogger) Error(msg string, keyvals ...interface{}) {
+	if el, isErrorLogger := rl.Logger.(ErrorLogger); isErrorLogger {
+		el.Error(msg, rl.fields(keyvals)...)
+		return
+	}
+	rl.Logger.Info(msg, rl.fields(keyvals)...)
+}
+
+func (rl requestLogger) fields(keyvals []interface{}) []interface{} {
+	return append([]interface{}{
+		"method", rl.req.Method,
+		"path", rl.req.URL.Path,
+		"request_id", rl.req.requestID,
+	}, keyvals...)
+}
+
+func (c *Request) logger() Logger {
+	if c.SphyraenaState == nil || c.SphyraenaState.Logger == nil {
+		return nil
+	}
+	return c.SphyraenaState.Logger
+}
+
+// Logger returns a Logger for handlers to log through, which adds the
+// method, path and RequestID of this request to everything logged. It is
+// an ErrorLogger.
+//
+// If there is no Logger configured, or this request came from a stream,
+// the records are discarded.
+func (c *Request) Logger() Logger {
+	logger := c.logger()
+	if logger == nil || c.Request == nil {
+		return nopLogger{}
+	}
+	return requestLogger{logger, c}
+}
+
+// AddLogFields adds the given alternating keys and values to the record
+// that will be logged for this request once it is complete.
+func (c *Request) AddLogFields(keyvals ...interface{}) {
+	c.logFields = append(c.logFields, keyvals...)
+}
+
+// LogRequest logs the record for this completed request, including the
+// given status and duration, the LogName of the request's identity, its
+// RequestID, and any fields added by AddLogFields.
+//
+// This is called by the router; it normally shouldn't be called by
+// anything else.
+func (c *Request) LogRequest(status int, duration time.Duration) {
+	logger := c.logger()
+	if logger == nil {
+		return
+	}
+
+	user := ""
+	if c.session != nil {
+		if id := c.session.Identity(); id != nil && id.Authentication != nil {
+			user = id.LogName()
+		}
+	}
+
+	logger.Info("request", append([]interface{}{
+		"method", c.Method,
+		"path", c.URL.Path,
+		"status", status,
+		"duration", duration,
+		"user", user,
+		"request_id", c.requestID,
+	}, c.logFields...)...)
+}
+
+type nopLogger struct{}
+
+func (nl nopLogger) Info(string, ...interface{}) {}
+
+func (nl nopLogger) Error(string, ...interface{}) {}
@@ -0,0 +1,120 @@
+package request
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MethodOverrideHeader and MethodOverrideField are where a POST request
+// may carry the method it should be treated as, when the SphyraenaState's
+// MethodOverride is set.
+const (
+	MethodOverrideHeader = "X-HTTP-Method-Override"
+	MethodOverrideField  = "_method"
+)
+
+// overridableMethods are the methods a POST may be overridden to. A POST
+// can never become a GET or HEAD, which are expected to be safe, nor
+// anything unknown.
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// overrideMethod changes the method of a POST request to the one it asks
+// to be treated as, if any, returning the original method.
+func (ss *SphyraenaState) overrideMethod(req *http.Request) string {
+	original := req.Method
+	if !ss.MethodOverride || req.Method != http.MethodPost {
+		return original
+	}
+
+	method := req.Header.Get(MethodOverrideHeader)
+	var form url.Values
+	if method == "" {
+		form = ss.postedForm(req)
+		method = form.Get(MethodOverrideField)
+	}
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if overridableMethods[method] {
+		req.Method = method
+		// net/http only parses the form bodies of some methods, so the
+		// form is supplied to the handler as it was sent.
+		if form != nil {
+			req.PostForm = form
+		}
+	}
+	return original
+}
+
+// postedForm returns the values of a POSTed HTML form, so its
+// MethodOverrideField can be examined, or nil if it isn't one.
+//
+// Only as much of the body as the SphyraenaState's MaxBodySize permits is
+// read; if the form is any larger, its method can't be overridden by the
+// field.
+func (ss *SphyraenaState) postedForm(req *http.Request) url.Values {
+	limit := ss.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	return PeekForm(req, limit)
+}
+
+// PeekForm returns the values of the request's body if it is an HTML form
+// sent as application/x-www-form-urlencoded, or nil if it isn't one, or
+// is larger than the limit. A negative limit means there is none.
+//
+// This is for examining the form before the handler runs. The body is
+// read to find the values, and then restored, so the handler sees it just
+// as it was sent. Bodies of any other type, such as multipart uploads, are
+// left alone entirely.
+func PeekForm(req *http.Request, limit int64) url.Values {
+	if req.Body == nil {
+		return nil
+	}
+	ct, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || ct != "application/x-www-form-urlencoded" {
+		return nil
+	}
+	if limit >= 0 && req.ContentLength > limit {
+		return nil
+	}
+
+	body := req.Body
+	if limit >= 0 {
+		body = ioutil.NopCloser(io.LimitReader(req.Body, limit+1))
+	}
+	buf, err := ioutil.ReadAll(body)
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+	if err != nil || (limit >= 0 && int64(len(buf)) > limit) {
+		return nil
+	}
+
+	values, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+// OriginalMethod returns the method the request was sent with, before
+// any override permitted by the SphyraenaState's MethodOverride.
+func (c *Request) OriginalMethod() string {
+	if c.originalMethod != "" {
+		return c.originalMethod
+	}
+	if c.Request == nil {
+		return ""
+	}
+	return c.Method
+}
@@ -0,0 +1,67 @@
+package request
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMethodOverride(t *testing.T) {
+	state := NewSphyraenaState(nil, nil)
+	send := func(method, header, body string) *Request {
+		httpReq, _ := http.NewRequest(method, "http://jerf.org/items/1",
+			strings.NewReader(body))
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			httpReq.Header.Set(MethodOverrideHeader, header)
+		}
+		req, _ := state.NewRequest(httptest.NewRecorder(), httpReq, false)
+		return req
+	}
+
+	if req := send("POST", "DELETE", "_method=PUT"); req.Method != "POST" {
+		t.Fatal("method overridden without MethodOverride")
+	}
+
+	state.MethodOverride = true
+	for _, test := range []struct {
+		method, header, body string
+		expected             string
+	}{
+		{"POST", "DELETE", "", "DELETE"},
+		{"POST", "", "a=b&_method=put", "PUT"},
+		{"POST", "patch", "_method=PUT", "PATCH"},
+		{"POST", "GET", "", "POST"},
+		{"POST", "", "_method=HEAD", "POST"},
+		{"POST", "CONNECT", "", "POST"},
+		{"GET", "DELETE", "_method=DELETE", "GET"},
+		{"PUT", "DELETE", "", "PUT"},
+	} {
+		req := send(test.method, test.header, test.body)
+		if req.Method != test.expected || req.OriginalMethod() != test.method {
+			t.Fatal("wrong method for", test.method, test.header, test.body,
+				":", req.Method)
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if string(body) != test.body {
+			t.Fatal("body not restored:", string(body))
+		}
+	}
+
+	// a form too large to examine is left alone
+	state.MaxBodySize = 16
+	req := send("POST", "", "_method=DELETE&padding=xxxxxxxx")
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Method != "POST" || string(body) != "_method=DELETE&padding=xxxxxxxx" {
+		t.Fatal("oversized form mishandled:", req.Method, string(body))
+	}
+
+	// a form read by the handler still has the field
+	state.MaxBodySize = 0
+	req = send("POST", "", "_method=DELETE&name=jerf")
+	if req.Method != "DELETE" || req.FormValue("name") != "jerf" {
+		t.Fatal("form not available to the handler")
+	}
+}
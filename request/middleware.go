@@ -0,0 +1,86 @@
+package request
+
+import (
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// A Middleware wraps a Handler in another Handler that adds some behavior
+// before or after it, such as Recover or Timing.
+//
+// Where RouterClauses decide whether and where a request is routed, a
+// Middleware changes how the Handler it reached is run.
+type Middleware func(Handler) Handler
+
+// Wrap returns the handler wrapped in the given middlewares. The first
+// middleware is the outermost, so
+//
+//    Wrap(h, Recover, Timing)
+//
+// is Recover(Timing(h)), and Recover sees everything Timing does.
+func Wrap(h Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Recover is a Middleware that recovers from a panic in the handler,
+// logging it as LogPanic does and sending a 500 in its place.
+//
+// If the handler had already begun its response, it can no longer be
+// replaced with an error, so the panic is only logged. A panic with
+// http.ErrAbortHandler is not recovered; see LogPanic.
+func Recover(next Handler) Handler {
+	return HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *Request) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			LogPanic(req, r)
+			if rw.Status() == 0 {
+				rw.Error(http.StatusInternalServerError,
+					http.StatusText(http.StatusInternalServerError))
+			}
+		}()
+		next.ServeStreaming(rw, req)
+	})
+}
+
+// LogPanic logs the value recovered from a panic in the handler for the
+// request, with its stack trace, at the error level of the request's
+// Logger. Anything recovering from panics in handlers should call this
+// with them.
+//
+// The exception is http.ErrAbortHandler, which a handler panics with to
+// abort its response, as httputil.ReverseProxy does when the upstream
+// response fails part-way. That is panicked with again, rather than
+// logged, so that net/http cuts off the connection instead of finishing
+// the truncated response as though it were complete.
+func LogPanic(req *Request, r interface{}) {
+	if r == http.ErrAbortHandler {
+		panic(r)
+	}
+	req.Logger().(ErrorLogger).Error("handler panicked",
+		"panic", r, "stack", string(debug.Stack()))
+}
+
+// Timing is a Middleware that adds how long the handler took to the
+// request's log record, as the "handler_duration" field.
+//
+// This differs from the duration the router logs for every request in
+// that it excludes the routing, so the two together show where the time
+// went.
+func Timing(next Handler) Handler {
+	return HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *Request) {
+		start := time.Now()
+		defer func() {
+			req.AddLogFields("handler_duration", time.Since(start))
+		}()
+		next.ServeStreaming(rw, req)
+	})
+}
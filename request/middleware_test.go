@@ -0,0 +1,86 @@
+package request
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+func TestMiddleware(t *testing.T) {
+	var log bytes.Buffer
+	serve := func(h Handler) *httptest.ResponseRecorder {
+		log.Reset()
+		state := NewSphyraenaState(nil, nil)
+		state.Logger = slog.New(slog.NewTextHandler(&log, nil))
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		rec := httptest.NewRecorder()
+		req, srw := state.NewRequest(rec, httpReq, false)
+		h.ServeStreaming(srw, req)
+		srw.Finish()
+		req.LogRequest(srw.Status(), 0)
+		return rec
+	}
+
+	var order []string
+	named := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *Request) {
+				order = append(order, name)
+				next.ServeStreaming(rw, req)
+			})
+		}
+	}
+	ok := HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *Request) {
+		_, _ = rw.Write([]byte("ok"))
+	})
+	rec := serve(Wrap(ok, named("outer"), named("inner")))
+	if rec.Body.String() != "ok" || strings.Join(order, ",") != "outer,inner" {
+		t.Fatal("middlewares not applied in order:", order, rec.Body.String())
+	}
+	if serve(Wrap(ok)).Body.String() != "ok" {
+		t.Fatal("Wrap with no middlewares changed the handler")
+	}
+
+	rec = serve(Wrap(HandlerFunc(func(*sphyrw.SphyraenaResponseWriter, *Request) {
+		panic("oops")
+	}), Recover))
+	if rec.Code != http.StatusInternalServerError ||
+		!strings.Contains(log.String(), "level=ERROR") ||
+		!strings.Contains(log.String(), "panic=oops") {
+		t.Fatal("panic not recovered:", rec.Code, log.String())
+	}
+
+	rec = serve(Wrap(HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, _ *Request) {
+		_, _ = rw.Write([]byte("partial"))
+		panic("oops")
+	}), Recover))
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" ||
+		!strings.Contains(log.String(), "handler panicked") {
+		t.Fatal("begun response not left alone:", rec.Code, rec.Body.String())
+	}
+
+	// an aborted response must stay aborted, so it doesn't look complete
+	aborted := func() (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		serve(Wrap(HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, _ *Request) {
+			_, _ = rw.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		}), Recover))
+		return nil
+	}()
+	if aborted != http.ErrAbortHandler {
+		t.Fatal("aborted handler recovered:", aborted)
+	}
+
+	serve(Wrap(ok, Timing))
+	if !strings.Contains(log.String(), "handler_duration=") {
+		t.Fatal("handler duration not logged:", log.String())
+	}
+}
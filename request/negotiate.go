@@ -0,0 +1,160 @@
+package request
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Negotiate chooses the best of the offered values according to the
+// given Accept-style request header, which may be "Accept",
+// "Accept-Encoding", "Accept-Language", or "Accept-Charset". It returns
+// the empty string if none of the offers are acceptable.
+//
+// The offers should be listed in the handler's order of preference, which
+// breaks ties between equal q-values. Each offer is weighted by the most
+// specific range in the header that matches it. If the header is absent,
+// the first offer is returned.
+//
+// Since the response now depends on that header, it is added to the Vary
+// header of the response, if it isn't already there. This happens
+// whatever the outcome, as a different value of the header could have
+// produced a different response.
+//
+// Matching follows the rules of the given header: media ranges such as
+// "text/*" for Accept, prefixes such as "en" matching "en-US" for
+// Accept-Language, and exact matches otherwise. For Accept-Encoding,
+// "identity" is acceptable unless explicitly refused.
+func (c *Request) Negotiate(
+	rw http.ResponseWriter,
+	header string,
+	offers ...string,
+) string {
+	addVary(rw.Header(), header)
+
+	if len(offers) == 0 {
+		return ""
+	}
+	values := c.Header.Values(header)
+	if len(values) == 0 {
+		return offers[0]
+	}
+
+	header = http.CanonicalHeaderKey(header)
+	best := ""
+	bestQ := 0.0
+	for _, offer := range offers {
+		q := offerQuality(header, values, offer)
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// offerQuality returns the q-value the header values give the offer.
+func offerQuality(header string, values []string, offer string) float64 {
+	q := -1.0
+	specificity := -1
+	for _, value := range values {
+		for value != "" {
+			var element string
+			if comma := strings.IndexByte(value, ','); comma >= 0 {
+				element, value = value[:comma], value[comma+1:]
+			} else {
+				element, value = value, ""
+			}
+
+			rng, elementQ := parseElement(element)
+			if rng == "" {
+				continue
+			}
+			s := rangeSpecificity(header, rng, offer)
+			if s > specificity {
+				q, specificity = elementQ, s
+			}
+		}
+	}
+
+	if specificity < 0 {
+		if header == "Accept-Encoding" && strings.EqualFold(offer, "identity") {
+			return 0.001
+		}
+		return 0
+	}
+	return q
+}
+
+// parseElement splits a single header element like "text/html;q=0.5"
+// into its range and q-value.
+func parseElement(element string) (string, float64) {
+	q := 1.0
+	rng := element
+	if semi := strings.IndexByte(element, ';'); semi >= 0 {
+		rng = element[:semi]
+		params := element[semi+1:]
+		for params != "" {
+			var param string
+			if next := strings.IndexByte(params, ';'); next >= 0 {
+				param, params = params[:next], params[next+1:]
+			} else {
+				param, params = params, ""
+			}
+			param = strings.TrimSpace(param)
+			if len(param) > 2 && (param[0] == 'q' || param[0] == 'Q') && param[1] == '=' {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil && parsed >= 0 && parsed <= 1 {
+					q = parsed
+				}
+			}
+		}
+	}
+	return strings.TrimSpace(rng), q
+}
+
+// rangeSpecificity returns how specifically the range matches the offer,
+// with higher being more specific, or -1 if it doesn't match at all.
+func rangeSpecificity(header, rng, offer string) int {
+	if rng == "*" {
+		return 0
+	}
+
+	switch header {
+	case "Accept":
+		if rng == "*/*" {
+			return 0
+		}
+		if strings.HasSuffix(rng, "/*") {
+			prefix := rng[:len(rng)-1]
+			if len(offer) > len(prefix) &&
+				strings.EqualFold(offer[:len(prefix)], prefix) {
+				return 1
+			}
+			return -1
+		}
+	case "Accept-Language":
+		if len(offer) > len(rng) && offer[len(rng)] == '-' &&
+			strings.EqualFold(offer[:len(rng)], rng) {
+			return len(rng)
+		}
+	}
+
+	if strings.EqualFold(rng, offer) {
+		return len(rng) + 1
+	}
+	return -1
+}
+
+// addVary adds the given header name to the Vary header, unless it is
+// already covered.
+func addVary(h http.Header, header string) {
+	for _, vary := range h.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, header) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", http.CanonicalHeaderKey(header))
+}
@@ -0,0 +1,51 @@
+package request
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	negotiate := func(header, value string, offers ...string) (string, http.Header) {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		if value != "" {
+			httpReq.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		req, _ := NewSphyraenaState(nil, nil).NewRequest(rec, httpReq, false)
+		return req.Negotiate(rec, header, offers...), rec.Header()
+	}
+
+	for _, test := range []struct {
+		header, value string
+		offers        []string
+		expected      string
+	}{
+		{"Accept", "", []string{"text/html", "application/json"}, "text/html"},
+		{"Accept", "application/json", []string{"text/html", "application/json"}, "application/json"},
+		{"Accept", "text/*;q=0.5, application/json;q=0.4", []string{"application/json", "text/html"}, "text/html"},
+		{"Accept", "*/*;q=0.1, text/html;q=0", []string{"text/html", "text/plain"}, "text/plain"},
+		{"Accept", "image/png", []string{"text/html"}, ""},
+		{"Accept-Language", "en;q=0.8, de", []string{"en-US", "de-DE"}, "de-DE"},
+		{"Accept-Language", "en-GB, en;q=0.5", []string{"en-US", "en-GB"}, "en-GB"},
+		{"Accept-Encoding", "gzip", []string{"br", "identity"}, "identity"},
+		{"Accept-Encoding", "gzip, identity;q=0", []string{"br", "identity"}, ""},
+		{"Accept-Encoding", "br;q=0.9, gzip", []string{"br", "gzip"}, "gzip"},
+	} {
+		result, header := negotiate(test.header, test.value, test.offers...)
+		if result != test.expected {
+			t.Fatalf("%s: %q offered %v: got %q, expected %q", test.header,
+				test.value, test.offers, result, test.expected)
+		}
+		if header.Get("Vary") != test.header {
+			t.Fatal("Vary header not set:", header)
+		}
+	}
+
+	vary := http.Header{"Vary": []string{"Accept-Encoding, accept"}}
+	addVary(vary, "Accept")
+	if len(vary["Vary"]) != 1 {
+		t.Fatal("Vary header duplicated:", vary)
+	}
+}
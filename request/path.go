@@ -0,0 +1,48 @@
+package request
+
+import (
+	"errors"
+	"strings"
+)
+
+// DefaultMaxPathLength and DefaultMaxPathSegments are the limits on the
+// URL path of requests when the SphyraenaState doesn't specify its own.
+// They are far beyond any path a site should be using, but bound the work
+// the router can be made to do for one request.
+const (
+	DefaultMaxPathLength   = 8 << 10
+	DefaultMaxPathSegments = 256
+)
+
+// ErrPathTooLong and ErrTooManyPathSegments are returned by CheckPath for
+// paths beyond the SphyraenaState's limits.
+var (
+	ErrPathTooLong         = errors.New("request path too long")
+	ErrTooManyPathSegments = errors.New("too many request path segments")
+)
+
+// CheckPath returns an error if the given URL path exceeds the
+// SphyraenaState's MaxPathLength or MaxPathSegments, or nil if it
+// doesn't. The router checks this before routing a request, and refuses
+// it with a 414 URI Too Long.
+//
+// The segments are counted by the slashes in the path, so "/a/b" and
+// "/a/b/" have two and three, respectively.
+func (ss *SphyraenaState) CheckPath(path string) error {
+	maxLength := ss.MaxPathLength
+	if maxLength == 0 {
+		maxLength = DefaultMaxPathLength
+	}
+	maxSegments := ss.MaxPathSegments
+	if maxSegments == 0 {
+		maxSegments = DefaultMaxPathSegments
+	}
+
+	if maxLength > 0 && len(path) > maxLength {
+		return ErrPathTooLong
+	}
+	if maxSegments > 0 && strings.Count(path, "/") > maxSegments {
+		return ErrTooManyPathSegments
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package request
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// maxRequestIDLength is the longest request ID accepted from the
+// SphyraenaState's RequestIDHeader.
+const maxRequestIDLength = 128
+
+// newRequestID returns a new random request ID. It is random rather than
+// sequential so that it reveals nothing about how many requests the
+// server is handling.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic("can't generate request ID: " + err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// acceptableRequestID returns whether a request ID received from a
+// trusted proxy is safe to log and to forward in a header.
+func acceptableRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID for a new request, taken from the trusted
+// RequestIDHeader if there is one and it is acceptable, or else newly
+// generated.
+func (ss *SphyraenaState) requestID(header func(string) string) string {
+	if ss != nil && ss.RequestIDHeader != "" {
+		id := header(ss.RequestIDHeader)
+		if acceptableRequestID(id) {
+			return id
+		}
+	}
+	return newRequestID()
+}
+
+// RequestID returns the ID of this request, which correlates everything
+// logged about it, including by what it is forwarded to. It is opaque;
+// nothing should be assumed about its contents.
+//
+// HTTP requests are given IDs by the SphyraenaState, as described by its
+// RequestIDHeader. Requests made over a stream are given their own.
+func (c *Request) RequestID() string {
+	return c.requestID
+}
@@ -0,0 +1,59 @@
+package request
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	state := NewSphyraenaState(nil, nil)
+	state.Logger = slog.New(slog.NewTextHandler(&buf, nil))
+	newRequest := func(header string) *Request {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		if header != "" {
+			httpReq.Header.Set("X-Request-ID", header)
+		}
+		req, _ := state.NewRequest(httptest.NewRecorder(), httpReq, false)
+		return req
+	}
+
+	first, second := newRequest("").RequestID(), newRequest("").RequestID()
+	if first == "" || first == second {
+		t.Fatal("request IDs not unique:", first, second)
+	}
+	if newRequest("proxy-id").RequestID() == "proxy-id" {
+		t.Fatal("request ID accepted from an untrusted header")
+	}
+
+	state.RequestIDHeader = "X-Request-ID"
+	req := newRequest("proxy-id")
+	if req.RequestID() != "proxy-id" {
+		t.Fatal("request ID not accepted from the trusted header:", req.RequestID())
+	}
+	for _, bad := range []string{"has space", "new\nline", strings.Repeat("a", 129)} {
+		if id := newRequest(bad).RequestID(); id == bad || id == "" {
+			t.Fatal("unacceptable request ID accepted:", bad)
+		}
+	}
+
+	req.Logger().Info("handler record")
+	req.LogRequest(200, 0)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("wrong number of records:", buf.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, " request_id=proxy-id") {
+			t.Fatal("request ID not logged:", line)
+		}
+	}
+
+	if streamed := FromStream(nil, nil, nil); streamed.RequestID() == "" {
+		t.Fatal("request from a stream has no ID")
+	}
+}
@@ -0,0 +1,42 @@
+package request
+
+import "strings"
+
+// Scheme returns the scheme the client used to make the request, "https"
+// or "http".
+//
+// Behind a TLS-terminating proxy, the connection Sphyraena sees is always
+// plain HTTP. If the SphyraenaState's ForwardedProtoHeader is set, the
+// proxy's claim in that header is believed; if the proxy appended to an
+// existing header, the last value, which is the one it added, is used.
+func (c *Request) Scheme() string {
+	if c.Request.TLS != nil {
+		return "https"
+	}
+	if c.SphyraenaState == nil || c.ForwardedProtoHeader == "" {
+		return "http"
+	}
+
+	values := c.Header.Values(c.ForwardedProtoHeader)
+	if len(values) == 0 {
+		return "http"
+	}
+	protos := strings.Split(values[len(values)-1], ",")
+	if strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+// IsTLS returns whether the client made the request over TLS, as
+// determined by Scheme.
+func (c *Request) IsTLS() bool {
+	return c.Scheme() == "https"
+}
+
+// SecureCookiesWork returns whether a Secure cookie set in the response
+// to this request will be kept by the browser, which it will only do for
+// a request the client made over TLS.
+func (c *Request) SecureCookiesWork() bool {
+	return c.IsTLS()
+}
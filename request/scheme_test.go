@@ -0,0 +1,44 @@
+package request
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScheme(t *testing.T) {
+	state := NewSphyraenaState(nil, nil)
+	scheme := func(overTLS bool, protos ...string) string {
+		httpReq, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		for _, proto := range protos {
+			httpReq.Header.Add("X-Forwarded-Proto", proto)
+		}
+		if overTLS {
+			httpReq.TLS = &tls.ConnectionState{}
+		}
+		req, _ := state.NewRequest(httptest.NewRecorder(), httpReq, false)
+		return req.Scheme()
+	}
+
+	if scheme(false) != "http" || scheme(true) != "https" {
+		t.Fatal("real connection scheme not used")
+	}
+	if scheme(false, "https") != "http" {
+		t.Fatal("forwarded header trusted by default")
+	}
+
+	state.ForwardedProtoHeader = "X-Forwarded-Proto"
+	if scheme(false, "https") != "https" || scheme(false, "HTTPS") != "https" {
+		t.Fatal("trusted forwarded header ignored")
+	}
+	if scheme(false, "https, http") != "http" || scheme(false, "http", "https") != "https" {
+		t.Fatal("value added by the proxy not used")
+	}
+	if scheme(false, "http") != "http" || scheme(false) != "http" {
+		t.Fatal("plain request considered TLS")
+	}
+	if scheme(true, "http") != "https" {
+		t.Fatal("real TLS connection overridden")
+	}
+}
@@ -0,0 +1,169 @@
+package request
+
+import (
+	"strings"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+)
+
+// A SessionTransport carries the session ID between the client and
+// Sphyraena, such as in a cookie or a header.
+//
+// SessionID returns the session ID the request carries, if any. It is
+// only a claim; the authentication clauses still look it up with the
+// SessionServer, which rejects IDs it did not issue.
+//
+// Issue sends the given session's ID to the client with the response to
+// the given request.
+// The cookie options are those the authentication clause was configured
+// with, already passed through CookieOptions; transports that don't use
+// cookies ignore them. Clear tells the client to discard the session ID,
+// as on logout.
+type SessionTransport interface {
+	SessionID(*Request) (session.SessionID, bool)
+	Issue(*Request, SessionResponse, session.Session, ...cookie.Option) error
+	Clear(*Request, SessionResponse, ...cookie.Option) error
+}
+
+// A SessionResponse is what a SessionTransport sends the session ID to
+// the client through. A router.Request is one, adding to the response
+// only if the routing goes through the clause that issued the session. A
+// SphyraenaResponseWriter can be used through WriterSessionResponse.
+type SessionResponse interface {
+	AddHeader(key, value string)
+	AddCookie(*cookie.OutCookie)
+}
+
+// WriterSessionResponse returns a SessionResponse that adds directly to
+// the given response.
+func WriterSessionResponse(rw *sphyrw.SphyraenaResponseWriter) SessionResponse {
+	return writerSessionResponse{rw}
+}
+
+type writerSessionResponse struct {
+	rw *sphyrw.SphyraenaResponseWriter
+}
+
+func (wsr writerSessionResponse) AddHeader(key, value string) {
+	wsr.rw.Header().Add(key, value)
+}
+
+func (wsr writerSessionResponse) AddCookie(c *cookie.OutCookie) {
+	wsr.rw.SetCookie(c)
+}
+
+// CookieSessionTransport carries the session ID in the authenticated
+// session cookie, named by SphyraenaState.SessionCookieName. It is the
+// default SessionTransport.
+type CookieSessionTransport struct{}
+
+// SessionID implements SessionTransport.
+func (CookieSessionTransport) SessionID(req *Request) (session.SessionID, bool) {
+	c := req.Cookies.Get(req.SessionCookieName())
+	if c == nil {
+		return session.NoSessionID, false
+	}
+	return session.SessionID(c.Value()), true
+}
+
+// Issue implements SessionTransport.
+func (CookieSessionTransport) Issue(
+	req *Request,
+	sr SessionResponse,
+	s session.Session,
+	options ...cookie.Option,
+) error {
+	hasID, sessionID := s.SessionID()
+	if !hasID {
+		return nil
+	}
+	c, err := cookie.NewOut(req.SessionCookieName(), string(sessionID), s, options...)
+	if err != nil {
+		return err
+	}
+	sr.AddCookie(c)
+	return nil
+}
+
+// Clear implements SessionTransport, deleting the session cookie.
+func (CookieSessionTransport) Clear(
+	req *Request,
+	sr SessionResponse,
+	options ...cookie.Option,
+) error {
+	deleteOptions := append(append([]cookie.Option{}, options...), cookie.Delete)
+	c, err := cookie.NewOut(req.SessionCookieName(), "", nil, deleteOptions...)
+	if err != nil {
+		return err
+	}
+	sr.AddCookie(c)
+	return nil
+}
+
+// HeaderSessionTransport carries the session ID in a request header,
+// for API clients that would rather not manage cookies.
+//
+// The client sends the session ID in the Header. If the Scheme is set,
+// the header must instead consist of the Scheme, a space, and the session
+// ID, so that the Authorization header can be used, as in
+// "Authorization: Session <id>".
+//
+// The session ID is issued to the client in the ResponseHeader, or the
+// Header if that is empty; as "Authorization" makes no sense as a
+// response header, set a ResponseHeader when using it. As the client
+// holds the session ID itself, Clear does nothing; the client should
+// discard it when it logs out or the session is refused.
+//
+// Unlike the session cookie, the session ID is sent bare, so as with
+// BearerAuth, this should only be used over HTTPS.
+type HeaderSessionTransport struct {
+	Header         string
+	Scheme         string
+	ResponseHeader string
+}
+
+// SessionID implements SessionTransport.
+func (hst HeaderSessionTransport) SessionID(req *Request) (session.SessionID, bool) {
+	if req.Request == nil {
+		return session.NoSessionID, false
+	}
+	value := strings.TrimSpace(req.Header.Get(hst.Header))
+	if hst.Scheme != "" {
+		prefix := hst.Scheme + " "
+		if len(value) <= len(prefix) ||
+			!strings.EqualFold(value[:len(prefix)], prefix) {
+			return session.NoSessionID, false
+		}
+		value = strings.TrimSpace(value[len(prefix):])
+	}
+	if value == "" {
+		return session.NoSessionID, false
+	}
+	return session.SessionID(value), true
+}
+
+// Issue implements SessionTransport.
+func (hst HeaderSessionTransport) Issue(
+	_ *Request,
+	sr SessionResponse,
+	s session.Session,
+	_ ...cookie.Option,
+) error {
+	hasID, sessionID := s.SessionID()
+	if !hasID {
+		return nil
+	}
+	header := hst.ResponseHeader
+	if header == "" {
+		header = hst.Header
+	}
+	sr.AddHeader(header, string(sessionID))
+	return nil
+}
+
+// Clear implements SessionTransport, and does nothing.
+func (hst HeaderSessionTransport) Clear(*Request, SessionResponse, ...cookie.Option) error {
+	return nil
+}
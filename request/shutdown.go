@@ -0,0 +1,79 @@
+package request
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// Shutdown gracefully shuts down the streaming side of Sphyraena.
+//
+// Once this is called, ShuttingDown returns true, which the router uses to
+// refuse new requests, and the channel returned by ShutdownStarted is
+// closed. Every stream held by the SessionServer is then closed, which
+// tells the external stream to close its connection to the user, and
+// this waits for the streams to terminate.
+//
+// If the context is done before all the streams have terminated, the
+// context's error is returned. The streams have all still been told to
+// close.
+//
+// Streams can only be found if the SessionServer is a
+// session.StreamEnumerator; otherwise this only stops new requests.
+//
+// This does not stop the http.Server; call its own Shutdown first, so
+// that in-flight HTTP requests finish, then this.
+func (ss *SphyraenaState) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&ss.shuttingDown, 0, 1) {
+		close(ss.shutdownChan())
+	}
+
+	enumerator, canEnumerate := ss.SessionServer.(session.StreamEnumerator)
+	if !canEnumerate {
+		return nil
+	}
+
+	streams := enumerator.Streams()
+	for _, stream := range streams {
+		// Close can block until the stream gets around to it, which must
+		// not hold up honoring the context. ErrClosed just means it's
+		// already on its way down.
+		go func(stream *strest.Stream) {
+			_ = stream.Close()
+		}(stream)
+	}
+
+	for _, stream := range streams {
+		select {
+		case <-stream.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// ShuttingDown returns whether Shutdown has been called.
+func (ss *SphyraenaState) ShuttingDown() bool {
+	return atomic.LoadInt32(&ss.shuttingDown) == 1
+}
+
+// ShutdownStarted returns a channel that is closed once Shutdown has been
+// called. The requests arriving on streams have contexts that are done
+// once it is, as the contexts of HTTP requests are done once the
+// http.Server shuts down.
+func (ss *SphyraenaState) ShutdownStarted() <-chan struct{} {
+	return ss.shutdownChan()
+}
+
+func (ss *SphyraenaState) shutdownChan() chan struct{} {
+	ss.shutdownLock.Lock()
+	defer ss.shutdownLock.Unlock()
+	if ss.shutdownStarted == nil {
+		ss.shutdownStarted = make(chan struct{})
+	}
+	return ss.shutdownStarted
+}
@@ -0,0 +1,126 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// SimpleStreamHandler returns a StreamHandler that runs the given function
+// on a bidirectional substream, taking care of the substream's lifecycle.
+//
+// The substream is created and the StreamResponse issued before the
+// function is called; if the substream can't be created, the function is
+// not called and the error is returned as the StreamResponse instead.
+//
+// send sends a message to the user. It returns strest.ErrClosed once the
+// user has closed the substream, the stream has gone away, or the function
+// has returned. recv carries the JSON of each message the user sends, and
+// is closed when the user closes the substream or the stream goes away.
+// Neither need be drained by the function.
+//
+// When the function returns, the substream is closed. If it returned an
+// error, the user is first sent a *StreamError describing it; an error
+// that already is, or wraps, a *StreamError is sent as-is, anything else
+// is sent with the Code "error" and the error's text as the Message.
+func SimpleStreamHandler(
+	f func(send func(interface{}) error, recv <-chan json.RawMessage) error,
+) StreamHandler {
+	return StreamHandlerFunc(func(req *Request) {
+		s, err := req.Substream()
+		if err != nil {
+			req.StreamResponse(StreamRequestResult{
+				Error:     err.Error(),
+				ErrorCode: http.StatusInternalServerError,
+			})
+			return
+		}
+		req.StreamResponse(StreamRequestResult{SubstreamID: s.SubstreamID()})
+
+		incoming, eventsToUser := s.RawChans()
+		recv := make(chan json.RawMessage)
+		// gone is closed by the pump when the user's side is closed, and
+		// finished by us when f returns. Between the two, every send
+		// also has the pump listening on incoming, as RawChans requires.
+		gone := make(chan struct{})
+		finished := make(chan struct{})
+		pumpDone := make(chan struct{})
+
+		go func() {
+			defer close(pumpDone)
+			for {
+				select {
+				case msg, ok := <-incoming:
+					if !ok {
+						close(gone)
+						close(recv)
+						return
+					}
+					select {
+					case recv <- msg.JSON:
+					case <-finished:
+						return
+					}
+				case <-finished:
+					return
+				}
+			}
+		}()
+
+		send := func(msg interface{}) error {
+			select {
+			case <-finished:
+				return strest.ErrClosed
+			case <-gone:
+				return strest.ErrClosed
+			default:
+			}
+			select {
+			case eventsToUser <- s.Message(msg):
+				return nil
+			case <-gone:
+				return strest.ErrClosed
+			case <-finished:
+				return strest.ErrClosed
+			}
+		}
+
+		var fErr error
+		defer func() {
+			close(finished)
+			<-pumpDone
+
+			if fErr != nil {
+				sendStreamError(s, fErr)
+			}
+			// This drains anything else the user sends until the close
+			// is accepted; ErrClosed just means the user beat us to it.
+			_ = s.Close()
+		}()
+
+		fErr = f(send, recv)
+	})
+}
+
+// sendStreamError sends the given error to the user as a *StreamError,
+// discarding anything the user sends in the meantime.
+func sendStreamError(s *strest.Substream, err error) {
+	var se *StreamError
+	if !errors.As(err, &se) {
+		se = &StreamError{Code: "error", Message: err.Error()}
+	}
+
+	incoming, eventsToUser := s.RawChans()
+	for {
+		select {
+		case eventsToUser <- s.Message(se):
+			return
+		case _, ok := <-incoming:
+			if !ok {
+				return
+			}
+		}
+	}
+}
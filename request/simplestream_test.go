@@ -0,0 +1,88 @@
+package request
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/thejerf/sphyraena/strest"
+	"github.com/thejerf/sphyraena/strest/streamtest"
+)
+
+func startSimple(
+	t *testing.T,
+	f func(func(interface{}) error, <-chan json.RawMessage) error,
+) (*strest.Stream, *streamtest.ExternalStream, strest.SubstreamID, chan struct{}) {
+	t.Helper()
+
+	stream, es := streamtest.NewStream()
+	responded := make(chan StreamRequestResult, 1)
+	req := FromStream(nil, stream, func(srr StreamRequestResult) {
+		responded <- srr
+	})
+
+	returned := make(chan struct{})
+	go func() {
+		SimpleStreamHandler(f).HandleStream(req)
+		close(returned)
+	}()
+
+	srr := <-responded
+	if srr.Error != "" || srr.SubstreamID == 0 {
+		t.Fatal("unexpected stream response:", srr)
+	}
+	return stream, es, srr.SubstreamID, returned
+}
+
+func TestSimpleStreamHandlerEcho(t *testing.T) {
+	stream, es, id, returned := startSimple(t,
+		func(send func(interface{}) error, recv <-chan json.RawMessage) error {
+			for msg := range recv {
+				var s string
+				if err := json.Unmarshal(msg, &s); err != nil {
+					return err
+				}
+				if err := send(s + "!"); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	defer stream.Close()
+
+	_ = es.Send(id, "echo", "hello")
+	es.Expect(t, id, "hello!")
+
+	es.CloseSubstream(id)
+	<-returned
+}
+
+func TestSimpleStreamHandlerError(t *testing.T) {
+	stream, es, id, returned := startSimple(t,
+		func(send func(interface{}) error, recv <-chan json.RawMessage) error {
+			if err := send("starting"); err != nil {
+				return err
+			}
+			// recv is deliberately never drained.
+			return errors.New("failed")
+		})
+	defer stream.Close()
+
+	es.Expect(t, id, "starting")
+	<-returned
+	es.Expect(t, id, &StreamError{Code: "error", Message: "failed"})
+	es.ExpectClose(t, id)
+}
+
+func TestSimpleStreamHandlerStreamError(t *testing.T) {
+	se := &StreamError{Code: "busy", Message: "try later", Retryable: true}
+	stream, es, id, returned := startSimple(t,
+		func(func(interface{}) error, <-chan json.RawMessage) error {
+			return se
+		})
+	defer stream.Close()
+
+	<-returned
+	es.Expect(t, id, se)
+	es.ExpectClose(t, id)
+}
@@ -1,9 +1,9 @@
 package request
 
 import (
-	"fmt"
+	"log/slog"
 
-	"github.com/davecgh/go-spew/spew"
+	"github.com/thejerf/sphyraena/logging"
 	"github.com/thejerf/sphyraena/strest"
 )
 
@@ -13,6 +13,39 @@ type StreamRequestResult struct {
 	SubstreamID strest.SubstreamID `json:"substream_id,omitempty"`
 	Error       string             `json:"error,omitempty"`
 	ErrorCode   int                `json:"error_code,omitempty"`
+
+	// ErrorDetail optionally describes the error in a form the client
+	// can act on, as a JSON API would in its error responses.
+	ErrorDetail *StreamError `json:"error_detail,omitempty"`
+}
+
+// A StreamError is a structured description of why a streaming request
+// failed, sent to the client in the StreamRequestResult.
+//
+// Code is a symbolic code for the client to switch on, such as
+// "validation_failed". Message is the human-readable description. Details
+// carries anything further, such as the error for each invalid field.
+// Retryable tells the client the same request may succeed later.
+type StreamError struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	Retryable bool                   `json:"retryable,omitempty"`
+}
+
+func (se *StreamError) Error() string {
+	return se.Message
+}
+
+// Result returns the StreamRequestResult reporting this error with the
+// given status, for passing to Request.StreamResponse. The Error is set
+// to the Message, for clients that don't look at the ErrorDetail.
+func (se *StreamError) Result(status int) StreamRequestResult {
+	return StreamRequestResult{
+		Error:       se.Message,
+		ErrorCode:   status,
+		ErrorDetail: se,
+	}
 }
 
 // A StreamHandler implements something that returns a stream handler, and
@@ -21,6 +54,47 @@ type StreamHandler interface {
 	HandleStream(*Request)
 }
 
+// A Describer is a StreamHandler that can describe what it supports, so
+// generic clients can discover it before opening a stream. See
+// StreamDescription.
+type Describer interface {
+	Describe() StreamDescription
+}
+
+// A StreamDescription is the capability document describing a stream
+// endpoint, sent to a client that asks for it without opening a stream.
+//
+// Bidirectional indicates that the handler accepts events from the user
+// as well as sending them. Sends and Receives list the types of the
+// messages the handler sends and accepts, in whatever terms the handler
+// documents its messages in, such as their "type" fields. Description is
+// a human-readable description of the stream.
+//
+// Handlers that don't implement Describer are described by
+// DefaultStreamDescription, which only claims that a stream is available.
+type StreamDescription struct {
+	Streaming     bool     `json:"streaming"`
+	Bidirectional bool     `json:"bidirectional,omitempty"`
+	Sends         []string `json:"sends,omitempty"`
+	Receives      []string `json:"receives,omitempty"`
+	Description   string   `json:"description,omitempty"`
+}
+
+// DefaultStreamDescription is the StreamDescription of a StreamHandler
+// that doesn't describe itself.
+var DefaultStreamDescription = StreamDescription{Streaming: true}
+
+// DescribeStreamHandler returns the StreamDescription of the given
+// StreamHandler.
+func DescribeStreamHandler(sh StreamHandler) StreamDescription {
+	if describer, isDescriber := sh.(Describer); isDescriber {
+		description := describer.Describe()
+		description.Streaming = true
+		return description
+	}
+	return DefaultStreamDescription
+}
+
 type StreamHandlerFunc func(*Request)
 
 func (shf StreamHandlerFunc) HandleStream(req *Request) {
@@ -31,11 +105,19 @@ func (shf StreamHandlerFunc) HandleStream(req *Request) {
 
 func (c *Request) getStream() (*strest.Stream, error) {
 	if c.currentStream == nil {
-		fmt.Printf("Getting stream from session of type %T\n", c.session)
 		stream, err := c.session.NewStream()
 		if err != nil {
 			return nil, err
 		}
+		err = stream.SetMetrics(c.Metrics())
+		if err != nil {
+			return nil, err
+		}
+		err = stream.SetLogger(logging.DefaultWith(slog.LevelError,
+			"request_id", c.requestID))
+		if err != nil {
+			return nil, err
+		}
 
 		c.currentStream = stream
 	}
@@ -50,12 +132,8 @@ func (c *Request) StreamID() (strest.StreamID, error) {
 	if err != nil {
 		return strest.StreamID(""), err
 	}
-	streamID := []byte(string(s.ID()))
-	authedStreamID, err := c.session.Authenticate(streamID)
-	if err != nil {
-		return strest.StreamID(""), err
-	}
-	return strest.StreamID(string(authedStreamID)), nil
+	// The session signs the stream's ID when it creates the stream.
+	return s.ID(), nil
 }
 
 // FIXME: This should issue the StreamResponse automatically
@@ -84,8 +162,6 @@ func (c *Request) Substream() (*strest.Substream, error) {
 		return nil, err
 	}
 
-	fmt.Println("****\n****\n*****\n\n*******")
 	ss, err := stream.Substream()
-	spew.Dump(ss)
 	return ss, err
 }
@@ -0,0 +1,185 @@
+package request
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// DefaultUploadMemory is how much of an upload is held in memory when the
+// UploadOptions do not specify; the rest is spooled to temporary files.
+const DefaultUploadMemory = 1 << 20
+
+// ErrNotMultipart is returned by ParseUpload when the request is not a
+// multipart/form-data POST or PUT.
+var ErrNotMultipart = errors.New("request is not a multipart form")
+
+// ErrUploadTooLarge is returned by ParseUpload when the upload exceeds its
+// maximum size.
+var ErrUploadTooLarge = errors.New("upload too large")
+
+// A DisallowedContentTypeError is returned by ParseUpload when a file is
+// declared to have a content type not in the allowed list.
+type DisallowedContentTypeError struct {
+	Field       string
+	ContentType string
+}
+
+func (dcte DisallowedContentTypeError) Error() string {
+	return fmt.Sprintf("file in field %q has disallowed content type %q",
+		dcte.Field, dcte.ContentType)
+}
+
+// UploadOptions configures ParseUpload.
+type UploadOptions struct {
+	// MaxMemory is how many bytes of the upload may be held in memory,
+	// with the rest spooled to temporary files. If zero,
+	// DefaultUploadMemory is used.
+	MaxMemory int64
+
+	// MaxSize is the maximum size of the entire request body. If zero,
+	// the body size limit of the route is used, as described on
+	// LimitBody. Nothing beyond this is ever read, in memory or on disk.
+	MaxSize int64
+
+	// AllowedContentTypes lists the content types that files may be
+	// declared as, such as "image/png". An entry may also be of the form
+	// "image/*". Comparison ignores case and parameters.
+	//
+	// If this is empty, no files are permitted at all.
+	AllowedContentTypes []string
+}
+
+func (uo UploadOptions) allows(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range uo.AllowedContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") &&
+			strings.HasPrefix(mediaType, allowed[:len(allowed)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// An Upload is a parsed multipart form, as returned by ParseUpload.
+//
+// Close must be called once the files are no longer needed, to remove any
+// temporary files.
+type Upload struct {
+	// Values are the non-file values of the form.
+	Values url.Values
+
+	// Files are the uploaded files, by form field name.
+	Files map[string][]*UploadedFile
+
+	form *multipart.Form
+}
+
+// Close removes any temporary files backing the Upload.
+func (u *Upload) Close() error {
+	return u.form.RemoveAll()
+}
+
+// An UploadedFile is a single file from an Upload.
+//
+// The Filename and ContentType are as the client declared them, and
+// should be treated as untrusted. The Filename has had any directory
+// components removed, but is otherwise unchecked; do not use it to name a
+// file on disk.
+type UploadedFile struct {
+	Field       string
+	Filename    string
+	ContentType string
+	Size        int64
+
+	fh *multipart.FileHeader
+}
+
+// Open opens the file's contents for reading.
+func (uf *UploadedFile) Open() (io.ReadCloser, error) {
+	return uf.fh.Open()
+}
+
+// ParseUpload parses the request as a multipart form, within the limits
+// given by the options.
+//
+// This reads the request body, so it may be called only once, and not
+// along with ParseForm or ParseMultipartForm.
+//
+// If the body exceeds the maximum size, ErrUploadTooLarge is returned. If
+// a file is declared with a content type that is not allowed, a
+// DisallowedContentTypeError is returned. In either case, nothing is left
+// on disk.
+func (c *Request) ParseUpload(options UploadOptions) (*Upload, error) {
+	if c.Method != http.MethodPost && c.Method != http.MethodPut {
+		return nil, ErrNotMultipart
+	}
+	mediaType, _, err := mime.ParseMediaType(c.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return nil, ErrNotMultipart
+	}
+
+	maxSize := options.MaxSize
+	if maxSize == 0 {
+		maxSize = c.maxBodySize()
+	}
+	if maxSize >= 0 {
+		if c.ContentLength > maxSize {
+			return nil, ErrUploadTooLarge
+		}
+		c.Body = http.MaxBytesReader(nil, c.Body, maxSize)
+	}
+
+	reader, err := c.MultipartReader()
+	if err != nil {
+		return nil, ErrNotMultipart
+	}
+	maxMemory := options.MaxMemory
+	if maxMemory == 0 {
+		maxMemory = DefaultUploadMemory
+	}
+	form, err := reader.ReadForm(maxMemory)
+	if err != nil {
+		if IsBodyTooLarge(err) || errors.Is(err, multipart.ErrMessageTooLarge) {
+			return nil, ErrUploadTooLarge
+		}
+		return nil, err
+	}
+
+	upload := &Upload{
+		Values: url.Values(form.Value),
+		Files:  map[string][]*UploadedFile{},
+		form:   form,
+	}
+	for field, fileHeaders := range form.File {
+		for _, fh := range fileHeaders {
+			contentType := fh.Header.Get("Content-Type")
+			if !options.allows(contentType) {
+				_ = form.RemoveAll()
+				return nil, DisallowedContentTypeError{field, contentType}
+			}
+			upload.Files[field] = append(upload.Files[field], &UploadedFile{
+				Field:       field,
+				Filename:    path.Base(strings.Replace(fh.Filename, "\\", "/", -1)),
+				ContentType: contentType,
+				Size:        fh.Size,
+				fh:          fh,
+			})
+		}
+	}
+
+	return upload, nil
+}
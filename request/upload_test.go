@@ -0,0 +1,76 @@
+package request
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+)
+
+func uploadRequest(t *testing.T, contentType string, content []byte) *Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("caption", "a picture")
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition",
+		`form-data; name="picture"; filename="C:\\pictures\\cat.png"`)
+	header.Set("Content-Type", contentType)
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write(content)
+	_ = mw.Close()
+
+	httpReq, _ := http.NewRequest("POST", "http://jerf.org/upload", &body)
+	httpReq.Header.Set("Content-Type", mw.FormDataContentType())
+	req, _ := NewSphyraenaState(nil, nil).NewRequest(httptest.NewRecorder(),
+		httpReq, false)
+	return req
+}
+
+func TestParseUpload(t *testing.T) {
+	options := UploadOptions{AllowedContentTypes: []string{"image/*"}}
+
+	upload, err := uploadRequest(t, "image/png", []byte("png!")).ParseUpload(options)
+	if err != nil {
+		t.Fatal("could not parse upload:", err)
+	}
+	defer upload.Close()
+	if upload.Values.Get("caption") != "a picture" || len(upload.Files["picture"]) != 1 {
+		t.Fatal("upload not parsed correctly:", upload)
+	}
+	file := upload.Files["picture"][0]
+	if file.Filename != "cat.png" || file.ContentType != "image/png" || file.Size != 4 {
+		t.Fatal("file not described correctly:", file)
+	}
+	r, err := file.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(content) != "png!" {
+		t.Fatal("wrong content:", string(content))
+	}
+
+	_, err = uploadRequest(t, "text/html", []byte("<script>")).ParseUpload(options)
+	if _, isDisallowed := err.(DisallowedContentTypeError); !isDisallowed {
+		t.Fatal("disallowed content type accepted:", err)
+	}
+
+	options.MaxSize = 100
+	_, err = uploadRequest(t, "image/png", make([]byte, 200)).ParseUpload(options)
+	if err != ErrUploadTooLarge {
+		t.Fatal("oversized upload accepted:", err)
+	}
+
+	req := uploadRequest(t, "image/png", nil)
+	req.Header.Set("Content-Type", "application/json")
+	if _, err = req.ParseUpload(options); err != ErrNotMultipart {
+		t.Fatal("non-multipart request accepted:", err)
+	}
+}
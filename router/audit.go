@@ -0,0 +1,44 @@
+package router
+
+import (
+	"strings"
+)
+
+// RoutingTable renders the routing table below the RouteBlock for review,
+// one clause per line, as its Name and Argument, indented beneath the
+// clause whose RouteBlock it is in. This is the final routing table, after
+// all the code that built it has run, so reviewers can see exactly what
+// gates each handler is behind, and, through AllowHeaders, what it can be
+// sent.
+//
+// A RouteBlock reached through more than one clause is rendered each time,
+// except beneath itself, where it is marked as "(cycle)".
+func (rb *RouteBlock) RoutingTable() string {
+	var b strings.Builder
+	writeRoutingTable(&b, rb, 0, map[*RouteBlock]bool{})
+	return b.String()
+}
+
+func writeRoutingTable(
+	b *strings.Builder,
+	rb *RouteBlock,
+	depth int,
+	visiting map[*RouteBlock]bool,
+) {
+	if rb == nil {
+		return
+	}
+	indent := strings.Repeat("  ", depth)
+	if visiting[rb] {
+		b.WriteString(indent + "(cycle)\n")
+		return
+	}
+	visiting[rb] = true
+	defer delete(visiting, rb)
+
+	for _, clause := range rb.clauses {
+		line := strings.TrimSpace(clause.Name() + " " + clause.Argument())
+		b.WriteString(indent + line + "\n")
+		writeRoutingTable(b, clause.GetRouteBlock(), depth+1, visiting)
+	}
+}
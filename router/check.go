@@ -0,0 +1,185 @@
+package router
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// A RouteWarning describes a clause in the routing table that can never
+// be reached, because the clauses before it take every request it could.
+//
+// Path is the location the clause is nested in, and Clause is its Name
+// and Argument, as they would appear in the routing configuration.
+// Shadowed is the location of the clause that takes its requests first.
+type RouteWarning struct {
+	Path     string
+	Clause   string
+	Shadowed string
+	Reason   string
+}
+
+// String implements fmt.Stringer.
+func (rw RouteWarning) String() string {
+	return fmt.Sprintf("%s at %q is unreachable: %s %q", rw.Clause, rw.Path,
+		rw.Reason, rw.Shadowed)
+}
+
+// CheckRoutes walks the routing table below the RouteBlock, and returns a
+// RouteWarning for each clause that can never be reached. This is meant
+// to be run at startup, to catch routing mistakes before they're served.
+//
+// Since StaticLocations match prefixes, and the first clause to produce a
+// handler wins, a location registered after a broader one that always
+// handles the request is dead, as is an ExactLocation that duplicates an
+// earlier one, or anything after a ForwardClause in the same RouteBlock.
+//
+// The check only knows the clauses in this package. Any clause it doesn't
+// know, such as authentication, or one that only routes some requests,
+// such as Method or QueryMatch, is assumed to possibly decline any
+// request, so nothing is reported as shadowed by it. It will therefore
+// miss some unreachable routes, but never report a reachable one.
+func (rb *RouteBlock) CheckRoutes() []RouteWarning {
+	warnings := []RouteWarning{}
+	checkBlock(rb, "", map[*RouteBlock]bool{}, &warnings)
+	return warnings
+}
+
+// WarnRoutes runs CheckRoutes on the router, and logs each RouteWarning
+// through slog.Warn, returning them as well.
+func (sr *SphyraenaRouter) WarnRoutes() []RouteWarning {
+	warnings := sr.CheckRoutes()
+	for _, w := range warnings {
+		slog.Warn("unreachable route", "path", w.Path, "clause", w.Clause,
+			"shadowed_by", w.Shadowed, "reason", w.Reason)
+	}
+	return warnings
+}
+
+// A routePattern is a set of paths, relative to a RouteBlock: either
+// exactly the location, or everything beginning with it.
+type routePattern struct {
+	location string
+	exact    bool
+}
+
+func (rp routePattern) covers(other routePattern) bool {
+	if rp.exact {
+		return other.exact && other.location == rp.location
+	}
+	return strings.HasPrefix(other.location, rp.location)
+}
+
+func checkBlock(
+	rb *RouteBlock,
+	path string,
+	visited map[*RouteBlock]bool,
+	warnings *[]RouteWarning,
+) {
+	if rb == nil || visited[rb] {
+		return
+	}
+	visited[rb] = true
+
+	caught := []routePattern{}
+	for _, clause := range rb.clauses {
+		reach := clauseReach(clause)
+		for _, c := range caught {
+			if !c.covers(reach) {
+				continue
+			}
+			reason := "shadowed by the earlier location"
+			if c.exact {
+				reason = "duplicates the earlier exact location"
+			}
+			*warnings = append(*warnings, RouteWarning{
+				Path:     path,
+				Clause:   strings.TrimSpace(clause.Name() + " " + clause.Argument()),
+				Shadowed: path + c.location,
+				Reason:   reason,
+			})
+			break
+		}
+		caught = append(caught, clauseCatches(clause, map[*RouteBlock]bool{})...)
+
+		childPath := path
+		switch c := clause.(type) {
+		case *StaticLocation:
+			childPath += c.Location
+		case *ExactLocation:
+			childPath += c.Location
+		}
+		checkBlock(clause.GetRouteBlock(), childPath, visited, warnings)
+	}
+}
+
+// clauseReach returns the paths the given clause could route.
+func clauseReach(clause RouterClause) routePattern {
+	switch c := clause.(type) {
+	case *StaticLocation:
+		return routePattern{c.Location, false}
+	case *ExactLocation:
+		return routePattern{c.Location, true}
+	}
+	return routePattern{"", false}
+}
+
+// clauseCatches returns the paths for which the given clause always
+// produces a handler.
+func clauseCatches(clause RouterClause, visited map[*RouteBlock]bool) []routePattern {
+	switch c := clause.(type) {
+	case ForwardClause:
+		if c.Handler != nil {
+			return []routePattern{{"", false}}
+		}
+	case StreamClause:
+		if c.StreamHandler != nil {
+			return []routePattern{{"", false}}
+		}
+	case DualClause:
+		if c.Handler != nil && c.StreamHandler != nil {
+			return []routePattern{{"", false}}
+		}
+	case ReturnClause:
+		if c.Handler != nil {
+			return []routePattern{{"", true}}
+		}
+	case *StaticLocation:
+		patterns := []routePattern{}
+		for _, p := range blockCatches(c.RouteBlock, visited) {
+			patterns = append(patterns, routePattern{c.Location + p.location, p.exact})
+		}
+		return patterns
+	case *ExactLocation:
+		for _, p := range blockCatches(c.RouteBlock, visited) {
+			if p.location == "" {
+				return []routePattern{{c.Location, true}}
+			}
+		}
+	// These always route into their RouteBlock, or else produce a
+	// handler of their own.
+	case *AllowHeaders:
+		return blockCatches(c.RouteBlock, visited)
+	case *MaxBodySize:
+		return blockCatches(c.RouteBlock, visited)
+	case *SecurityHoles:
+		return blockCatches(c.RouteBlock, visited)
+	case *Timeout:
+		return blockCatches(c.RouteBlock, visited)
+	}
+	return nil
+}
+
+func blockCatches(rb *RouteBlock, visited map[*RouteBlock]bool) []routePattern {
+	if rb == nil || visited[rb] {
+		return nil
+	}
+	visited[rb] = true
+	defer delete(visited, rb)
+
+	patterns := []routePattern{}
+	for _, clause := range rb.clauses {
+		patterns = append(patterns, clauseCatches(clause, visited)...)
+	}
+	return patterns
+}
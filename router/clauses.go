@@ -2,8 +2,15 @@ package router
 
 import (
 	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
 )
 
 // A StaticLocation matches a given static portion of the URL.
@@ -140,6 +147,47 @@ func (sc StreamClause) Prototype() RouterClause {
 	return StreamClause{}
 }
 
+// A DualClause serves one resource both to plain HTTP requests, with its
+// Handler, and to streaming requests, with its StreamHandler, in the same
+// manner as a ForwardClause or a StreamClause respectively. This is how a
+// resource that may be either fetched or streamed is bound to a single
+// location.
+type DualClause struct {
+	request.Handler
+	request.StreamHandler
+}
+
+// Route implements the RoutingClause interface, returning the handler for
+// the kind of request being routed.
+func (dc DualClause) Route(rr *Request) (res Result) {
+	if rr.Request.IsStreaming() {
+		res.StreamHandler = dc.StreamHandler
+	} else {
+		res.Handler = dc.Handler
+	}
+	return
+}
+
+// Name returns "dual".
+func (dc DualClause) Name() string {
+	return "dual"
+}
+
+// Argument returns the types of both handlers, so the routing table shows
+// what serves each kind of request.
+func (dc DualClause) Argument() string {
+	return fmt.Sprintf("%T %T", dc.Handler, dc.StreamHandler)
+}
+
+func (dc DualClause) GetRouteBlock() *RouteBlock {
+	return nil
+}
+
+// Prototype returns a DualClause object.
+func (dc DualClause) Prototype() RouterClause {
+	return DualClause{}
+}
+
 // ExactLocation matches if and only if the location match is EXACT. This
 // allows putting specific matches in front of things that will forward
 // entire chunks of the URL space. This is useful for things like an index
@@ -182,3 +230,362 @@ func (el *ExactLocation) Prototype() RouterClause {
 func AddExactLocation(rb *RouteBlock, path string, h request.Handler) {
 	rb.Add(&ExactLocation{path, NewRouteBlock(ForwardClause{h})})
 }
+
+// QueryMatch routes into its RouteBlock if and only if the request's query
+// string has the given Value for the given Key. The value is also stored
+// as a parameter under the Key.
+//
+// If the key appears more than once in the query string, only the first
+// value is considered, as that is the one url.Values.Get will give the
+// handler.
+type QueryMatch struct {
+	Key   string
+	Value string
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (qm *QueryMatch) Route(rr *Request) (res Result) {
+	query := rr.URL.Query()
+	if _, present := query[qm.Key]; present && query.Get(qm.Key) == qm.Value {
+		rr.AddParameter(qm.Key, qm.Value)
+		res.RouteBlock = qm.RouteBlock
+	}
+
+	return
+}
+
+// Name returns "query_match".
+func (qm *QueryMatch) Name() string {
+	return "query_match"
+}
+
+// Argument returns the key and value in query string form.
+func (qm *QueryMatch) Argument() string {
+	return url.QueryEscape(qm.Key) + "=" + url.QueryEscape(qm.Value)
+}
+
+// Prototype returns a QueryMatch object.
+func (qm *QueryMatch) Prototype() RouterClause {
+	return &QueryMatch{}
+}
+
+// QueryPresent routes into its RouteBlock if and only if the request's
+// query string has the given Key, with any value. The value is stored as
+// a parameter under the Key.
+type QueryPresent struct {
+	Key string
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (qp *QueryPresent) Route(rr *Request) (res Result) {
+	query := rr.URL.Query()
+	if _, present := query[qp.Key]; present {
+		rr.AddParameter(qp.Key, query.Get(qp.Key))
+		res.RouteBlock = qp.RouteBlock
+	}
+
+	return
+}
+
+// Name returns "query_present".
+func (qp *QueryPresent) Name() string {
+	return "query_present"
+}
+
+// Argument returns the key.
+func (qp *QueryPresent) Argument() string {
+	return url.QueryEscape(qp.Key)
+}
+
+// Prototype returns a QueryPresent object.
+func (qp *QueryPresent) Prototype() RouterClause {
+	return &QueryPresent{}
+}
+
+// RequireTLS routes into its RouteBlock only if the request arrived over
+// TLS. Otherwise, if something in its RouteBlock would have handled the
+// request, routing terminates: GET and HEAD requests are redirected to the
+// https:// equivalent of the URL, and all other requests are refused with
+// a 403, since redirecting them would have already sent their content in
+// the clear, and would invite the client to do so again. Requests nothing
+// in it would handle continue on to the clauses after it.
+//
+// If Sphyraena is behind a TLS-terminating proxy, req.TLS will always be
+// nil. In that case, the SphyraenaState's ForwardedProtoHeader should be
+// set, as described by request.Request.Scheme. ForwardedProtoHeader here
+// overrides that for just this clause, and a value of "https" in it will
+// be accepted. Only do this if the proxy always sets or strips that
+// header, as otherwise the client can simply send it.
+type RequireTLS struct {
+	ForwardedProtoHeader string
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (rt *RequireTLS) Route(rr *Request) (res Result) {
+	if isTLS(rr, rt.ForwardedProtoHeader) {
+		res.RouteBlock = rt.RouteBlock
+		return
+	}
+
+	probed := rr.probe(rt.RouteBlock)
+	if probed.Error != nil {
+		res.Error = probed.Error
+		return
+	}
+	if probed.Handler != nil || probed.StreamHandler != nil {
+		res.Handler = request.HandlerFunc(refuseWithoutTLS)
+	}
+	return
+}
+
+// Name returns "require_tls".
+func (rt *RequireTLS) Name() string {
+	return "require_tls"
+}
+
+// Argument returns the trusted forwarded protocol header, if any.
+func (rt *RequireTLS) Argument() string {
+	return rt.ForwardedProtoHeader
+}
+
+// Prototype returns a RequireTLS object.
+func (rt *RequireTLS) Prototype() RouterClause {
+	return &RequireTLS{}
+}
+
+// MaxBodySize sets the request body size limit for everything routed
+// through its RouteBlock, overriding the SphyraenaState's MaxBodySize and
+// any MaxBodySize enclosing it. A negative Limit removes the limit
+// entirely.
+//
+// The limit is enforced before the handler runs: a request declaring a
+// larger Content-Length is refused with a 413, and reading past the limit
+// of a body without one is an error. See request.Request.LimitBody.
+type MaxBodySize struct {
+	Limit int64
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (mbs *MaxBodySize) Route(rr *Request) (res Result) {
+	rr.SetMaxBodySize(mbs.Limit)
+	res.RouteBlock = mbs.RouteBlock
+	return
+}
+
+// Name returns "max_body_size".
+func (mbs *MaxBodySize) Name() string {
+	return "max_body_size"
+}
+
+// Argument returns the limit.
+func (mbs *MaxBodySize) Argument() string {
+	return strconv.FormatInt(mbs.Limit, 10)
+}
+
+// Prototype returns a MaxBodySize object.
+func (mbs *MaxBodySize) Prototype() RouterClause {
+	return &MaxBodySize{}
+}
+
+// SecurityHoles opens the given holes for everything routed through its
+// RouteBlock, so a policy can be declared once for a whole subtree of the
+// site rather than at each handler. Holes opened by nested SecurityHoles,
+// or by any other clause, are added to these rather than replacing them.
+//
+// As with every hole, they are only applied if the request is ultimately
+// handled within the RouteBlock.
+type SecurityHoles struct {
+	Holes hole.SecurityHoles
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (sh *SecurityHoles) Route(rr *Request) (res Result) {
+	for _, h := range sh.Holes {
+		rr.AddSecurityHole(h)
+	}
+	res.RouteBlock = sh.RouteBlock
+	return
+}
+
+// Name returns "security_holes".
+func (sh *SecurityHoles) Name() string {
+	return "security_holes"
+}
+
+// Argument returns the holes opened, so they show up when the routing
+// table is reviewed.
+func (sh *SecurityHoles) Argument() string {
+	return sh.Holes.String()
+}
+
+// Prototype returns a SecurityHoles object.
+func (sh *SecurityHoles) Prototype() RouterClause {
+	return &SecurityHoles{}
+}
+
+// Method routes into its RouteBlock only if the request's method is one
+// of the given Methods. As GET handlers are expected to answer HEAD
+// requests as well, a Method permitting GET also permits HEAD.
+//
+// Streaming requests have no method, and so never match.
+type Method struct {
+	Methods []string
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (m *Method) Route(rr *Request) (res Result) {
+	if rr.Request == nil || rr.Request.Request == nil {
+		return
+	}
+	if methodPermitted(m.Methods, rr.Method) {
+		res.RouteBlock = m.RouteBlock
+	}
+	return
+}
+
+// Name returns "method".
+func (m *Method) Name() string {
+	return "method"
+}
+
+// Argument returns the permitted methods, separated by commas.
+func (m *Method) Argument() string {
+	return strings.Join(m.Methods, ",")
+}
+
+// Prototype returns a Method object.
+func (m *Method) Prototype() RouterClause {
+	return &Method{}
+}
+
+func methodPermitted(methods []string, method string) bool {
+	for _, permitted := range methods {
+		if permitted == method ||
+			(permitted == http.MethodGet && method == http.MethodHead) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowHeaders declares the request headers its RouteBlock can deal with,
+// so that what a route may be sent can be audited, and handlers that echo
+// or forward headers can't be made to pass along anything else.
+//
+// Headers not named in Headers are removed from the request before it is
+// routed into the RouteBlock, or, if Reject is set, the request is refused
+// with a 400 instead. Names are matched case-insensitively. Clauses in the
+// RouteBlock see only the allowed headers through RequestHeader, but the
+// request itself is only changed once a handler in the RouteBlock is
+// selected, so the clauses tried after this one if nothing in it matches
+// see all the headers. Once it is changed, anything that examines the
+// headers, including the handler and the CORS handling of the response,
+// sees only the allowed headers, so any header needed by those must be
+// named as well. The cookies and the session were already taken from the
+// request before routing, and are unaffected.
+//
+// Streaming requests have no headers of their own, and are always routed
+// into the RouteBlock.
+//
+// The allowed headers are listed by RouteBlock.RoutingTable, so reviewers
+// can see exactly what a handler can receive.
+type AllowHeaders struct {
+	Headers []string
+	Reject  bool
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (ah *AllowHeaders) Route(rr *Request) (res Result) {
+	res.RouteBlock = ah.RouteBlock
+	if rr.Request == nil || rr.Request.Request == nil {
+		return
+	}
+
+	// The headers are stripped from a copy, which only replaces the
+	// request's own if a handler is found under this clause.
+	var allowed http.Header
+	header := rr.RequestHeader()
+	for name := range header {
+		if headerAllowed(ah.Headers, name) {
+			continue
+		}
+		if ah.Reject {
+			return Result{Handler: request.HandlerFunc(refuseHeaders)}
+		}
+		if allowed == nil {
+			allowed = header.Clone()
+		}
+		allowed.Del(name)
+	}
+	if allowed != nil {
+		rr.SetRequestHeader(allowed)
+	}
+	return
+}
+
+// Name returns "allow_headers".
+func (ah *AllowHeaders) Name() string {
+	return "allow_headers"
+}
+
+// Argument returns the allowed headers in their canonical form, separated
+// by commas, preceded by "reject " if unexpected headers are refused.
+func (ah *AllowHeaders) Argument() string {
+	canonical := make([]string, len(ah.Headers))
+	for i, header := range ah.Headers {
+		canonical[i] = http.CanonicalHeaderKey(header)
+	}
+	headers := strings.Join(canonical, ",")
+	if ah.Reject {
+		return "reject " + headers
+	}
+	return headers
+}
+
+// Prototype returns an AllowHeaders object.
+func (ah *AllowHeaders) Prototype() RouterClause {
+	return &AllowHeaders{}
+}
+
+func headerAllowed(headers []string, name string) bool {
+	for _, allowed := range headers {
+		if strings.EqualFold(allowed, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func refuseHeaders(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	rw.Error(http.StatusBadRequest, "unexpected request header")
+}
+
+func isTLS(rr *Request, forwardedProtoHeader string) bool {
+	if rr.IsTLS() {
+		return true
+	}
+	return forwardedProtoHeader != "" &&
+		rr.RequestHeader().Get(forwardedProtoHeader) == "https"
+}
+
+func refuseWithoutTLS(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Error(http.StatusForbidden, "TLS required")
+		return
+	}
+
+	target := url.URL{
+		Scheme:   "https",
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		RawQuery: req.URL.RawQuery,
+	}
+	http.Redirect(rw, req.Request, target.String(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headResponseWriter is the http.ResponseWriter used when answering a HEAD
+// request by running the GET handler. It passes the headers through, but
+// discards the body, counting it instead so the Content-Length can be
+// reported.
+//
+// Since the Content-Length can't be known until the handler is done, the
+// status is held back until finish is called.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	length int64
+}
+
+func (hrw *headResponseWriter) WriteHeader(code int) {
+	if hrw.status == 0 {
+		hrw.status = code
+	}
+}
+
+func (hrw *headResponseWriter) Write(b []byte) (int, error) {
+	if hrw.status == 0 {
+		hrw.status = http.StatusOK
+	}
+	hrw.length += int64(len(b))
+	return len(b), nil
+}
+
+// finish sends the held-back status, along with the Content-Length the
+// body would have had if the handler didn't set one itself.
+func (hrw *headResponseWriter) finish() {
+	if hrw.status == 0 {
+		hrw.status = http.StatusOK
+	}
+
+	header := hrw.Header()
+	if header.Get("Content-Length") == "" && bodyAllowed(hrw.status) {
+		header.Set("Content-Length", strconv.FormatInt(hrw.length, 10))
+	}
+	hrw.ResponseWriter.WriteHeader(hrw.status)
+}
+
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status < 200:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// serveHEAD answers a HEAD request by routing it as a GET request and
+// discarding the body.
+func (sr *SphyraenaRouter) serveHEAD(rw http.ResponseWriter, req *http.Request) {
+	hrw := &headResponseWriter{ResponseWriter: rw}
+
+	getReq := *req
+	getReq.Method = http.MethodGet
+	ctx, srw := sr.sphyraenaState.NewRequest(hrw, &getReq, false)
+
+	sr.RunRoute(srw, ctx)
+	hrw.finish()
+}
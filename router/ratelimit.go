@@ -0,0 +1,188 @@
+package router
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// minSweepSize is the fewest buckets a RateLimit will hold before it
+// bothers discarding the full ones.
+const minSweepSize = 1024
+
+// ClientIP returns the IP address of the client that made the request.
+//
+// By default this is the host of the request's RemoteAddr. If Sphyraena
+// is behind a proxy, that will be the proxy's address. In that case, set
+// forwardedForHeader to the header the proxy records the client's address
+// in, such as "X-Forwarded-For", and the last address in it will be used,
+// which is the one the proxy itself added. As with
+// RequireTLS.ForwardedProtoHeader, only do this if there always is such a
+// proxy, as otherwise the client can claim to be anyone.
+func ClientIP(req *http.Request, forwardedForHeader string) string {
+	if forwardedForHeader != "" {
+		values := req.Header.Values(forwardedForHeader)
+		if len(values) > 0 {
+			addrs := strings.Split(values[len(values)-1], ",")
+			addr := strings.TrimSpace(addrs[len(addrs)-1])
+			if addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// RateLimit routes into its RouteBlock only if the client has not
+// exceeded its allowed rate of requests. Otherwise, routing terminates,
+// and the request is refused with a 429 Too Many Requests, with a
+// Retry-After header indicating when the client may try again.
+//
+// Clients are identified by their IP address, as given by ClientIP with
+// the ForwardedForHeader, and each is given a token bucket which holds up
+// to Burst tokens and is refilled at Rate tokens per second. Each request
+// that something in the RouteBlock would handle costs one token, except
+// while the request is only being probed; see Request.Probing. Requests
+// nothing in it would handle cost nothing, and continue on to the
+// clauses after it. Rate must be positive; a Burst less than one is taken
+// as one.
+//
+// All the requests routed through the same RateLimit share buckets, so
+// placing one RateLimit in front of several routes limits the total rate
+// across all of them.
+//
+// If the AbstractTime is nil, the real time is used. A RateLimit must not
+// be copied after first use.
+type RateLimit struct {
+	Rate               float64
+	Burst              int
+	ForwardedForHeader string
+	abtime.AbstractTime
+	*RouteBlock
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Route implements the RoutingClause interface.
+func (rl *RateLimit) Route(rr *Request) (res Result) {
+	if rr.Probing() {
+		res.RouteBlock = rl.RouteBlock
+		return
+	}
+
+	probed := rr.probe(rl.RouteBlock)
+	if probed.Error != nil {
+		res.Error = probed.Error
+		return
+	}
+	if probed.Handler == nil && probed.StreamHandler == nil {
+		return
+	}
+
+	wait := rl.take(ClientIP(rr.Request.Request, rl.ForwardedForHeader))
+	if wait == 0 {
+		res.RouteBlock = rl.RouteBlock
+		return
+	}
+
+	retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	res.Handler = request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Header().Set("Retry-After", retryAfter)
+			rw.Error(http.StatusTooManyRequests, "too many requests")
+		})
+	return
+}
+
+// take takes a token from the given client's bucket. If there is no token
+// available, it returns how long until there will be one.
+func (rl *RateLimit) take(client string) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.AbstractTime == nil {
+		rl.AbstractTime = abtime.NewRealTime()
+	}
+	if rl.buckets == nil {
+		rl.buckets = map[string]*tokenBucket{}
+	}
+	burst := float64(rl.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := rl.Now()
+
+	bucket := rl.buckets[client]
+	if bucket == nil {
+		if len(rl.buckets) >= rl.nextSweep {
+			rl.sweep(now, burst)
+		}
+		bucket = &tokenBucket{burst, now}
+		rl.buckets[client] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rl.Rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / rl.Rate * float64(time.Second))
+}
+
+// sweep discards the buckets that would have refilled by now, as they are
+// no different from having no bucket at all. It must be called with the
+// lock held.
+func (rl *RateLimit) sweep(now time.Time, burst float64) {
+	for client, bucket := range rl.buckets {
+		refilled := bucket.tokens + now.Sub(bucket.last).Seconds()*rl.Rate
+		if refilled >= burst {
+			delete(rl.buckets, client)
+		}
+	}
+
+	rl.nextSweep = 2 * len(rl.buckets)
+	if rl.nextSweep < minSweepSize {
+		rl.nextSweep = minSweepSize
+	}
+}
+
+// Name returns "rate_limit".
+func (rl *RateLimit) Name() string {
+	return "rate_limit"
+}
+
+// Argument returns the rate and burst.
+func (rl *RateLimit) Argument() string {
+	return fmt.Sprintf("%g/s burst %d", rl.Rate, rl.Burst)
+}
+
+// Prototype returns a RateLimit object.
+func (rl *RateLimit) Prototype() RouterClause {
+	return &RateLimit{}
+}
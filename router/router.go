@@ -64,18 +64,18 @@ package router
 //   can deal with. This should be both leverageable for auditability
 //   for security (especially for proxied requests), and also make it
 //   easier to test these things by making it much clearer what the
-//   requests can and can not contain.
-
-// FIXME: Router needs to wrap the context and offer a Set/Value
-// interface. Probably need to expose the Session via that mechanism too,
-// so if the session is set but we somehow escape out of that router it
-// won't "stick".
+//   requests can and can not contain. (Done, see AllowHeaders.)
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/identity/session"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/sphyrw/cookie"
 	"github.com/thejerf/sphyraena/sphyrw/hole"
@@ -84,6 +84,15 @@ import (
 // Debug can be used to debug the routing
 var Debug = false
 
+// DefaultRecursionLimit is the recursion limit used when the
+// SphyraenaRouter does not specify one.
+const DefaultRecursionLimit = 64
+
+// ErrRecursionLimit is returned as the Error of a Result when routing
+// recursed into more RouteBlocks than the recursion limit permits. This
+// almost certainly indicates a cycle in the routing configuration.
+var ErrRecursionLimit = errors.New("router recursion limit exceeded")
+
 func dprintln(a ...interface{}) {
 	if Debug {
 		fmt.Println(a...)
@@ -110,6 +119,12 @@ type RouterFrame struct {
 	headersSet http.Header
 	cookies    map[string]*cookie.OutCookie
 	holes      []hole.SecurityHole
+	values     map[interface{}]interface{}
+	session    session.Session
+	header     http.Header
+	maxBody    int64
+	timeout    time.Duration
+	clock      abtime.AbstractTime
 	consume    int
 	isFinal    bool
 }
@@ -119,7 +134,11 @@ func (rr *Request) routeResult() *request.RouteResult {
 	headers := http.Header{}
 	cookies := map[string]*cookie.OutCookie{}
 	holes := hole.SecurityHoles{}
+	var maxBody int64
 	for _, frame := range rr.frames[0 : rr.current+1] {
+		if frame.maxBody != 0 {
+			maxBody = frame.maxBody
+		}
 		for key, value := range frame.parameters {
 			parameters[key] = value
 		}
@@ -149,7 +168,19 @@ func (rr *Request) routeResult() *request.RouteResult {
 		Headers:       headers,
 		Cookies:       cookies,
 		Holes:         holes,
+		MaxBodySize:   maxBody,
+	}
+}
+
+// timeout returns the innermost timeout set on the route, and the clock
+// to track it with, or a zero duration if none was set.
+func (rr *Request) timeout() (time.Duration, abtime.AbstractTime) {
+	for i := rr.current; i >= 0; i-- {
+		if rr.frames[i].timeout != 0 {
+			return rr.frames[i].timeout, rr.frames[i].clock
+		}
 	}
+	return 0, nil
 }
 
 // A request is finalized either when the matcher says it is, or when the
@@ -169,6 +200,48 @@ func (rf *RouterFrame) Reset(path []byte) {
 	rf.path = path
 	rf.consume = 0
 	rf.parameters = nil
+	rf.values = nil
+	rf.session = nil
+	rf.header = nil
+	rf.maxBody = 0
+	rf.timeout = 0
+	rf.clock = nil
+}
+
+// snapshot returns a copy of the frame that can be restored if a clause
+// routes into a RouteBlock that turns out not to match, discarding
+// anything that clause set.
+func (rf *RouterFrame) snapshot() RouterFrame {
+	snap := *rf
+	snap.headersAdd = cloneHeader(rf.headersAdd)
+	snap.headersSet = cloneHeader(rf.headersSet)
+	snap.holes = append([]hole.SecurityHole(nil), rf.holes...)
+	if rf.cookies != nil {
+		snap.cookies = make(map[string]*cookie.OutCookie, len(rf.cookies))
+		for name, c := range rf.cookies {
+			snap.cookies[name] = c
+		}
+	}
+	if rf.parameters != nil {
+		snap.parameters = make(map[string]string, len(rf.parameters))
+		for key, value := range rf.parameters {
+			snap.parameters[key] = value
+		}
+	}
+	if rf.values != nil {
+		snap.values = make(map[interface{}]interface{}, len(rf.values))
+		for key, value := range rf.values {
+			snap.values[key] = value
+		}
+	}
+	return snap
+}
+
+func cloneHeader(h http.Header) http.Header {
+	if h == nil {
+		return nil
+	}
+	return h.Clone()
 }
 
 // A Request is a request.Request for the current request, gussied
@@ -189,9 +262,9 @@ func (rf *RouterFrame) Reset(path []byte) {
 type Request struct {
 	basePath []byte
 	frames   []RouterFrame
-	holes    []hole.SecurityHole
 	current  int
 	limit    int
+	probing  bool
 	*request.Request
 }
 
@@ -207,8 +280,8 @@ func newRequest(req *request.Request) *Request {
 	return &Request{
 		basePath: basePath,
 		frames:   frames,
-		holes:    []hole.SecurityHole{},
 		current:  0,
+		limit:    DefaultRecursionLimit,
 		Request:  req,
 	}
 }
@@ -221,8 +294,11 @@ func (rr *Request) AddParameter(key, value string) {
 	currentFrame.parameters[key] = value
 }
 
+// AddSecurityHole opens the given SecurityHole on the response, only if
+// this frame is used in the final routing request.
 func (rr *Request) AddSecurityHole(hole hole.SecurityHole) {
-	rr.holes = append(rr.holes, hole)
+	currentFrame := &rr.frames[rr.current]
+	currentFrame.holes = append(currentFrame.holes, hole)
 }
 
 // AddHeader adds an HTTP header to the response only if this frame is used
@@ -239,6 +315,174 @@ func (rr *Request) AddCookie(c *cookie.OutCookie) {
 	rr.frames[rr.current].cookies[c.Name()] = c
 }
 
+// Set sets the given value on the request only if this frame is used in
+// the final routing request.
+//
+// This shadows the request.Request's Set, so that clauses that are
+// routed through but ultimately fail leave no values behind.
+func (rr *Request) Set(key, value interface{}) {
+	currentFrame := &rr.frames[rr.current]
+	if currentFrame.values == nil {
+		currentFrame.values = map[interface{}]interface{}{}
+	}
+	currentFrame.values[key] = value
+}
+
+// Value returns the value for the given key, as set by this frame or the
+// ones enclosing it, falling back to the request.Request's values.
+func (rr *Request) Value(key interface{}) interface{} {
+	for i := rr.current; i >= 0; i-- {
+		if value, have := rr.frames[i].values[key]; have {
+			return value
+		}
+	}
+	return rr.Request.Value(key)
+}
+
+// SetSession sets the session for the request only if this frame is used
+// in the final routing request.
+//
+// This shadows the request.Request's SetSession. Notably, the current
+// session is not expired unless and until the routing actually succeeds
+// through this frame; otherwise an authentication clause that was backed
+// out of could leave its session set on an unrelated route.
+func (rr *Request) SetSession(s session.Session) {
+	rr.frames[rr.current].session = s
+}
+
+// Session returns the session as set by this frame or the ones enclosing
+// it, falling back to the request.Request's session.
+func (rr *Request) Session() session.Session {
+	for i := rr.current; i >= 0; i-- {
+		if rr.frames[i].session != nil {
+			return rr.frames[i].session
+		}
+	}
+	return rr.Request.Session()
+}
+
+// Probing returns whether the request is only being routed to find out
+// where it would go, rather than to serve it, as when a trailing slash
+// redirect is being considered, a CORS preflight is being answered, or a
+// stream is being described. Clauses with effects beyond this Request,
+// such as using up a rate limit or creating a session, should skip them
+// while probing, as the request is routed again if it is served.
+//
+// The authentication clauses let a probed request through without
+// authenticating it, as a preflight never carries credentials, so the
+// clauses after them see no session while probing.
+func (rr *Request) Probing() bool {
+	return rr.probing
+}
+
+// probe routes the request into the given RouteBlock only to find out
+// whether something in it would handle the request, for clauses that
+// refuse requests, so they can leave the ones nothing below them would
+// serve to the clauses after them. The request is probed, and nothing set
+// while routing the RouteBlock is kept.
+func (rr *Request) probe(rb *RouteBlock) Result {
+	current, probing := rr.current, rr.probing
+	rr.probing = true
+	res := rb.Route(rr)
+	rr.current, rr.probing = current, probing
+	return res
+}
+
+// SetRequestHeader replaces the headers of the request being routed with
+// the given ones, only if this frame is used in the final routing
+// request. Clauses after this one see them through RequestHeader.
+//
+// The given header should be a copy; the request's own header is not to
+// be modified while routing, as other routes may still be tried.
+func (rr *Request) SetRequestHeader(h http.Header) {
+	rr.frames[rr.current].header = h
+}
+
+// RequestHeader returns the headers of the request being routed, as set
+// by this frame or the ones enclosing it, falling back to the headers the
+// request arrived with.
+func (rr *Request) RequestHeader() http.Header {
+	for i := rr.current; i >= 0; i-- {
+		if rr.frames[i].header != nil {
+			return rr.frames[i].header
+		}
+	}
+	if rr.Request == nil || rr.Request.Request == nil {
+		return nil
+	}
+	return rr.Header
+}
+
+// commit applies the values, session and request headers set along the
+// final routing path to the underlying request.Request.
+func (rr *Request) commit() {
+	var s session.Session
+	var header http.Header
+	for _, frame := range rr.frames[0 : rr.current+1] {
+		for key, value := range frame.values {
+			rr.Request.Set(key, value)
+		}
+		if frame.session != nil {
+			s = frame.session
+		}
+		if frame.header != nil {
+			header = frame.header
+		}
+	}
+	if s != nil {
+		rr.Request.SetSession(s)
+	}
+	if header != nil {
+		rr.Request.Header = header
+	}
+}
+
+// SetTimeout sets the time the handler has to respond, tracked by the
+// given clock, only if this frame is used in the final routing request.
+// The innermost timeout set along the routing path is the one used. If
+// the clock is nil, the real time is used. See Timeout.
+func (rr *Request) SetTimeout(d time.Duration, clock abtime.AbstractTime) {
+	rr.frames[rr.current].timeout = d
+	rr.frames[rr.current].clock = clock
+}
+
+// SetMaxBodySize sets the request body size limit, only if this frame is
+// used in the final routing request. The innermost limit set along the
+// routing path is the one used; a negative limit removes it.
+func (rr *Request) SetMaxBodySize(limit int64) {
+	rr.frames[rr.current].maxBody = limit
+}
+
+// PostedForm returns the values of the request's body, if it is an HTML
+// form sent as application/x-www-form-urlencoded within the body size
+// limit set so far along the routing path, or the SphyraenaState's. It
+// returns nil for any other request. See request.PeekForm; the body is
+// restored for the handler.
+//
+// Clauses should use this rather than the request's FormValue, which
+// would read any kind of body, and unlimited, before the route's limit is
+// applied to it.
+func (rr *Request) PostedForm() url.Values {
+	if rr.Request == nil || rr.Request.Request == nil {
+		return nil
+	}
+	return request.PeekForm(rr.Request.Request, rr.maxBodySize())
+}
+
+// maxBodySize returns the body size limit the request would have if it
+// were routed to a handler now.
+func (rr *Request) maxBodySize() int64 {
+	for i := rr.current; i >= 0; i-- {
+		if rr.frames[i].maxBody != 0 {
+			return rr.frames[i].maxBody
+		}
+	}
+	if rr.SphyraenaState != nil && rr.SphyraenaState.MaxBodySize != 0 {
+		return rr.SphyraenaState.MaxBodySize
+	}
+	return request.DefaultMaxBodySize
+}
+
 // SetHeader sets the given HTTP header in the response only if this frame
 // is used in the final routing request.
 func (rr *Request) SetHeader(key, value string) {
@@ -272,6 +516,10 @@ func (rr *Request) Finalize() {
 }
 
 func (rr *Request) advance() error {
+	if rr.current >= rr.limit {
+		return ErrRecursionLimit
+	}
+
 	dprintln("creating a new frame", rr.current+1, "in the request from", rr.current)
 	prevFrame := rr.frames[rr.current]
 	rr.current++
@@ -364,11 +612,15 @@ type RouteBlock struct {
 // As a special case, a call to this method will never itself yield a
 // non-nil *RouteBlock.
 func (rb *RouteBlock) Route(rr *Request) Result {
-	rr.advance()
+	err := rr.advance()
+	if err != nil {
+		return Result{Error: err}
+	}
 	ddump("current frame:", rr.frames[rr.current])
 
 	for _, router := range rb.clauses {
 		dprintln("checking clause", router.Name(), router.Argument())
+		snap := rr.frames[rr.current].snapshot()
 		res := router.Route(rr)
 		ddump("result:", res)
 		if res.Handler != nil || res.StreamHandler != nil {
@@ -396,8 +648,15 @@ func (rb *RouteBlock) Route(rr *Request) Result {
 			dprintln("error(1):", res.Error)
 			return res
 		}
-		// FIXME: It may be possible to just "reset" this here
-		rr.frames[rr.current].Reset(rr.frames[rr.current].path)
+		// A clause that routed into a RouteBlock that didn't match has
+		// its effects on this frame undone. A clause that simply passed
+		// through keeps them, so clauses like authentication can set
+		// the session for the clauses that follow.
+		if res.RouteBlock != nil {
+			rr.frames[rr.current] = snap
+		} else {
+			rr.frames[rr.current].consume = snap.consume
+		}
 	}
 
 	// NOT deferred above on purpose; the "advance"s without corresponding
@@ -432,6 +691,81 @@ func (rb *RouteBlock) Location(path string) *RouteBlock {
 	return rrb
 }
 
+// Query adds a new QueryMatch element and returns the resulting RouteBlock
+// for further modification.
+func (rb *RouteBlock) Query(key, value string) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&QueryMatch{key, value, rrb})
+	return rrb
+}
+
+// QueryPresent adds a new QueryPresent element and returns the resulting
+// RouteBlock for further modification.
+func (rb *RouteBlock) QueryPresent(key string) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&QueryPresent{key, rrb})
+	return rrb
+}
+
+// RequireTLS adds a new RequireTLS element and returns the resulting
+// RouteBlock for further modification.
+func (rb *RouteBlock) RequireTLS(forwardedProtoHeader string) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&RequireTLS{forwardedProtoHeader, rrb})
+	return rrb
+}
+
+// Method adds a new Method element permitting the given methods and
+// returns the resulting RouteBlock for further modification.
+func (rb *RouteBlock) Method(methods ...string) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&Method{methods, rrb})
+	return rrb
+}
+
+// AllowHeaders adds a new AllowHeaders element that removes all but the
+// given request headers, and returns the resulting RouteBlock for further
+// modification.
+func (rb *RouteBlock) AllowHeaders(headers ...string) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&AllowHeaders{headers, false, rrb})
+	return rrb
+}
+
+// RateLimit adds a new RateLimit element with the given rate and burst,
+// identifying clients by their RemoteAddr and using the real time, and
+// returns the resulting RouteBlock for further modification.
+func (rb *RouteBlock) RateLimit(rate float64, burst int) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&RateLimit{Rate: rate, Burst: burst, RouteBlock: rrb})
+	return rrb
+}
+
+// Timeout adds a new Timeout element with the given duration, using the
+// real time, and returns the resulting RouteBlock for further
+// modification.
+func (rb *RouteBlock) Timeout(d time.Duration) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&Timeout{Duration: d, RouteBlock: rrb})
+	return rrb
+}
+
+// MaxBodySize adds a new MaxBodySize element and returns the resulting
+// RouteBlock for further modification.
+func (rb *RouteBlock) MaxBodySize(limit int64) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&MaxBodySize{limit, rrb})
+	return rrb
+}
+
+// WithHoles adds a new SecurityHoles element opening the given holes, and
+// returns the resulting RouteBlock for further modification.
+func (rb *RouteBlock) WithHoles(holes ...hole.SecurityHole) *RouteBlock {
+	rrb := NewRouteBlock()
+	rb.Add(&SecurityHoles{hole.SecurityHoles(holes), rrb})
+	return rrb
+}
+
 // AddLocationReturn is a simple convenience function to add a
 // streaming REST handler directly to the given location.
 func (rb *RouteBlock) AddLocationReturn(path string, h request.Handler) {
@@ -444,6 +778,16 @@ func (rb *RouteBlock) AddLocationForward(path string, h request.Handler) {
 	rb.Add(&StaticLocation{path, &RouteBlock{[]RouterClause{ForwardClause{h}}}})
 }
 
+// AddDualForward is a simple convenience function to add a DualClause
+// directly to a given location.
+func (rb *RouteBlock) AddDualForward(
+	path string,
+	h request.Handler,
+	sh request.StreamHandler,
+) {
+	rb.Add(&StaticLocation{path, &RouteBlock{[]RouterClause{DualClause{h, sh}}}})
+}
+
 // AddStreamForward is a simple convenience function to add a
 // ForwardClause directly to a given location.
 func (rb *RouteBlock) AddStreamForward(path string, h request.StreamHandler) {
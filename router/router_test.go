@@ -1,13 +1,25 @@
 package router
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/identity/session"
+	"github.com/thejerf/sphyraena/metrics"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
+	"github.com/thejerf/sphyraena/strest"
 )
 
 func ptr(i int) *int {
@@ -151,3 +163,1453 @@ func TestMultipleLocation(t *testing.T) {
 		t.Fatal("location didn't match correctly")
 	}
 }
+
+func TestSynthesizeHEAD(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sawMethod := ""
+	sr.AddLocationReturn("/", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			sawMethod = req.Method
+			rw.Header().Set("X-Test", "yes")
+			rw.Write([]byte("hello"))
+		},
+	))
+
+	req, _ := http.NewRequest("HEAD", "http://jerf.org/", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if sawMethod != "HEAD" {
+		t.Fatal("HEAD was rewritten without SynthesizeHEAD")
+	}
+
+	sr.SynthesizeHEAD = true
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if sawMethod != "GET" {
+		t.Fatal("HEAD not routed as GET")
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatal("HEAD response incorrect:", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Length") != "5" ||
+		rec.Header().Get("X-Test") != "yes" {
+		t.Fatal("HEAD headers incorrect:", rec.Header())
+	}
+	if req.Method != "HEAD" {
+		t.Fatal("original request modified")
+	}
+}
+
+// corsClause opens a CORS hole, then routes on down its RouteBlock.
+type corsClause struct {
+	*RouteBlock
+}
+
+func (cc corsClause) Route(rr *Request) (res Result) {
+	rr.AddSecurityHole(hole.CORS([]string{"https://good.example"},
+		[]string{"GET", "PUT"}, []string{"X-Thing"}, true))
+	res.RouteBlock = cc.RouteBlock
+	return
+}
+
+func (cc corsClause) Name() string            { return "cors" }
+func (cc corsClause) Argument() string        { return "" }
+func (cc corsClause) Prototype() RouterClause { return corsClause{} }
+
+func TestCORS(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	rb := NewRouteBlock()
+	rb.AddLocationReturn("/api", SF1)
+	rb.Method("PUT").AddLocationReturn("/put", SF1)
+	sr.Add(corsClause{rb})
+	sr.AddLocationReturn("/private", SF2)
+
+	preflight := func(path, origin, method, headers string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("OPTIONS", "http://jerf.org"+path, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("/api", "https://good.example", "PUT", "x-thing")
+	if rec.Code != http.StatusNoContent ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		rec.Header().Get("Access-Control-Allow-Methods") != "GET, PUT" {
+		t.Fatal("allowed preflight not allowed:", rec.Code, rec.Header())
+	}
+
+	// the preflight is routed as the method it asks about
+	rec = preflight("/put", "https://good.example", "PUT", "")
+	if rec.Code != http.StatusNoContent ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" {
+		t.Fatal("preflight for a method-gated route not allowed:", rec.Code, rec.Header())
+	}
+	if rec = preflight("/put", "https://good.example", "GET", ""); rec.Code != http.StatusNotFound {
+		t.Fatal("preflight for a method the route doesn't take found it:", rec.Code)
+	}
+
+	for _, bad := range [][4]string{
+		{"/api", "https://evil.example", "PUT", ""},
+		{"/api", "https://good.example", "DELETE", ""},
+		{"/api", "https://good.example", "GET", "X-Other"},
+		{"/private", "https://good.example", "GET", ""},
+	} {
+		rec = preflight(bad[0], bad[1], bad[2], bad[3])
+		if rec.Code != http.StatusForbidden ||
+			rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Fatal("disallowed preflight allowed:", bad, rec.Code, rec.Header())
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/api", nil)
+	req.Header.Set("Origin", "https://good.example")
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" {
+		t.Fatal("CORS headers not applied to actual request:", rec.Header())
+	}
+
+	req.Header.Set("Origin", "https://evil.example")
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers applied to disallowed origin")
+	}
+
+	// whatever the origin, or lack of one, the response depends on it
+	for _, origin := range []string{"https://good.example", "https://evil.example", ""} {
+		req.Header.Set("Origin", origin)
+		rec = httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if vary := rec.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Origin" {
+			t.Fatal("response under a CORS hole does not vary by origin:",
+				origin, rec.Header())
+		}
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("wildcard origin with credentials permitted")
+		}
+	}()
+	hole.CORS([]string{"*"}, []string{"GET"}, nil, true)
+}
+
+func TestWithHoles(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	api := sr.WithHoles(hole.CORS([]string{"https://good.example"},
+		[]string{"GET"}, nil, false))
+	api.AddLocationReturn("/api", SF1)
+	api.WithHoles(hole.AllowBrowserTypeGuessing()).
+		AddLocationReturn("/api/legacy", SF2)
+	sr.AddLocationReturn("/private", SF2)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		req.Header.Set("Origin", "https://good.example")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" ||
+		rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatal("group holes not applied correctly:", rec.Header())
+	}
+
+	rec = get("/api/legacy")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://good.example" ||
+		rec.Header().Get("X-Content-Type-Options") != "" {
+		t.Fatal("nested group holes did not compose:", rec.Header())
+	}
+
+	rec = get("/private")
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" ||
+		rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatal("group holes leaked out of their group:", rec.Header())
+	}
+
+	clause := &SecurityHoles{Holes: hole.SecurityHoles{
+		hole.AllowBrowserTypeGuessing(),
+		hole.CORS([]string{"https://b.example", "https://a.example"},
+			[]string{"GET"}, nil, false),
+	}}
+	if clause.Argument() != "allow_browser_type_guessing, "+
+		"cors(origins=https://a.example https://b.example methods=GET headers= credentials=false)" {
+		t.Fatal("holes not described for review:", clause.Argument())
+	}
+}
+
+func TestTighteningHoles(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	site := sr.WithHoles(hole.AllowBrowserTypeGuessing(),
+		hole.CORS([]string{"https://good.example"}, []string{"GET"}, nil, false))
+	site.AddLocationReturn("/public", SF1)
+	site.WithHoles(hole.DenyBrowserTypeGuessing(), hole.DenyCORS()).
+		AddLocationReturn("/admin", SF2)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		req.Header.Set("Origin", "https://good.example")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/public")
+	if rec.Header().Get("X-Content-Type-Options") != "" ||
+		rec.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatal("parent holes not applied:", rec.Header())
+	}
+
+	rec = get("/admin")
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" ||
+		rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("child did not tighten its parent's holes:", rec.Header())
+	}
+}
+
+func TestRecursionLimit(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.RecursionLimit = 10
+
+	// The SphyraenaRouter's own block, the eight locations, and the block
+	// holding the return come to exactly ten.
+	rb := sr.Location("/a")
+	for i := 0; i < 7; i++ {
+		rb = rb.Location("/a")
+	}
+	rb.AddLocationReturn("/end", SF1)
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/a/a/a/a/a/a/a/a/end", nil)
+	ctx, _ := sr.sphyraenaState.NewRequest(httptest.NewRecorder(), req, false)
+	handler, _, err := sr.getHTTPHandler(ctx)
+	if err != nil || !samefunc(handler, SF1) {
+		t.Fatal("route within the recursion limit failed:", err)
+	}
+
+	sr.RecursionLimit = 9
+	_, _, err = sr.getHTTPHandler(ctx)
+	if err != ErrRecursionLimit {
+		t.Fatal("route beyond the recursion limit did not error:", err)
+	}
+
+	// A cyclic route configuration must terminate, rather than overflow
+	// the stack.
+	cyclic := New(request.NewSphyraenaState(nil, nil))
+	cyclic.AddLocation("", cyclic.RouteBlock)
+	_, _, err = cyclic.getHTTPHandler(ctx)
+	if err != ErrRecursionLimit {
+		t.Fatal("cyclic route did not hit the recursion limit:", err)
+	}
+
+	// A routing error is a 500 that doesn't reveal the error.
+	rec := httptest.NewRecorder()
+	cyclic.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError ||
+		strings.Contains(rec.Body.String(), "recursion") {
+		t.Fatal("routing error not turned into a 500:", rec.Code, rec.Body.String())
+	}
+
+	var result request.StreamRequestResult
+	streamReq := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+		result = srr
+	})
+	streamReq.Request = req
+	cyclic.RunStreamingRoute(streamReq)
+	if result.ErrorCode != http.StatusInternalServerError ||
+		strings.Contains(result.Error, "recursion") {
+		t.Fatal("streaming routing error not turned into a 500:", result)
+	}
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationReturn("/dir/", SF1)
+	sr.AddLocationReturn("/file", SF2)
+
+	get := func(method, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("GET", "http://jerf.org/dir"); rec.Code != http.StatusNotFound {
+		t.Fatal("trailing slash redirected without being requested:", rec.Code)
+	}
+
+	sr.RedirectTrailingSlash = true
+	rec := get("GET", "http://jerf.org/dir?a=b")
+	if rec.Code != http.StatusMovedPermanently ||
+		rec.Header().Get("Location") != "/dir/?a=b" {
+		t.Fatal("missing trailing slash not redirected:", rec.Code, rec.Header())
+	}
+	rec = get("GET", "http://jerf.org/file/")
+	if rec.Code != http.StatusMovedPermanently ||
+		rec.Header().Get("Location") != "/file" {
+		t.Fatal("extra trailing slash not redirected:", rec.Code, rec.Header())
+	}
+	rec = get("POST", "http://jerf.org/dir")
+	if rec.Code != http.StatusPermanentRedirect {
+		t.Fatal("POST not redirected with a 308:", rec.Code)
+	}
+	if rec = get("GET", "http://jerf.org/nothing"); rec.Code != http.StatusNotFound {
+		t.Fatal("unmatched path redirected:", rec.Code)
+	}
+
+	// looking for the alternate path doesn't use up the rate limit
+	limited := NewRouteBlock()
+	sr.Add(&RateLimit{Rate: 1, Burst: 2, AbstractTime: abtime.NewManual(),
+		RouteBlock: limited})
+	limited.AddLocationReturn("/limited/", SF1)
+	if rec = get("GET", "http://jerf.org/limited"); rec.Code != http.StatusMovedPermanently {
+		t.Fatal("rate limited path not redirected:", rec.Code)
+	}
+	if rec = get("GET", "http://jerf.org/limited/"); rec.Code != http.StatusOK {
+		t.Fatal("redirect used up the rate limit twice:", rec.Code)
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	page := sr.Location("/page")
+	page.Query("action", "edit").AddLocationReturn("", SF1)
+	page.QueryPresent("id").AddLocationReturn("", SF2)
+
+	route := func(url string) (request.Handler, *request.RouteResult) {
+		req, _ := http.NewRequest("GET", url, nil)
+		ctx, _ := sr.sphyraenaState.NewRequest(httptest.NewRecorder(), req, false)
+		handler, rr, err := sr.getHTTPHandler(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler, rr
+	}
+
+	handler, rr := route("http://jerf.org/page?action=edit&id=3")
+	if !samefunc(handler, SF1) || rr.Parameters["action"] != "edit" {
+		t.Fatal("QueryMatch did not match")
+	}
+	handler, rr = route("http://jerf.org/page?action=view&id=3")
+	if !samefunc(handler, SF2) || rr.Parameters["id"] != "3" ||
+		rr.Parameters["action"] != "" {
+		t.Fatal("QueryPresent did not match, or QueryMatch leaked a parameter")
+	}
+	if handler, _ = route("http://jerf.org/page?action=view"); handler != nil {
+		t.Fatal("query clauses matched a request they shouldn't have")
+	}
+
+	qm := &QueryMatch{"a b", "c&d", nil}
+	if qm.Argument() != "a+b=c%26d" {
+		t.Fatal("QueryMatch argument not properly escaped:", qm.Argument())
+	}
+}
+
+func TestRequireTLS(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.RequireTLS("X-Forwarded-Proto").AddLocationReturn("/secure", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Write([]byte("secure"))
+		},
+	))
+	sr.AddLocationReturn("/public", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Write([]byte("public"))
+		},
+	))
+
+	path := "/secure?a=b"
+	serve := func(method, proto string, overTLS bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://jerf.org"+path, nil)
+		if proto != "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if overTLS {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("GET", "", true); rec.Body.String() != "secure" {
+		t.Fatal("TLS request refused:", rec.Code)
+	}
+	if rec := serve("GET", "https", false); rec.Body.String() != "secure" {
+		t.Fatal("trusted forwarded TLS request refused:", rec.Code)
+	}
+	rec := serve("GET", "http", false)
+	if rec.Code != http.StatusMovedPermanently ||
+		rec.Header().Get("Location") != "https://jerf.org/secure?a=b" {
+		t.Fatal("plain GET not redirected:", rec.Code, rec.Header())
+	}
+	if rec = serve("POST", "", false); rec.Code != http.StatusForbidden {
+		t.Fatal("plain POST not refused:", rec.Code)
+	}
+
+	// routes after the RequireTLS are unaffected by it
+	path = "/public"
+	if rec = serve("GET", "", false); rec.Body.String() != "public" {
+		t.Fatal("plain request for a route after RequireTLS refused:", rec.Code)
+	}
+}
+
+func TestRequireTLSForwardedProtoState(t *testing.T) {
+	state := request.NewSphyraenaState(nil, nil)
+	sr := New(state)
+	sr.RequireTLS("").AddLocationReturn("/secure", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Write([]byte("secure"))
+		},
+	))
+
+	serve := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org/secure", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusMovedPermanently {
+		t.Fatal("forwarded header trusted by default:", rec.Code)
+	}
+	state.ForwardedProtoHeader = "X-Forwarded-Proto"
+	if rec := serve(); rec.Body.String() != "secure" {
+		t.Fatal("state's forwarded header not trusted:", rec.Code)
+	}
+}
+
+type testSession struct {
+	session.Session
+	expired bool
+}
+
+func (ts *testSession) Expire() {
+	ts.expired = true
+}
+
+type valueKey struct{}
+
+// escapeClause sets a session and a value, as an authentication clause
+// would, then routes into a RouteBlock that may fail.
+type escapeClause struct {
+	session *testSession
+	*RouteBlock
+}
+
+func (ec escapeClause) Route(rr *Request) (res Result) {
+	rr.SetSession(ec.session)
+	rr.Set(valueKey{}, "escaped")
+	res.RouteBlock = ec.RouteBlock
+	return
+}
+
+func (ec escapeClause) Name() string            { return "escape" }
+func (ec escapeClause) Argument() string        { return "" }
+func (ec escapeClause) Prototype() RouterClause { return escapeClause{} }
+
+func TestFrameValuesDoNotEscape(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	authed := &testSession{Session: session.AnonymousSession}
+	protected := NewRouteBlock()
+	protected.AddLocationReturn("/protected", SF1)
+	sr.Add(escapeClause{authed, protected})
+	sr.AddLocationReturn("/public", SF2)
+
+	routeTo := func(url string) (*request.Request, request.Handler) {
+		req, _ := http.NewRequest("GET", url, nil)
+		ctx, _ := sr.sphyraenaState.NewRequest(httptest.NewRecorder(), req, false)
+		handler, _, err := sr.getHTTPHandler(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, handler
+	}
+
+	// The escape clause is routed through, but its block fails, so the
+	// /public route is taken. The session and value must not stick.
+	ctx, handler := routeTo("http://jerf.org/public")
+	if !samefunc(handler, SF2) {
+		t.Fatal("wrong handler for public route")
+	}
+	if ctx.Session() == authed || ctx.Value(valueKey{}) != nil {
+		t.Fatal("session or value escaped from a failed route")
+	}
+
+	ctx, handler = routeTo("http://jerf.org/protected")
+	if !samefunc(handler, SF1) {
+		t.Fatal("wrong handler for protected route")
+	}
+	if ctx.Session() != authed || ctx.Value(valueKey{}) != "escaped" {
+		t.Fatal("session or value not committed on the successful route")
+	}
+
+	// With no RouteBlock, the clause simply passes through, and what it
+	// set must survive to the handler that follows it.
+	sr = New(request.NewSphyraenaState(nil, nil))
+	sr.Add(escapeClause{authed, nil})
+	sr.AddLocationReturn("/public", SF2)
+	ctx, handler = routeTo("http://jerf.org/public")
+	if !samefunc(handler, SF2) {
+		t.Fatal("wrong handler for public route")
+	}
+	if ctx.Session() != authed || ctx.Value(valueKey{}) != "escaped" {
+		t.Fatal("session or value set by a pass-through clause was lost")
+	}
+}
+
+// streamsServer is a SessionServer that only knows about some streams.
+type streamsServer struct {
+	session.SessionServer
+	streams []*strest.Stream
+}
+
+func (ss streamsServer) Streams() []*strest.Stream {
+	return ss.streams
+}
+
+func TestShutdown(t *testing.T) {
+	stream := strest.NewStream(strest.StreamID("stream"))
+	toUser := make(chan strest.EventToUser)
+	stream.SetExternalStream(strest.ChannelsStream{
+		ToUser:   toUser,
+		FromUser: make(chan strest.EventFromUser),
+	})
+
+	ss := request.NewSphyraenaState(streamsServer{nil, []*strest.Stream{stream}}, nil)
+	sr := New(ss)
+	sr.AddLocationForward("/", SF1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := ss.Shutdown(ctx)
+	if err != nil {
+		t.Fatal("could not shut down:", err)
+	}
+	if _, open := <-toUser; open {
+		t.Fatal("external stream not closed by shutdown")
+	}
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatal("request accepted after shutdown:", rec.Code)
+	}
+}
+
+// countingMetrics counts calls by metric name and labels.
+type countingMetrics struct {
+	metrics.Nop
+	counts map[string]int
+}
+
+func (cm *countingMetrics) IncCounter(name string, labels metrics.Labels) {
+	cm.counts[name+" "+labels["method"]+" "+labels["status"]]++
+}
+
+func TestRequestMetrics(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	cm := &countingMetrics{counts: map[string]int{}}
+	ss.Metrics = cm
+	sr := New(ss)
+	sr.AddLocationReturn("/teapot", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.WriteHeader(http.StatusTeapot)
+		}))
+
+	for _, url := range []string{"/teapot", "/teapot", "/missing"} {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+url, nil)
+		sr.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if cm.counts[metrics.RequestsTotal+" GET 418"] != 2 ||
+		cm.counts[metrics.RequestsTotal+" GET 404"] != 1 {
+		t.Fatal("requests not counted correctly:", cm.counts)
+	}
+}
+
+// recordingLogger keeps the key/value pairs of every record it is given.
+type recordingLogger struct {
+	records []map[interface{}]interface{}
+}
+
+func (rl *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	record := map[interface{}]interface{}{"msg": msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		record[keyvals[i]] = keyvals[i+1]
+	}
+	rl.records = append(rl.records, record)
+}
+
+func TestRequestLogging(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	rl := &recordingLogger{}
+	ss.Logger = rl
+	sr := New(ss)
+	sr.AddLocationReturn("/logged", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			req.AddLogFields("widgets", 3)
+			req.Logger().Info("handling")
+			rw.WriteHeader(http.StatusAccepted)
+		}))
+
+	req, _ := http.NewRequest("POST", "http://jerf.org/logged", nil)
+	sr.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(rl.records) != 2 {
+		t.Fatal("wrong number of records logged:", rl.records)
+	}
+	handlerRecord, requestRecord := rl.records[0], rl.records[1]
+	if handlerRecord["msg"] != "handling" || handlerRecord["path"] != "/logged" {
+		t.Fatal("handler's record lacks the request:", handlerRecord)
+	}
+	if requestRecord["msg"] != "request" ||
+		requestRecord["method"] != "POST" ||
+		requestRecord["status"] != http.StatusAccepted ||
+		requestRecord["user"] != "Unauthenticated User" ||
+		requestRecord["widgets"] != 3 {
+		t.Fatal("request record incorrect:", requestRecord)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	at := abtime.NewManual()
+	sr := New(request.NewSphyraenaState(nil, nil))
+	rrb := NewRouteBlock()
+	sr.Add(&RateLimit{Rate: 1, Burst: 2, AbstractTime: at, RouteBlock: rrb})
+	rrb.AddLocationReturn("/limited", SF1)
+	sr.AddLocationReturn("/unlimited", SF2)
+
+	path := "/limited"
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// routes after the RateLimit neither use up nor are refused by it
+	path = "/unlimited"
+	for i := 0; i < 3; i++ {
+		if rec := get("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatal("route after the RateLimit limited:", rec.Code)
+		}
+	}
+	path = "/limited"
+
+	for i := 0; i < 2; i++ {
+		if rec := get("10.0.0.1:1234"); rec.Code != http.StatusOK {
+			t.Fatal("request within burst refused:", rec.Code)
+		}
+	}
+	rec := get("10.0.0.1:5678")
+	if rec.Code != http.StatusTooManyRequests ||
+		rec.Header().Get("Retry-After") != "1" {
+		t.Fatal("request over the limit not refused correctly:", rec.Code,
+			rec.Header())
+	}
+	if rec := get("10.0.0.2:1234"); rec.Code != http.StatusOK {
+		t.Fatal("other client limited too:", rec.Code)
+	}
+
+	at.Advance(time.Second)
+	if rec := get("10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Fatal("bucket did not refill:", rec.Code)
+	}
+	if rec := get("10.0.0.1:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Fatal("bucket refilled too much:", rec.Code)
+	}
+	path = "/unlimited"
+	if rec := get("10.0.0.1:1234"); rec.Code != http.StatusOK {
+		t.Fatal("limited client refused a route after the RateLimit:", rec.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+	req.RemoteAddr = "192.0.2.1:4000"
+	req.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	if ip := ClientIP(req, ""); ip != "192.0.2.1" {
+		t.Fatal("wrong IP from RemoteAddr:", ip)
+	}
+	if ip := ClientIP(req, "X-Forwarded-For"); ip != "198.51.100.7" {
+		t.Fatal("wrong IP from forwarded header:", ip)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.MaxBodySize = 10
+	sr := New(ss)
+
+	var readErr error
+	read := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			_, readErr = ioutil.ReadAll(req.Body)
+		})
+	sr.AddLocationReturn("/small", read)
+	sr.MaxBodySize(100).AddLocationReturn("/large", read)
+
+	post := func(path string, body io.Reader) int {
+		readErr = nil
+		req, _ := http.NewRequest("POST", "http://jerf.org"+path, body)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	twenty := strings.Repeat("x", 20)
+
+	if code := post("/small", strings.NewReader(twenty)); code != http.StatusRequestEntityTooLarge {
+		t.Fatal("oversized declared body not refused:", code)
+	}
+	if code := post("/large", strings.NewReader(twenty)); code != http.StatusOK || readErr != nil {
+		t.Fatal("route could not raise the limit:", code, readErr)
+	}
+
+	// with no declared length, the limit is only found by reading
+	post("/small", ioutil.NopCloser(strings.NewReader(twenty)))
+	if !request.IsBodyTooLarge(readErr) {
+		t.Fatal("reading past the limit did not fail correctly:", readErr)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.MaxHeaderCount = 3
+	ss.MaxHeaderBytes = 40
+	sr := New(ss)
+	sr.AddLocationReturn("/", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {}))
+
+	get := func(header http.Header) int {
+		req, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get(http.Header{"A": {"1", "2"}, "B": {"3"}}); code != http.StatusOK {
+		t.Fatal("headers within the limits refused:", code)
+	}
+	if code := get(http.Header{"A": {"1", "2"}, "B": {"3", "4"}}); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatal("too many headers accepted:", code)
+	}
+	if code := get(http.Header{"A": {strings.Repeat("x", 40)}}); code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatal("oversized headers accepted:", code)
+	}
+
+	ss.MaxHeaderCount = -1
+	ss.MaxHeaderBytes = -1
+	if code := get(http.Header{"A": {"1", "2", "3", strings.Repeat("x", 40)}}); code != http.StatusOK {
+		t.Fatal("headers refused without limits:", code)
+	}
+}
+
+func TestPathLimits(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.MaxPathLength = 20
+	ss.MaxPathSegments = 3
+	sr := New(ss)
+	handler := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {})
+	sr.AddLocationForward("/", handler)
+
+	get := func(path string) int {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	stream := func(path string) request.StreamRequestResult {
+		var result request.StreamRequestResult
+		req := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+			result = srr
+		})
+		req.Request, _ = http.NewRequest("GET", "http://jerf.org"+path, nil)
+		sr.RunStreamingRoute(req)
+		return result
+	}
+
+	if code := get("/a/b/c"); code != http.StatusOK {
+		t.Fatal("path within the limits refused:", code)
+	}
+	if code := get("/a/b/c/"); code != http.StatusRequestURITooLong {
+		t.Fatal("path with too many segments accepted:", code)
+	}
+	if code := get("/" + strings.Repeat("a", 20)); code != http.StatusRequestURITooLong {
+		t.Fatal("overlong path accepted:", code)
+	}
+	if result := stream("/a/b/c/d"); result.ErrorCode != http.StatusRequestURITooLong {
+		t.Fatal("streaming request with too many segments accepted:", result)
+	}
+
+	ss.MaxPathLength = -1
+	ss.MaxPathSegments = -1
+	if code := get("/a/b/c/d/" + strings.Repeat("a", 20)); code != http.StatusOK {
+		t.Fatal("path refused without limits:", code)
+	}
+}
+
+func TestAllowHeaders(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	sr := New(ss)
+
+	var seen http.Header
+	record := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			seen = req.Header
+		})
+	sr.Location("/strip").AllowHeaders("accept", "X-Token").Add(ReturnClause{record})
+	reject := NewRouteBlock()
+	reject.Add(ReturnClause{record})
+	sr.Location("/reject").Add(&AllowHeaders{[]string{"Accept", "X-Token"}, true, reject})
+	// a GET doesn't match under the AllowHeaders, and falls through to a
+	// handler that must still see every header
+	loc := sr.Location("/fallthrough")
+	loc.AllowHeaders("Accept").Method("PUT").Add(ReturnClause{record})
+	loc.Add(ReturnClause{record})
+
+	get := func(path string) int {
+		seen = nil
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		req.Header.Set("Accept", "text/html")
+		req.Header.Set("X-Token", "t")
+		req.Header.Set("X-Evil", "e")
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := get("/strip"); code != http.StatusOK || len(seen) != 2 ||
+		seen.Get("Accept") != "text/html" || seen.Get("X-Token") != "t" {
+		t.Fatal("headers not stripped correctly:", code, seen)
+	}
+	if code := get("/reject"); code != http.StatusBadRequest || seen != nil {
+		t.Fatal("unexpected headers not rejected:", code, seen)
+	}
+	if code := get("/fallthrough"); code != http.StatusOK ||
+		seen.Get("X-Token") != "t" || seen.Get("X-Evil") != "e" {
+		t.Fatal("headers stripped by a route that didn't match:", code, seen)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	handler := request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {})
+	api := sr.Location("/api")
+	api.AllowHeaders("accept", "x-token").Method("GET").Add(ForwardClause{handler})
+	api.Add(&MaxBodySize{10, api})
+
+	expected := `location /api
+  allow_headers Accept,X-Token
+    method GET
+      forward TBD
+  max_body_size 10
+    (cycle)
+`
+	if table := sr.RoutingTable(); table != expected {
+		t.Fatal("wrong routing table:\n" + table)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// Each case gets its own clock, as a manual clock's Trigger is used
+	// up by the first timer registered under the ID, even one that was
+	// stopped.
+	fastClock := abtime.NewManual()
+	slowClock := abtime.NewManual()
+	ss := request.NewSphyraenaState(nil, nil)
+	rl := &recordingLogger{}
+	ss.Logger = rl
+	sr := New(ss)
+	fast := NewRouteBlock()
+	sr.Add(&Timeout{time.Second, fastClock, fast})
+	slow := NewRouteBlock()
+	sr.Add(&Timeout{time.Second, slowClock, slow})
+
+	started := make(chan struct{})
+	writeErr := make(chan error, 1)
+	fast.AddLocationReturn("/fast", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			req.AddLogFields("handler", "fast")
+			rw.Header().Set("X-Handler", "yes")
+			rw.WriteHeader(http.StatusCreated)
+			_, _ = rw.Write([]byte("fast"))
+		},
+	))
+	slow.AddLocationReturn("/slow", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			close(started)
+			<-req.Request.Context().Done()
+			// neither of these may race with the router logging the
+			// request
+			req.AddLogFields("handler", "slow")
+			req.Set("late", true)
+			_, err := rw.Write([]byte("too late"))
+			writeErr <- err
+		},
+	))
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/fast", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated || rec.Body.String() != "fast" ||
+		rec.Header().Get("X-Handler") != "yes" {
+		t.Fatal("handler's response not passed along:", rec.Code, rec.Header(),
+			rec.Body.String())
+	}
+	if rl.records[len(rl.records)-1]["handler"] != "fast" {
+		t.Fatal("handler's log fields not passed along:", rl.records)
+	}
+
+	req, _ = http.NewRequest("GET", "http://jerf.org/slow", nil)
+	rec = httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		sr.ServeHTTP(rec, req)
+		close(served)
+	}()
+	<-started
+	slowClock.Trigger(timeoutTimer)
+	<-served
+	if rec.Code != http.StatusServiceUnavailable ||
+		rec.Body.String() != ErrRequestTimeout.Error()+"\n" {
+		t.Fatal("timeout not sent:", rec.Code, rec.Body.String())
+	}
+	if err := <-writeErr; err != ErrRequestTimeout {
+		t.Fatal("handler could write after timing out:", err)
+	}
+	if _, have := rl.records[len(rl.records)-1]["handler"]; have {
+		t.Fatal("timed out handler's log fields were logged:", rl.records)
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	clock := abtime.NewManual()
+	sr := New(request.NewSphyraenaState(nil, nil))
+	// the innermost Timeout is the one that applies
+	timed := NewRouteBlock()
+	sr.Timeout(time.Hour).Add(&Timeout{time.Second, clock, timed})
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	timed.AddStreamForward("/stuck", request.StreamHandlerFunc(
+		func(req *request.Request) {
+			close(started)
+			<-req.Request.Context().Done()
+			close(cancelled)
+		},
+	))
+
+	var result request.StreamRequestResult
+	req := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+		result = srr
+	})
+	req.Request, _ = http.NewRequest("GET", "http://jerf.org/stuck", nil)
+	go sr.RunStreamingRoute(req)
+	<-started
+	clock.Trigger(timeoutTimer)
+	<-cancelled
+	if result.ErrorCode != http.StatusServiceUnavailable ||
+		result.Error != ErrRequestTimeout.Error() {
+		t.Fatal("stream timeout not sent:", result)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/panic", request.HandlerFunc(
+		func(*sphyrw.SphyraenaResponseWriter, *request.Request) {
+			panic("handler panic")
+		},
+	))
+	sr.AddLocationForward("/ok", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+			_, _ = rw.Write([]byte("ok"))
+		},
+	))
+	sr.AddStreamForward("/stream", request.StreamHandlerFunc(
+		func(*request.Request) {
+			panic("stream handler panic")
+		},
+	))
+
+	for _, url := range []string{"/panic", "/ok"} {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+url, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if url == "/panic" && rec.Code != http.StatusInternalServerError {
+			t.Fatal("panic not turned into a 500:", rec.Code)
+		}
+		if url == "/ok" && rec.Body.String() != "ok" {
+			t.Fatal("server did not stay up after a panic:", rec.Code)
+		}
+	}
+
+	var result request.StreamRequestResult
+	req := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+		result = srr
+	})
+	req.Request, _ = http.NewRequest("GET", "http://jerf.org/stream", nil)
+	sr.RunStreamingRoute(req)
+	if result.ErrorCode != http.StatusInternalServerError {
+		t.Fatal("stream handler panic not reported:", result)
+	}
+}
+
+func TestTryWriteJSON(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/json", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			var val interface{} = map[string]int{"a": 1}
+			if req.URL.Query().Get("bad") != "" {
+				val = map[string]interface{}{"a": make(chan int)}
+			}
+			if err := rw.TryWriteJSON(val); err != nil {
+				rw.Error(http.StatusInternalServerError, "can't encode")
+			}
+		},
+	))
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/json", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "{\"a\":1}\n" ||
+		rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatal("JSON not written:", rec.Code, rec.Header(), rec.Body.String())
+	}
+
+	req, _ = http.NewRequest("GET", "http://jerf.org/json?bad=1", nil)
+	rec = httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError ||
+		rec.Body.String() != "can't encode\n" {
+		t.Fatal("encoding failure not left to the handler:", rec.Code,
+			rec.Body.String())
+	}
+}
+
+func TestResponseBuffering(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	ss.ResponseBufferSize = 10
+	sr := New(ss)
+	sr.AddLocationForward("/small", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+			_, _ = rw.Write([]byte("hello"))
+			_, _ = rw.Write([]byte("!"))
+		},
+	))
+	sr.AddLocationForward("/large", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+			_, _ = rw.Write([]byte("hello"))
+			_, _ = rw.Write([]byte(" world, at length"))
+		},
+	))
+	sr.AddLocationForward("/flushed", request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+			_, _ = rw.Write([]byte("hello"))
+			rw.Flush()
+		},
+	))
+	sr.AddLocationForward("/empty", request.HandlerFunc(
+		func(*sphyrw.SphyraenaResponseWriter, *request.Request) {},
+	))
+
+	for _, test := range []struct {
+		path          string
+		body          string
+		contentLength string
+	}{
+		{"/small", "hello!", "6"},
+		{"/large", "hello world, at length", ""},
+		{"/flushed", "hello", ""},
+		{"/empty", "", "0"},
+	} {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+test.path, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != test.body ||
+			rec.Header().Get("Content-Length") != test.contentLength {
+			t.Fatal("wrong buffered response for", test.path, ":", rec.Code,
+				rec.Body.String(), rec.Header())
+		}
+	}
+
+	// streaming requests are never buffered
+	req, _ := http.NewRequest("GET", "http://jerf.org/small", nil)
+	rec := httptest.NewRecorder()
+	_, srw := ss.NewRequest(rec, req, true)
+	_, _ = srw.Write([]byte("hello"))
+	if rec.Body.String() != "hello" {
+		t.Fatal("streaming request buffered")
+	}
+}
+
+// codeRecorder records every status code written, including
+// informational ones.
+type codeRecorder struct {
+	*httptest.ResponseRecorder
+	codes []int
+}
+
+func (cr *codeRecorder) WriteHeader(code int) {
+	cr.codes = append(cr.codes, code)
+	cr.ResponseRecorder.WriteHeader(code)
+}
+
+func TestPushAndEarlyHints(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	req, _ := http.NewRequest("GET", "http://jerf.org/", nil)
+	rec := &codeRecorder{ResponseRecorder: httptest.NewRecorder()}
+	_, srw := ss.NewRequest(rec, req, false)
+
+	if err := srw.Push("/app.js", nil); err != http.ErrNotSupported {
+		t.Fatal("push without a Pusher did not report it:", err)
+	}
+
+	link := sphyrw.PreloadLink("/app.js", "script")
+	srw.EarlyHints(link)
+	if srw.Status() != 0 {
+		t.Fatal("early hints taken as the response status:", srw.Status())
+	}
+	srw.WriteHeader(http.StatusCreated)
+	srw.EarlyHints(sphyrw.PreloadLink("/late.js", "script"))
+	if fmt.Sprint(rec.codes) != "[103 201]" ||
+		fmt.Sprint(rec.Header().Values("Link")) != "["+link+"]" {
+		t.Fatal("wrong early hints:", rec.codes, rec.Header())
+	}
+}
+
+func TestDualClause(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	var streamed bool
+	sr.AddDualForward("/resource",
+		request.HandlerFunc(
+			func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+				rw.Write([]byte("fetched"))
+			},
+		),
+		request.StreamHandlerFunc(func(req *request.Request) {
+			streamed = true
+			req.StreamResponse(request.StreamRequestResult{SubstreamID: 3})
+		}),
+	)
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/resource", nil)
+	rec := httptest.NewRecorder()
+	sr.ServeHTTP(rec, req)
+	if rec.Body.String() != "fetched" || streamed {
+		t.Fatal("HTTP request not served by the handler:", rec.Body.String())
+	}
+
+	var result request.StreamRequestResult
+	streamReq := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+		result = srr
+	})
+	streamReq.Request, _ = http.NewRequest("GET", "http://jerf.org/resource", nil)
+	sr.RunStreamingRoute(streamReq)
+	if !streamed || result.SubstreamID != 3 {
+		t.Fatal("streaming request not served by the stream handler:", result)
+	}
+
+	dc := DualClause{request.HandlerFunc(nil), request.StreamHandlerFunc(nil)}
+	if dc.Argument() != "request.HandlerFunc request.StreamHandlerFunc" {
+		t.Fatal("routing table does not show both handlers:", dc.Argument())
+	}
+}
+
+type nonStreaming struct {
+	request.StreamHandlerFunc
+}
+
+func (ns nonStreaming) ServeStreaming(*sphyrw.SphyraenaResponseWriter, *request.Request) {}
+
+func (ns nonStreaming) MayStream() bool {
+	return false
+}
+
+func TestStreamingNotSupported(t *testing.T) {
+	ran := false
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/plain", nonStreaming{})
+	sr.AddStreamForward("/declines", nonStreaming{func(*request.Request) {
+		ran = true
+	}})
+
+	for _, path := range []string{"/plain", "/declines"} {
+		var result request.StreamRequestResult
+		req := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+			result = srr
+		})
+		req.Request, _ = http.NewRequest("GET", "http://jerf.org"+path, nil)
+		sr.RunStreamingRoute(req)
+		if result.ErrorCode != http.StatusNotAcceptable ||
+			result.Error != ErrStreamingNotSupported.Error() {
+			t.Fatal("stream request to a non-streaming resource not refused:",
+				path, result)
+		}
+	}
+	if ran {
+		t.Fatal("stream handler declining to stream was run")
+	}
+}
+
+func TestNoStreamResponse(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddStreamForward("/forgetful", request.StreamHandlerFunc(func(*request.Request) {}))
+
+	var result request.StreamRequestResult
+	responses := 0
+	req := request.FromStream(nil, nil, func(srr request.StreamRequestResult) {
+		result = srr
+		responses++
+	})
+	req.Request, _ = http.NewRequest("GET", "http://jerf.org/forgetful", nil)
+	sr.RunStreamingRoute(req)
+	if responses != 1 || result.ErrorCode != http.StatusInternalServerError ||
+		result.Error != ErrNoStreamResponse.Error() || !req.StreamResponded() {
+		t.Fatal("handler that opened no stream not reported:", responses, result)
+	}
+}
+
+func TestNotFoundAndErrorHandlers(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/panic", request.HandlerFunc(
+		func(*sphyrw.SphyraenaResponseWriter, *request.Request) {
+			panic("handler panic")
+		},
+	))
+	broken := sr.Location("/broken")
+	broken.AddLocation("", broken)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://jerf.org"+path, nil)
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/missing"); rec.Code != http.StatusNotFound {
+		t.Fatal("default not found response changed:", rec.Code)
+	}
+
+	sr.NotFoundHandler = request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.WriteHeader(http.StatusNotFound)
+			_, _ = rw.Write([]byte("no " + req.URL.Path))
+		},
+	)
+	var handledErr error
+	sr.ErrorHandler = request.HandlerFunc(
+		func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			handledErr = RequestError(req)
+			rw.WriteHeader(RequestErrorStatus(req))
+			_, _ = rw.Write([]byte("sorry"))
+		},
+	)
+
+	rec := get("/missing")
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "no /missing" {
+		t.Fatal("NotFoundHandler not used:", rec.Code, rec.Body.String())
+	}
+
+	rec = get("/panic")
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "sorry" ||
+		handledErr == nil || !strings.Contains(handledErr.Error(), "handler panic") {
+		t.Fatal("ErrorHandler not used for a panic:", rec.Code, handledErr)
+	}
+
+	handledErr = nil
+	rec = get("/broken")
+	if rec.Code != http.StatusInternalServerError || rec.Body.String() != "sorry" ||
+		handledErr != ErrRecursionLimit {
+		t.Fatal("ErrorHandler not used for a routing error:", rec.Code, handledErr)
+	}
+
+	sr.ErrorHandler = request.HandlerFunc(
+		func(*sphyrw.SphyraenaResponseWriter, *request.Request) {
+			panic("error handler panic")
+		},
+	)
+	if rec = get("/panic"); rec.Code != http.StatusInternalServerError {
+		t.Fatal("panicking ErrorHandler not turned into a 500:", rec.Code)
+	}
+}
+
+// headerAuth refuses requests without the X-Auth header, as an
+// authentication clause would.
+type headerAuth struct{}
+
+func (ha headerAuth) Route(rr *Request) (res Result) {
+	if rr.Request.Header.Get("X-Auth") == "" {
+		res.Handler = request.HandlerFunc(
+			func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+				rw.Error(http.StatusForbidden, "forbidden")
+			})
+	}
+	return
+}
+
+func (ha headerAuth) Name() string               { return "header_auth" }
+func (ha headerAuth) Argument() string           { return "" }
+func (ha headerAuth) GetRouteBlock() *RouteBlock { return nil }
+func (ha headerAuth) Prototype() RouterClause    { return headerAuth{} }
+
+func TestAddRoutes(t *testing.T) {
+	says := func(body string) request.Handler {
+		return request.HandlerFunc(
+			func(rw *sphyrw.SphyraenaResponseWriter, _ *request.Request) {
+				_, _ = rw.Write([]byte(body))
+			})
+	}
+
+	sr := New(request.NewSphyraenaState(nil, nil))
+	err := sr.AddRoutes(
+		RouteSpec{Path: "/", Exact: true, Handler: says("index")},
+		RouteSpec{Path: "/items", Exact: true, Methods: []string{"GET"},
+			Handler: says("list")},
+		RouteSpec{Path: "/items", Exact: true, Methods: []string{"POST"},
+			Handler: says("create")},
+		RouteSpec{
+			Path:  "/admin",
+			Auth:  []RouterClause{headerAuth{}},
+			Holes: hole.SecurityHoles{hole.AllowBrowserTypeGuessing()},
+			Routes: []RouteSpec{
+				{Path: "/users", Handler: says("users")},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, path string
+		auth         bool
+		status       int
+		body         string
+	}{
+		{"GET", "/", false, 200, "index"},
+		{"GET", "/items", false, 200, "list"},
+		{"HEAD", "/items", false, 200, ""},
+		{"POST", "/items", false, 200, "create"},
+		{"DELETE", "/items", false, 404, ""},
+		{"GET", "/items/1", false, 404, ""},
+		{"GET", "/admin/users", false, 403, ""},
+		{"GET", "/admin/users/1", true, 200, "users"},
+	} {
+		req, _ := http.NewRequest(test.method, "http://jerf.org"+test.path, nil)
+		if test.auth {
+			req.Header.Set("X-Auth", "yes")
+		}
+		rec := httptest.NewRecorder()
+		sr.ServeHTTP(rec, req)
+		if rec.Code != test.status ||
+			(test.body != "" && rec.Body.String() != test.body) {
+			t.Fatal("wrong result for", test.method, test.path, ":",
+				rec.Code, rec.Body.String())
+		}
+		if test.body == "users" && rec.Header().Get("X-Content-Type-Options") != "" {
+			t.Fatal("route spec holes not opened")
+		}
+	}
+
+	for _, specs := range [][]RouteSpec{
+		{
+			{Path: "/a", Exact: true, Handler: SF1},
+			{Path: "/a", Exact: true, Methods: []string{"POST"}, Handler: SF2},
+		},
+		{
+			{Path: "/a", Exact: true, Methods: []string{"GET"}, Handler: SF1},
+			{Path: "/a", Exact: true, Methods: []string{"HEAD"}, Handler: SF2},
+		},
+		{
+			{Path: "/a", Routes: []RouteSpec{
+				{Path: "/b", Exact: true, Handler: SF1},
+			}},
+			{Path: "/a/b", Exact: true, Handler: SF2},
+		},
+	} {
+		rb := NewRouteBlock()
+		if err := rb.AddRoutes(specs...); !errors.Is(err, ErrDuplicateRoute) {
+			t.Fatal("duplicate routes not detected:", err)
+		}
+		if len(rb.clauses) != 0 {
+			t.Fatal("invalid route specs partially added")
+		}
+	}
+
+	for _, spec := range []RouteSpec{
+		{Path: "/a"},
+		{Path: "/a", Handler: SF1, Routes: []RouteSpec{{Handler: SF2}}},
+		{Path: "/a", Exact: true, Routes: []RouteSpec{{Handler: SF2}}},
+		{Path: "/a", Handler: SF1, Auth: []RouterClause{nil}},
+	} {
+		if err := NewRouteBlock().AddRoutes(spec); !errors.Is(err, ErrInvalidRouteSpec) {
+			t.Fatal("invalid route spec accepted:", err)
+		}
+	}
+
+	if err := NewRouteBlock().AddRoutes(
+		RouteSpec{Path: "/a", Methods: []string{"GET"}, Handler: SF1},
+		RouteSpec{Path: "/a", Methods: []string{"POST"}, Handler: SF2},
+		RouteSpec{Path: "/a", Exact: true, Handler: SF2},
+	); err != nil {
+		t.Fatal("distinct routes refused:", err)
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	sr := New(request.NewSphyraenaState(nil, nil))
+	sr.AddLocationForward("/public/", SF1)
+	sr.AddLocationForward("/public/img/", SF2)
+	AddExactLocation(sr.RouteBlock, "/about", SF1)
+	AddExactLocation(sr.RouteBlock, "/about", SF2)
+	sr.Method("GET").AddLocationForward("/api", SF1)
+	sr.AddLocationForward("/api", SF2)
+	sr.AddLocationReturn("/exact", SF1)
+	sr.AddLocationReturn("/exact/more", SF2)
+	admin := sr.Location("/admin")
+	admin.Add(ForwardClause{SF1})
+	admin.AddLocationReturn("/users", SF2)
+	sr.AddLocationForward("/", SF1)
+	sr.AddLocationForward("/late", SF2)
+
+	warnings := sr.WarnRoutes()
+	descriptions := []string{}
+	for _, w := range warnings {
+		descriptions = append(descriptions, w.String())
+	}
+	expected := []string{
+		`location /public/img/ at "" is unreachable: shadowed by the earlier location "/public/"`,
+		`exact_location /about at "" is unreachable: duplicates the earlier exact location "/about"`,
+		`location /users at "/admin" is unreachable: shadowed by the earlier location "/admin"`,
+		`location /late at "" is unreachable: shadowed by the earlier location "/"`,
+	}
+	if strings.Join(descriptions, "\n") != strings.Join(expected, "\n") {
+		t.Fatal("wrong route warnings:\n" + strings.Join(descriptions, "\n"))
+	}
+
+	// a cycle in the routing table doesn't hang the check
+	cyclic := NewRouteBlock()
+	cyclic.AddLocation("/again", cyclic)
+	if len(cyclic.CheckRoutes()) != 0 {
+		t.Fatal("spurious warnings for a cyclic routing table")
+	}
+}
@@ -0,0 +1,171 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
+)
+
+// ErrInvalidRouteSpec is wrapped by the errors AddRoutes returns for a
+// RouteSpec that can't be built.
+var ErrInvalidRouteSpec = errors.New("invalid route spec")
+
+// ErrDuplicateRoute is wrapped by the errors AddRoutes returns for a route
+// that could never be reached because an earlier route takes the same
+// requests.
+var ErrDuplicateRoute = errors.New("duplicate route")
+
+// A RouteSpec declares a route, or a group of routes, as data, so that a
+// route table can be written and reviewed as one literal. See AddRoutes.
+//
+// Path is matched as a StaticLocation, or as an ExactLocation if Exact is
+// set, after the Path of any enclosing RouteSpec has been matched. An
+// empty Path matches without consuming any of the path, which groups
+// routes that share their Methods, Holes, or Auth.
+//
+// Methods, if not empty, restricts the route to requests with those
+// methods, as the Method clause does. As streaming requests have no
+// method, a route with Methods never takes them.
+//
+// Holes are opened for the route as the SecurityHoles clause does.
+//
+// Auth are the clauses the request is routed through before reaching the
+// Handler or the Routes, such as a clauses.CookieAuth or
+// clauses.BasicAuth, in order.
+//
+// A RouteSpec either is handled by its Handler, StreamHandler, or both, as
+// the ForwardClause, StreamClause, and DualClause do, or contains further
+// Routes, but not both.
+type RouteSpec struct {
+	Path    string
+	Exact   bool
+	Methods []string
+	Holes   hole.SecurityHoles
+	Auth    []RouterClause
+
+	Handler       request.Handler
+	StreamHandler request.StreamHandler
+
+	Routes []RouteSpec
+}
+
+// AddRoutes builds the given RouteSpecs into clauses and adds them to the
+// RouteBlock, in order.
+//
+// The RouteSpecs are checked before anything is added. If a RouteSpec is
+// malformed, or any two take the same requests, such as two Exact routes
+// for the same path with the same method, an error is returned and the
+// RouteBlock is left unchanged.
+func (rb *RouteBlock) AddRoutes(specs ...RouteSpec) error {
+	seen := map[routeKey][][]string{}
+	for _, spec := range specs {
+		if err := checkRouteSpec(spec, "", seen); err != nil {
+			return err
+		}
+	}
+
+	for _, spec := range specs {
+		buildRouteSpec(rb, spec)
+	}
+	return nil
+}
+
+// a routeKey identifies the requests a route takes, other than by method
+type routeKey struct {
+	path  string
+	exact bool
+}
+
+func checkRouteSpec(spec RouteSpec, prefix string, seen map[routeKey][][]string) error {
+	path := prefix + spec.Path
+	hasHandler := spec.Handler != nil || spec.StreamHandler != nil
+
+	switch {
+	case hasHandler && len(spec.Routes) > 0:
+		return fmt.Errorf("%w %q: has both a handler and routes", ErrInvalidRouteSpec, path)
+	case !hasHandler && len(spec.Routes) == 0:
+		return fmt.Errorf("%w %q: has neither a handler nor routes", ErrInvalidRouteSpec, path)
+	case spec.Exact && len(spec.Routes) > 0:
+		return fmt.Errorf("%w %q: an exact location can't contain routes", ErrInvalidRouteSpec, path)
+	}
+	for _, auth := range spec.Auth {
+		if auth == nil {
+			return fmt.Errorf("%w %q: has a nil Auth clause", ErrInvalidRouteSpec, path)
+		}
+	}
+
+	if hasHandler {
+		key := routeKey{path, spec.Exact}
+		for _, previous := range seen[key] {
+			if methodsOverlap(previous, spec.Methods) {
+				return fmt.Errorf("%w: %q", ErrDuplicateRoute, path)
+			}
+		}
+		seen[key] = append(seen[key], spec.Methods)
+		return nil
+	}
+
+	for _, child := range spec.Routes {
+		// A child can only take requests with the methods its parents
+		// permit.
+		if len(child.Methods) == 0 {
+			child.Methods = spec.Methods
+		}
+		if err := checkRouteSpec(child, path, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// methodsOverlap returns whether any request could be permitted by both
+// sets of methods, where an empty set permits every method.
+func methodsOverlap(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, method := range a {
+		if methodPermitted(b, method) {
+			return true
+		}
+	}
+	for _, method := range b {
+		if methodPermitted(a, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func buildRouteSpec(rb *RouteBlock, spec RouteSpec) {
+	switch {
+	case spec.Exact:
+		exact := NewRouteBlock()
+		rb.Add(&ExactLocation{spec.Path, exact})
+		rb = exact
+	case spec.Path != "":
+		rb = rb.Location(spec.Path)
+	}
+	if len(spec.Methods) > 0 {
+		rb = rb.Method(spec.Methods...)
+	}
+	if len(spec.Holes) > 0 {
+		rb = rb.WithHoles(spec.Holes...)
+	}
+	rb.Add(spec.Auth...)
+
+	switch {
+	case spec.Handler != nil && spec.StreamHandler != nil:
+		rb.Add(DualClause{spec.Handler, spec.StreamHandler})
+	case spec.Handler != nil:
+		rb.Add(ForwardClause{spec.Handler})
+	case spec.StreamHandler != nil:
+		rb.Add(StreamClause{spec.StreamHandler})
+	}
+
+	for _, child := range spec.Routes {
+		buildRouteSpec(rb, child)
+	}
+}
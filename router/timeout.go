@@ -0,0 +1,206 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+)
+
+// ErrRequestTimeout is returned by writes made by a handler after its
+// Timeout has expired, and sent to streaming requests that were not
+// responded to in time.
+var ErrRequestTimeout = errors.New("request timed out")
+
+// the abtime timer ID used for Timeouts
+const timeoutTimer = 1
+
+// Timeout bounds how long the handler for anything routed through its
+// RouteBlock has to respond, overriding any Timeout enclosing it. It is
+// tracked with the AbstractTime, or the real time if that is nil.
+//
+// For HTTP requests, the handler is run in its own goroutine, and what it
+// writes is held back until it returns. If it hasn't returned within the
+// Duration, the user is sent a 503 Service Unavailable instead, the
+// context of the request's http.Request is cancelled, and anything the
+// handler writes afterwards is discarded, with ErrRequestTimeout returned
+// from its writes. As the response is held back, a handler that streams
+// its response over time, or hijacks the connection, should not be
+// placed under a Timeout. The handler is given its own copy of the
+// request, as from request.Request.Fork, whose changes are taken on only
+// if it returns in time. A handler still running after the timeout should
+// stop as soon as it sees the context is done.
+//
+// For streaming requests, only the initial response is bounded. If the
+// StreamHandler has not called StreamResponse within the Duration, the
+// user is sent ErrRequestTimeout with a 503 and the context is cancelled;
+// once the stream has been opened, it may run as long as it likes.
+type Timeout struct {
+	Duration time.Duration
+	abtime.AbstractTime
+	*RouteBlock
+}
+
+// Route implements the RoutingClause interface.
+func (t *Timeout) Route(rr *Request) (res Result) {
+	rr.SetTimeout(t.Duration, t.AbstractTime)
+	res.RouteBlock = t.RouteBlock
+	return
+}
+
+// Name returns "timeout".
+func (t *Timeout) Name() string {
+	return "timeout"
+}
+
+// Argument returns the duration.
+func (t *Timeout) Argument() string {
+	return t.Duration.String()
+}
+
+// Prototype returns a Timeout object.
+func (t *Timeout) Prototype() RouterClause {
+	return &Timeout{}
+}
+
+type timeoutHandler struct {
+	request.Handler
+	d     time.Duration
+	clock abtime.AbstractTime
+}
+
+func (th timeoutHandler) ServeStreaming(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	ctx, cancel := context.WithCancel(req.Request.Context())
+	defer cancel()
+	req.Request = req.Request.WithContext(ctx)
+
+	timer := clockOrReal(th.clock).NewTimer(th.d, timeoutTimer)
+	defer timer.Stop()
+
+	tw := &timeoutWriter{header: rw.Header().Clone()}
+	fork := req.Fork()
+	done := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked <- r
+			}
+		}()
+		srw := sphyrw.NewSphyraenaResponseWriter(tw)
+		th.Handler.ServeStreaming(srw, fork)
+		srw.Finish()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// The handler is done with the timeoutWriter and its request, so
+		// they can be read without the lock.
+		req.Join(fork)
+		header := rw.Header()
+		for key := range header {
+			delete(header, key)
+		}
+		for key, value := range tw.header {
+			header[key] = value
+		}
+		if tw.code != 0 {
+			rw.WriteHeader(tw.code)
+			_, _ = rw.Write(tw.buf.Bytes())
+		}
+	case r := <-panicked:
+		// rethrown here, so the router recovers it as for any handler
+		panic(r)
+	case <-timer.Channel():
+		tw.mu.Lock()
+		tw.timedOut = true
+		tw.mu.Unlock()
+		cancel()
+		req.Logger().Info("handler timed out", "timeout", th.d.String())
+		rw.Error(http.StatusServiceUnavailable, ErrRequestTimeout.Error())
+	}
+}
+
+// timeoutWriter holds back the response written by a handler under a
+// Timeout. Once timedOut is set, the response belongs to the router,
+// and everything further the handler writes is discarded.
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	code     int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, ErrRequestTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+	return tw.buf.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	// informational responses can't be held back, so they are dropped
+	if tw.timedOut || tw.code != 0 || isInformational(code) {
+		return
+	}
+	tw.code = code
+}
+
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+type timeoutStreamHandler struct {
+	request.StreamHandler
+	d     time.Duration
+	clock abtime.AbstractTime
+}
+
+func (tsh timeoutStreamHandler) HandleStream(req *request.Request) {
+	cancel := func() {}
+	if req.Request != nil {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(req.Request.Context())
+		req.Request = req.Request.WithContext(ctx)
+	}
+	defer cancel()
+
+	timer := clockOrReal(tsh.clock).AfterFunc(tsh.d, func() {
+		responded := req.TryStreamResponse(request.StreamRequestResult{
+			Error:     ErrRequestTimeout.Error(),
+			ErrorCode: http.StatusServiceUnavailable,
+		})
+		if responded {
+			cancel()
+		}
+	}, timeoutTimer)
+	defer timer.Stop()
+
+	tsh.StreamHandler.HandleStream(req)
+}
+
+func clockOrReal(clock abtime.AbstractTime) abtime.AbstractTime {
+	if clock == nil {
+		return abtime.NewRealTime()
+	}
+	return clock
+}
@@ -3,9 +3,15 @@ package router
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
+	"github.com/thejerf/sphyraena/metrics"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/sphyrw"
 	"github.com/thejerf/sphyraena/sphyrw/hole"
@@ -15,6 +21,19 @@ import (
 
 var ErrStreamHandlerNotFound = errors.New("stream handler not found")
 
+// ErrNoStreamResponse is returned to stream requests whose StreamHandler
+// returned without calling StreamResponse.
+var ErrNoStreamResponse = errors.New("stream handler terminated without ever creating a stream")
+
+// ErrStreamingNotSupported is returned to stream requests that are routed
+// to a resource which only serves plain HTTP requests, or to a
+// StreamHandler that is a request.MayStreamer declining to stream.
+var ErrStreamingNotSupported = errors.New("resource does not support streaming")
+
+// ErrShuttingDown is returned to stream requests that arrive after the
+// SphyraenaState has begun shutting down.
+var ErrShuttingDown = errors.New("server shutting down")
+
 // This package defines the top-level router that defines a Sphyraena
 // application. It may someday come out of this module.
 //
@@ -27,18 +46,83 @@ var ErrStreamHandlerNotFound = errors.New("stream handler not found")
 type SphyraenaRouter struct {
 	*RouteBlock
 
+	// If SynthesizeHEAD is true, HEAD requests are answered by routing
+	// them as GET requests, running the resulting handler, and discarding
+	// the body it writes. The handler sees a GET request. The
+	// Content-Length is set to the length of the discarded body, unless
+	// the handler set it itself.
+	//
+	// This means every GET handler will be run for HEAD requests as well,
+	// so this must not be turned on if any GET handler has side effects
+	// that must not happen for a HEAD. Of course, GET handlers shouldn't
+	// have side effects, but this is a default-secure framework, so this
+	// is off unless you ask for it.
+	SynthesizeHEAD bool
+
+	// RecursionLimit is the maximum number of RouteBlocks a request may be
+	// routed into. If zero, DefaultRecursionLimit is used.
+	RecursionLimit int
+
+	// If RedirectTrailingSlash is true, a request that matches no route,
+	// but would match one if a trailing slash were added to or removed
+	// from its path, is redirected to that path. GET and HEAD requests are
+	// redirected with a 301; all other methods with a 308, so the
+	// client resends the method and body rather than turning it into a
+	// GET.
+	//
+	// This is off by default, as Sphyraena prefers URLs to match exactly
+	// what they say.
+	RedirectTrailingSlash bool
+
+	// NotFoundHandler, if set, is run in place of the plain 404 for HTTP
+	// requests that match no route, such as to render the site's own
+	// page, or a JSON error for an API. The path that was attempted is
+	// the request's URL.Path. The handler must set the status itself.
+	NotFoundHandler request.Handler
+
+	// ErrorHandler, if set, is run in place of the plain 500 when routing
+	// an HTTP request fails, or its handler panics before responding.
+	// RequestError returns the error to it; as that may carry internal
+	// details, it should be logged rather than shown to the user. The
+	// handler must set the status itself; RequestErrorStatus gives the
+	// one that would have been sent. Should it panic as well, the
+	// plain 500 is sent.
+	ErrorHandler request.Handler
+
 	sphyraenaState *request.SphyraenaState
 }
 
 func New(ss *request.SphyraenaState) *SphyraenaRouter {
 	return &SphyraenaRouter{
-		&RouteBlock{[]RouterClause{}},
-		ss,
+		RouteBlock:     &RouteBlock{[]RouterClause{}},
+		sphyraenaState: ss,
 	}
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (sr *SphyraenaRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if sr.sphyraenaState.ShuttingDown() {
+		rw.Header().Set("Connection", "close")
+		http.Error(rw, "server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := sr.sphyraenaState.CheckHeaders(req.Header); err != nil {
+		http.Error(rw, err.Error(), http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+	if err := sr.sphyraenaState.CheckPath(req.URL.Path); err != nil {
+		http.Error(rw, err.Error(), http.StatusRequestURITooLong)
+		return
+	}
+	if hole.IsPreflight(req) {
+		sr.servePreflight(rw, req)
+		return
+	}
+	if req.Method == http.MethodHead && sr.SynthesizeHEAD {
+		sr.serveHEAD(rw, req)
+		return
+	}
+
 	ctx, srw := sr.sphyraenaState.NewRequest(rw, req, false)
 
 	sr.RunRoute(srw, ctx)
@@ -46,10 +130,17 @@ func (sr *SphyraenaRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request)
 
 // RunRoute runs the given route with an HTTP request (not a streaming request).
 func (sr *SphyraenaRouter) RunRoute(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+	start := time.Now()
 	handler, routeResult, err := sr.getHTTPHandler(req)
 	if err != nil {
-		// FIXME: need to do something different
-		panic(err.Error())
+		status, msg := routingError(req, err)
+		if sr.ErrorHandler != nil {
+			sr.serveError(rw, req, err, status)
+		} else {
+			rw.Error(status, msg)
+		}
+		recordRequest(rw, req, start)
+		return
 	}
 
 	// This means that if a nil handler is returned, any content in the
@@ -57,7 +148,15 @@ func (sr *SphyraenaRouter) RunRoute(rw *sphyrw.SphyraenaResponseWriter, req *req
 	// Though as SphyRW gets stronger and starts returning things, maybe
 	// that will be less true.
 	if handler == nil {
-		http.NotFound(rw, req.Request)
+		if !sr.RedirectTrailingSlash || !sr.redirectTrailingSlash(rw, req) {
+			if sr.NotFoundHandler != nil {
+				request.Recover(sr.NotFoundHandler).ServeStreaming(rw, req)
+				rw.Finish()
+			} else {
+				http.NotFound(rw, req.Request)
+			}
+		}
+		recordRequest(rw, req, start)
 		return
 	}
 
@@ -76,17 +175,201 @@ func (sr *SphyraenaRouter) RunRoute(rw *sphyrw.SphyraenaResponseWriter, req *req
 	// difficult to audit.) For this reason, the routing table is given
 	// priority over the handlers.
 	hole.ApplySecurityHeaders(rw.Header(), routeResult.Holes)
+	hole.ApplyCORSHeaders(rw.Header(), req.Request, routeResult.Holes)
+
+	if !req.LimitBody(rw) {
+		recordRequest(rw, req, start)
+		return
+	}
+	sr.runHandler(handler, rw, req)
+	rw.Finish()
+	recordRequest(rw, req, start)
+}
+
+type requestErrorKey struct{}
 
+type requestError struct {
+	err    error
+	status int
+}
+
+// RequestError returns the error that caused the ErrorHandler to be run
+// for the given request, or nil if it wasn't.
+func RequestError(req *request.Request) error {
+	re, _ := req.Value(requestErrorKey{}).(requestError)
+	return re.err
+}
+
+// RequestErrorStatus returns the status that would have been sent in
+// place of the ErrorHandler for the given request, or 0 if it wasn't run.
+// An ErrorHandler may use it as its own status.
+func RequestErrorStatus(req *request.Request) int {
+	re, _ := req.Value(requestErrorKey{}).(requestError)
+	return re.status
+}
+
+// runHandler runs the handler for an HTTP request, recovering from any
+// panic as request.Recover does, but with the ErrorHandler.
+func (sr *SphyraenaRouter) runHandler(
+	handler request.Handler,
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+) {
+	if sr.ErrorHandler == nil {
+		request.Recover(handler).ServeStreaming(rw, req)
+		return
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		request.LogPanic(req, r)
+		if rw.Status() == 0 {
+			sr.serveError(rw, req, fmt.Errorf("handler panicked: %v", r),
+				http.StatusInternalServerError)
+		}
+	}()
 	handler.ServeStreaming(rw, req)
 }
 
-func (sr *SphyraenaRouter) RunStreamingRoute(req *request.Request) {
-	// FIXME: This MUST handle panics! It's being run as a top-level goroutine.
-	handler, routeResult, err := sr.getStreamingHandler(req)
+// serveError runs the ErrorHandler for the given error, in place of
+// responding with the given status.
+func (sr *SphyraenaRouter) serveError(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	err error,
+	status int,
+) {
+	req.Set(requestErrorKey{}, requestError{err, status})
+	request.Recover(sr.ErrorHandler).ServeStreaming(rw, req)
+	rw.Finish()
+}
+
+// routingError logs an error returned by routing the request, and returns
+// the status and message to respond with in its place.
+//
+// The error may carry internal details of the route configuration, so it
+// is not sent to the client.
+func routingError(req *request.Request, err error) (int, string) {
+	logArgs := []interface{}{"err", err}
+	if req.Request != nil {
+		logArgs = append(logArgs, "method", req.Method, "path", req.URL.Path)
+	}
+	slog.Error("could not route request", logArgs...)
+	return http.StatusInternalServerError,
+		http.StatusText(http.StatusInternalServerError)
+}
+
+// recordRequest reports the metrics and the log record for a completed
+// HTTP request.
+func recordRequest(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+	start time.Time,
+) {
+	status := rw.Status()
+	if status == 0 {
+		// nothing written; Finish will send an empty 200
+		status = http.StatusOK
+	}
+	labels := metrics.Labels{
+		"method": req.Method,
+		"status": strconv.Itoa(status),
+	}
+	duration := time.Since(start)
+	m := req.Metrics()
+	m.IncCounter(metrics.RequestsTotal, labels)
+	m.ObserveHistogram(metrics.RequestDuration, duration.Seconds(), labels)
+
+	req.LogRequest(status, duration)
+}
+
+// servePreflight answers a CORS preflight request from the CORS holes of
+// the route the request would take. The handler itself is never run.
+//
+// As CORS is default-deny, if no hole permits the request, the preflight
+// is refused.
+func (sr *SphyraenaRouter) servePreflight(rw http.ResponseWriter, req *http.Request) {
+	// The preflight is routed as the request it asks about would be, so
+	// that Method clauses match it, on a copy of the request.
+	asked := req.Clone(req.Context())
+	asked.Method = req.Header.Get("Access-Control-Request-Method")
+	ctx, srw := sr.sphyraenaState.NewRequest(rw, asked, false)
+
+	// As the handler is never run, the request is only probed, and
+	// nothing set while routing is committed to the request.
+	handler, routerRequest, err := sr.routeHTTP(ctx, true)
 	if err != nil || handler == nil {
-		if err != nil {
-			fmt.Println("Error getting the streaming handler:", err)
+		http.NotFound(srw, req)
+		return
+	}
+
+	holes := routerRequest.routeResult().Holes
+	hole.ApplySecurityHeaders(srw.Header(), holes)
+	if hole.ApplyPreflightHeaders(srw.Header(), req, holes) {
+		srw.WriteHeader(http.StatusNoContent)
+	} else {
+		srw.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// RunStreamingRoute routes the given streaming request and runs the
+// resulting StreamHandler.
+//
+// As this is run as a top-level goroutine, a panic in routing or in the
+// handler is recovered, logged, and sent to the user as a 500 if the
+// handler had not yet responded, rather than crashing the process.
+//
+// A request routed to a resource that does not support streaming is
+// answered with ErrStreamingNotSupported and a 406.
+func (sr *SphyraenaRouter) RunStreamingRoute(req *request.Request) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		logArgs := []interface{}{"panic", r, "stack", string(debug.Stack())}
+		if req.Request != nil {
+			logArgs = append(logArgs, "method", req.Method, "path", req.URL.Path)
 		}
+		slog.Error("stream handler panicked", logArgs...)
+		req.StreamResponse(request.StreamRequestResult{
+			Error:     http.StatusText(http.StatusInternalServerError),
+			ErrorCode: http.StatusInternalServerError,
+		})
+	}()
+
+	if sr.sphyraenaState.ShuttingDown() {
+		req.StreamResponse(request.StreamRequestResult{
+			Error:     ErrShuttingDown.Error(),
+			ErrorCode: http.StatusServiceUnavailable,
+		})
+		return
+	}
+	if result, tooLong := sr.checkStreamPath(req); tooLong {
+		req.StreamResponse(result)
+		return
+	}
+
+	handler, routeResult, err := sr.getStreamingHandler(req)
+	if err == ErrStreamingNotSupported {
+		req.StreamResponse(request.StreamRequestResult{
+			Error:     err.Error(),
+			ErrorCode: http.StatusNotAcceptable,
+		})
+		return
+	}
+	if err != nil {
+		status, msg := routingError(req, err)
+		req.StreamResponse(request.StreamRequestResult{
+			Error:     msg,
+			ErrorCode: status,
+		})
+		return
+	}
+	if handler == nil {
 		req.StreamResponse(request.StreamRequestResult{
 			Error:     ErrStreamHandlerNotFound.Error(),
 			ErrorCode: 404,
@@ -97,30 +380,199 @@ func (sr *SphyraenaRouter) RunStreamingRoute(req *request.Request) {
 	req.RouteResult = routeResult
 	// apply security holes here?
 
-	fmt.Println("Using handler:", handler)
+	slog.Debug("running stream handler", "handler", fmt.Sprintf("%T", handler))
 
 	handler.HandleStream(req)
 
-	req.StreamResponse(request.StreamRequestResult{
-		Error:     "stream handler terminated without ever creating a stream",
-		ErrorCode: 604,
-	})
+	// A handler that returns without responding would otherwise leave
+	// the client waiting forever for its stream.
+	if !req.StreamResponded() {
+		logArgs := []interface{}{"handler", fmt.Sprintf("%T", handler)}
+		if req.Request != nil {
+			logArgs = append(logArgs, "path", req.URL.Path)
+		}
+		slog.Error("stream handler returned without responding", logArgs...)
+		req.StreamResponse(request.StreamRequestResult{
+			Error:     ErrNoStreamResponse.Error(),
+			ErrorCode: http.StatusInternalServerError,
+		})
+	}
+}
 
-	// FIXME: If we get here and no stream was opened we should emit an
-	// error to the initial response handler.
+// checkStreamPath checks the path of the streaming request against the
+// SphyraenaState's limits, returning the result to refuse it with and
+// true if it exceeds them.
+func (sr *SphyraenaRouter) checkStreamPath(req *request.Request) (
+	request.StreamRequestResult,
+	bool,
+) {
+	if req.Request == nil || req.URL == nil {
+		return request.StreamRequestResult{}, false
+	}
+	if err := sr.sphyraenaState.CheckPath(req.URL.Path); err != nil {
+		return request.StreamRequestResult{
+			Error:     err.Error(),
+			ErrorCode: http.StatusRequestURITooLong,
+		}, true
+	}
+	return request.StreamRequestResult{}, false
 }
 
-// this is primarily broken out for the tests
-func (sr *SphyraenaRouter) getHTTPHandler(req *request.Request) (request.Handler, *request.RouteResult, error) {
+// routeStreaming finds the StreamHandler for the given streaming
+// request, without committing the routing. If probing is true, the
+// request is only probed; see Request.Probing.
+func (sr *SphyraenaRouter) routeStreaming(req *request.Request, probing bool) (
+	request.StreamHandler,
+	*Request,
+	error,
+) {
+	routerRequest := sr.newRouterRequest(req)
+	routerRequest.probing = probing
+	result := sr.Route(routerRequest)
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.StreamHandler == nil {
+		// a resource found, but with only a handler for plain HTTP
+		if result.Handler != nil {
+			return nil, nil, ErrStreamingNotSupported
+		}
+		return nil, nil, nil
+	}
+	mayStreamer, isMayStreamer := result.StreamHandler.(request.MayStreamer)
+	if isMayStreamer && !mayStreamer.MayStream() {
+		return nil, nil, ErrStreamingNotSupported
+	}
+	return result.StreamHandler, routerRequest, nil
+}
+
+// DescribeStream routes the given streaming request as RunStreamingRoute
+// would, and returns the StreamDescription of the StreamHandler it
+// routes to, without running it. See request.Describer.
+//
+// If there is no StreamHandler to describe, the StreamRequestResult
+// carries the error the client would be sent had it opened the stream;
+// otherwise, it is the zero value.
+func (sr *SphyraenaRouter) DescribeStream(req *request.Request) (
+	request.StreamDescription,
+	request.StreamRequestResult,
+) {
+	if sr.sphyraenaState.ShuttingDown() {
+		return request.StreamDescription{}, request.StreamRequestResult{
+			Error:     ErrShuttingDown.Error(),
+			ErrorCode: http.StatusServiceUnavailable,
+		}
+	}
+	if result, tooLong := sr.checkStreamPath(req); tooLong {
+		return request.StreamDescription{}, result
+	}
+
+	handler, _, err := sr.routeStreaming(req, true)
+	if err == ErrStreamingNotSupported {
+		return request.StreamDescription{}, request.StreamRequestResult{
+			Error:     err.Error(),
+			ErrorCode: http.StatusNotAcceptable,
+		}
+	}
+	if err != nil {
+		status, msg := routingError(req, err)
+		return request.StreamDescription{}, request.StreamRequestResult{
+			Error:     msg,
+			ErrorCode: status,
+		}
+	}
+	if handler == nil {
+		return request.StreamDescription{}, request.StreamRequestResult{
+			Error:     ErrStreamHandlerNotFound.Error(),
+			ErrorCode: http.StatusNotFound,
+		}
+	}
+	return request.DescribeStreamHandler(handler), request.StreamRequestResult{}
+}
+
+func (sr *SphyraenaRouter) newRouterRequest(req *request.Request) *Request {
 	routerRequest := newRequest(req)
+	if sr.RecursionLimit != 0 {
+		routerRequest.limit = sr.RecursionLimit
+	}
+	return routerRequest
+}
+
+// redirectTrailingSlash redirects the request to its path with the
+// trailing slash toggled, if that path has a handler. It returns whether
+// it redirected.
+func (sr *SphyraenaRouter) redirectTrailingSlash(
+	rw *sphyrw.SphyraenaResponseWriter,
+	req *request.Request,
+) bool {
+	path := req.URL.Path
+	if path == "" || path == "/" {
+		return false
+	}
 
+	var altPath string
+	if strings.HasSuffix(path, "/") {
+		altPath = strings.TrimRight(path, "/")
+	} else {
+		altPath = path + "/"
+	}
+	// A path beginning with // would be taken as a reference to another
+	// host in the Location header.
+	if altPath == "" || strings.HasPrefix(altPath, "//") {
+		return false
+	}
+
+	// The alternate path is only probed; the request was already routed
+	// once, and the clauses must not have their effects a second time.
+	routerRequest := sr.newRouterRequest(req)
+	routerRequest.probing = true
+	routerRequest.basePath = []byte(altPath)
+	routerRequest.frames[0].path = routerRequest.basePath
 	result := sr.Route(routerRequest)
+	if result.Error != nil || result.Handler == nil {
+		return false
+	}
 
-	if result.Handler == nil {
-		return nil, nil, nil
+	code := http.StatusPermanentRedirect
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		code = http.StatusMovedPermanently
+	}
+	target := url.URL{Path: altPath, RawQuery: req.URL.RawQuery}
+	http.Redirect(rw, req.Request, target.String(), code)
+	return true
+}
+
+// routeHTTP routes the request to its handler, without committing what
+// was set along the routing path to the request. If probing is true, the
+// request is only probed; see Request.Probing.
+func (sr *SphyraenaRouter) routeHTTP(req *request.Request, probing bool) (
+	request.Handler,
+	*Request,
+	error,
+) {
+	routerRequest := sr.newRouterRequest(req)
+	routerRequest.probing = probing
+
+	result := sr.Route(routerRequest)
+
+	if result.Error != nil {
+		return nil, nil, result.Error
 	}
+	return result.Handler, routerRequest, nil
+}
 
-	return result.Handler, routerRequest.routeResult(), result.Error
+// this is primarily broken out for the tests
+func (sr *SphyraenaRouter) getHTTPHandler(req *request.Request) (request.Handler, *request.RouteResult, error) {
+	handler, routerRequest, err := sr.routeHTTP(req, false)
+	if err != nil || handler == nil {
+		return nil, nil, err
+	}
+
+	routerRequest.commit()
+	if d, clock := routerRequest.timeout(); d > 0 {
+		handler = timeoutHandler{handler, d, clock}
+	}
+	return handler, routerRequest.routeResult(), nil
 }
 
 func (sr *SphyraenaRouter) getStreamingHandler(req *request.Request) (
@@ -128,12 +580,14 @@ func (sr *SphyraenaRouter) getStreamingHandler(req *request.Request) (
 	*request.RouteResult,
 	error,
 ) {
-	routerRequest := newRequest(req)
-	result := sr.Route(routerRequest)
-	spew.Dump("stream route result:", result)
-	if result.StreamHandler == nil {
-		return nil, nil, nil
+	streamHandler, routerRequest, err := sr.routeStreaming(req, false)
+	if err != nil || streamHandler == nil {
+		return nil, nil, err
 	}
 
-	return result.StreamHandler, routerRequest.routeResult(), result.Error
+	routerRequest.commit()
+	if d, clock := routerRequest.timeout(); d > 0 {
+		streamHandler = timeoutStreamHandler{streamHandler, d, clock}
+	}
+	return streamHandler, routerRequest.routeResult(), nil
 }
@@ -67,6 +67,31 @@ func (g *Generator) Get() *Secret {
 	return <-g.output
 }
 
+// TryGet returns a Secret if one has already been generated, without
+// blocking. If none is available, it returns nil and false.
+func (g *Generator) TryGet() (*Secret, bool) {
+	select {
+	case s := <-g.output:
+		return s, true
+	default:
+		return nil, false
+	}
+}
+
+// Len returns the number of secrets currently generated in advance. If
+// this stays low while secrets are being requested, generation is not
+// keeping up, most likely for lack of entropy.
+func (g *Generator) Len() int {
+	return len(g.output)
+}
+
+// Ready returns whether a secret has been generated in advance, so that
+// the next Get will not block. If this remains false while Serve is
+// running, the generator is being starved of entropy.
+func (g *Generator) Ready() bool {
+	return g.Len() > 0
+}
+
 func (g *Generator) generate() *Secret {
 	b := make([]byte, 32)
 	n, err := g.randReader.Read(b)
@@ -18,6 +18,22 @@ func TestGenerator(t *testing.T) {
 	}
 }
 
+func TestGeneratorTryGet(t *testing.T) {
+	g := NewGenerator(2)
+	if s, ok := g.TryGet(); ok || s != nil || g.Len() != 0 {
+		t.Fatal("TryGet returned a secret before any were generated")
+	}
+
+	go g.Serve()
+	defer g.Stop()
+	for g.Len() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if s, ok := g.TryGet(); !ok || s == nil {
+		t.Fatal("TryGet did not return a generated secret")
+	}
+}
+
 func TestGeneratorErrorHandleng(t *testing.T) {
 	defer func() {
 		if r := recover(); r == nil {
@@ -0,0 +1,159 @@
+package cookie
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/thejerf/sphyraena/secret"
+)
+
+// MaxCookieSize is the largest cookie, as rendered into its Set-Cookie
+// header with all of its attributes, that browsers can be relied upon to
+// keep. RFC 6265 requires them to accept at least this much; past it,
+// many silently drop the cookie.
+const MaxCookieSize = 4096
+
+// ErrNoAuthenticator is returned by NewChunkedOut when it is given no
+// Authenticator, as a chunked cookie is only reassembled if its signature
+// verifies.
+var ErrNoAuthenticator = errors.New("chunked cookies must be authenticated")
+
+// NewChunkedOut creates an authenticated cookie whose value may be too
+// large to fit in one cookie, such as a large set of signed claims.
+//
+// The value is signed as a whole, as NewOut would sign it, and the signed
+// value is then split across as many cookies as needed, named by
+// appending ".0", ".1", and so on to the name, each of which renders to
+// no more than MaxCookieSize. All of them carry the given options; set
+// all of the returned cookies on the response.
+//
+// ParseCookies reassembles the chunks and verifies the signature of the
+// combined value, making it available under the original name just as
+// any other authenticated cookie. If the signature fails, the chunks are
+// deleted as with any other cookie that fails authentication; if a chunk
+// is missing, the value is not authenticated at all. Chunks left over
+// from a previous, longer value are deleted, so a value may freely
+// shrink.
+//
+// The value is held to the same rules as NewOut's.
+func NewChunkedOut(
+	name string,
+	value string,
+	authenticator secret.Authenticator,
+	options ...Option,
+) ([]*OutCookie, error) {
+	if authenticator == nil {
+		return nil, ErrNoAuthenticator
+	}
+	// Validates everything about the cookie other than the names of the
+	// chunks, which can only be legal if the name is.
+	template, err := newcookie(true, name, value, nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := authenticator.Authenticate([]byte(name), []byte(value))
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := string(signed)
+	chunks := []*OutCookie{}
+	for i := 0; remaining != ""; i++ {
+		chunk := *template
+		chunk.name = chunkName(name, i)
+		chunk.value = ""
+		overhead, _ := chunk.Render()
+		room := MaxCookieSize - len(overhead)
+		if room < authedLength {
+			return nil, &errCookieInvalid{name, "its attributes leave no room for its value"}
+		}
+
+		size := room
+		if size >= len(remaining) {
+			size = len(remaining)
+		} else {
+			// The last chunk must carry the whole signature, as that
+			// is how ParseCookies knows it is the last, and so no other
+			// chunk may look like it does.
+			if len(remaining)-size < authedLength {
+				size = len(remaining) - authedLength
+			}
+			for isAuthed(remaining[:size]) {
+				size--
+			}
+		}
+
+		chunk.value = remaining[:size]
+		remaining = remaining[size:]
+		chunks = append(chunks, &chunk)
+	}
+
+	return chunks, nil
+}
+
+func chunkName(name string, idx int) string {
+	return name + "." + strconv.Itoa(idx)
+}
+
+// splitChunkName returns the name and index of the chunk of a chunked
+// cookie the given cookie name would be, if any.
+func splitChunkName(name string) (string, int, bool) {
+	dot := strings.LastIndexByte(name, '.')
+	if dot < 1 || dot == len(name)-1 {
+		return "", 0, false
+	}
+	digits := name[dot+1:]
+	if len(digits) > 1 && digits[0] == '0' {
+		return "", 0, false
+	}
+	for _, c := range []byte(digits) {
+		if c < '0' || c > '9' {
+			return "", 0, false
+		}
+	}
+	idx, err := strconv.Atoi(digits)
+	if err != nil {
+		return "", 0, false
+	}
+	return name[:dot], idx, true
+}
+
+// A chunkedCookie collects the chunks of a chunked cookie as they are
+// parsed.
+type chunkedCookie struct {
+	name   string
+	chunks map[int]string
+}
+
+// assemble returns the signed value of the chunked cookie, and the names
+// of the chunks that make it up, if a complete run of chunks is present.
+// The names of any chunks after the last one are returned as stale.
+func (cc *chunkedCookie) assemble() (value string, names []string, stale []string, ok bool) {
+	var buf strings.Builder
+	last := -1
+	for i := 0; i < len(cc.chunks); i++ {
+		chunk, have := cc.chunks[i]
+		if !have {
+			return "", nil, nil, false
+		}
+		buf.WriteString(chunk)
+		names = append(names, chunkName(cc.name, i))
+		if isAuthed(chunk) {
+			last = i
+			break
+		}
+	}
+	if last == -1 {
+		return "", nil, nil, false
+	}
+
+	for idx := range cc.chunks {
+		if idx > last {
+			stale = append(stale, chunkName(cc.name, idx))
+		}
+	}
+	sort.Strings(stale)
+	return buf.String(), names, stale, true
+}
@@ -0,0 +1,131 @@
+package cookie
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/secret"
+)
+
+// cookieHeader renders the given cookies into the Cookie header a browser
+// would send back.
+func cookieHeader(t *testing.T, cookies ...*OutCookie) string {
+	pairs := []string{}
+	for _, c := range cookies {
+		rendered, err := c.Render()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pairs = append(pairs, strings.SplitN(rendered, ";", 2)[0])
+	}
+	return strings.Join(pairs, "; ")
+}
+
+func TestChunkedCookies(t *testing.T) {
+	authenticator := secret.New([]byte("badsecret"))
+	sessionID, _ := authenticator.Authenticate([]byte("session"), []byte("1"))
+	sessionCookie := "session=" + string(sessionID)
+	parse := func(header string) (*InCookies, []string) {
+		return ParseCookies([]string{sessionCookie, header},
+			UnprefixedSessionCookieName, &ConstantUnwrapper{authenticator})
+	}
+
+	if _, err := NewChunkedOut("claims", "x", nil); err != ErrNoAuthenticator {
+		t.Fatal("chunked cookies can be unauthenticated")
+	}
+	if _, err := NewChunkedOut("claims", "x y", authenticator); err == nil {
+		t.Fatal("chunked cookies can have illegal values")
+	}
+
+	small, err := NewChunkedOut("claims", "small", authenticator)
+	if err != nil || len(small) != 1 || small[0].Name() != "claims.0" {
+		t.Fatal("small chunked cookie not created correctly:", small, err)
+	}
+	c, rejected := parse(cookieHeader(t, small...))
+	if len(rejected) != 0 || c.Get("claims") == nil ||
+		c.Get("claims").Value() != "small" {
+		t.Fatalf("small chunked cookie not parsed: %#v %v", c, rejected)
+	}
+
+	value := strings.Repeat("0123456789", 1000)
+	big, err := NewChunkedOut("claims", value, authenticator,
+		Path("/some/long/path"), Domain("example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(big) != 3 {
+		t.Fatal("unexpected number of chunks:", len(big))
+	}
+	for i, chunk := range big {
+		rendered, _ := chunk.Render()
+		if len(rendered) > MaxCookieSize {
+			t.Fatal("chunk too large:", len(rendered))
+		}
+		if chunk.authenticator != nil || isAuthed(chunk.value) != (i == 2) {
+			t.Fatal("only the last chunk should look authenticated")
+		}
+	}
+
+	c, rejected = parse(cookieHeader(t, big...))
+	if len(rejected) != 0 || c.Get("claims") == nil ||
+		c.Get("claims").Value() != value || c.Get("claims.0") != nil {
+		t.Fatalf("chunked cookie not parsed: %v", rejected)
+	}
+
+	// leftovers from a longer value are rejected
+	c, rejected = parse(cookieHeader(t, small...) + "; claims.1=old; claims.2=older")
+	if c.Get("claims") == nil || c.Get("claims").Value() != "small" ||
+		!reflect.DeepEqual(rejected, []string{"claims.1", "claims.2"}) {
+		t.Fatalf("stale chunks not rejected: %#v %v", c, rejected)
+	}
+
+	// a tampered chunk rejects the whole cookie
+	tampered := *big[1]
+	tampered.value = "X" + tampered.value[1:]
+	c, rejected = parse(cookieHeader(t, big[0], &tampered, big[2]))
+	if c.Get("claims") != nil ||
+		!reflect.DeepEqual(rejected, []string{"claims.0", "claims.1", "claims.2"}) {
+		t.Fatalf("tampered chunked cookie accepted: %v", rejected)
+	}
+
+	// without a session, nothing can authenticate the chunks
+	c, rejected = ParseCookies([]string{cookieHeader(t, big...)},
+		UnprefixedSessionCookieName, &ConstantUnwrapper{authenticator})
+	if c.Get("claims") != nil || len(rejected) != 0 {
+		t.Fatalf("chunked cookie accepted without a session: %v", rejected)
+	}
+
+	// a missing chunk means there is no chunked cookie, and the rest are
+	// just cookies
+	c, _ = parse(cookieHeader(t, big[0], big[2]))
+	if c.Get("claims") != nil ||
+		c.GetPossiblyUnauthenticated("claims.0").Value() != big[0].value {
+		t.Fatalf("incomplete chunked cookie mishandled: %#v", c)
+	}
+
+	// cookies that merely look like chunks are left alone
+	c, rejected = parse("version.1=beta; a.01=b; .0=c")
+	if len(rejected) != 0 ||
+		c.GetPossiblyUnauthenticated("version.1").Value() != "beta" ||
+		c.GetPossiblyUnauthenticated("a.01").Value() != "b" ||
+		c.GetPossiblyUnauthenticated(".0").Value() != "c" {
+		t.Fatalf("chunk-like cookies mishandled: %#v %v", c, rejected)
+	}
+}
+
+func TestSplitChunkName(t *testing.T) {
+	for name, expected := range map[string]bool{
+		"a.0":    true,
+		"a.b.12": true,
+		"a.":     false,
+		".1":     false,
+		"a.01":   false,
+		"a.+1":   false,
+		"a":      false,
+	} {
+		if _, _, isChunk := splitChunkName(name); isChunk != expected {
+			t.Fatal("splitChunkName wrong for", name)
+		}
+	}
+}
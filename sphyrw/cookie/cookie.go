@@ -23,6 +23,12 @@ By default, a cookie emitted by Sphyraena is:
   * Path set to /.
   * The SameSite flag will be set to Strict.
 
+Cookie names with the "__Secure-" and "__Host-" prefixes are held to the
+rules browsers enforce for them: they can't be made Insecure, and a
+"__Host-" cookie can't have a Domain or a Path other than "/". The
+session cookie is named with the "__Secure-" prefix by default, so that
+a cookie set over plain HTTP can not shadow it.
+
 As other security features are added to cookies, they will be added in by
 default here.
 
@@ -95,6 +101,14 @@ var Lax = CookieStrictness{1}
 // remove the SameSite setting from the cookie.
 var NoSameSiteSetting = CookieStrictness{2}
 
+// None can be passed to the SameSite option to set the SameSite cookie
+// flag to None, which permits the cookie to be sent on cross-site
+// requests, such as from a page embedding this site in an iframe.
+//
+// Browsers reject SameSite=None on cookies that are not Secure, so a
+// cookie can not be created with both None and Insecure.
+var None = CookieStrictness{3}
+
 type CookieStrictness struct {
 	strictness byte
 }
@@ -105,15 +119,40 @@ func (cs CookieStrictness) render() string {
 		return "SameSite=Strict"
 	case 1:
 		return "SameSite=Lax"
+	case 3:
+		return "SameSite=None"
 	default:
 		return ""
 	}
 }
 
+// The names of the session cookie. SessionCookieName is used unless the
+// SphyraenaState is configured otherwise, as its prefix means browsers
+// only accept it from a Secure, HTTPS response. UnprefixedSessionCookieName
+// is for environments that can't guarantee HTTPS.
+const (
+	SessionCookieName           = "__Secure-session"
+	UnprefixedSessionCookieName = "session"
+)
+
+// The cookie name prefixes browsers give special meaning to.
+const (
+	securePrefix = "__Secure-"
+	hostPrefix   = "__Host-"
+)
+
 // A Option modifies an OutCookie in the given manner.
 type Option func(*OutCookie) error
 
-var t abtime.AbstractTime = abtime.NewRealTime()
+// A Clock provides the time that cookie expiration times are computed
+// from. The package-level Duration uses the real time; use a Clock with
+// another AbstractTime, such as a manual one for tests, to compute them
+// from that instead.
+type Clock struct {
+	abtime.AbstractTime
+}
+
+var realClock = Clock{abtime.NewRealTime()}
 
 type errCookieInvalid struct {
 	name   string
@@ -276,7 +315,8 @@ func (ic InCookies) GoString() string {
 	return buf.String()
 }
 
-// ParseCookies parses the incoming cookies.
+// ParseCookies parses the given Cookie header values, authenticating
+// them against the session cookie with the given name.
 //
 // This is necessary because only Sphyraena can correctly unwrap
 // the authenticated names. This will never return nil, which can be used
@@ -286,6 +326,9 @@ func (ic InCookies) GoString() string {
 // authentication. Sphyraena will automatically serve Set-Cookie headers to
 // attempt to expire these cookies.
 //
+// The chunks of cookies created by NewChunkedOut are reassembled into the
+// cookie they were split from before being authenticated.
+//
 // The last value is nil if there was no valid session ID, or a pointer to
 // a string containing the session ID if it is valid.
 //
@@ -293,7 +336,11 @@ func (ic InCookies) GoString() string {
 // of authenticating cookies probably needs to be further unwrapped from
 // this somehow, perhaps handing off all the apparently-authenticated
 // cookies to something?
-func ParseCookies(cookies []string, authUnwrappers secret.AuthenticationUnwrappers) (*InCookies, []string) {
+func ParseCookies(
+	cookies []string,
+	sessionName string,
+	authUnwrappers secret.AuthenticationUnwrappers,
+) (*InCookies, []string) {
 	// copied from net/http/cookie.go, modified into near-unrecognizability
 	result := &InCookies{}
 	failedCookies := []string{}
@@ -318,6 +365,26 @@ func ParseCookies(cookies []string, authUnwrappers secret.AuthenticationUnwrappe
 
 	hmaced := []*InCookie{}
 	var possiblySession *InCookie
+	chunked := map[string]*chunkedCookie{}
+	chunkedOrder := []string{}
+
+	addParsed := func(name, val string) {
+		if isAuthed(val) {
+			if name == sessionName {
+				// should the browser send more than one, we will take
+				// the first. Since this is authenticated this shouldn't
+				// do anything weird; worst case should be the session
+				// value is invalid and everything gets cleared.
+				if possiblySession == nil {
+					possiblySession = &InCookie{name: name, value: val}
+				}
+			} else {
+				hmaced = append(hmaced, &InCookie{name: name, value: val})
+			}
+		} else {
+			result.addCookie(name, val, unauthenticated)
+		}
+	}
 
 	for _, line := range cookies {
 		parts := strings.Split(strings.TrimSpace(line), ";")
@@ -342,32 +409,58 @@ func ParseCookies(cookies []string, authUnwrappers secret.AuthenticationUnwrappe
 				continue
 			}
 
-			if isAuthed(val) {
-				// FIXME: ought to either use something else or make this
-				// configurable at the Sphyraena level so it can get along
-				// with other things that may insist on this.
-				if name == "session" {
-					// should the browser send more than one, we will take
-					// the first. Since this is authenticated this shouldn't
-					// do anything weird; worst case should be the session
-					// value is invalid and everything gets cleared.
-					if possiblySession == nil {
-						possiblySession = &InCookie{name: name, value: val}
-					}
-				} else {
-					hmaced = append(hmaced, &InCookie{name: name, value: val})
+			if base, idx, isChunk := splitChunkName(name); isChunk && name != sessionName {
+				cc := chunked[base]
+				if cc == nil {
+					cc = &chunkedCookie{name: base, chunks: map[int]string{}}
+					chunked[base] = cc
+					chunkedOrder = append(chunkedOrder, base)
 				}
-			} else {
-				result.addCookie(name, val, unauthenticated)
+				if _, have := cc.chunks[idx]; !have {
+					cc.chunks[idx] = val
+				}
+				continue
 			}
+
+			addParsed(name, val)
+		}
+	}
+
+	// Chunks that don't assemble into a chunked cookie are just cookies
+	// that happen to have a dot and a number in their name.
+	chunkNames := map[string][]string{}
+	for _, base := range chunkedOrder {
+		cc := chunked[base]
+		value, names, stale, ok := cc.assemble()
+		if ok {
+			hmaced = append(hmaced, &InCookie{name: base, value: value})
+			chunkNames[base] = names
+			failedCookies = append(failedCookies, stale...)
+			continue
+		}
+		indexes := []int{}
+		for idx := range cc.chunks {
+			indexes = append(indexes, idx)
+		}
+		sort.Ints(indexes)
+		for _, idx := range indexes {
+			addParsed(chunkName(base, idx), cc.chunks[idx])
 		}
 	}
 
+	fail := func(name string) {
+		if names, isChunked := chunkNames[name]; isChunked {
+			failedCookies = append(failedCookies, names...)
+			return
+		}
+		failedCookies = append(failedCookies, name)
+	}
+
 	nukeAllAuthedCookies := func() {
 		for _, cookie := range hmaced {
-			failedCookies = append(failedCookies, cookie.name)
+			fail(cookie.name)
 		}
-		failedCookies = append(failedCookies, "session")
+		failedCookies = append(failedCookies, sessionName)
 	}
 
 	// now, having dealt with parsing the cookies, we need to see if one of
@@ -386,20 +479,22 @@ func ParseCookies(cookies []string, authUnwrappers secret.AuthenticationUnwrappe
 		} else {
 			// only thing the _ could be is the session ID we already extracted.
 			_, err := authUnwrapper.UnwrapAuthentication(
-				[]byte("session"),
+				[]byte(sessionName),
 				[]byte(possiblySession.value),
 			)
 			if err != nil {
 				nukeAllAuthedCookies()
 			} else {
-				result.addCookie("session", string(possibleSessionID), true)
+				result.addCookie(sessionName, string(possibleSessionID), true)
 				for _, cookie := range hmaced {
 					val, err := authUnwrapper.UnwrapAuthentication(
 						[]byte(cookie.name),
 						[]byte(cookie.value),
 					)
 					if err != nil {
-						failedCookies = append(failedCookies, cookie.name)
+						fail(cookie.name)
+					} else if _, isChunked := chunkNames[cookie.name]; isChunked {
+						result.addCookie(cookie.name, string(val), authenticated)
 					} else {
 						cookie.name = string(val)
 						result.addInCookie(cookie)
@@ -526,6 +621,18 @@ func newcookie(
 		}
 	}
 
+	if cookie.sameSiteStrictness == None && cookie.insecure {
+		return nil, &errCookieInvalid{name, "SameSite=None requires the cookie to be Secure"}
+	}
+	if (strings.HasPrefix(name, securePrefix) || strings.HasPrefix(name, hostPrefix)) &&
+		cookie.insecure {
+		return nil, &errCookieInvalid{name, "the name's prefix requires the cookie to be Secure"}
+	}
+	if strings.HasPrefix(name, hostPrefix) &&
+		(cookie.domain != "" || (cookie.path != "" && cookie.path != "/")) {
+		return nil, &errCookieInvalid{name, "the __Host- prefix forbids a Domain or Path"}
+	}
+
 	return cookie, nil
 }
 
@@ -634,6 +741,12 @@ func Delete(c *OutCookie) error {
 	return nil
 }
 
+// Duration is the time for the cookie to be set, computed from the real
+// time. See Clock.Duration.
+func Duration(d time.Duration) Option {
+	return realClock.Duration(d)
+}
+
 // Duration is the time for the cookie to be set.
 //
 // This results in both Max-Age and Expires being sent. Browsers that use
@@ -646,8 +759,9 @@ func Delete(c *OutCookie) error {
 // the intent), or if the resulting Expires calculation's year exceeds
 // 2038. This will presumably at some point be lifted, but it's still a bit
 // of a bad idea to send out cookies beyond that.
-func Duration(d time.Duration) Option {
+func (clock Clock) Duration(d time.Duration) Option {
 	return func(c *OutCookie) error {
+		now := clock.Now()
 		var reasonInvalid error
 		if d < 0 {
 			reasonInvalid = &errCookieInvalid{c.name, "duration was negative (use .Delete to delete deliberaterly)"}
@@ -655,7 +769,7 @@ func Duration(d time.Duration) Option {
 		if d < time.Second {
 			reasonInvalid = &errCookieInvalid{c.name, "duration was set to less than one second"}
 		}
-		if t.Now().Add(d).Year() >= 2038 {
+		if now.Add(d).Year() >= 2038 {
 			reasonInvalid = &errCookieInvalid{c.name, "cookie's duration is too long (use .Forever() to set deliberate long-lived cookie)"}
 		}
 
@@ -664,7 +778,7 @@ func Duration(d time.Duration) Option {
 		}
 
 		c.hasExpires = true
-		c.expires = t.Now().Add(d)
+		c.expires = now.Add(d)
 		c.maxAge = d
 
 		return nil
@@ -19,13 +19,8 @@ type successfulTest struct {
 	result string
 }
 
-var faketime abtime.AbstractTime
-
-func init() {
-	// Friday, 14-Jul-17 02:40:00 UTC
-	faketime = abtime.NewManualAtTime(time.Unix(1500000000, 0).UTC())
-	t = faketime
-}
+// Friday, 14-Jul-17 02:40:00 UTC
+var fakeClock = Clock{abtime.NewManualAtTime(time.Unix(1500000000, 0).UTC())}
 
 // This function tests the rendering of the cookie when it should be
 // successful. It ignores HMAC, we'll test that separately.
@@ -39,9 +34,9 @@ func TestSuccessfulRendering(t *testing.T) {
 		{"c", "v", []Option{}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;HttpOnly;Secure;SameSite=Strict"},
 		{"c", "v", []Option{Delete}, "c=;Expires=Fri, 02-Jan-1970 00:00:01 GMT;Path=/;HttpOnly;Secure;SameSite=Strict"},
 		// ensure order works
-		{"c", "v", []Option{Duration(time.Hour), Session},
+		{"c", "v", []Option{fakeClock.Duration(time.Hour), Session},
 			"c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;HttpOnly;Secure;SameSite=Strict"},
-		{"c", "v", []Option{Duration(time.Hour)},
+		{"c", "v", []Option{fakeClock.Duration(time.Hour)},
 			"c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Max-Age=3600;Expires=Fri, 14 Jul 2017 03:40:00 GMT;Path=/;HttpOnly;Secure;SameSite=Strict"},
 		{"c", "v", []Option{Path("/moo/")}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/moo/;HttpOnly;Secure;SameSite=Strict"},
 		{"c", "v", []Option{Domain("fo-o2.com")}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;Domain=fo-o2.com;HttpOnly;Secure;SameSite=Strict"},
@@ -49,6 +44,8 @@ func TestSuccessfulRendering(t *testing.T) {
 		{"c", "v", []Option{ClientCanRead}, "c=v;Path=/;Secure;SameSite=Strict"},
 		{"c", "v", []Option{SameSite(Lax)}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;HttpOnly;Secure;SameSite=Lax"},
 		{"c", "v", []Option{SameSite(NoSameSiteSetting)}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;HttpOnly;Secure"},
+		{"c", "v", []Option{SameSite(None)}, "c=v__!sauthed!_TmVPtWyCByrJUs%HCJ5OjyPUH9UlJA5r%u1O2$nLQNg;Path=/;HttpOnly;Secure;SameSite=None"},
+		{"__Host-c", "v", []Option{ClientCanRead, Path("/")}, "__Host-c=v;Path=/;Secure;SameSite=Strict"},
 	}
 
 	for _, test := range tests {
@@ -75,6 +72,7 @@ func TestSuccessfulRendering(t *testing.T) {
 
 		inCookies, rejected := ParseCookies(
 			[]string{sessionCookie, cookieIn},
+			UnprefixedSessionCookieName,
 			&ConstantUnwrapper{authenticator},
 		)
 		if len(rejected) > 0 {
@@ -121,11 +119,17 @@ func TestIllegalCookies(t *testing.T) {
 		{"n", " strict mode space", []Option{}},
 		{"", "", []Option{}},
 		{"", "\tmoo", []Option{}},
-		{"n", "v", []Option{Duration(time.Duration(-2))}},
-		{"n", "v", []Option{Duration(time.Millisecond)}},
-		{"n", "v", []Option{Duration(time.Hour * 24 * 365 * 24)}},
+		{"n", "v", []Option{fakeClock.Duration(time.Duration(-2))}},
+		{"n", "v", []Option{fakeClock.Duration(time.Millisecond)}},
+		{"n", "v", []Option{fakeClock.Duration(time.Hour * 24 * 365 * 24)}},
 		{"c", "\x10", []Option{}},
 		{"c", "v", []Option{Path("/bad;path/")}},
+		{"c", "v", []Option{SameSite(None), Insecure}},
+		{"c", "v", []Option{Insecure, SameSite(None)}},
+		{"__Secure-c", "v", []Option{Insecure}},
+		{"__Host-c", "v", []Option{Insecure}},
+		{"__Host-c", "v", []Option{Path("/moo/")}},
+		{"__Host-c", "v", []Option{Domain("foo.com")}},
 
 		// lots of ways for domain to be illegal, aren't there?
 		{"c", "v", []Option{Domain("")}},
@@ -161,7 +165,7 @@ func cookies(in ...*InCookie) *InCookies {
 }
 
 func TestParseCookies(t *testing.T) {
-	x, y := ParseCookies(nil, nil)
+	x, y := ParseCookies(nil, UnprefixedSessionCookieName, nil)
 	if x.Count() > 0 || len(y) > 0 {
 		t.Fatal("unexpected squeezed blood from a stone")
 	}
@@ -235,7 +239,8 @@ func TestParseCookies(t *testing.T) {
 			[]string{"session"},
 		},
 	} {
-		cookies, rejected := ParseCookies(test.cookies, &ConstantUnwrapper{authenticator})
+		cookies, rejected := ParseCookies(test.cookies, UnprefixedSessionCookieName,
+			&ConstantUnwrapper{authenticator})
 		if !reflect.DeepEqual(cookies, test.expected) ||
 			!reflect.DeepEqual(rejected, rejected) {
 			t.Fatal(fmt.Sprintf("Failed to correctly parse cookie \"%s\". Expected to get:\ncookies: %#v\nrejected: %#v\n\n but got instead: cookies: %#v\nrejected: %#v", test.cookies, test.expected, test.rejected, cookies, rejected))
@@ -243,13 +248,30 @@ func TestParseCookies(t *testing.T) {
 	}
 
 	// test the case where the authentication just plain errors out
-	c, rejected := ParseCookies([]string{sessionCookie}, NeverUnwrapper{})
+	c, rejected := ParseCookies([]string{sessionCookie},
+		UnprefixedSessionCookieName, NeverUnwrapper{})
 	if !reflect.DeepEqual(c, cookies()) ||
 		!reflect.DeepEqual(rejected, []string{"session"}) {
 		t.Fatal("Did not correctly reject session when no auth found")
 	}
 }
 
+func TestParsePrefixedSessionCookie(t *testing.T) {
+	authenticator := secret.New([]byte("badsecret"))
+	sessionID, _ := authenticator.Authenticate([]byte(SessionCookieName), []byte("1"))
+	unprefixedID, _ := authenticator.Authenticate([]byte("session"), []byte("2"))
+
+	c, rejected := ParseCookies(
+		[]string{"session=" + string(unprefixedID), SessionCookieName + "=" + string(sessionID)},
+		SessionCookieName,
+		&ConstantUnwrapper{authenticator},
+	)
+	if len(rejected) != 0 || c.Get(SessionCookieName) == nil ||
+		c.Get(SessionCookieName).Value() != "1" || c.Get("session") != nil {
+		t.Fatalf("prefixed session cookie not used: %#v %v", c, rejected)
+	}
+}
+
 func TestGettingFromInCookies(t *testing.T) {
 	inCookies := cookies(
 		&InCookie{"session", "1", true},
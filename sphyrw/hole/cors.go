@@ -0,0 +1,232 @@
+package hole
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// corsPolicy is a single set of cross-origin permissions, as created by
+// CORS.
+type corsPolicy struct {
+	origins     map[string]bool
+	anyOrigin   bool
+	methods     []string
+	headers     []string
+	credentials bool
+}
+
+func (cp *corsPolicy) applySecurityHole(s *security) {
+	s.cors = append(s.cors, cp)
+}
+
+func (cp *corsPolicy) String() string {
+	origins := make([]string, 0, len(cp.origins)+1)
+	if cp.anyOrigin {
+		origins = append(origins, "*")
+	}
+	for origin := range cp.origins {
+		origins = append(origins, origin)
+	}
+	sort.Strings(origins)
+	return fmt.Sprintf("cors(origins=%s methods=%s headers=%s credentials=%v)",
+		strings.Join(origins, " "), strings.Join(cp.methods, " "),
+		strings.Join(cp.headers, " "), cp.credentials)
+}
+
+func (cp *corsPolicy) allowsOrigin(origin string) bool {
+	return cp.anyOrigin || cp.origins[origin]
+}
+
+func (cp *corsPolicy) allowsMethod(method string) bool {
+	for _, allowed := range cp.methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (cp *corsPolicy) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		found := false
+		for _, allowed := range cp.headers {
+			if strings.EqualFold(allowed, header) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets the headers common to preflights and actual requests.
+func (cp *corsPolicy) setOrigin(headers http.Header, origin string) {
+	if cp.anyOrigin {
+		headers.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		headers.Set("Access-Control-Allow-Origin", origin)
+	}
+	if cp.credentials {
+		headers.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// CORS returns a SecurityHole that permits cross-origin requests from the
+// given origins, using the given methods and request headers.
+//
+// By default, Sphyraena emits no Access-Control-Allow-Origin header at
+// all, so browsers will refuse to let other origins read responses. With
+// this hole, requests from the listed origins will have their origin
+// echoed back, along with Access-Control-Allow-Credentials if credentials
+// is true. Origins must be given exactly as the browser sends them, e.g.
+// "https://example.com".
+//
+// The origin "*" allows any origin. As browsers will not send credentials
+// to a wildcard, and echoing back arbitrary origins with credentials
+// enabled would let any site act as the user, "*" together with
+// credentials is a configuration error, and this will panic.
+//
+// Multiple CORS holes may apply to the same response. They are
+// considered independently, and the first one that permits the request
+// is used.
+func CORS(
+	origins []string,
+	methods []string,
+	headers []string,
+	credentials bool,
+) SecurityHole {
+	cp := &corsPolicy{
+		origins:     map[string]bool{},
+		methods:     append([]string{}, methods...),
+		headers:     append([]string{}, headers...),
+		credentials: credentials,
+	}
+	for _, origin := range origins {
+		if origin == "*" {
+			cp.anyOrigin = true
+		} else {
+			cp.origins[origin] = true
+		}
+	}
+
+	if cp.anyOrigin && credentials {
+		panic("CORS can not allow all origins with credentials")
+	}
+
+	return cp
+}
+
+// varyOrigin adds Origin to the Vary header if any CORS hole applies, as
+// whether the response carries CORS headers then depends on it, whatever
+// the origin of this particular request. Otherwise a cache could serve
+// the response to one origin to another.
+func (s *security) varyOrigin(headers http.Header) {
+	if len(s.cors) == 0 {
+		return
+	}
+	for _, vary := range headers.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || strings.EqualFold(name, "Origin") {
+				return
+			}
+		}
+	}
+	headers.Add("Vary", "Origin")
+}
+
+// ApplyCORSHeaders applies the CORS headers for an actual (not preflight)
+// cross-origin request, if any of the holes permit it.
+//
+// If any CORS hole applies, Origin is added to the Vary header. Beyond
+// that, if the request carries no Origin header, or no hole permits the
+// origin and method, nothing is set.
+func ApplyCORSHeaders(headers http.Header, req *http.Request, holes SecurityHoles) {
+	sec := security{}
+	sec.applyHoles(holes)
+	sec.varyOrigin(headers)
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+
+	for _, cp := range sec.cors {
+		if cp.allowsOrigin(origin) && cp.allowsMethod(req.Method) {
+			cp.setOrigin(headers, origin)
+			return
+		}
+	}
+}
+
+type denyCORS struct{}
+
+func (dc denyCORS) applySecurityHole(s *security) {
+	s.cors = nil
+}
+
+func (dc denyCORS) String() string {
+	return "deny_cors"
+}
+
+// DenyCORS returns a SecurityHole that withdraws every CORS hole applied
+// before it, so that no other origin may read the response.
+func DenyCORS() SecurityHole {
+	return denyCORS{}
+}
+
+// IsPreflight returns whether the given request is a CORS preflight
+// request.
+func IsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// ApplyPreflightHeaders applies the headers answering the given CORS
+// preflight request, if any of the holes permit the origin, method and
+// headers it asks about. It returns whether the preflight was permitted.
+//
+// The Access-Control-Allow-Methods and Access-Control-Allow-Headers are
+// drawn from the permitting hole. As with ApplyCORSHeaders, Origin is
+// added to the Vary header if any CORS hole applies.
+func ApplyPreflightHeaders(
+	headers http.Header,
+	req *http.Request,
+	holes SecurityHoles,
+) bool {
+	origin := req.Header.Get("Origin")
+	method := req.Header.Get("Access-Control-Request-Method")
+	requestedHeaders := req.Header.Get("Access-Control-Request-Headers")
+
+	sec := security{}
+	sec.applyHoles(holes)
+	sec.varyOrigin(headers)
+
+	for _, cp := range sec.cors {
+		if !cp.allowsOrigin(origin) || !cp.allowsMethod(method) ||
+			!cp.allowsHeaders(requestedHeaders) {
+			continue
+		}
+
+		cp.setOrigin(headers, origin)
+		headers.Set("Access-Control-Allow-Methods",
+			strings.Join(cp.methods, ", "))
+		if len(cp.headers) > 0 {
+			headers.Set("Access-Control-Allow-Headers",
+				strings.Join(cp.headers, ", "))
+		}
+		return true
+	}
+
+	return false
+}
@@ -14,13 +14,18 @@ in your security to operate, but they should be viewed as holes, not merely
 */
 package hole
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
 
 // security tracks the security requests for this connection. It defaults
-// to total security, and monoidally backs down the security as requests
-// come in.
+// to total security, and backs down the security as holes are applied,
+// except where a later hole tightens it back up again.
 type security struct {
 	allowBrowserTypeGuessing bool
+	cors                     []*corsPolicy
 }
 
 func (s *security) applyHoles(holes []SecurityHole) {
@@ -31,6 +36,11 @@ func (s *security) applyHoles(holes []SecurityHole) {
 
 // ApplySecurityHeaders takes the given SecurityHoles and applies the
 // correct HTML headers to implement the given policy.
+//
+// The holes are applied in order, so where a hole tightens security, as
+// DenyBrowserTypeGuessing does, it overrides whatever holes came before
+// it. The router gathers holes from the outermost routing frame inwards,
+// so a child route's holes take precedence over its parent's.
 func ApplySecurityHeaders(headers http.Header, holes SecurityHoles) {
 	sec := security{}
 	sec.applyHoles(holes)
@@ -43,6 +53,14 @@ func ApplySecurityHeaders(headers http.Header, holes SecurityHoles) {
 // A SecurityHole is a request to lower the security on a given
 // response. Applying security policy is done by starting with the base
 // "default deny" policy and applying all the relevant holes.
+//
+// A few holes instead restore the default deny for something an earlier
+// hole opened. They exist so a site that is generally loosened can still
+// carve out a stricter island, such as an admin section, without having to
+// restructure its routing to keep the loosening away from it.
+//
+// The holes this package provides describe themselves with String, for
+// reviewing what holes a route opens.
 type SecurityHole interface {
 	applySecurityHole(*security)
 }
@@ -53,6 +71,10 @@ func (acs allowBrowserTypeGuessing) applySecurityHole(s *security) {
 	s.allowBrowserTypeGuessing = true
 }
 
+func (acs allowBrowserTypeGuessing) String() string {
+	return "allow_browser_type_guessing"
+}
+
 // AllowBrowserTypeGuessing returns a SecurityLoosening that allows browers
 // to guess the type of the content coming in.
 //
@@ -66,6 +88,23 @@ func AllowBrowserTypeGuessing() SecurityHole {
 	return allowBrowserTypeGuessing{}
 }
 
+type denyBrowserTypeGuessing struct{}
+
+func (dbtg denyBrowserTypeGuessing) applySecurityHole(s *security) {
+	s.allowBrowserTypeGuessing = false
+}
+
+func (dbtg denyBrowserTypeGuessing) String() string {
+	return "deny_browser_type_guessing"
+}
+
+// DenyBrowserTypeGuessing returns a SecurityHole that undoes any
+// AllowBrowserTypeGuessing applied before it, so that
+// X-Content-Type-Options: nosniff is emitted after all.
+func DenyBrowserTypeGuessing() SecurityHole {
+	return denyBrowserTypeGuessing{}
+}
+
 // The NoHole is something that conforms to the SecurityHole
 // interface, but does not result in any opening of security when
 // applied.
@@ -84,6 +123,10 @@ func (nh noHole) applySecurityHole(s *security) {
 	return
 }
 
+func (nh noHole) String() string {
+	return "no_hole"
+}
+
 // SecurityHoles is simply a slice type of SecurityHole that is augmented
 // with the method to turn it into a SecurityHole itself.
 //
@@ -100,3 +143,12 @@ func (sh SecurityHoles) applySecurityHole(s *security) {
 		hole.applySecurityHole(s)
 	}
 }
+
+// String describes the holes, separated by commas.
+func (sh SecurityHoles) String() string {
+	described := make([]string, 0, len(sh))
+	for _, hole := range sh {
+		described = append(described, fmt.Sprint(hole))
+	}
+	return strings.Join(described, ", ")
+}
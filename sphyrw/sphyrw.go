@@ -22,10 +22,15 @@ package sphyrw
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/thejerf/sphyraena/sphyrw/cookie"
 )
@@ -45,6 +50,12 @@ type SphyraenaResponseWriter struct {
 	doneChan         chan interface{}
 	responseWritten  bool
 	finished         bool
+	status           int
+
+	// set by Buffer; buffering is turned off once the buffer is sent
+	buffering   bool
+	bufferLimit int
+	buffer      []byte
 }
 
 // NewSphyraenaResponseWriter creates a new ResponseWriter from the given
@@ -59,6 +70,54 @@ func NewSphyraenaResponseWriter(rw http.ResponseWriter) *SphyraenaResponseWriter
 		nil,
 		false,
 		false,
+		0,
+		false,
+		0,
+		nil,
+	}
+}
+
+// Buffer makes the writer hold back up to limit bytes of the body, rather
+// than writing it straight through. If the response is finished without
+// exceeding that, and without WriteHeader being called, it is sent all at
+// once with a Content-Length, rather than chunked. If the body grows past
+// the limit, or WriteHeader or Flush is called, what has been held back is
+// sent and the rest of the response is written straight through.
+//
+// This must be called before anything is written. It is normally only
+// called by internal code, according to the SphyraenaState's
+// ResponseBufferSize.
+func (srw *SphyraenaResponseWriter) Buffer(limit int) {
+	srw.buffering = true
+	srw.bufferLimit = limit
+}
+
+// sendBuffer turns off buffering, and sends what was held back.
+func (srw *SphyraenaResponseWriter) sendBuffer() error {
+	srw.buffering = false
+	if len(srw.buffer) == 0 {
+		return nil
+	}
+	if !srw.responseWritten {
+		srw.writeResponse()
+	}
+	_, err := srw.underlyingWriter.Write(srw.buffer)
+	srw.buffer = nil
+	return err
+}
+
+// Flush sends any part of the response that has been held back by
+// Buffer, ending the buffering, and flushes the underlying writer if it
+// is an http.Flusher.
+func (srw *SphyraenaResponseWriter) Flush() {
+	if srw.finished {
+		panic("Can't call Flush on a Finished SphyraenaResponseWriter")
+	}
+	if srw.buffering {
+		_ = srw.sendBuffer()
+	}
+	if flusher, isFlusher := srw.underlyingWriter.(http.Flusher); isFlusher {
+		flusher.Flush()
 	}
 }
 
@@ -88,6 +147,19 @@ func (srw *SphyraenaResponseWriter) Write(b []byte) (int, error) {
 	if srw.finished {
 		panic("Can't call Write on a Finished SphyraenaResponseWriter")
 	}
+	if srw.status == 0 {
+		srw.status = http.StatusOK
+	}
+	if srw.buffering {
+		if len(srw.buffer)+len(b) <= srw.bufferLimit {
+			srw.buffer = append(srw.buffer, b...)
+			return len(b), nil
+		}
+		err := srw.sendBuffer()
+		if err != nil {
+			return 0, err
+		}
+	}
 	if srw.responseWritten {
 		return srw.underlyingWriter.Write(b)
 	}
@@ -96,14 +168,103 @@ func (srw *SphyraenaResponseWriter) Write(b []byte) (int, error) {
 	return srw.underlyingWriter.Write(b)
 }
 
+// WriteHeader sends the status code, and the headers and cookies with
+// it. Informational 1xx codes other than 101 Switching Protocols are
+// passed straight through, as they precede the real response rather than
+// being it.
 func (srw *SphyraenaResponseWriter) WriteHeader(code int) {
 	if srw.finished {
 		panic("Can't call WriteHeader on a Finished SphyraenaResponseWriter")
 	}
-	srw.writeResponse()
+	if isInformational(code) {
+		srw.underlyingWriter.WriteHeader(code)
+		return
+	}
+	if srw.status == 0 {
+		srw.status = code
+	}
+	if srw.buffering {
+		_ = srw.sendBuffer()
+	}
+	if !srw.responseWritten {
+		srw.writeResponse()
+	}
 	srw.underlyingWriter.WriteHeader(code)
 }
 
+func isInformational(code int) bool {
+	return code >= 100 && code < 200 && code != http.StatusSwitchingProtocols
+}
+
+// Push initiates an HTTP/2 server push of the given target, if the
+// underlying writer supports it, as described by http.Pusher. If it does
+// not, as is the case for HTTP/1.x connections, nothing is done and
+// http.ErrNotSupported is returned. As pushing is only ever an
+// optimization, that error can generally be ignored.
+func (srw *SphyraenaResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if srw.finished {
+		panic("Can't call Push on a Finished SphyraenaResponseWriter")
+	}
+	pusher, isPusher := srw.underlyingWriter.(http.Pusher)
+	if !isPusher {
+		return http.ErrNotSupported
+	}
+	return pusher.Push(target, opts)
+}
+
+// EarlyHints sends a 103 Early Hints response with the given Link header
+// values, such as those produced by PreloadLink, so the browser can begin
+// fetching the resources they name while the real response is prepared.
+// The links are also left in the headers of the real response.
+//
+// This must be called before the real response is begun; afterwards,
+// or if no links are given, it does nothing. Clients that do not
+// understand Early Hints ignore them.
+func (srw *SphyraenaResponseWriter) EarlyHints(links ...string) {
+	if srw.finished {
+		panic("Can't call EarlyHints on a Finished SphyraenaResponseWriter")
+	}
+	if len(links) == 0 || srw.status != 0 || srw.responseWritten {
+		return
+	}
+	header := srw.underlyingWriter.Header()
+	for _, link := range links {
+		header.Add("Link", link)
+	}
+	srw.underlyingWriter.WriteHeader(http.StatusEarlyHints)
+}
+
+// PreloadLink returns a Link header value asking the browser to preload
+// the resource at the given URL, which is of the given type, such as
+// "script", "style", "font" or "image", for use with EarlyHints.
+func PreloadLink(url string, as string) string {
+	return "<" + url + ">; rel=preload; as=" + as
+}
+
+// IsLocalRedirect returns whether the redirect target can only refer to
+// this site: a path, or a reference relative to the request's own URL.
+//
+// It refuses anything with a scheme or host, and the tricks like "//host"
+// and "/\host" that browsers take as referring to another host.
+func IsLocalRedirect(target string) bool {
+	// Browsers treat backslashes as slashes, so "/\host" is "//host".
+	if strings.Contains(target, `\`) {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && u.User == nil &&
+		!strings.HasPrefix(target, "//")
+}
+
+// Status returns the status code sent so far, or 0 if neither WriteHeader
+// nor Write has been called yet.
+func (srw *SphyraenaResponseWriter) Status() int {
+	return srw.status
+}
+
 func (srw *SphyraenaResponseWriter) SetCookie(cookie *cookie.OutCookie) {
 	if srw.finished {
 		panic("Can't call SetCookie on a Finished SphyraenaResponseWriter")
@@ -130,11 +291,11 @@ func (srw *SphyraenaResponseWriter) writeResponse() {
 // using encoding/json.
 //
 // This will panic if the type passed in can not be emitted via
-// encoding/json.
+// encoding/json. If the value may legitimately fail to encode, such as a
+// map of user-supplied data or a type with a MarshalJSON method that can
+// fail, use TryWriteJSON instead.
 func (srw *SphyraenaResponseWriter) WriteJSON(val interface{}) {
-	srw.Header().Set("Content-Type", "application/json")
-	encoder := json.NewEncoder(srw)
-	err := encoder.Encode(val)
+	err := srw.TryWriteJSON(val)
 	if err != nil {
 		// since this is constant per type, rather than value-dependent, at
 		// least AFAIK, this should be OK.
@@ -142,6 +303,57 @@ func (srw *SphyraenaResponseWriter) WriteJSON(val interface{}) {
 	}
 }
 
+// TryWriteJSON is like WriteJSON, but returns the error if the value can
+// not be encoded, rather than panicking.
+//
+// The value is encoded before anything is sent, so on error nothing has
+// been written, not even the Content-Type, and the handler is still free
+// to respond with a 500 or anything else. Errors writing the response
+// itself are not returned, as with WriteJSON.
+func (srw *SphyraenaResponseWriter) TryWriteJSON(val interface{}) error {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(val)
+	if err != nil {
+		return err
+	}
+
+	srw.Header().Set("Content-Type", "application/json")
+	_, _ = srw.Write(buf.Bytes())
+	return nil
+}
+
+// WriteJSONStatus is like WriteJSON, but sends the given status code
+// instead of the implied 200.
+//
+// The value is encoded before anything is sent, so if this panics
+// because the value can not be encoded, the response is still untouched.
+//
+// As with WriteHeader, this must be called before any call to Write; it
+// sets the cookies, the Content-Type and the status together, none of
+// which can be changed once the body has begun.
+func (srw *SphyraenaResponseWriter) WriteJSONStatus(code int, val interface{}) {
+	b, err := json.Marshal(val)
+	if err != nil {
+		panic("Can't use WriteJSONStatus to write value: " + err.Error())
+	}
+
+	srw.Header().Set("Content-Type", "application/json")
+	srw.WriteHeader(code)
+	_, _ = srw.Write(append(b, '\n'))
+}
+
+// Error sends the given status code with the given message as a plain
+// text body, in the manner of http.Error.
+//
+// As with WriteHeader, this must be called before any call to Write.
+func (srw *SphyraenaResponseWriter) Error(code int, msg string) {
+	header := srw.Header()
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("X-Content-Type-Options", "nosniff")
+	srw.WriteHeader(code)
+	_, _ = fmt.Fprintln(srw, msg)
+}
+
 // Finish completes the request. If in a streaming context, this will
 // "release" the current HTTP response while the goroutine continues
 // streaming.
@@ -150,11 +362,21 @@ func (srw *SphyraenaResponseWriter) WriteJSON(val interface{}) {
 // SphyraenaResponseWriter will result in a panic, as it can only be a
 // serious error in logic. It is safe to call Finish multiple times, though
 // the latter ones will have no effect.
+//
+// If the response was entirely held back by Buffer, this is where it is
+// sent, with its Content-Length.
 func (srw *SphyraenaResponseWriter) Finish() {
 	if srw.finished {
 		return
 	}
 
+	if srw.buffering && !srw.responseWritten {
+		header := srw.underlyingWriter.Header()
+		if header.Get("Content-Length") == "" {
+			header.Set("Content-Length", strconv.Itoa(len(srw.buffer)))
+		}
+		_ = srw.sendBuffer()
+	}
 	if !srw.responseWritten {
 		srw.writeResponse()
 	}
@@ -0,0 +1,107 @@
+/*
+
+Package sphyrwtest provides a recorder for testing handlers that write to
+a SphyraenaResponseWriter.
+
+The Recorder wraps an httptest.ResponseRecorder in a
+SphyraenaResponseWriter, and exposes what a client would receive: the
+status, the body, and the cookies set, which the SphyraenaResponseWriter
+itself only renders into headers when the response is written. NewRequest
+builds a request.Request around it, as the router would.
+
+	req, rec := sphyrwtest.NewRequest(ss, httptest.NewRequest("GET", "/", nil))
+	handler.ServeStreaming(rec.Writer, req)
+
+	if rec.Status() != http.StatusOK || rec.Cookie("prefs") == nil {
+		t.Fatal("prefs not saved")
+	}
+
+*/
+package sphyrwtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
+)
+
+// A Recorder records the response written to its Writer.
+//
+// The methods examining the response call Finish on the Writer first, as
+// the cookies aren't sent until the response begins, and a buffered
+// response isn't sent until it is finished. So they must only be called
+// once the handler is done with the Writer.
+type Recorder struct {
+	Writer *sphyrw.SphyraenaResponseWriter
+	*httptest.ResponseRecorder
+}
+
+// NewRecorder returns a new Recorder, with a new SphyraenaResponseWriter.
+func NewRecorder() *Recorder {
+	rec := httptest.NewRecorder()
+	return &Recorder{sphyrw.NewSphyraenaResponseWriter(rec), rec}
+}
+
+// NewRequest returns a request.Request for the given http.Request, created
+// by the SphyraenaState as for a real request, along with a Recorder for
+// its response.
+func NewRequest(ss *request.SphyraenaState, req *http.Request) (*request.Request, *Recorder) {
+	rec := httptest.NewRecorder()
+	sreq, srw := ss.NewRequest(rec, req, false)
+	return sreq, &Recorder{srw, rec}
+}
+
+// Status returns the final status of the response. As with a real
+// response, it is 200 if the handler never set one.
+func (r *Recorder) Status() int {
+	r.Writer.Finish()
+	return r.Code
+}
+
+// BodyString returns the body of the response.
+func (r *Recorder) BodyString() string {
+	r.Writer.Finish()
+	return r.Body.String()
+}
+
+// SetCookies returns the rendered Set-Cookie headers of the response, in
+// sorted order.
+func (r *Recorder) SetCookies() []string {
+	r.Writer.Finish()
+	setCookies := append([]string{}, r.Header()["Set-Cookie"]...)
+	sort.Strings(setCookies)
+	return setCookies
+}
+
+// Cookies returns the cookies set by the response, as a client would
+// parse them.
+func (r *Recorder) Cookies() []*http.Cookie {
+	r.Writer.Finish()
+	return r.Result().Cookies()
+}
+
+// Cookie returns the named cookie set by the response, or nil if it
+// wasn't set. The value of an authenticated cookie is as the client
+// receives it, with its authentication.
+func (r *Recorder) Cookie(name string) *http.Cookie {
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Holes returns the SecurityHoles the router opened for the given
+// request, whose response is being recorded, or nil if it was never
+// routed. The headers they result in are in the Header of the response.
+func (r *Recorder) Holes(req *request.Request) hole.SecurityHoles {
+	if req.RouteResult == nil {
+		return nil
+	}
+	return req.RouteResult.Holes
+}
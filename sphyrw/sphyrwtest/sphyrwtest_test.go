@@ -0,0 +1,73 @@
+package sphyrwtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/sphyrw/cookie"
+	"github.com/thejerf/sphyraena/sphyrw/hole"
+)
+
+func TestRecorder(t *testing.T) {
+	rec := NewRecorder()
+	for _, name := range []string{"b", "a"} {
+		c, err := cookie.NewOut(name, "value-"+name, nil, cookie.Path("/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec.Writer.SetCookie(c)
+	}
+	rec.Writer.Error(http.StatusTeapot, "short and stout")
+
+	if rec.Status() != http.StatusTeapot ||
+		rec.BodyString() != "short and stout\n" {
+		t.Fatal("response not recorded:", rec.Status(), rec.BodyString())
+	}
+	setCookies := rec.SetCookies()
+	if len(setCookies) != 2 || !strings.HasPrefix(setCookies[0], "a=value-a") ||
+		!strings.HasPrefix(setCookies[1], "b=value-b") {
+		t.Fatal("wrong Set-Cookie headers:", setCookies)
+	}
+	if c := rec.Cookie("b"); c == nil || c.Value != "value-b" || c.Path != "/" {
+		t.Fatal("cookie not parsed:", c)
+	}
+	if rec.Cookie("c") != nil {
+		t.Fatal("unset cookie found")
+	}
+
+	// cookies are sent even if the handler writes nothing at all
+	rec = NewRecorder()
+	c, _ := cookie.NewOut("quiet", "1", nil)
+	rec.Writer.SetCookie(c)
+	if rec.Status() != http.StatusOK || rec.Cookie("quiet") == nil {
+		t.Fatal("cookie from an empty response not recorded:", rec.SetCookies())
+	}
+}
+
+func TestRecorderRequest(t *testing.T) {
+	ss := request.NewSphyraenaState(nil, nil)
+	sr := router.New(ss)
+	sr.WithHoles(hole.AllowBrowserTypeGuessing()).AddLocationForward("/",
+		request.HandlerFunc(func(rw *sphyrw.SphyraenaResponseWriter, req *request.Request) {
+			rw.Write([]byte("hello"))
+		}))
+
+	req, rec := NewRequest(ss, httptest.NewRequest("GET", "/", nil))
+	if rec.Holes(req) != nil {
+		t.Fatal("unrouted request has holes")
+	}
+	sr.RunRoute(rec.Writer, req)
+
+	holes := rec.Holes(req)
+	if rec.BodyString() != "hello" || len(holes) != 1 ||
+		holes.String() != fmt.Sprint(hole.AllowBrowserTypeGuessing()) ||
+		rec.Header().Get("X-Content-Type-Options") != "" {
+		t.Fatal("routed response not recorded:", rec.BodyString(), holes)
+	}
+}
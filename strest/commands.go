@@ -1,5 +1,12 @@
 package strest
 
+import (
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/metrics"
+)
+
 type streamCommand interface {
 	isStreamCommand()
 }
@@ -11,6 +18,10 @@ func (s stop) isStreamCommand() {}
 type setExternalStream struct {
 	toUser   chan EventToUser
 	fromUser chan EventFromUser
+
+	// if resuming, the Seq of the last event the user received
+	resuming     bool
+	lastReceived uint64
 }
 
 func (ses setExternalStream) isStreamCommand() {}
@@ -22,6 +33,30 @@ type unsetExternalStream struct {
 
 func (ues unsetExternalStream) isStreamCommand() {}
 
+type setMetrics struct {
+	metrics metrics.Metrics
+}
+
+func (sm setMetrics) isStreamCommand() {}
+
+type setAbstractTime struct {
+	clock abtime.AbstractTime
+}
+
+func (sat setAbstractTime) isStreamCommand() {}
+
+type setLogger struct {
+	logger func(string, ...interface{})
+}
+
+func (sl setLogger) isStreamCommand() {}
+
+type closeSubstream struct {
+	id SubstreamID
+}
+
+func (cs closeSubstream) isStreamCommand() {}
+
 type getSubstream struct {
 	canReceive bool
 	ss         chan substreamret
@@ -29,6 +64,19 @@ type getSubstream struct {
 
 func (gs getSubstream) isStreamCommand() {}
 
+type enableAcks struct {
+	window       int
+	stallTimeout time.Duration
+}
+
+func (ea enableAcks) isStreamCommand() {}
+
+type inspect struct {
+	ret chan inspectret
+}
+
+func (i inspect) isStreamCommand() {}
+
 type dopanic struct {
 	panicval interface{}
 }
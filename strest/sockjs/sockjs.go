@@ -6,9 +6,13 @@ package sockjs
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
 
 	sockjssrv "github.com/igm/sockjs-go/sockjs"
+	"github.com/thejerf/abtime"
 	"github.com/thejerf/sphyraena/identity/session"
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/router"
@@ -16,7 +20,39 @@ import (
 	"github.com/thejerf/sphyraena/strest/utf8stream"
 )
 
-var DefaultOptions = sockjssrv.DefaultOptions
+// DefaultIdleTimeout is the IdleTimeout used by DefaultOptions.
+const DefaultIdleTimeout = 5 * time.Minute
+
+// ErrClosed is returned from a receive on a sockjs session that has been
+// closed.
+var ErrClosed = errors.New("sockjs session closed")
+
+// ErrIdleTimeout is returned from a receive on a sockjs session when the
+// peer has sent nothing within the configured IdleTimeout.
+var ErrIdleTimeout = errors.New("sockjs session idle timeout")
+
+// Options wraps the sockjs server options with the settings the streaming
+// REST handler itself uses.
+//
+// IdleTimeout is how long a session may go without receiving anything
+// from the peer before it is closed. sockjs heartbeats only flow from the
+// server to the client, so they will not keep a session alive; clients
+// are expected to send something within this window, such as the "ping"
+// message utf8stream answers for the purpose. Zero or less disables the
+// timeout.
+//
+// The AbstractTime is used for the IdleTimeout. If nil, the real time is
+// used.
+type Options struct {
+	sockjssrv.Options
+	IdleTimeout time.Duration
+	abtime.AbstractTime
+}
+
+var DefaultOptions = Options{
+	Options:     sockjssrv.DefaultOptions,
+	IdleTimeout: DefaultIdleTimeout,
+}
 
 // As it happens, a sockjs.Session is a utf8stream.UTF8StreamDriver, so we
 // don't require a wrapper struct.
@@ -25,49 +61,73 @@ type sockjskey string
 
 // FIXME: Update the name here
 
+// StreamingRESTHandler returns the handler serving streams over sockjs.
+//
+// The client selects among the given protocols, in the manner of
+// utf8stream.Negotiate; if none are given, only the
+// utf8stream.DefaultProtocol is served. The client requests protocols
+// with the "protocol" query parameter, as described under
+// utf8stream.RequestedProtocols, and the selection is announced to it as
+// the first message.
 func StreamingRESTHandler(
 	prefix string,
 	sr *router.SphyraenaRouter,
 	ss session.SessionServer,
-	options sockjssrv.Options,
+	options Options,
+	protocols ...utf8stream.Protocol,
 ) request.HandlerFunc {
-	sockjsHandler := sockjssrv.NewHandler(prefix, options,
+	if len(protocols) == 0 {
+		protocols = []utf8stream.Protocol{utf8stream.DefaultProtocol}
+	}
+	if options.AbstractTime == nil {
+		options.AbstractTime = abtime.NewRealTime()
+	}
+
+	sockjsHandler := sockjssrv.NewHandler(prefix, options.Options,
 		func(sjs sockjssrv.Session) {
-			fmt.Println("Serving session handler")
 			origReq := sjs.Request()
 			reqURL := origReq.URL
 			values := reqURL.Query()
 			streamID := values.Get("stream_id")
 
+			requested := utf8stream.RequestedProtocols(origReq)
+			protocol, err := utf8stream.Negotiate(requested, protocols)
+			if err != nil {
+				slog.Warn("could not negotiate a stream protocol",
+					"requested", requested, "err", err)
+				return
+			}
+
 			origSphyReq := origReq.Context().Value(sockjskey("orig_sphy_req")).(*request.Request)
 			mySession := origSphyReq.Session()
-			fmt.Printf("My session: %#v\n", mySession)
 			stream, err := mySession.GetStream([]byte(streamID))
 			if err != nil {
-				// FIXME: Log properly
-				fmt.Println("Failed to get stream", streamID, ":", err)
+				slog.Warn("could not get the requested stream",
+					"stream_id", streamID, "err", err)
 				return
 			}
 
 			u8s := utf8stream.NewUTF8Stream(
-				sockJSDriver{sjs},
+				newSockJSDriver(sjs, options.IdleTimeout, options.AbstractTime),
 				origSphyReq.Session(),
 				stream,
 				origSphyReq.SphyraenaState,
 				sr,
+				protocol,
+				0,
 			)
 
-			if err != nil {
-				// FIXME: Log properly
-				fmt.Println("Failed to find stream |", string(streamID), "|")
-				return
+			if len(requested) != 0 {
+				err = u8s.AnnounceProtocol()
+				if err != nil {
+					slog.Warn("could not announce the stream protocol",
+						"protocol", protocol.Name(), "err", err)
+					return
+				}
 			}
 
-			// now take the stream over
-			stream.SetExternalStream(u8s)
-
-			fmt.Println("Falling off the bottom of the sockjs handler")
-
+			// Serve takes the stream over, resuming it if this is the
+			// client reconnecting.
 			u8s.Serve()
 		})
 
@@ -75,7 +135,6 @@ func StreamingRESTHandler(
 		rw *sphyrw.SphyraenaResponseWriter,
 		req *request.Request,
 	) {
-		fmt.Println("Got request for socket")
 		desiredContext := context.WithValue(
 			req.Context(),
 			sockjskey("orig_sphy_req"),
@@ -89,32 +148,91 @@ func StreamingRESTHandler(
 	return request.HandlerFunc(handler)
 }
 
-type sockJSDriver struct {
-	sess sockjssrv.Session
-}
+// idleTimer is the abtime ID of the timer for the IdleTimeout.
+const idleTimer = 1
 
-func (sjd sockJSDriver) Close() error {
-	return sjd.sess.Close(0, "closed")
+type sockJSDriver struct {
+	sess        sockjssrv.Session
+	idleTimeout time.Duration
+	clock       abtime.AbstractTime
+
+	// With an idle timeout, a single goroutine receives from the session
+	// for the life of the driver, so Receive can give up waiting on it.
+	received  chan received
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func (sjd sockJSDriver) Receive() ([]byte, error) {
-	s, err := sjd.sess.Recv()
-	return []byte(s), err
+type received struct {
+	msg string
+	err error
 }
 
-func (sjd sockJSDriver) Send(s string) error {
-	return sjd.sess.Send(s)
+func newSockJSDriver(
+	sess sockjssrv.Session,
+	idleTimeout time.Duration,
+	clock abtime.AbstractTime,
+) *sockJSDriver {
+	sjd := &sockJSDriver{
+		sess:        sess,
+		idleTimeout: idleTimeout,
+		clock:       clock,
+		received:    make(chan received),
+		closed:      make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go sjd.receiveLoop()
+	}
+	return sjd
 }
 
-func echoHandler(session sockjssrv.Session) {
-	fmt.Println("Entering echo handler")
+// receiveLoop passes along what the session receives, until it fails or
+// the driver is closed.
+func (sjd *sockJSDriver) receiveLoop() {
 	for {
-		if msg, err := session.Recv(); err == nil {
-			fmt.Println("Got SockJS message:", msg)
-			fmt.Printf("Session type: %T\n", session)
-			session.Send(msg)
-			continue
+		s, err := sjd.sess.Recv()
+		select {
+		case sjd.received <- received{s, err}:
+		case <-sjd.closed:
+			return
+		}
+		if err != nil {
+			return
 		}
-		break
 	}
 }
+
+func (sjd *sockJSDriver) close(status uint32, reason string) error {
+	sjd.closeOnce.Do(func() { close(sjd.closed) })
+	return sjd.sess.Close(status, reason)
+}
+
+func (sjd *sockJSDriver) Close() error {
+	return sjd.close(0, "closed")
+}
+
+// Receive returns the next message from the peer. If the idle timeout
+// passes first, the session is closed and ErrIdleTimeout is returned.
+func (sjd *sockJSDriver) Receive() ([]byte, error) {
+	if sjd.idleTimeout <= 0 {
+		s, err := sjd.sess.Recv()
+		return []byte(s), err
+	}
+
+	timer := sjd.clock.NewTimer(sjd.idleTimeout, idleTimer)
+	defer timer.Stop()
+
+	select {
+	case r := <-sjd.received:
+		return []byte(r.msg), r.err
+	case <-sjd.closed:
+		return nil, ErrClosed
+	case <-timer.Channel():
+		_ = sjd.close(3000, "idle timeout")
+		return nil, ErrIdleTimeout
+	}
+}
+
+func (sjd *sockJSDriver) Send(s string) error {
+	return sjd.sess.Send(s)
+}
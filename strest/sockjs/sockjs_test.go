@@ -0,0 +1,81 @@
+package sockjs
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejerf/abtime"
+)
+
+type silentSession struct {
+	sync.Mutex
+	incoming chan string
+	closed   chan struct{}
+	status   uint32
+}
+
+func (ss *silentSession) ID() string             { return "silent" }
+func (ss *silentSession) Request() *http.Request { return nil }
+func (ss *silentSession) Send(string) error      { return nil }
+
+func (ss *silentSession) Recv() (string, error) {
+	select {
+	case msg := <-ss.incoming:
+		return msg, nil
+	case <-ss.closed:
+		return "", errors.New("session closed")
+	}
+}
+
+func (ss *silentSession) Close(status uint32, reason string) error {
+	ss.Lock()
+	defer ss.Unlock()
+	select {
+	case <-ss.closed:
+	default:
+		ss.status = status
+		close(ss.closed)
+	}
+	return nil
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sess := &silentSession{closed: make(chan struct{})}
+	clock := abtime.NewManual()
+	driver := newSockJSDriver(sess, time.Minute, clock)
+
+	go clock.Trigger(idleTimer)
+	_, err := driver.Receive()
+	if err != ErrIdleTimeout {
+		t.Fatal("expected idle timeout, got", err)
+	}
+	select {
+	case <-sess.closed:
+	default:
+		t.Fatal("idle session was not closed")
+	}
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.status != 3000 {
+		t.Fatal("unexpected close status:", sess.status)
+	}
+}
+
+func TestReceiveBeforeIdleTimeout(t *testing.T) {
+	sess := &silentSession{incoming: make(chan string), closed: make(chan struct{})}
+	driver := newSockJSDriver(sess, time.Minute, abtime.NewManual())
+	defer driver.Close()
+
+	for _, sent := range []string{"ping", "pong"} {
+		go func(sent string) {
+			sess.incoming <- sent
+		}(sent)
+		msg, err := driver.Receive()
+		if err != nil || string(msg) != sent {
+			t.Fatal("message not received:", string(msg), err)
+		}
+	}
+}
@@ -2,10 +2,10 @@
 
 Package strest contains the "streaming rest" support code.
 
-FIXME: I have to separate out REST handlers and streaming handlers;
-handling the same thing on the same URL will be handled by the router.
-So this package should be the streaming support package. But it needs to be
-renamed from "strest" to just "streaming"; there is no longer a distinction.
+REST handlers and streaming handlers are separate; serving both on the
+same URL is handled by the router's DualClause. So this package should be
+the streaming support package. FIXME: But it needs to be renamed from
+"strest" to just "streaming"; there is no longer a distinction.
 
 As of this writing, it is not clear exactly what this package really is.
 The code in it is definitely good and needs to live somewhere, but the
@@ -19,12 +19,26 @@ package strest
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"log"
+	"log/slog"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thejerf/abtime"
+	"github.com/thejerf/sphyraena/logging"
+	"github.com/thejerf/sphyraena/metrics"
 )
 
+// stallTimeoutTimer is the abtime ID of the timer that detects a stalled
+// user.
+const stallTimeoutTimer = 1
+
+// activeStreams counts the Streams whose goroutines are running, for the
+// metrics.ActiveStreams gauge. It must be accessed atomically.
+var activeStreams int64
+
 // FIXME: A stream needs to be able to determine when its session is over
 // and terminate if the session is still expired.
 
@@ -43,6 +57,11 @@ type substreamret struct {
 	err error
 }
 
+type inspectret struct {
+	info StreamInfo
+	err  error
+}
+
 // This file defines a "stream" abstraction which, when passed in as part
 // of a Streaming REST request, allows you to interact with streamed events
 // and such easily.
@@ -63,20 +82,46 @@ type StreamID string
 
 // EventFromUser represents an incoming event from whatever is concretely
 // instantiating the stream.
+//
+// Ack, if non-zero, acknowledges that the user has received every
+// EventToUser up to and including that Seq. An event with an Ack and no
+// Dest is only an acknowledgement.
 type EventFromUser struct {
 	Dest    SubstreamID     `json:"dest"`
 	Close   bool            `json:"close,omitempty"`
 	Message json.RawMessage `json:"message,omitempty"`
 	Type    string          `json:"type"`
+	Ack     uint64          `json:"ack,omitempty"`
 }
 
 // EventToUser represents an outgoing event from whatever is concretely
 // instantiating the stream.
+//
+// The Type tells the client what kind of message this is, as the same
+// connection also carries messages that aren't events on a substream. An
+// EventToUser is always of type EventType; use NewEventToUser to create
+// one rather than building it by hand.
+//
+// In acknowledgement mode, the Seq is assigned by the Stream as the event
+// is queued for the user, counting up from 1 over the life of the Stream.
+// Otherwise it is zero. See Stream for how it is used.
 type EventToUser struct {
 	Source  SubstreamID `json:"source"`
 	Close   bool        `json:"close,omitempty"`
 	Message interface{} `json:"message,omitempty"`
 	Type    string      `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
+}
+
+// EventType is the Type of every event on a substream, in either
+// direction.
+const EventType = "event"
+
+// NewEventToUser returns the EventToUser sending the given message to the
+// user from the given substream. If close is true, the event closes the
+// substream; the message may be nil.
+func NewEventToUser(source SubstreamID, close bool, msg interface{}) EventToUser {
+	return EventToUser{source, close, msg, EventType, 0}
 }
 
 // An ExternalStream is something from which the requisite channels can
@@ -93,6 +138,35 @@ type ExternalStream interface {
 	Channels() (chan EventToUser, chan EventFromUser)
 }
 
+// A ResumingExternalStream is an ExternalStream taking over a Stream from
+// a previous one that was disconnected, as created by Resume.
+type ResumingExternalStream interface {
+	ExternalStream
+
+	// LastReceived returns the Seq of the last EventToUser the user
+	// received, or 0 if none.
+	LastReceived() uint64
+}
+
+type resumingStream struct {
+	ExternalStream
+	lastReceived uint64
+}
+
+func (rs resumingStream) LastReceived() uint64 {
+	return rs.lastReceived
+}
+
+// Resume returns a ResumingExternalStream for the given ExternalStream,
+// which tells the Stream that the user last received the EventToUser with
+// the given Seq.
+//
+// This is only useful for a Stream in acknowledgement mode. Other Streams
+// don't keep the events to replay.
+func Resume(es ExternalStream, lastReceived uint64) ResumingExternalStream {
+	return resumingStream{es, lastReceived}
+}
+
 // ChannelsStream is a struct that implements the ExternalStream interface
 // if given a chan EventToUser and chan EventFromUser.
 type ChannelsStream struct {
@@ -118,10 +192,25 @@ func (cs ChannelsStream) Channels() (chan EventToUser, chan EventFromUser) {
 // implementing something that can consume and produce EventToUser and
 // EventFromUser structs, and calling the SetExternalStream method.
 //
-// Future warning: At the moment, it is permitted to call SetExternalStream
-// more than once. This will likely be removed in the future as there is
-// probably no practical safe way to transfer streams without potentially
-// losing messages, but we'll see how that goes.
+// By default, events are fire-and-forget: once one has been handed to the
+// ExternalStream, the Stream forgets about it. EnableAcks turns on
+// acknowledgement mode, in which the Stream numbers every EventToUser
+// with a Seq, and keeps those that have been handed to the ExternalStream
+// until the user acknowledges them with the Ack of an EventFromUser. This
+// gives at-least-once delivery, bounds how far the Stream can get ahead
+// of the user, and lets the Stream detect a user that has stalled.
+//
+// SetExternalStream may be called more than once, to move the Stream to a
+// new connection. In acknowledgement mode, this can be done without
+// losing events. A transport that loses its connection calls
+// DisconnectExternalStream rather than closing its fromUser channel,
+// which would terminate the Stream, and the Stream holds on to
+// everything for the user. When the user reconnects, telling the
+// transport the Seq of the last event it got, the new ExternalStream is
+// wrapped with Resume, and the Stream replays everything after that. A
+// plain ExternalStream, not wrapped by Resume, is taken to have received
+// everything already sent. The utf8stream package does all of this for
+// its transports, including sockjs.
 type Stream struct {
 	streamMembers map[SubstreamID]*substream
 	commands      chan streamCommand
@@ -135,8 +224,32 @@ type Stream struct {
 
 	closedMutex sync.Mutex
 	closed      bool
+	done        chan struct{}
 
 	logger func(string, ...interface{})
+
+	metrics metrics.Metrics
+
+	clock abtime.AbstractTime
+
+	// The acknowledgement mode settings, as set by EnableAcks. A zero
+	// ackWindow means acknowledgement mode is off.
+	ackWindow    int
+	stallTimeout time.Duration
+
+	// whether the Stream has ever had an ExternalStream, so that a new
+	// one may be taking over from it
+	hadExternalStream bool
+
+	// the Seq of the last event queued to the user
+	lastSeq uint64
+	// the events handed to the external stream but not yet acknowledged,
+	// in Seq order
+	unacknowledged []*EventToUser
+	// running while there are unacknowledged events, reset when an
+	// acknowledgement arrives
+	stallTimer abtime.Timer
+	stallC     <-chan time.Time
 }
 
 // NewStream returns a new stream.
@@ -149,11 +262,15 @@ func NewStream(id StreamID) *Stream {
 		streamMembers:       map[SubstreamID]*substream{},
 		fromSubstreamToUser: make(chan EventToUser),
 		commands:            make(chan streamCommand),
+		done:                make(chan struct{}),
 		nextSubstreamID:     SubstreamID(2), // FIXME: Randomize or something?
 		fromUser:            nil,
 		toUser:              nil,
-		logger:              log.Printf,
+		logger:              logging.Default(slog.LevelError),
+		metrics:             metrics.Nop{},
+		clock:               abtime.NewRealTime(),
 	}
+	atomic.AddInt64(&activeStreams, 1)
 	go s.serve()
 	return s
 }
@@ -174,19 +291,27 @@ func (s *Stream) serve() {
 		s.cleanup()
 	}()
 
-	fmt.Println("In stream serve")
-
 	sendingToUser := chan EventToUser(nil)
 	msgs := []*EventToUser{}
 	nilEventToUser := &EventToUser{}
 	var nextMessage *EventToUser
+	enqueue := func(m EventToUser) {
+		if s.ackWindow > 0 {
+			s.lastSeq++
+			m.Seq = s.lastSeq
+		}
+		msgs = append(msgs, &m)
+	}
 	for {
-		fmt.Println("Select loop")
 		// This adapts the fairly standard idiom in Go of setting a
 		// possibly-interesting channel in a select to nil if it isn't
 		// interesting right now to include the message to send on that
 		// channel, if possible.
-		if len(msgs) == 0 {
+		//
+		// In acknowledgement mode, nothing more is sent while the user has
+		// a full window of events it hasn't acknowledged.
+		if len(msgs) == 0 ||
+			(s.ackWindow > 0 && len(s.unacknowledged) >= s.ackWindow) {
 			nextMessage = nilEventToUser
 			sendingToUser = nil
 		} else {
@@ -208,13 +333,45 @@ func (s *Stream) serve() {
 				}
 				s.streamMembers[ssID] = ss
 				msg.ss <- substreamret{ss, nil}
+			case inspect:
+				msg.ret <- inspectret{s.info(), nil}
 			case setExternalStream:
 				s.fromUser = msg.fromUser
 				s.toUser = msg.toUser
+				s.hadExternalStream = true
+				if msg.resuming {
+					s.acknowledge(msg.lastReceived)
+					msgs = append(s.unacknowledged, msgs...)
+				}
+				s.unacknowledged = nil
+				s.resetStallTimer()
+			case enableAcks:
+				s.ackWindow = msg.window
+				s.stallTimeout = msg.stallTimeout
+			case closeSubstream:
+				ss, haveSS := s.streamMembers[msg.id]
+				if !haveSS {
+					continue
+				}
+				close(ss.fromUser)
+				delete(s.streamMembers, msg.id)
+				enqueue(NewEventToUser(msg.id, true, nil))
+			case setLogger:
+				s.logger = msg.logger
+			case setAbstractTime:
+				s.clock = msg.clock
+			case setMetrics:
+				s.metrics = msg.metrics
+				s.metrics.SetGauge(metrics.ActiveStreams,
+					float64(atomic.LoadInt64(&activeStreams)), nil)
 			case unsetExternalStream:
 				if s.fromUser == msg.fromUser && s.toUser == msg.toUser {
 					s.fromUser = nil
 					s.toUser = nil
+					// The user can't acknowledge anything while it is
+					// disconnected, so it isn't stalled either. The timer
+					// starts again when events are replayed on resuming.
+					s.stopStallTimer()
 				}
 			case stop:
 				return
@@ -222,6 +379,12 @@ func (s *Stream) serve() {
 				panic(msg.panicval)
 			}
 		case sendingToUser <- *nextMessage:
+			if s.ackWindow > 0 {
+				s.unacknowledged = append(s.unacknowledged, nextMessage)
+				if s.stallC == nil {
+					s.resetStallTimer()
+				}
+			}
 			// this makes it so that if messages are going out much slower
 			// than they are being received, the common case, this slice
 			// does not tend to itself generate garbage, re-using the
@@ -238,7 +401,7 @@ func (s *Stream) serve() {
 		case m := <-s.fromSubstreamToUser:
 			// FIXME: We need some sort of very high limit that says
 			// this is just too much right now.
-			m.Type = "event"
+			m.Type = EventType
 			if m.Close {
 				ssID := m.Source
 				ss, haveSS := s.streamMembers[ssID]
@@ -247,29 +410,38 @@ func (s *Stream) serve() {
 				}
 				close(ss.fromUser)
 				delete(s.streamMembers, ssID)
-				msgs = append(msgs, &m)
-			} else {
-				msgs = append(msgs, &m)
 			}
+			enqueue(m)
+		case <-s.stallC:
+			s.logger("Stream %v stalled: the user has not acknowledged event %d in %v",
+				s.id, s.unacknowledged[0].Seq, s.stallTimeout)
+			return
 		case incoming, ok := <-s.fromUser:
 			if !ok {
 				return
 			}
 
-			fmt.Printf("Received incoming message: %#v\n", incoming)
+			if incoming.Ack != 0 {
+				if s.acknowledge(incoming.Ack) {
+					s.resetStallTimer()
+				}
+				if incoming.Dest == 0 {
+					continue
+				}
+			}
 
 			dest := incoming.Dest
 			ss, hasStream := s.streamMembers[dest]
 			if !hasStream {
-				fmt.Println("Couldn't find receiver:", dest, s.streamMembers)
-				msgs = append(msgs, &EventToUser{dest, true, nil, "event"})
+				s.metrics.IncCounter(metrics.DroppedMessages,
+					metrics.Labels{"reason": "no_substream"})
+				enqueue(NewEventToUser(dest, true, nil))
 				continue
 			}
 
 			if incoming.Close {
 				close(ss.fromUser)
 				delete(s.streamMembers, dest)
-				fmt.Println("Closing stream")
 				continue
 			}
 
@@ -281,24 +453,88 @@ func (s *Stream) serve() {
 				// a user-end bug; why would you ever "send" to something
 				// that isn't receiving? Since there's no "generic"
 				// protocol defined here, what would that even mean?
-				fmt.Println("Bailing out of message because substream",
-					ss, "can't receive")
-				fmt.Printf("Substream type: %T\n", ss)
+				s.metrics.IncCounter(metrics.DroppedMessages,
+					metrics.Labels{"reason": "cannot_receive"})
 				continue
 			}
 
-			fmt.Println("Sending to substream fromUser")
 			ss.fromUser <- TypedJSON{incoming.Type, incoming.Message}
 		}
 	}
 }
 
+// acknowledge discards the unacknowledged events up to and including the
+// given Seq, returning whether there were any. It must only be called
+// from the serve goroutine.
+func (s *Stream) acknowledge(seq uint64) bool {
+	acked := 0
+	for acked < len(s.unacknowledged) && s.unacknowledged[acked].Seq <= seq {
+		s.unacknowledged[acked] = nil
+		acked++
+	}
+	s.unacknowledged = s.unacknowledged[acked:]
+	return acked > 0
+}
+
+// resetStallTimer starts the stall timer over if there are unacknowledged
+// events and a stall timeout, or stops it otherwise. It must only be
+// called from the serve goroutine.
+func (s *Stream) resetStallTimer() {
+	s.stopStallTimer()
+	if len(s.unacknowledged) > 0 && s.stallTimeout > 0 {
+		s.stallTimer = s.clock.NewTimer(s.stallTimeout, stallTimeoutTimer)
+		s.stallC = s.stallTimer.Channel()
+	}
+}
+
+// stopStallTimer stops the stall timer, if it is running. It must only be
+// called from the serve goroutine.
+func (s *Stream) stopStallTimer() {
+	if s.stallTimer != nil {
+		s.stallTimer.Stop()
+		s.stallTimer = nil
+		s.stallC = nil
+	}
+}
+
+// EnableAcks turns on acknowledgement mode, as described under Stream.
+//
+// The window is how many events may be sent to the user without being
+// acknowledged; once it is full, further events wait in the Stream. If
+// the stallTimeout is non-zero and the user goes that long without
+// acknowledging anything while events are outstanding, the user is
+// considered to have stalled and the Stream is closed. The time the user
+// spends disconnected doesn't count; the timer starts over once the
+// outstanding events are replayed to the resumed user.
+//
+// This should be called before the Stream is given its ExternalStream,
+// so that every event the user gets carries a Seq.
+func (s *Stream) EnableAcks(window int, stallTimeout time.Duration) error {
+	if window < 1 {
+		return errors.New("acknowledgement window must be at least 1")
+	}
+	return s.sendCommand(enableAcks{window, stallTimeout})
+}
+
 // Close terminates the Stream and its associated goroutine.
+//
+// This returns once the Stream has accepted the command, not once it has
+// terminated; use Done to wait for that.
 func (s *Stream) Close() error {
 	return s.sendCommand(stop{})
 }
 
+// Done returns a channel that is closed once the Stream's goroutine has
+// terminated, and the external stream has been told the stream is closed.
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
 func (s *Stream) cleanup() {
+	if s.stallTimer != nil {
+		s.stallTimer.Stop()
+	}
+
 	// prevent any more messages from comming in on the command channel
 	s.closedMutex.Lock()
 	s.closed = true
@@ -315,6 +551,8 @@ DRAIN_COMMANDS:
 			// replies
 			case getSubstream:
 				msg.ss <- substreamret{nil, ErrClosed}
+			case inspect:
+				msg.ret <- inspectret{StreamInfo{}, ErrClosed}
 			default:
 				// don't need to do anything for setExternalStream?
 			}
@@ -331,6 +569,13 @@ DRAIN_COMMANDS:
 	if s.toUser != nil {
 		close(s.toUser)
 	}
+
+	// streams not created by NewStream were never counted
+	if s.metrics != nil {
+		s.metrics.SetGauge(metrics.ActiveStreams,
+			float64(atomic.AddInt64(&activeStreams, -1)), nil)
+	}
+	close(s.done)
 }
 
 // commands are actually relatively rare; sync'ing on a mutex is not that
@@ -344,15 +589,114 @@ func (s *Stream) sendCommand(sc streamCommand) error {
 		return ErrClosed
 	}
 
-	s.commands <- sc
-	return nil
+	// the stream may finish closing between the check above and this
+	// send, in which case nothing will ever receive the command.
+	select {
+	case s.commands <- sc:
+		return nil
+	case <-s.done:
+		return ErrClosed
+	}
+}
+
+// SubstreamInfo describes one of the substreams of a Stream.
+//
+// CanReceive is whether the substream accepts messages from the user;
+// messages sent by the user to a substream that can't receive them are
+// dropped.
+type SubstreamInfo struct {
+	ID         SubstreamID
+	CanReceive bool
+}
+
+// StreamInfo is a snapshot of the substreams of a Stream, as returned by
+// Inspect. The Substreams are sorted by ID, and Count is how many there
+// are.
+//
+// Resumable is whether the Stream is in acknowledgement mode and has
+// already had an ExternalStream, so that a transport giving it a new one
+// should find out from the user where to resume it, and one losing its
+// connection should call DisconnectExternalStream.
+type StreamInfo struct {
+	Count      int
+	Substreams []SubstreamInfo
+	Resumable  bool
+}
+
+// info must only be called from the serve goroutine.
+func (s *Stream) info() StreamInfo {
+	substreams := make([]SubstreamInfo, 0, len(s.streamMembers))
+	for id, ss := range s.streamMembers {
+		substreams = append(substreams, SubstreamInfo{id, ss.canReceive})
+	}
+	sort.Slice(substreams, func(i, j int) bool {
+		return substreams[i].ID < substreams[j].ID
+	})
+	return StreamInfo{
+		len(substreams),
+		substreams,
+		s.ackWindow > 0 && s.hadExternalStream,
+	}
+}
+
+// Inspect returns a snapshot of the Stream's current substreams, for
+// monitoring and debugging. As with any snapshot of a running Stream,
+// substreams may be opened or closed as soon as it is taken.
+//
+// This is safe to call from any goroutine. It returns ErrClosed if the
+// Stream is closed.
+func (s *Stream) Inspect() (StreamInfo, error) {
+	c := make(chan inspectret)
+	err := s.sendCommand(inspect{c})
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	ret := <-c
+	return ret.info, ret.err
 }
 
 // SetExternalStream accepts channels that are hooked up to some concrete
 // communicatation mechanism, and will communicate with some user.
-func (s *Stream) SetExternalStream(es ExternalStream) {
+//
+// If the ExternalStream is a ResumingExternalStream, the events after the
+// one it last received are sent to it again, as described under Stream.
+//
+// This returns ErrClosed if the Stream is closed.
+func (s *Stream) SetExternalStream(es ExternalStream) error {
 	toUser, fromUser := es.Channels()
-	s.commands <- setExternalStream{toUser, fromUser}
+	cmd := setExternalStream{toUser: toUser, fromUser: fromUser}
+	if res, isResuming := es.(ResumingExternalStream); isResuming {
+		cmd.resuming = true
+		cmd.lastReceived = res.LastReceived()
+	}
+	return s.sendCommand(cmd)
+}
+
+// SetMetrics sets the Metrics the Stream reports through. Streams start out
+// using metrics.Nop.
+func (s *Stream) SetMetrics(m metrics.Metrics) error {
+	return s.sendCommand(setMetrics{m})
+}
+
+// SetAbstractTime sets the source of time for the Stream's timers, for
+// testing. Streams start out using the real time.
+func (s *Stream) SetAbstractTime(at abtime.AbstractTime) error {
+	return s.sendCommand(setAbstractTime{at})
+}
+
+// CloseSubstream closes the given substream from the server's side,
+// telling both the user and the substream's handler, which will see its
+// messages from the user end. Closing a substream that is not open does
+// nothing.
+func (s *Stream) CloseSubstream(id SubstreamID) error {
+	return s.sendCommand(closeSubstream{id})
+}
+
+// SetLogger sets the log.Printf-like function the Stream logs its
+// problems through. Streams start out logging to slog.Default() at the
+// Error level.
+func (s *Stream) SetLogger(logger func(string, ...interface{})) error {
+	return s.sendCommand(setLogger{logger})
 }
 
 // DisconnectExternalStream notifies the Stream that the given
@@ -361,9 +705,11 @@ func (s *Stream) SetExternalStream(es ExternalStream) {
 // It is necessary to send the ExternalStream you are trying to disconnect
 // so that the stream will not disconnect any other ExternalStreams, such
 // as one that may have superceded this one.
-func (s *Stream) DisconnectExternalStream(es ExternalStream) {
+//
+// This returns ErrClosed if the Stream is closed.
+func (s *Stream) DisconnectExternalStream(es ExternalStream) error {
 	toUser, fromUser := es.Channels()
-	s.commands <- unsetExternalStream{toUser, fromUser}
+	return s.sendCommand(unsetExternalStream{toUser, fromUser})
 }
 
 // SubstreamToUser returns a Substream that can only be used to send to the
@@ -382,7 +728,6 @@ func (s *Stream) getSubstream(canReceive bool) (*substream, error) {
 		return nil, err
 	}
 	ssret := <-c
-	fmt.Printf("Getting substream: %#v\n", ssret.ss)
 	return ssret.ss, ssret.err
 }
 
@@ -1,10 +1,14 @@
 package strest
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
+
+	"github.com/thejerf/abtime"
 )
 
 // ***
@@ -81,7 +85,7 @@ func TestEmitting(t *testing.T) {
 	<-sync
 
 	if !reflect.DeepEqual(ss.CloseMessage(),
-		EventToUser{ss.substreamID, true, nil, "event"}) {
+		NewEventToUser(ss.substreamID, true, nil)) {
 		t.Fatal("Close message not working for send-only substream")
 	}
 
@@ -97,7 +101,6 @@ func TestEmitting(t *testing.T) {
 	}
 }
 
-/*
 func TestReceiving(t *testing.T) {
 	s, _, fromUser := getTestStream()
 	defer s.Close()
@@ -107,27 +110,52 @@ func TestReceiving(t *testing.T) {
 		for i := int(0); i < 3; i++ {
 			// note this is actually simulating it coming from the user,
 			// not directly poking the stream->substream channel
-			fromUser <- EventFromUser{ss.substreamID, false, i}
+			fromUser <- EventFromUser{
+				Dest:    ss.substreamID,
+				Message: json.RawMessage(strconv.Itoa(i)),
+				Type:    "int",
+			}
+		}
+		fromUser <- EventFromUser{
+			Dest:    ss.substreamID,
+			Message: json.RawMessage(`"not an int"`),
+			Type:    "string",
 		}
 	}()
 
 	_ = ss.ReceiveChan()
 
-	for i := int(0); i < 3; i++ {
-		msg, err := ss.Receive()
+	msg, err := ss.Receive()
+	if err != nil {
+		t.Fatal("Got an error on what should be a clean receive")
+	}
+	if tj, isTyped := msg.(TypedJSON); !isTyped || tj.Type != "int" ||
+		string(tj.JSON) != "0" {
+		t.Fatal("Receive did not yield the raw message:", msg)
+	}
+
+	for i := int(1); i < 3; i++ {
+		var n int
+		err := ss.ReceiveInto(&n)
 		if err != nil {
 			t.Fatal("Got an error on what should be a clean receive")
 		}
-		if msg.(int) != i {
+		if n != i {
 			t.Fatal("Somehow did not get the message from the user received")
 		}
 	}
+
+	var n int
+	err = ss.ReceiveInto(&n)
+	if _, isTypeError := err.(*json.UnmarshalTypeError); !isTypeError {
+		t.Fatal("Message of the wrong type decoded:", err)
+	}
+
 	ss.Close()
-	msg, err := ss.Receive()
-	if msg != nil || err != ErrClosed {
+	err = ss.ReceiveInto(&n)
+	if err != ErrClosed {
 		t.Fatal("Was able to receive a message post-closure")
 	}
-
 }
 
 func TestUserClosesSubstream(t *testing.T) {
@@ -143,7 +171,7 @@ func TestUserClosesSubstream(t *testing.T) {
 		}
 	}()
 
-	fromUser <- EventFromUser{ss.substreamID, true, nil}
+	fromUser <- EventFromUser{Dest: ss.substreamID, Close: true}
 	<-ch
 	// if we make it here, the substreamFromUser was closed properly
 }
@@ -153,7 +181,7 @@ func TestClosingNonexistantSubstreams(t *testing.T) {
 	// doesn't fail.
 	s, _, _ := getTestStream()
 
-	s.fromSubstreamToUser <- EventToUser{SubstreamID(50), true, nil}
+	s.fromSubstreamToUser <- NewEventToUser(SubstreamID(50), true, nil)
 	s.Close()
 }
 
@@ -179,8 +207,10 @@ func TestClosingStream(t *testing.T) {
 
 	// by sync'ing on the close of toUser, we can know that we're past the
 	// point where the stream has closed, allowing us to test that the
-	// sendCommand properly fails
-	_, _ = <-toUser
+	// sendCommand properly fails. The stream may still deliver some of
+	// the emitter's messages before it notices fromUser closing.
+	for range toUser {
+	}
 	_, err := s.Substream()
 	if err != ErrClosed {
 		t.Fatal("Stream is unexpectedly not closed.")
@@ -199,11 +229,11 @@ func TestFullSubstream(t *testing.T) {
 	}
 
 	if !reflect.DeepEqual(ss.Message("moo"),
-		EventToUser{ss.substreamID, false, "moo"}) {
+		NewEventToUser(ss.substreamID, false, "moo")) {
 		t.Fatal("message call not working on substream")
 	}
 	if !reflect.DeepEqual(ss.CloseMessage(),
-		EventToUser{ss.substreamID, true, nil}) {
+		NewEventToUser(ss.substreamID, true, nil)) {
 		t.Fatal("Close message not working for send-only substream")
 	}
 	ss.Close()
@@ -217,21 +247,26 @@ func TestUserSideSendingIllegally(t *testing.T) {
 		t.Fatal("Could not get substream to user")
 	}
 
+	moo := json.RawMessage(`"moo"`)
+
 	// There's two illegal things the user can do:
 	// 1. Send to a non-existant stream:
-	fromUser <- EventFromUser{SubstreamID(4), false, "moo"}
+	fromUser <- EventFromUser{Dest: SubstreamID(4), Message: moo}
 	reply := <-toUser
 
-	if !reply.Close {
+	if !reply.Close || reply.Source != SubstreamID(4) {
 		t.Fatal("Stream does not correctly send closeSubstream when speaking to nonexistant substream")
 	}
 
-	// 2. Send to a receive-only stream, in which case the message is eaten
-	// without errors or deadlocks.
-	fromUser <- EventFromUser{ss.substreamID, false, "moo"}
+	// 2. Send to a send-only stream, in which case the message is eaten
+	// without errors or deadlocks, and the substream carries on.
+	fromUser <- EventFromUser{Dest: ss.substreamID, Message: moo}
+	info, err := s.Inspect()
+	if err != nil || info.Count != 1 || info.Substreams[0].ID != ss.substreamID {
+		t.Fatal("Illegal send disturbed the substream:", info, err)
+	}
 	s.Close()
 }
-*/
 
 func TestCoverageDraining(t *testing.T) {
 	// this is a bit hacky. I can not think of a way to reliably test the
@@ -245,6 +280,7 @@ func TestCoverageDraining(t *testing.T) {
 		streamMembers:       map[SubstreamID]*substream{},
 		fromSubstreamToUser: make(chan EventToUser),
 		commands:            make(chan streamCommand),
+		done:                make(chan struct{}),
 	}
 	// note that according to the documentation, it is illegal to t.Fatal
 	// in a goroutine other than the one calling this test
@@ -353,15 +389,14 @@ func TestEmitWhenStreamClose(t *testing.T) {
 	}
 }
 
-/*
 func TestSubstreamDrain(t *testing.T) {
 	ss := &substream{
 		toUser:   make(chan EventToUser),
-		fromUser: make(chan interface{}),
+		fromUser: make(chan TypedJSON),
 	}
 
 	go func() {
-		ss.fromUser <- ""
+		ss.fromUser <- TypedJSON{}
 		close(ss.fromUser)
 	}()
 
@@ -370,13 +405,14 @@ func TestSubstreamDrain(t *testing.T) {
 		t.Fatal("Substream drain not working as expected")
 	}
 }
-*/
 
 func TestCoverage(t *testing.T) {
 	stop{}.isStreamCommand()
-	setExternalStream{nil, nil}.isStreamCommand()
+	setExternalStream{}.isStreamCommand()
 	getSubstream{}.isStreamCommand()
 	dopanic{123}.isStreamCommand()
+	inspect{}.isStreamCommand()
+	enableAcks{}.isStreamCommand()
 
 	// test that we panic correctly
 	c := make(chan struct{})
@@ -388,3 +424,192 @@ func TestCoverage(t *testing.T) {
 	s.commands <- dopanic{123}
 	<-c
 }
+
+func TestInspect(t *testing.T) {
+	s, _, _ := getTestStream()
+
+	info, err := s.Inspect()
+	if err != nil || info.Count != 0 || len(info.Substreams) != 0 {
+		t.Fatal("new stream has substreams:", info, err)
+	}
+
+	toUser, _ := s.SubstreamToUser()
+	fromUser, _ := s.SubstreamFromUser()
+	info, err = s.Inspect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := StreamInfo{2, []SubstreamInfo{
+		{toUser.substreamID, false},
+		{fromUser.substreamID, true},
+	}, false}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatal("wrong stream info:", info)
+	}
+
+	s.Close()
+	<-s.Done()
+	_, err = s.Inspect()
+	if err != ErrClosed {
+		t.Fatal("closed stream can be inspected:", err)
+	}
+}
+
+func TestAcks(t *testing.T) {
+	s, toUser, fromUser := getTestStream()
+	defer s.Close()
+
+	if s.EnableAcks(0, 0) == nil {
+		t.Fatal("acknowledgement mode enabled with no window")
+	}
+	err := s.EnableAcks(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := s.SubstreamToUser()
+	received := func(toUser chan EventToUser, seq uint64, msg interface{}) {
+		event := <-toUser
+		if event.Seq != seq || event.Message != msg {
+			t.Fatal("wrong event received:", event, "expected", seq, msg)
+		}
+	}
+
+	go func() {
+		for i := 1; i <= 5; i++ {
+			_ = ss.Send(i)
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		received(toUser, uint64(i), i)
+	}
+
+	// The window is full, so nothing more comes until an acknowledgement.
+	select {
+	case event := <-toUser:
+		t.Fatal("event sent past a full window:", event)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fromUser <- EventFromUser{Ack: 1}
+	received(toUser, 4, 4)
+
+	// The connection drops, with the user only having got the third
+	// event through. On reconnecting, everything after it is replayed.
+	s.DisconnectExternalStream(ChannelsStream{toUser, fromUser})
+	toUser2 := make(chan EventToUser)
+	fromUser2 := make(chan EventFromUser)
+	s.SetExternalStream(Resume(ChannelsStream{toUser2, fromUser2}, 3))
+	received(toUser2, 4, 4)
+	received(toUser2, 5, 5)
+	fromUser2 <- EventFromUser{Ack: 5}
+
+	info, err := s.Inspect()
+	if err != nil || info.Count != 1 {
+		t.Fatal("acknowledgement disturbed the stream:", info, err)
+	}
+}
+
+func TestAcksOffByDefault(t *testing.T) {
+	s, toUser, _ := getTestStream()
+	defer s.Close()
+
+	ss, _ := s.SubstreamToUser()
+	go func() {
+		for i := 1; i <= 5; i++ {
+			_ = ss.Send(i)
+		}
+	}()
+	for i := 1; i <= 5; i++ {
+		event := <-toUser
+		if event.Seq != 0 || event.Message != i {
+			t.Fatal("wrong event received without acknowledgement mode:", event)
+		}
+	}
+}
+
+func TestStalledUser(t *testing.T) {
+	s, toUser, _ := getTestStream()
+	clock := abtime.NewManual()
+	err := s.SetAbstractTime(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.EnableAcks(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := s.SubstreamToUser()
+	go func() {
+		_ = ss.Send(1)
+	}()
+	<-toUser
+
+	// the user never acknowledges the event, so the stream gives up on it
+	clock.Trigger(stallTimeoutTimer)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalled user not detected")
+	}
+}
+
+func TestDisconnectedUserNotStalled(t *testing.T) {
+	s, toUser, fromUser := getTestStream()
+	defer s.Close()
+	clock := abtime.NewManual()
+	err := s.SetAbstractTime(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.EnableAcks(10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := s.SubstreamToUser()
+	go func() {
+		_ = ss.Send(1)
+	}()
+	<-toUser
+
+	// While the user is disconnected, it can't acknowledge anything, and
+	// however long that takes, it hasn't stalled. The Inspect ensures the
+	// disconnection has stopped the timer before it is triggered.
+	s.DisconnectExternalStream(ChannelsStream{toUser, fromUser})
+	if _, err = s.Inspect(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Trigger(stallTimeoutTimer)
+	if _, err = s.Inspect(); err != nil {
+		t.Fatal("disconnected user considered stalled:", err)
+	}
+
+	toUser2 := make(chan EventToUser)
+	fromUser2 := make(chan EventFromUser)
+	s.SetExternalStream(Resume(ChannelsStream{toUser2, fromUser2}, 0))
+	if event := <-toUser2; event.Seq != 1 || event.Message != 1 {
+		t.Fatal("event not replayed on resuming:", event)
+	}
+	fromUser2 <- EventFromUser{Ack: 1}
+	info, err := s.Inspect()
+	if err != nil || info.Count != 1 {
+		t.Fatal("resumed stream not intact:", info, err)
+	}
+
+	// Once resumed, the timer runs again. Each event outstanding after the
+	// resumption started a timer, and each Trigger fires the first one
+	// queued, so a second Trigger is needed for the one that is running
+	// in case the one the acknowledgement stopped comes first.
+	go func() {
+		_ = ss.Send(2)
+	}()
+	<-toUser2
+	clock.Trigger(stallTimeoutTimer)
+	clock.Trigger(stallTimeoutTimer)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalled user not detected after resuming")
+	}
+}
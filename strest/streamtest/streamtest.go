@@ -0,0 +1,229 @@
+/*
+
+Package streamtest provides a fake ExternalStream for testing code that
+uses strest Streams.
+
+The ExternalStream takes the place of the user's connection. It accepts
+everything the Stream sends the user as soon as it is sent, so the Stream
+never blocks on a test that isn't reading, and keeps it to be examined by
+Next, Expect and ExpectClose, which wait for the events with a timeout
+rather than deadlocking. Events from the user are injected with Inject, or
+more conveniently with Send, CloseSubstream and Ack.
+
+	stream, es := streamtest.NewStream()
+	defer stream.Close()
+
+	ss, _ := stream.SubstreamToUser()
+	go handler(ss)
+	es.Expect(t, ss.SubstreamID(), "hello")
+
+*/
+package streamtest
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// DefaultTimeout is how long an ExternalStream waits for an event by
+// default.
+const DefaultTimeout = time.Second
+
+// ErrTimeout is returned by Next when no event arrives in time.
+var ErrTimeout = errors.New("timed out waiting for an event")
+
+// ErrClosed is returned by Next when the Stream has closed the
+// ExternalStream and every event has been read.
+var ErrClosed = errors.New("stream closed")
+
+// An ExternalStream is a strest.ExternalStream for tests, as described in
+// the package documentation.
+//
+// Timeout is how long Next, Expect and ExpectClose wait for an event.
+type ExternalStream struct {
+	Timeout time.Duration
+
+	toUser   chan strest.EventToUser
+	fromUser chan strest.EventFromUser
+
+	lock    sync.Mutex
+	events  []strest.EventToUser
+	read    int
+	closed  bool
+	arrived chan struct{}
+}
+
+// New returns a new ExternalStream, which must be given to a Stream with
+// SetExternalStream.
+func New() *ExternalStream {
+	es := &ExternalStream{
+		Timeout:  DefaultTimeout,
+		toUser:   make(chan strest.EventToUser),
+		fromUser: make(chan strest.EventFromUser),
+		arrived:  make(chan struct{}),
+	}
+	go es.receive()
+	return es
+}
+
+// NewStream returns a new strest.Stream already hooked up to a new
+// ExternalStream.
+func NewStream() (*strest.Stream, *ExternalStream) {
+	stream := strest.NewStream(strest.StreamID("streamtest"))
+	es := New()
+	stream.SetExternalStream(es)
+	return stream, es
+}
+
+// Channels implements the strest.ExternalStream interface.
+func (es *ExternalStream) Channels() (chan strest.EventToUser, chan strest.EventFromUser) {
+	return es.toUser, es.fromUser
+}
+
+func (es *ExternalStream) receive() {
+	for event := range es.toUser {
+		es.lock.Lock()
+		es.events = append(es.events, event)
+		close(es.arrived)
+		es.arrived = make(chan struct{})
+		es.lock.Unlock()
+	}
+
+	es.lock.Lock()
+	es.closed = true
+	close(es.arrived)
+	es.lock.Unlock()
+}
+
+// Events returns every event the Stream has sent, whether or not it has
+// been read by Next.
+func (es *ExternalStream) Events() []strest.EventToUser {
+	es.lock.Lock()
+	defer es.lock.Unlock()
+
+	return append([]strest.EventToUser(nil), es.events...)
+}
+
+// Next returns the next event the Stream sent that has not yet been
+// returned by Next, waiting up to the Timeout for it.
+func (es *ExternalStream) Next() (strest.EventToUser, error) {
+	timeout := time.NewTimer(es.Timeout)
+	defer timeout.Stop()
+
+	for {
+		es.lock.Lock()
+		if es.read < len(es.events) {
+			event := es.events[es.read]
+			es.read++
+			es.lock.Unlock()
+			return event, nil
+		}
+		closed := es.closed
+		arrived := es.arrived
+		es.lock.Unlock()
+
+		if closed {
+			return strest.EventToUser{}, ErrClosed
+		}
+		select {
+		case <-arrived:
+		case <-timeout.C:
+			return strest.EventToUser{}, ErrTimeout
+		}
+	}
+}
+
+// Expect fails the test unless the next event is the given message on the
+// given substream. The message is compared with reflect.DeepEqual against
+// the value the substream sent.
+func (es *ExternalStream) Expect(t testing.TB, source strest.SubstreamID, msg interface{}) {
+	t.Helper()
+
+	event, err := es.Next()
+	if err != nil {
+		t.Fatalf("expected %#v on substream %d: %v", msg, source, err)
+	}
+	if event.Source != source || event.Close || !reflect.DeepEqual(event.Message, msg) {
+		t.Fatalf("expected %#v on substream %d, got %#v", msg, source, event)
+	}
+}
+
+// ExpectClose fails the test unless the next event closes the given
+// substream.
+func (es *ExternalStream) ExpectClose(t testing.TB, source strest.SubstreamID) {
+	t.Helper()
+
+	event, err := es.Next()
+	if err != nil {
+		t.Fatalf("expected substream %d to close: %v", source, err)
+	}
+	if event.Source != source || !event.Close {
+		t.Fatalf("expected substream %d to close, got %#v", source, event)
+	}
+}
+
+// WaitClosed waits up to the Timeout for the Stream to close the
+// ExternalStream, returning whether it did.
+func (es *ExternalStream) WaitClosed() bool {
+	timeout := time.NewTimer(es.Timeout)
+	defer timeout.Stop()
+
+	for {
+		es.lock.Lock()
+		closed := es.closed
+		arrived := es.arrived
+		es.lock.Unlock()
+
+		if closed {
+			return true
+		}
+		select {
+		case <-arrived:
+		case <-timeout.C:
+			return false
+		}
+	}
+}
+
+// Inject sends the given event from the user to the Stream.
+func (es *ExternalStream) Inject(event strest.EventFromUser) {
+	es.fromUser <- event
+}
+
+// Send sends the given message from the user to the given substream,
+// encoded as JSON with the given type.
+//
+// As with a real user, this blocks until the Stream accepts the event,
+// which it will not while it is trying to deliver the event to a
+// substream that isn't receiving.
+func (es *ExternalStream) Send(dest strest.SubstreamID, ty string, msg interface{}) error {
+	encoded, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	es.Inject(strest.EventFromUser{Dest: dest, Message: encoded, Type: ty})
+	return nil
+}
+
+// CloseSubstream closes the given substream from the user's side.
+func (es *ExternalStream) CloseSubstream(dest strest.SubstreamID) {
+	es.Inject(strest.EventFromUser{Dest: dest, Close: true, Type: strest.EventType})
+}
+
+// Ack acknowledges every event through the given Seq, for a Stream in
+// acknowledgement mode.
+func (es *ExternalStream) Ack(seq uint64) {
+	es.Inject(strest.EventFromUser{Ack: seq, Type: strest.EventType})
+}
+
+// Disconnect closes the user's side of the connection, which terminates
+// the Stream.
+func (es *ExternalStream) Disconnect() {
+	close(es.fromUser)
+}
@@ -0,0 +1,52 @@
+package streamtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/strest"
+)
+
+func TestExternalStream(t *testing.T) {
+	stream, es := NewStream()
+
+	toUser, _ := stream.SubstreamToUser()
+	go func() {
+		_ = toUser.Send("hello")
+		_ = toUser.Send(map[string]int{"a": 1})
+		_ = toUser.Close()
+	}()
+	es.Expect(t, toUser.SubstreamID(), "hello")
+	es.Expect(t, toUser.SubstreamID(), map[string]int{"a": 1})
+	es.ExpectClose(t, toUser.SubstreamID())
+
+	es.Timeout = 10 * time.Millisecond
+	_, err := es.Next()
+	if err != ErrTimeout {
+		t.Fatal("Next returned without an event:", err)
+	}
+	if len(es.Events()) != 3 {
+		t.Fatal("events not recorded:", es.Events())
+	}
+
+	fromUser, _ := stream.SubstreamFromUser()
+	err = es.Send(fromUser.SubstreamID(), strest.EventType, []int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	err = fromUser.ReceiveInto(&got)
+	if err != nil || len(got) != 2 || got[1] != 2 {
+		t.Fatal("message from the user not received:", got, err)
+	}
+
+	es.Timeout = DefaultTimeout
+	es.Disconnect()
+	if !es.WaitClosed() {
+		t.Fatal("stream did not close on disconnection")
+	}
+	_, err = es.Next()
+	if err != ErrClosed {
+		t.Fatal("Next on a closed stream:", err)
+	}
+}
@@ -64,11 +64,11 @@ func (ss *substream) close() error {
 }
 
 func (ss *substream) message(msg interface{}) EventToUser {
-	return EventToUser{ss.substreamID, false, msg, "event"}
+	return NewEventToUser(ss.substreamID, false, msg)
 }
 
 func (ss *substream) closeMessage() EventToUser {
-	return EventToUser{ss.substreamID, true, nil, "event"}
+	return NewEventToUser(ss.substreamID, true, nil)
 }
 
 // A SendOnlySubstream is a Substream that only has Sending
@@ -90,7 +90,7 @@ func (sos *SendOnlySubstream) Send(msg interface{}) error {
 		return ErrClosed
 	}
 	select {
-	case sos.toUser <- EventToUser{sos.substreamID, false, msg, "event"}:
+	case sos.toUser <- sos.message(msg):
 		return nil
 	case _, _ = <-sos.fromUser:
 		// the only way this can happen for a SendOnlySubstream is if the
@@ -146,6 +146,9 @@ func (ros *ReceiveOnlySubstream) ReceiveChan() <-chan TypedJSON {
 
 // Receive will receive one message from the remote user.
 //
+// The message is always a TypedJSON, carrying the type the user gave it
+// and the still-encoded JSON. ReceiveInto decodes the message for you.
+//
 // If an error is returned, no further Receive calls will work.
 func (ros *ReceiveOnlySubstream) Receive() (interface{}, error) {
 	// As this is only safe in a ReceiveOnlySubstream, we implement this
@@ -162,6 +165,20 @@ func (ros *ReceiveOnlySubstream) Receive() (interface{}, error) {
 	return nil, ErrClosed
 }
 
+// ReceiveInto will receive one message from the remote user, and
+// decode its JSON into dst as json.Unmarshal would.
+//
+// If ErrClosed is returned, no further ReceiveInto calls will work. If the
+// message can't be decoded into dst, the json error is returned, and the
+// substream remains open for further messages.
+func (ros *ReceiveOnlySubstream) ReceiveInto(dst interface{}) error {
+	msg, err := ros.Receive()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg.(TypedJSON).JSON, dst)
+}
+
 // An Substream is a bi-directional communicator with a remote stream.
 //
 // The Substream's communication with its parent stream is threadsafe,
@@ -13,7 +13,17 @@ surprisingly easy to implement in generic clients.
 
 This defines a stream that permits simple HTTP requests to be made
 inline, responses to be matched up with their requests, and streaming
-events to be received.
+events to be received. A client may also send a "describe" request to
+learn what the stream endpoint at a URL supports before opening a stream
+to it; see request.Describer.
+
+A client whose connection drops may reconnect to a Stream in
+acknowledgement mode and resume it without losing events, by sending a
+"resume" message as its first frame; see UTF8Stream.Serve.
+
+A client may send a "ping" message, with any payload, at any time, which
+is answered with a "pong" StreamMessage. This keeps a connection that
+would otherwise be idle from being closed by a transport's idle timeout.
 
 */
 package utf8stream
@@ -0,0 +1,99 @@
+package utf8stream
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrMalformedFrame is returned by a Protocol when a frame received from
+// the client can not be parsed.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// ErrNoProtocol is returned by Negotiate when the client requested
+// protocols, but none of them are supported.
+var ErrNoProtocol = errors.New("none of the requested protocols are supported")
+
+// A Protocol is a version of the framing used between a UTF8Stream and
+// its client.
+//
+// Different clients may speak different versions of the framing; the
+// client requests the ones it speaks, and the server selects one with
+// Negotiate. This allows the framing to evolve without breaking older
+// clients.
+type Protocol interface {
+	// Name is the name the client requests the protocol by.
+	Name() string
+
+	// ParseFrame splits a frame received from the client into its
+	// message type and its JSON payload.
+	ParseFrame([]byte) (ty string, payload []byte, err error)
+}
+
+// LengthPrefixed is the original Protocol, in which each frame is a
+// single byte giving the length of the message type, the message type,
+// and then the JSON payload.
+type LengthPrefixed struct{}
+
+// Name implements the Protocol interface.
+func (lp LengthPrefixed) Name() string {
+	return "sphyraena.v1"
+}
+
+// ParseFrame implements the Protocol interface.
+func (lp LengthPrefixed) ParseFrame(frame []byte) (string, []byte, error) {
+	if len(frame) == 0 || len(frame) < 1+int(frame[0]) {
+		return "", nil, ErrMalformedFrame
+	}
+	end := 1 + int(frame[0])
+	return string(frame[1:end]), frame[end:], nil
+}
+
+// DefaultProtocol is the Protocol used for clients that do not request
+// one.
+var DefaultProtocol Protocol = LengthPrefixed{}
+
+// Negotiate selects the Protocol to use with a client that requested the
+// given protocols, in its order of preference.
+//
+// A client that requests no protocols at all predates negotiation, and
+// is given the first of the server's protocols. If the client requested
+// protocols and none are supported, ErrNoProtocol is returned.
+func Negotiate(requested []string, protocols []Protocol) (Protocol, error) {
+	if len(protocols) == 0 {
+		return nil, ErrNoProtocol
+	}
+	if len(requested) == 0 {
+		return protocols[0], nil
+	}
+
+	for _, name := range requested {
+		for _, protocol := range protocols {
+			if protocol.Name() == name {
+				return protocol, nil
+			}
+		}
+	}
+	return nil, ErrNoProtocol
+}
+
+// RequestedProtocols returns the protocols requested by the given HTTP
+// request, which begins a stream.
+//
+// They are read from the comma-separated "protocol" query parameter. The
+// Sec-WebSocket-Protocol header is not consulted: not every transport can
+// send it, and a WebSocket server that does not echo back a subprotocol
+// the client offered has its connection refused by the browser, so the
+// selection is announced with AnnounceProtocol instead.
+func RequestedProtocols(req *http.Request) []string {
+	var requested []string
+	for _, value := range req.URL.Query()["protocol"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name != "" {
+				requested = append(requested, name)
+			}
+		}
+	}
+	return requested
+}
@@ -0,0 +1,92 @@
+package utf8stream
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+)
+
+// colonProtocol frames messages as the type, a colon, and the payload.
+type colonProtocol struct{}
+
+func (cp colonProtocol) Name() string {
+	return "test.colon"
+}
+
+func (cp colonProtocol) ParseFrame(frame []byte) (string, []byte, error) {
+	i := bytes.IndexByte(frame, ':')
+	if i == -1 {
+		return "", nil, ErrMalformedFrame
+	}
+	return string(frame[:i]), frame[i+1:], nil
+}
+
+func TestLengthPrefixed(t *testing.T) {
+	ty, payload, err := LengthPrefixed{}.ParseFrame(frame("event", 1))
+	if err != nil || ty != "event" || string(payload) != "1" {
+		t.Fatal("frame not parsed:", ty, string(payload), err)
+	}
+
+	for _, bad := range [][]byte{nil, {5, 'a', 'b'}} {
+		_, _, err = LengthPrefixed{}.ParseFrame(bad)
+		if err != ErrMalformedFrame {
+			t.Fatal("malformed frame accepted:", bad)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	protocols := []Protocol{LengthPrefixed{}, colonProtocol{}}
+
+	for _, test := range []struct {
+		requested []string
+		expected  Protocol
+	}{
+		{nil, LengthPrefixed{}},
+		{[]string{"test.colon"}, colonProtocol{}},
+		{[]string{"unknown", "test.colon", "sphyraena.v1"}, colonProtocol{}},
+		{[]string{"unknown"}, nil},
+	} {
+		protocol, err := Negotiate(test.requested, protocols)
+		if protocol != test.expected || (protocol == nil) != (err == ErrNoProtocol) {
+			t.Fatal("wrong protocol negotiated for", test.requested, ":", protocol, err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "http://jerf.org/socket?protocol=a,+b&protocol=c", nil)
+	req.Header.Add("Sec-WebSocket-Protocol", "d")
+	if !reflect.DeepEqual(RequestedProtocols(req), []string{"a", "b", "c"}) {
+		t.Fatal("requested protocols not read:", RequestedProtocols(req))
+	}
+}
+
+func TestServeWithProtocol(t *testing.T) {
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddStreamForward("/", request.StreamHandlerFunc(func(req *request.Request) {
+		req.StreamResponse(request.StreamRequestResult{ErrorCode: 200})
+	}))
+
+	td := newTestDriver()
+	u8s := NewUTF8Stream(td, nil, nil, nil, sr, colonProtocol{}, 0)
+	go func() {
+		_ = u8s.AnnounceProtocol()
+		_ = u8s.Serve()
+	}()
+	defer td.Close()
+
+	if announcement := <-td.toClient; announcement !=
+		`{"type":"protocol","substream_id":0,"data":"test.colon"}` {
+		t.Fatal("protocol not announced:", announcement)
+	}
+
+	td.fromClient <- []byte("garbage")
+	td.fromClient <- []byte(`new_stream:{"method":"GET","url":"/a","request_id":1}`)
+	resp := td.response(t)
+	if resp.ID != 1 || resp.Data.ErrorCode != 200 {
+		t.Fatal("request not parsed with the negotiated protocol:", resp)
+	}
+}
@@ -0,0 +1,91 @@
+package utf8stream
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrMissingRequestID is returned when a client request arrives with no
+// request ID. Zero is never a valid client request ID, because it is
+// what an omitted ID decodes to.
+var ErrMissingRequestID = errors.New("request ID missing")
+
+// ErrDuplicateRequestID is returned when a client request arrives with a
+// request ID that is still awaiting its response.
+var ErrDuplicateRequestID = errors.New("request ID is already outstanding")
+
+// ErrReusedRequestID is returned when a client request arrives with a
+// request ID that has already been used on this stream.
+var ErrReusedRequestID = errors.New("request ID has already been used")
+
+// A RequestNamespace identifies who generated a given request ID.
+//
+// The client and the server each number their requests independently, so
+// a bare ID is ambiguous; the namespace travels along with the ID in
+// every StreamMessage that refers to a request.
+type RequestNamespace string
+
+const (
+	// ClientNamespace is used for request IDs the client chose.
+	ClientNamespace = RequestNamespace("client")
+
+	// ServerNamespace is used for request IDs the server generated for
+	// its own correlation.
+	ServerNamespace = RequestNamespace("server")
+)
+
+// requestIDs tracks the request IDs used on a given stream.
+//
+// Client request IDs must strictly increase over the life of the
+// stream. This lets us detect reuse without remembering every ID we have
+// ever seen; the outstanding set is what lets us tell the client it sent
+// a duplicate of something still in flight rather than something already
+// finished.
+type requestIDs struct {
+	sync.Mutex
+	outstanding     map[uint64]struct{}
+	highestClientID uint64
+	lastServerID    uint64
+}
+
+func newRequestIDs() *requestIDs {
+	return &requestIDs{outstanding: map[uint64]struct{}{}}
+}
+
+// claim registers the given client request ID as outstanding, or returns
+// the reason it can't be used.
+func (ri *requestIDs) claim(id uint64) error {
+	if id == 0 {
+		return ErrMissingRequestID
+	}
+
+	ri.Lock()
+	defer ri.Unlock()
+
+	if _, isOutstanding := ri.outstanding[id]; isOutstanding {
+		return ErrDuplicateRequestID
+	}
+	if id <= ri.highestClientID {
+		return ErrReusedRequestID
+	}
+
+	ri.outstanding[id] = struct{}{}
+	ri.highestClientID = id
+	return nil
+}
+
+// release marks the given client request ID as answered. The ID remains
+// unusable for future requests.
+func (ri *requestIDs) release(id uint64) {
+	ri.Lock()
+	delete(ri.outstanding, id)
+	ri.Unlock()
+}
+
+func (ri *requestIDs) nextServerID() uint64 {
+	ri.Lock()
+	ri.lastServerID++
+	id := ri.lastServerID
+	ri.Unlock()
+	return id
+}
@@ -1,63 +1,104 @@
 package utf8stream
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"log/slog"
 
 	"github.com/thejerf/sphyraena/request"
 	"github.com/thejerf/sphyraena/strest"
 )
 
+// Serve hooks the UTF8Stream up to its Stream, and serves the client
+// until its connection fails.
+//
+// If the Stream is resumable, as given by strest.StreamInfo, this is a
+// new connection taking it over, and the client's first frame is checked
+// for a "resume" message, whose payload is a ResumeRequest giving the Seq
+// of the last event the client received. The events after that are
+// replayed to the client. If the first frame is anything else, the client
+// is taken to have received everything already sent. When the connection
+// fails, a resumable Stream is only disconnected, holding on to its events
+// for the client to resume on a new connection; any other Stream is
+// terminated.
 func (s *UTF8Stream) Serve() error {
-	go func() {
-		for {
-			outgoing, ok := <-s.toUser
-			if !ok {
-				fmt.Println("Terminating send loop")
-				return
-			}
+	done := make(chan struct{})
+	defer close(done)
+	go s.sendToUser(done)
 
-			outbytes, err := json.Marshal(outgoing)
-			if err != nil {
-				// FIXME: Logging must go somewhere
-				continue
-			}
-			s.sd.Send(string(outbytes))
-		}
-	}()
+	awaitingResume, err := s.attach()
+	if err != nil {
+		return err
+	}
 
 	for {
 		msg, err := s.sd.Receive()
-		fmt.Println(string(msg), err)
 		if err != nil {
 			// FIXME: error should go somewhere if it's not EOF
-			close(s.fromUser)
+			s.detach()
 			return err
 		}
 
-		// get the first byte to see how far to read
-		// FIXME: Shield against illegal array reads
-		len := msg[0]
-		ty := string(msg[1 : 1+len])
-		msg = msg[1+len:]
+		ty, msg, err := s.protocol.ParseFrame(msg)
+		if err != nil {
+			slog.Debug("could not parse stream frame", "err", err)
+			continue
+		}
+
+		if awaitingResume {
+			awaitingResume = false
+			if ty == "resume" {
+				err = s.resume(msg)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			err = s.stream.SetExternalStream(s)
+			if err != nil {
+				return err
+			}
+		}
 
 		switch ty {
 		// FIXME: Should be "new_substream"
 		case "new_stream":
-			fmt.Println("Seeing a new request come in:", string(msg))
 			// FIXME: Rename this to stream request or something, it's not HTTP
 			httpreq := HTTPRequest{}
 			err := json.Unmarshal(msg, &httpreq)
 			if err != nil {
 				// FIXME: Do something better
-				fmt.Println("Error unmarshaling msg:", err)
+				slog.Warn("invalid stream request", "err", err)
+				continue
+			}
+
+			requestID := httpreq.RequestID
+			err = s.requestIDs.claim(requestID)
+			if err != nil {
+				slog.Debug("rejecting stream request",
+					"request_id", requestID, "err", err)
+				err = sendJSON(s, StreamMessage{
+					Type:      "new_stream_response",
+					ID:        requestID,
+					Namespace: ClientNamespace,
+					Data: request.StreamRequestResult{
+						Error:     err.Error(),
+						ErrorCode: 409,
+					},
+				})
+				if err != nil {
+					slog.Warn("could not send stream response",
+						"request_id", requestID, "err", err)
+				}
 				continue
 			}
 
 			r, err := httpreq.ToRequest()
 			if err != nil {
 				// FIXME: do something better
-				fmt.Println("Error converting to request:", err)
+				slog.Warn("invalid stream request",
+					"request_id", requestID, "err", err)
+				s.requestIDs.release(requestID)
 				continue
 			}
 
@@ -65,46 +106,234 @@ func (s *UTF8Stream) Serve() error {
 				s.session,
 				s.stream,
 				func(srr request.StreamRequestResult) {
+					s.requestIDs.release(requestID)
 					err := sendJSON(s, StreamMessage{
 						Type:        "new_stream_response",
-						ID:          httpreq.RequestID,
+						ID:          requestID,
+						Namespace:   ClientNamespace,
 						Data:        srr,
 						SubstreamID: srr.SubstreamID,
 					})
 					if err != nil {
-						// FIXME: Log better
-						fmt.Println("Couldn't send stream response:", err)
+						slog.Warn("could not send stream response",
+							"request_id", requestID, "err", err)
 					}
 				},
 			)
+			ctx, cancel := s.requestContext()
 			req.SphyraenaState = s.ss
-			req.Request = r
+			req.Request = r.WithContext(ctx)
+
+			go func() {
+				defer cancel()
+				s.router.RunStreamingRoute(req)
+			}()
+
+		case "describe":
+			httpreq := HTTPRequest{}
+			err := json.Unmarshal(msg, &httpreq)
+			if err != nil {
+				// FIXME: Do something better
+				slog.Warn("invalid describe request", "err", err)
+				continue
+			}
+			go s.describe(httpreq)
+
+		case "resume":
+			slog.Debug("ignoring a resume request after the stream began")
 
-			fmt.Println("Using router:", s.router)
-			go s.router.RunStreamingRoute(req)
+		case "ping":
+			// keeps the connection from going idle; see sockjs.Options
+			err := sendJSON(s, StreamMessage{Type: "pong"})
+			if err != nil {
+				slog.Warn("could not send pong", "err", err)
+			}
 
-		case "event":
+		case strest.EventType:
 			efu := strest.EventFromUser{}
 			err := json.Unmarshal(msg, &efu)
 			if err != nil {
 				// FIXME: Do something better
-				fmt.Println("Error unmarshaling event:", err)
+				slog.Warn("invalid stream event", "err", err)
 				continue
 			}
 			s.fromUser <- efu
 
 		default:
-			fmt.Println("Unknown request type:", ty)
+			slog.Warn("unknown stream message type", "type", ty)
 		}
 	}
 }
 
+// sendToUser sends the events from the Stream to the client, until the
+// Stream closes or done is closed.
+func (s *UTF8Stream) sendToUser(done chan struct{}) {
+	for {
+		var outgoing strest.EventToUser
+		var ok bool
+		select {
+		case outgoing, ok = <-s.toUser:
+			if !ok {
+				return
+			}
+		case <-done:
+			return
+		}
+
+		outbytes, err := json.Marshal(outgoing)
+		if err != nil {
+			// FIXME: Logging must go somewhere
+			continue
+		}
+		if s.frameTooLarge(len(outbytes)) {
+			slog.Warn("dropping stream event larger than the maximum frame size",
+				"substream", outgoing.Source, "size", len(outbytes),
+				"max_frame_size", s.maxFrameSize)
+			if s.stream != nil && !outgoing.Close {
+				// not waited for, as the Stream may be waiting on
+				// this loop to take its next event
+				go func(id strest.SubstreamID) {
+					_ = s.stream.CloseSubstream(id)
+				}(outgoing.Source)
+			}
+			continue
+		}
+		s.sd.Send(string(outbytes))
+	}
+}
+
+// attach hooks the UTF8Stream up to its Stream, returning true instead if
+// the Stream is resumable, as the client's first frame must be checked
+// for a resume request first.
+func (s *UTF8Stream) attach() (awaitingResume bool, err error) {
+	if s.stream == nil {
+		return false, nil
+	}
+	info, err := s.stream.Inspect()
+	if err != nil {
+		return false, err
+	}
+	if info.Resumable {
+		return true, nil
+	}
+	return false, s.stream.SetExternalStream(s)
+}
+
+// A ResumeRequest is the payload of the "resume" message with which a
+// client reconnecting to a resumable Stream begins. LastSeq is the Seq of
+// the last event it received, or 0 if none.
+type ResumeRequest struct {
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// resume hooks the UTF8Stream up to its Stream, replaying the events
+// after the one the client's resume request says it last received.
+func (s *UTF8Stream) resume(msg []byte) error {
+	rr := ResumeRequest{}
+	err := json.Unmarshal(msg, &rr)
+	if err != nil {
+		slog.Warn("invalid resume request; resuming from the start", "err", err)
+	}
+	return s.stream.SetExternalStream(strest.Resume(s, rr.LastSeq))
+}
+
+// detach lets go of the Stream once the client's connection has failed.
+// A resumable Stream is disconnected, and any other is terminated.
+func (s *UTF8Stream) detach() {
+	if s.stream != nil {
+		info, err := s.stream.Inspect()
+		if err != nil {
+			return
+		}
+		if info.Resumable {
+			_ = s.stream.DisconnectExternalStream(s)
+			return
+		}
+	}
+	close(s.fromUser)
+}
+
+// requestContext returns the context for a request arriving on the
+// stream, which is done once the Stream terminates or the SphyraenaState
+// begins shutting down, as well as once the returned function is called.
+func (s *UTF8Stream) requestContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var streamDone, shutdown <-chan struct{}
+	if s.stream != nil {
+		streamDone = s.stream.Done()
+	}
+	if s.ss != nil {
+		shutdown = s.ss.ShutdownStarted()
+	}
+	go func() {
+		select {
+		case <-streamDone:
+		case <-shutdown:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// describe answers a "describe" request, which asks what the stream
+// handler at the request's URL supports without opening a stream. The
+// response is a StreamMessage of type "describe_response", whose Data is
+// the request.StreamDescription, or if there is no stream there to
+// describe, the request.StreamRequestResult opening it would have
+// failed with.
+func (s *UTF8Stream) describe(httpreq HTTPRequest) {
+	requestID := httpreq.RequestID
+	respond := func(data interface{}) {
+		err := sendJSON(s, StreamMessage{
+			Type:      "describe_response",
+			ID:        requestID,
+			Namespace: ClientNamespace,
+			Data:      data,
+		})
+		if err != nil {
+			slog.Warn("could not send describe response",
+				"request_id", requestID, "err", err)
+		}
+	}
+
+	if err := s.requestIDs.claim(requestID); err != nil {
+		respond(request.StreamRequestResult{Error: err.Error(), ErrorCode: 409})
+		return
+	}
+	defer s.requestIDs.release(requestID)
+
+	r, err := httpreq.ToRequest()
+	if err != nil {
+		respond(request.StreamRequestResult{Error: err.Error(), ErrorCode: 400})
+		return
+	}
+
+	ctx, cancel := s.requestContext()
+	defer cancel()
+	req := request.FromStream(s.session, s.stream, nil)
+	req.SphyraenaState = s.ss
+	req.Request = r.WithContext(ctx)
+
+	description, failure := s.router.DescribeStream(req)
+	if failure.ErrorCode != 0 {
+		respond(failure)
+		return
+	}
+	respond(description)
+}
+
 // FIXME: Is this already defined somewhere?
-// FIXME: Namespace the request IDs so we can tell the difference between them.
 
+// A StreamMessage is a message sent to the client that is not simply an
+// event on a substream.
+//
+// ID is the request this message responds to, and Namespace indicates
+// whether that ID was generated by the client or the server.
 type StreamMessage struct {
 	Type        string             `json:"type"`
 	ID          uint64             `json:"response_to,omitempty"`
+	Namespace   RequestNamespace   `json:"namespace,omitempty"`
 	SubstreamID strest.SubstreamID `json:"substream_id"`
 	Data        interface{}        `json:"data"`
 }
@@ -114,7 +343,9 @@ func sendJSON(s *UTF8Stream, data interface{}) error {
 	if err != nil {
 		return err
 	}
+	if s.frameTooLarge(len(marshaled)) {
+		return ErrFrameTooLarge
+	}
 
-	fmt.Println("Sending response:", string(marshaled))
 	return s.sd.Send(string(marshaled))
 }
@@ -0,0 +1,392 @@
+package utf8stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejerf/sphyraena/request"
+	"github.com/thejerf/sphyraena/router"
+	"github.com/thejerf/sphyraena/sphyrw"
+	"github.com/thejerf/sphyraena/strest"
+)
+
+// testDriver is a UTF8StreamDriver driven entirely by channels.
+type testDriver struct {
+	fromClient chan []byte
+	toClient   chan string
+	closed     chan struct{}
+}
+
+func newTestDriver() *testDriver {
+	return &testDriver{make(chan []byte), make(chan string), make(chan struct{})}
+}
+
+func (td *testDriver) Receive() ([]byte, error) {
+	msg, ok := <-td.fromClient
+	if !ok {
+		return nil, errors.New("closed")
+	}
+	return msg, nil
+}
+
+func (td *testDriver) Send(s string) error {
+	select {
+	case td.toClient <- s:
+		return nil
+	case <-td.closed:
+		return errors.New("closed")
+	}
+}
+
+func (td *testDriver) Close() error {
+	close(td.fromClient)
+	close(td.closed)
+	return nil
+}
+
+func (td *testDriver) event(t *testing.T) strest.EventToUser {
+	var event strest.EventToUser
+	err := json.Unmarshal([]byte(<-td.toClient), &event)
+	if err != nil {
+		t.Fatal("Couldn't unmarshal stream event:", err)
+	}
+	return event
+}
+
+func frame(ty string, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return append(append([]byte{byte(len(ty))}, ty...), b...)
+}
+
+type streamResponse struct {
+	Type      string                      `json:"type"`
+	ID        uint64                      `json:"response_to"`
+	Namespace RequestNamespace            `json:"namespace"`
+	Data      request.StreamRequestResult `json:"data"`
+}
+
+func (td *testDriver) response(t *testing.T) streamResponse {
+	var sr streamResponse
+	err := json.Unmarshal([]byte(<-td.toClient), &sr)
+	if err != nil {
+		t.Fatal("Couldn't unmarshal stream response:", err)
+	}
+	return sr
+}
+
+func TestDuplicateRequestIDs(t *testing.T) {
+	release := make(chan struct{})
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddStreamForward("/", request.StreamHandlerFunc(func(req *request.Request) {
+		<-release
+		req.StreamResponse(request.StreamRequestResult{ErrorCode: 200})
+	}))
+
+	td := newTestDriver()
+	u8s := NewUTF8Stream(td, nil, nil, nil, sr, nil, 0)
+	go u8s.Serve()
+	defer td.Close()
+
+	td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a", RequestID: 1})
+	td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a", RequestID: 1})
+
+	resp := td.response(t)
+	if resp.ID != 1 || resp.Namespace != ClientNamespace ||
+		resp.Data.Error != ErrDuplicateRequestID.Error() {
+		t.Fatal(fmt.Sprintf("Duplicate request ID not rejected: %#v", resp))
+	}
+
+	close(release)
+	resp = td.response(t)
+	if resp.ID != 1 || resp.Data.Error != "" || resp.Data.ErrorCode != 200 {
+		t.Fatal(fmt.Sprintf("Original request did not complete: %#v", resp))
+	}
+
+	td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a", RequestID: 1})
+	resp = td.response(t)
+	if resp.Data.Error != ErrReusedRequestID.Error() {
+		t.Fatal(fmt.Sprintf("Reused request ID not rejected: %#v", resp))
+	}
+
+	td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a"})
+	resp = td.response(t)
+	if resp.Data.Error != ErrMissingRequestID.Error() {
+		t.Fatal(fmt.Sprintf("Missing request ID not rejected: %#v", resp))
+	}
+
+	if u8s.NewServerRequestID() != 1 || u8s.NewServerRequestID() != 2 {
+		t.Fatal("Server request IDs not independent of client IDs")
+	}
+}
+
+func TestStructuredStreamError(t *testing.T) {
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddStreamForward("/", request.StreamHandlerFunc(func(req *request.Request) {
+		se := &request.StreamError{
+			Code:      "validation_failed",
+			Message:   "the request is invalid",
+			Details:   map[string]interface{}{"name": "required"},
+			Retryable: true,
+		}
+		req.StreamResponse(se.Result(422))
+	}))
+
+	td := newTestDriver()
+	u8s := NewUTF8Stream(td, nil, nil, nil, sr, nil, 0)
+	go u8s.Serve()
+	defer td.Close()
+
+	td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a", RequestID: 1})
+	resp := td.response(t)
+	detail := resp.Data.ErrorDetail
+	if resp.Data.ErrorCode != 422 || resp.Data.Error != "the request is invalid" ||
+		detail == nil || detail.Code != "validation_failed" ||
+		detail.Details["name"] != "required" || !detail.Retryable {
+		t.Fatal(fmt.Sprintf("structured error not carried through: %#v", resp))
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	stream := strest.NewStream(strest.StreamID("frames"))
+	defer stream.Close()
+	td := newTestDriver()
+	u8s := NewUTF8Stream(td, nil, stream, nil, nil, nil, 100)
+	go u8s.Serve()
+	defer td.Close()
+
+	ss, err := stream.Substream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	incoming, toUser := ss.RawChans()
+	toUser <- ss.Message(strings.Repeat("x", 200))
+
+	var event strest.EventToUser
+	err = json.Unmarshal([]byte(<-td.toClient), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Source != ss.SubstreamID() || !event.Close || event.Message != nil {
+		t.Fatal(fmt.Sprintf("oversized event not replaced by a close: %#v", event))
+	}
+	if _, open := <-incoming; open {
+		t.Fatal("substream with an oversized event not closed")
+	}
+
+	if err = sendJSON(u8s, StreamMessage{Data: strings.Repeat("x", 200)}); err != ErrFrameTooLarge {
+		t.Fatal("oversized message sent:", err)
+	}
+}
+
+type describedHandler struct{}
+
+func (dh describedHandler) HandleStream(req *request.Request) {
+	panic("describing a stream must not run its handler")
+}
+
+func (dh describedHandler) Describe() request.StreamDescription {
+	return request.StreamDescription{
+		Bidirectional: true,
+		Sends:         []string{"message"},
+		Receives:      []string{"say"},
+		Description:   "a chat room",
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	sr := router.New(request.NewSphyraenaState(nil, nil))
+	sr.AddStreamForward("/chat", describedHandler{})
+	sr.AddStreamForward("/plain", request.StreamHandlerFunc(func(*request.Request) {
+		panic("describing a stream must not run its handler")
+	}))
+	sr.AddLocationForward("/page", request.HandlerFunc(
+		func(*sphyrw.SphyraenaResponseWriter, *request.Request) {}))
+
+	td := newTestDriver()
+	u8s := NewUTF8Stream(td, nil, nil, nil, sr, nil, 0)
+	go u8s.Serve()
+	defer td.Close()
+
+	describe := func(url string, id uint64) json.RawMessage {
+		td.fromClient <- frame("describe", HTTPRequest{URL: url, RequestID: id})
+		var msg struct {
+			Type string          `json:"type"`
+			ID   uint64          `json:"response_to"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(<-td.toClient), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type != "describe_response" || msg.ID != id {
+			t.Fatal("wrong describe response:", msg.Type, msg.ID)
+		}
+		return msg.Data
+	}
+
+	data := describe("/chat", 1)
+	if string(data) != `{"streaming":true,"bidirectional":true,"sends":["message"],`+
+		`"receives":["say"],"description":"a chat room"}` {
+		t.Fatal("wrong description:", string(data))
+	}
+
+	data = describe("/plain", 2)
+	if string(data) != `{"streaming":true}` {
+		t.Fatal("wrong default description:", string(data))
+	}
+
+	for _, test := range []struct {
+		url    string
+		id     uint64
+		status int
+	}{
+		{"/page", 3, 406},
+		{"/nowhere", 4, 404},
+		{"/chat", 4, 409},
+	} {
+		data = describe(test.url, test.id)
+		var srr request.StreamRequestResult
+		if err := json.Unmarshal(data, &srr); err != nil || srr.ErrorCode != test.status {
+			t.Fatal("wrong failure describing", test.url, ":", string(data))
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	stream := strest.NewStream(strest.StreamID("resume"))
+	defer stream.Close()
+	err := stream.EnableAcks(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := stream.SubstreamToUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td := newTestDriver()
+	served := make(chan struct{})
+	go func() {
+		_ = NewUTF8Stream(td, nil, stream, nil, nil, nil, 0).Serve()
+		close(served)
+	}()
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			_ = ss.Send(i)
+		}
+	}()
+	for i := 1; i <= 3; i++ {
+		if event := td.event(t); event.Seq != uint64(i) || event.Message != float64(i) {
+			t.Fatal("wrong event received:", event)
+		}
+	}
+	td.fromClient <- frame(strest.EventType, strest.EventFromUser{Ack: 1})
+
+	// The connection drops with events 2 and 3 unacknowledged, and only
+	// event 2 having made it to the client. The Stream holds on to them,
+	// and to anything sent while the client is away.
+	td.Close()
+	<-served
+	info, err := stream.Inspect()
+	if err != nil || !info.Resumable {
+		t.Fatal("stream not left resumable by the dropped connection:", info, err)
+	}
+	err = ss.Send(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td2 := newTestDriver()
+	defer td2.Close()
+	go func() {
+		_ = NewUTF8Stream(td2, nil, stream, nil, nil, nil, 0).Serve()
+	}()
+	td2.fromClient <- frame("resume", ResumeRequest{LastSeq: 2})
+	for i := 3; i <= 4; i++ {
+		if event := td2.event(t); event.Seq != uint64(i) || event.Message != float64(i) {
+			t.Fatal("wrong event replayed on resuming:", event)
+		}
+	}
+}
+
+func TestDroppedConnectionEndsPlainStream(t *testing.T) {
+	stream := strest.NewStream(strest.StreamID("plain"))
+	defer stream.Close()
+
+	td := newTestDriver()
+	served := make(chan struct{})
+	go func() {
+		_ = NewUTF8Stream(td, nil, stream, nil, nil, nil, 0).Serve()
+		close(served)
+	}()
+	td.Close()
+	<-served
+
+	select {
+	case <-stream.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stream without acknowledgements outlived its connection")
+	}
+}
+
+func TestPing(t *testing.T) {
+	td := newTestDriver()
+	go NewUTF8Stream(td, nil, nil, nil, nil, nil, 0).Serve()
+	defer td.Close()
+
+	td.fromClient <- frame("ping", nil)
+	if pong := <-td.toClient; pong != `{"type":"pong","substream_id":0,"data":null}` {
+		t.Fatal("ping not answered:", pong)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		end  func(*strest.Stream, *request.SphyraenaState)
+	}{
+		{"stream closed", func(stream *strest.Stream, _ *request.SphyraenaState) {
+			_ = stream.Close()
+		}},
+		{"shut down", func(_ *strest.Stream, state *request.SphyraenaState) {
+			_ = state.Shutdown(context.Background())
+		}},
+	} {
+		state := request.NewSphyraenaState(nil, nil)
+		started := make(chan struct{})
+		cancelled := make(chan error)
+		sr := router.New(state)
+		sr.AddStreamForward("/", request.StreamHandlerFunc(func(req *request.Request) {
+			close(started)
+			<-req.Context().Done()
+			cancelled <- req.Context().Err()
+		}))
+
+		stream := strest.NewStream(strest.StreamID("context"))
+		td := newTestDriver()
+		go NewUTF8Stream(td, nil, stream, state, sr, nil, 0).Serve()
+
+		td.fromClient <- frame("new_stream", HTTPRequest{Method: "GET", URL: "/a", RequestID: 1})
+		<-started
+		test.end(stream, state)
+		select {
+		case err := <-cancelled:
+			if err != context.Canceled {
+				t.Fatal(test.name, ": wrong context error:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal(test.name, ": request context not done")
+		}
+
+		td.Close()
+		stream.Close()
+	}
+}
@@ -2,6 +2,7 @@ package utf8stream
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -22,8 +23,21 @@ type UTF8Stream struct {
 	stream   *strest.Stream
 	ss       *request.SphyraenaState
 	router   *router.SphyraenaRouter
+	protocol Protocol
+
+	maxFrameSize int
+
+	requestIDs *requestIDs
 }
 
+// DefaultMaxFrameSize is the largest frame a UTF8Stream sends to its
+// client, if it is not constructed with another limit.
+const DefaultMaxFrameSize = 1 << 20
+
+// ErrFrameTooLarge is returned when a frame to be sent to the client is
+// larger than the UTF8Stream's maximum frame size.
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
 // FIXME: Document EXACTLY what this is.
 
 // NewUTF8Stream returns a constructed UTF8Stream object. This also begins
@@ -31,14 +45,29 @@ type UTF8Stream struct {
 //
 // sd is a StreamDriver that is hooked up and ready to start streaming.
 // The SphyraenaRouter is the top-level router for the requests. identity
-// is the known identity of the current stream.
+// is the known identity of the current stream. protocol is the Protocol
+// negotiated with the client; if nil, the DefaultProtocol is used.
+//
+// maxFrameSize is the largest frame, once serialized, that will be sent
+// to the client; if zero, DefaultMaxFrameSize is used, and if negative,
+// there is no limit. An event too large to send is dropped and logged,
+// and its substream is closed, so its handler and the client both learn
+// that it has failed rather than silently missing the event.
 func NewUTF8Stream(
 	sd UTF8StreamDriver,
 	sess session.Session,
 	stream *strest.Stream,
 	ss *request.SphyraenaState,
 	router *router.SphyraenaRouter,
+	protocol Protocol,
+	maxFrameSize int,
 ) *UTF8Stream {
+	if protocol == nil {
+		protocol = DefaultProtocol
+	}
+	if maxFrameSize == 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
 	return &UTF8Stream{
 		sd,
 		make(chan strest.EventToUser),
@@ -47,9 +76,41 @@ func NewUTF8Stream(
 		stream,
 		ss,
 		router,
+		protocol,
+		maxFrameSize,
+		newRequestIDs(),
 	}
 }
 
+// frameTooLarge returns whether a frame of the given size exceeds the
+// maximum frame size.
+func (s *UTF8Stream) frameTooLarge(size int) bool {
+	return s.maxFrameSize > 0 && size > s.maxFrameSize
+}
+
+// NewServerRequestID returns a fresh request ID for a request initiated
+// by the server. Any StreamMessage referring to it must be sent with the
+// ServerNamespace, so the client can not confuse it with one of its own
+// request IDs.
+func (s *UTF8Stream) NewServerRequestID() uint64 {
+	return s.requestIDs.nextServerID()
+}
+
+// Protocol returns the Protocol this stream speaks with its client.
+func (s *UTF8Stream) Protocol() Protocol {
+	return s.protocol
+}
+
+// AnnounceProtocol tells the client which Protocol was selected, with a
+// StreamMessage of type "protocol" whose Data is the Protocol's Name.
+//
+// This is how the choice is echoed back to the client. It should be sent
+// before Serve, and only to clients that requested protocols, as older
+// clients won't understand it.
+func (s *UTF8Stream) AnnounceProtocol() error {
+	return sendJSON(s, StreamMessage{Type: "protocol", Data: s.protocol.Name()})
+}
+
 // Channels implements the strest.ExternalStream interface, allowing this
 // to be hooked up to a Stream.
 func (s *UTF8Stream) Channels() (chan strest.EventToUser, chan strest.EventFromUser) {
@@ -90,6 +151,8 @@ type HTTPRequest struct {
 	Header http.Header `json:"header"`
 	Body   string      `json:"body"`
 
+	// RequestID is chosen by the client, and must strictly increase over
+	// the life of the stream. Requests that reuse an ID are rejected.
 	RequestID uint64 `json:"request_id"`
 }
 
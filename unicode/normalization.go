@@ -1,6 +1,9 @@
 package unicode
 
-import "golang.org/x/text/unicode/norm"
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
 
 // An NFKCNormalized value is a value that has been run through the NFKC
 // Unicode normalization process. This is a somewhat-destructive procedure
@@ -25,3 +28,55 @@ func (nn *NFKCNormalized) GoString() string {
 func NFKCNormalize(s string) NFKCNormalized {
 	return NFKCNormalized{norm.NFKC.String(s)}
 }
+
+// Casefold returns the NFKCCasefolded form of the normalized value.
+func (nn NFKCNormalized) Casefold() NFKCCasefolded {
+	return NFKCCasefold(nn.value)
+}
+
+// An NFKCCasefolded value is a value that has been NFKC normalized and
+// case folded, so that values differing only in case are equal, as
+// for case-insensitive usernames. Like NFKCNormalized, it is comparable
+// and can be used as a map key.
+//
+// The case folding is Unicode's full, locale-independent case folding,
+// not lowercasing in any particular language, so it does not suffer from
+// the likes of the Turkish dotless i, where "I" lowercases differently
+// depending on the language in effect. This approximates the
+// NFKC_Casefold mapping of http://www.unicode.org/reports/tr31/ , which
+// Unicode recommends for case-insensitive identifiers.
+//
+// Case folding is even more destructive than NFKC normalization, so
+// only use it for values that are meant to be case-insensitive; never
+// for passwords.
+type NFKCCasefolded struct {
+	value string
+}
+
+// String returns the string value of the case folded value, implementing
+// fmt.Stringer in the process.
+func (nc *NFKCCasefolded) String() string {
+	return nc.value
+}
+
+// GoString implements fmt.GoStringer, returning the string value of the string.
+func (nc *NFKCCasefolded) GoString() string {
+	return nc.value
+}
+
+// NFKCCasefold NFKC normalizes and case folds the given string.
+//
+// The folding can undo the normalization, as with characters that fold
+// to more than one character, so the string is normalized both before
+// and after.
+func NFKCCasefold(s string) NFKCCasefolded {
+	// a Caser holds state, so it can't be shared between goroutines
+	folded := cases.Fold().String(norm.NFKC.String(s))
+	return NFKCCasefolded{norm.NFKC.String(folded)}
+}
+
+// EqualFold reports whether the two strings are equal after both are
+// NFKC normalized and case folded.
+func EqualFold(a, b string) bool {
+	return NFKCCasefold(a) == NFKCCasefold(b)
+}
@@ -0,0 +1,29 @@
+package unicode
+
+import "testing"
+
+func TestNFKCCasefold(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{"jerf", "JERF", true},
+		{"Straße", "STRASSE", true},
+		{"ﬁle", "FILE", true},
+		{"ｊｅｒｆ", "Jerf", true},
+		{"ΣΑΣ", "σας", true},
+		// the dotless i is a different letter, whatever the locale
+		{"ı", "I", false},
+		{"jerf", "jeff", false},
+	} {
+		if EqualFold(test.a, test.b) != test.equal {
+			t.Fatal("wrong EqualFold result for", test.a, test.b)
+		}
+	}
+
+	normalized := NFKCNormalize("ＪＥＲＦ")
+	if folded := normalized.Casefold(); folded.String() != "jerf" ||
+		folded != NFKCCasefold("Jerf") {
+		t.Fatal("wrong Casefold of a normalized value:", folded.String())
+	}
+}